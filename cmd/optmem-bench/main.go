@@ -0,0 +1,271 @@
+// Command optmem-bench simulates announce and scrape workloads against an
+// optmem PeerStore and reports latency percentiles and memory usage.
+//
+// It is meant to evaluate settings like the number of shards for an expected
+// workload before deploying them, for example:
+//
+//	optmem-bench -swarms 1000000 -peers 10000000 -shard-bits 12 -duration 1m
+//
+// Swarm popularity follows a Zipf distribution, so a few swarms receive most
+// of the announces, like on real trackers.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem"
+)
+
+// config holds the parameters of a simulation.
+type config struct {
+	swarms      int
+	peers       int
+	zipfS       float64
+	scrapeRatio float64
+	churn       float64
+	seederRatio float64
+	numWant     int
+	workers     int
+	duration    time.Duration
+	shardBits   uint
+	seed        int64
+	maxSamples  int
+}
+
+func main() {
+	var cfg config
+	flag.IntVar(&cfg.swarms, "swarms", 100000, "number of swarms")
+	flag.IntVar(&cfg.peers, "peers", 1000000, "number of peers stored before the simulation starts")
+	flag.Float64Var(&cfg.zipfS, "zipf", 1.1, "exponent of the Zipf distribution of swarm popularity, must be > 1")
+	flag.Float64Var(&cfg.scrapeRatio, "scrape-ratio", 0.1, "share of requests that are scrapes")
+	flag.Float64Var(&cfg.churn, "churn", 0.05, "share of announces that are stops, each followed by a new peer starting")
+	flag.Float64Var(&cfg.seederRatio, "seeder-ratio", 0.5, "share of peers that are seeders")
+	flag.IntVar(&cfg.numWant, "numwant", 50, "numWant of announces")
+	flag.IntVar(&cfg.workers, "workers", runtime.GOMAXPROCS(0), "number of concurrent workers")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "duration of the simulation")
+	flag.UintVar(&cfg.shardBits, "shard-bits", 10, "shard_count_bits of the store")
+	flag.Int64Var(&cfg.seed, "seed", 1, "seed of the workload")
+	flag.IntVar(&cfg.maxSamples, "samples", 1000000, "maximum number of latency samples kept per operation and worker")
+	flag.Parse()
+
+	if cfg.zipfS <= 1 || cfg.swarms <= 0 || cfg.workers <= 0 {
+		fmt.Fprintln(os.Stderr, "invalid parameters")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg config) error {
+	ps, err := optmem.New(optmem.Config{
+		ShardCountBits:            cfg.shardBits,
+		GarbageCollectionInterval: time.Hour,
+		PeerLifetime:              time.Hour,
+		DisablePrometheus:         true,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { <-ps.Stop() }()
+
+	infoHashes := make([]bittorrent.InfoHash, cfg.swarms)
+	r := rand.New(rand.NewSource(cfg.seed))
+	for i := range infoHashes {
+		r.Read(infoHashes[i][:])
+	}
+
+	fmt.Printf("populating %d swarms with %d peers\n", cfg.swarms, cfg.peers)
+	start := time.Now()
+	w := newWorker(cfg, infoHashes, ps, 0)
+	for i := 0; i < cfg.peers; i++ {
+		err = w.put(w.pickSwarm(), peerFor(i))
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("populated in %v\n", time.Since(start))
+	printMemory()
+
+	fmt.Printf("running %d workers for %v\n", cfg.workers, cfg.duration)
+	workers := make([]*worker, cfg.workers)
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(cfg.duration)
+	for i := range workers {
+		workers[i] = newWorker(cfg, infoHashes, ps, int64(i+1))
+		workers[i].nextPeer = cfg.peers + i
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(deadline)
+		}(workers[i])
+	}
+	wg.Wait()
+
+	var announces, scrapes, deletes latencies
+	var errs int
+	for _, w := range workers {
+		announces.merge(w.announces)
+		scrapes.merge(w.scrapes)
+		deletes.merge(w.deletes)
+		errs += w.errors
+	}
+	printLatencies("announce", announces, cfg.duration)
+	printLatencies("scrape", scrapes, cfg.duration)
+	printLatencies("delete", deletes, cfg.duration)
+	fmt.Printf("errors: %d\n", errs)
+
+	seeders, leechers := ps.NumTotalPeers()
+	fmt.Printf("swarms: %d, seeders: %d, leechers: %d\n", ps.NumSwarms(), seeders, leechers)
+	printMemory()
+
+	return nil
+}
+
+// worker runs the simulated workload.
+type worker struct {
+	cfg        config
+	infoHashes []bittorrent.InfoHash
+	ps         *optmem.PeerStore
+	r          *rand.Rand
+	zipf       *rand.Zipf
+
+	// nextPeer is the index of the next peer to start, incremented by the
+	// number of workers.
+	nextPeer int
+
+	announces, scrapes, deletes latencies
+	errors                      int
+}
+
+func newWorker(cfg config, infoHashes []bittorrent.InfoHash, ps *optmem.PeerStore, seed int64) *worker {
+	r := rand.New(rand.NewSource(cfg.seed + seed))
+	return &worker{
+		cfg:        cfg,
+		infoHashes: infoHashes,
+		ps:         ps,
+		r:          r,
+		zipf:       rand.NewZipf(r, cfg.zipfS, 1, uint64(len(infoHashes)-1)),
+	}
+}
+
+// pickSwarm returns the infohash of a swarm chosen by popularity.
+func (w *worker) pickSwarm() bittorrent.InfoHash {
+	return w.infoHashes[w.zipf.Uint64()]
+}
+
+// put stores a peer as a seeder or leecher, as chosen by the seeder ratio.
+func (w *worker) put(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if w.r.Float64() < w.cfg.seederRatio {
+		return w.ps.PutSeeder(ih, p)
+	}
+	return w.ps.PutLeecher(ih, p)
+}
+
+// run performs requests until the deadline.
+func (w *worker) run(deadline time.Time) {
+	for i := 0; ; i++ {
+		// Checking the time is expensive compared to a request.
+		if i%64 == 0 && time.Now().After(deadline) {
+			return
+		}
+
+		ih := w.pickSwarm()
+		if w.r.Float64() < w.cfg.scrapeRatio {
+			start := time.Now()
+			w.ps.ScrapeSwarm(ih, bittorrent.IPv4)
+			w.scrapes.record(w.r, w.cfg.maxSamples, time.Since(start))
+			continue
+		}
+
+		p := peerFor(w.r.Intn(w.cfg.peers + w.nextPeer + 1))
+		if w.r.Float64() < w.cfg.churn {
+			start := time.Now()
+			w.ps.DeleteLeecher(ih, p)
+			w.deletes.record(w.r, w.cfg.maxSamples, time.Since(start))
+
+			p = peerFor(w.nextPeer)
+			w.nextPeer += w.cfg.workers
+		}
+
+		seeder := w.r.Float64() < w.cfg.seederRatio
+		start := time.Now()
+		_, err := w.ps.AnnounceAndPut(ih, seeder, w.cfg.numWant, p)
+		w.announces.record(w.r, w.cfg.maxSamples, time.Since(start))
+		if err != nil {
+			w.errors++
+		}
+	}
+}
+
+// latencies holds latency samples of an operation.
+type latencies struct {
+	samples []time.Duration
+	n       int // number of operations, including the ones not sampled
+}
+
+// record adds a latency, replacing a random sample once the maximum number
+// of samples is reached.
+func (l *latencies) record(r *rand.Rand, maxSamples int, d time.Duration) {
+	l.n++
+	if len(l.samples) < maxSamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[r.Intn(len(l.samples))] = d
+}
+
+// merge adds the samples and operations of o.
+func (l *latencies) merge(o latencies) {
+	l.samples = append(l.samples, o.samples...)
+	l.n += o.n
+}
+
+// peerFor returns the peer with the given index.
+// The IPs are public IPv4 addresses, so that the store accepts them.
+func peerFor(i int) bittorrent.Peer {
+	var ip [4]byte
+	binary.BigEndian.PutUint32(ip[:], uint32(i))
+	ip[0] = 20 + ip[0]%64
+	return bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.IP(ip[:]), AddressFamily: bittorrent.IPv4},
+		Port: uint16(i),
+	}
+}
+
+func printLatencies(op string, l latencies, duration time.Duration) {
+	samples := l.samples
+	if len(samples) == 0 {
+		fmt.Printf("%s: no requests\n", op)
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	percentile := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))]
+	}
+	fmt.Printf("%s: %d requests, %.0f/s, p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+		op, l.n, float64(l.n)/duration.Seconds(),
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(0.999), samples[len(samples)-1])
+}
+
+func printMemory() {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Printf("heap in use: %d MiB, system: %d MiB, GC pauses: %v total\n",
+		m.HeapInuse>>20, m.Sys>>20, time.Duration(m.PauseTotalNs))
+}
@@ -0,0 +1,338 @@
+package optmem
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// PinSwarm pins the swarm of the given infohash.
+// Pinned swarms and their per-family peer lists are not removed when their
+// last peer is deleted or garbage collected, which keeps their download
+// counters.
+// If the swarm does not exist, an empty pinned swarm is created.
+// Returns ErrReadOnly if the store is read-only.
+func (s *PeerStore) PinSwarm(infoHash bittorrent.InfoHash) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	ih := infohash(infoHash)
+	shard := s.shards.lockShardByHash(ih)
+	pl, existed := shard.swarms[ih]
+	pl.pinned = true
+	if !existed {
+		pl.created = uint16(s.nowUnix())
+		pl.swept, pl.oldest = pl.created, pl.created
+	}
+	shard.setSwarm(ih, pl)
+
+	if existed {
+		s.shards.unlockShardByHash(ih, 0)
+	} else {
+		s.hooks.swarmCreated(shard, ih)
+		s.shards.unlockShardByHash(ih, 1)
+	}
+	return nil
+}
+
+// UnpinSwarm unpins the swarm of the given infohash.
+// If the swarm has no peers and no web seeds, it is removed.
+// Returns ErrReadOnly if the store is read-only.
+func (s *PeerStore) UnpinSwarm(infoHash bittorrent.InfoHash) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	ih := infohash(infoHash)
+	shard := s.shards.lockShardByHash(ih)
+	pl, ok := shard.swarms[ih]
+	if !ok {
+		s.shards.unlockShardByHash(ih, 0)
+		return nil
+	}
+
+	final := pl
+	pl.pinned = false
+	if pl.retained() {
+		shard.setSwarm(ih, pl)
+		s.shards.unlockShardByHash(ih, 0)
+		return nil
+	}
+	if pl.peers4 != nil && pl.peers4.numPeers == 0 {
+		pl.peers4 = nil
+	}
+	if pl.peers6 != nil && pl.peers6.numPeers == 0 {
+		pl.peers6 = nil
+	}
+	if pl.peers4 == nil && pl.peers6 == nil {
+		s.hooks.swarmRemoved(shard, ih, final)
+		shard.deleteSwarm(ih)
+		s.shards.unlockShardByHash(ih, -1)
+		return nil
+	}
+
+	shard.setSwarm(ih, pl)
+	s.shards.unlockShardByHash(ih, 0)
+	return nil
+}
+
+// RebalanceSwarm resizes the buckets of the swarm of the given infohash to
+// the number of its peers and removes tombstones, as is otherwise done after
+// puts, deletes and garbage collection.
+// This is mostly useful in tests.
+// Returns whether the buckets of any address family were resized.
+func (s *PeerStore) RebalanceSwarm(infoHash bittorrent.InfoHash) bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	ih := infohash(infoHash)
+	shard := s.shards.lockShardByHash(ih)
+	defer s.shards.unlockShardByHash(ih, 0)
+
+	rebalanced := false
+	sw := shard.swarms[ih]
+	for _, pl := range [2]*peerList{sw.peers4, sw.peers6} {
+		if pl != nil && pl.rebalanceBuckets() {
+			rebalanced = true
+		}
+	}
+	return rebalanced
+}
+
+// DeleteSwarm removes the swarm of the given infohash and all its peers,
+// regardless of whether it is pinned.
+// Its durable download counters are removed as well.
+// Returns whether the swarm existed.
+func (s *PeerStore) DeleteSwarm(infoHash bittorrent.InfoHash) bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	ih := infohash(infoHash)
+	shard := s.shards.lockShardByHash(ih)
+	sw, ok := shard.swarms[ih]
+	if !ok {
+		s.shards.unlockShardByHash(ih, 0)
+		return false
+	}
+
+	shard.counts.subSwarm(sw)
+	s.hooks.swarmRemoved(shard, ih, sw)
+	shard.deleteSwarm(ih)
+	delete(shard.downloads, ih)
+	s.shards.unlockShardByHash(ih, -1)
+
+	return true
+}
+
+// SwarmInfo holds information about a single swarm.
+type SwarmInfo struct {
+	InfoHash bittorrent.InfoHash
+	Stats    SwarmStats
+	Version  uint64
+	Pinned   bool
+	Frozen   bool
+	WebSeeds []string
+	Buckets4 int
+	Buckets6 int
+}
+
+// SwarmInfo returns information about the swarm of the given infohash.
+// Returns false if the swarm does not exist.
+func (s *PeerStore) SwarmInfo(infoHash bittorrent.InfoHash) (info SwarmInfo, ok bool) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	info.InfoHash = infoHash
+	ih := infohash(infoHash)
+	shard := s.shards.rLockShardByHash(ih)
+	pl, ok := shard.swarms[ih]
+	info.Stats = pl.stats(infoHash)
+	info.Stats.Tags = append([]string(nil), shard.tags[ih]...)
+	if ok {
+		info.Version = pl.version
+		info.Pinned = pl.pinned
+		info.Frozen = pl.frozen
+		info.WebSeeds = append([]string(nil), shard.webSeeds[ih]...)
+		if pl.peers4 != nil {
+			info.Buckets4 = len(pl.peers4.peerBuckets)
+		}
+		if pl.peers6 != nil {
+			info.Buckets6 = len(pl.peers6.peerBuckets)
+		}
+	}
+	s.shards.rUnlockShardByHash(ih)
+
+	return
+}
+
+// ShardStats holds the counts of a single shard.
+type ShardStats struct {
+	Index    int
+	Swarms   int
+	Seeders  uint64
+	Leechers uint64
+}
+
+// ShardStats returns the counts of every shard.
+// The counts are read without locking the shards, they reflect the state of
+// every shard as of the last time it was unlocked.
+// Runs in linear time in regards to the number of shards.
+func (s *PeerStore) ShardStats() []ShardStats {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	stats := make([]ShardStats, len(s.shards.shards))
+	for i, shard := range s.shards.shards {
+		seeders, leechers := shard.published.load().total()
+		stats[i] = ShardStats{
+			Index:    i,
+			Swarms:   int(atomic.LoadUint64(&shard.numSwarms)),
+			Seeders:  seeders,
+			Leechers: leechers,
+		}
+	}
+
+	return stats
+}
+
+// removeIP removes all peers with the given IP, regardless of their port.
+// Tombstones are removed as well.
+// Returns the number of peers and seeders removed.
+func (pl *peerList) removeIP(ip []byte) (removed, removedSeeders int) {
+	pl.own()
+	for j, b := range pl.peerBuckets {
+		kept := b[:0]
+		for _, p := range b {
+			if p.isDead() {
+				continue
+			}
+			if net.IP(p[:ipLen]).Equal(ip) {
+				pl.deleteStats(&p)
+				removed++
+				if p.isSeeder() {
+					removedSeeders++
+				}
+				if p.isWebRTC() {
+					pl.numWebRTC--
+				}
+				continue
+			}
+			kept = append(kept, p)
+		}
+		pl.peerBuckets[j] = kept
+	}
+
+	pl.numPeers -= removed
+	pl.numSeeders -= removedSeeders
+	pl.numDead = 0
+	if removed > 0 {
+		// The hot set might hold the removed peers.
+		pl.hot = nil
+	}
+	return
+}
+
+// PurgeIP removes all peers with the given IP from all swarms.
+// Runs in linear time in regards to the number of peers tracked.
+// Returns the number of peers removed, or ErrReadOnly if the store is
+// read-only.
+func (s *PeerStore) PurgeIP(ip net.IP) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return 0, nil
+	}
+
+	total := 0
+	for i := 0; i < len(s.shards.shards); i++ {
+		deltaTorrents := 0
+		shard := s.shards.lockShard(i)
+		for ih, sw := range shard.swarms {
+			final := sw
+			var removed int
+			sw.peers4, removed = purgeIPFromList(shard, sw.peers4, bittorrent.IPv4, ip16, sw.retained())
+			total += removed
+			changed := removed > 0
+			sw.peers6, removed = purgeIPFromList(shard, sw.peers6, bittorrent.IPv6, ip16, sw.retained())
+			total += removed
+			changed = changed || removed > 0
+
+			if !changed {
+				continue
+			}
+			if !sw.retained() && sw.peers4 == nil && sw.peers6 == nil {
+				s.hooks.swarmRemoved(shard, ih, final)
+				shard.deleteSwarm(ih)
+				deltaTorrents--
+				continue
+			}
+			sw.version = shard.nextVersion()
+			shard.setSwarm(ih, sw)
+		}
+		s.shards.unlockShard(i, deltaTorrents)
+	}
+
+	return total, nil
+}
+
+// purgeIPFromList removes all peers with the given IP from a peerList and
+// updates the counts of the shard.
+// Returns the peerList to keep, which is nil if it became empty and the swarm
+// is not pinned.
+// The shard must be write-locked by the caller.
+func purgeIPFromList(shard *shard, pl *peerList, af bittorrent.AddressFamily, ip []byte, retained bool) (*peerList, int) {
+	if pl == nil {
+		return nil, 0
+	}
+
+	removed, removedSeeders := pl.removeIP(ip)
+	if removed == 0 {
+		return pl, 0
+	}
+	shard.counts.sub(af, removed, removedSeeders)
+
+	if pl.numPeers == 0 && !retained {
+		return nil, removed
+	}
+	pl.rebalanceBuckets()
+	return pl, removed
+}
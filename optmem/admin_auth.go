@@ -0,0 +1,165 @@
+package optmem
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// ErrAdminCredentials is returned by New if admin servers are configured
+// without credentials and AdminInsecure is not set.
+var ErrAdminCredentials = errors.New("admin servers require credentials, set admin_insecure to run them without")
+
+// Scopes of admin credentials.
+const (
+	// AdminScopeRead allows reading from the admin servers.
+	AdminScopeRead = "read"
+
+	// AdminScopeMutate allows reading from and mutating the store through
+	// the admin servers.
+	AdminScopeMutate = "mutate"
+)
+
+// AdminTokenConfig configures a bearer token for the admin servers.
+type AdminTokenConfig struct {
+	// Name identifies the token in the audit log.
+	Name string `yaml:"name"`
+
+	// Token is the bearer token.
+	Token string `yaml:"token"`
+
+	// Scope is AdminScopeRead or AdminScopeMutate.
+	Scope string `yaml:"scope"`
+}
+
+// AdminTLSConfig configures TLS for the admin servers.
+type AdminTLSConfig struct {
+	// CertFile and KeyFile are the paths of the PEM-encoded certificate and
+	// key of the servers.
+	// Empty paths disable TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// ClientCAFile is the path of PEM-encoded CA certificates that client
+	// certificates must be signed by.
+	// If set, clients must present a certificate.
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// ClientScopes maps the common names of client certificates to the
+	// scope they are granted.
+	// Clients with certificates not listed here must authenticate with a
+	// token.
+	// If ClientCAFile is set without any scopes, every client certificate
+	// signed by one of its CAs is granted the mutate scope.
+	ClientScopes map[string]string `yaml:"client_scopes"`
+}
+
+// enabled returns whether TLS is configured.
+func (cfg AdminTLSConfig) enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+// verifiesClients returns whether clients must present a certificate signed
+// by one of the ClientCAFile CAs.
+func (cfg AdminTLSConfig) verifiesClients() bool {
+	return cfg.enabled() && cfg.ClientCAFile != ""
+}
+
+// serverConfig loads the certificates and returns the tls.Config of the
+// admin servers.
+func (cfg AdminTLSConfig) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load admin certificate")
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read admin client CAs")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in admin client CA file")
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// adminIdentity is an authenticated caller of the admin servers.
+type adminIdentity struct {
+	name  string // of the token or client certificate, empty for the AdminToken
+	scope string
+}
+
+// canMutate returns whether the identity may mutate the store.
+func (id adminIdentity) canMutate() bool {
+	return id.scope == AdminScopeMutate
+}
+
+// adminAuthRequired returns whether the admin servers require authentication.
+func (cfg Config) adminAuthRequired() bool {
+	return cfg.AdminToken != "" || len(cfg.AdminTokens) > 0 || len(cfg.AdminTLS.ClientScopes) > 0 || cfg.AdminTLS.verifiesClients()
+}
+
+// authenticate returns the identity of a caller with the given bearer token
+// and TLS connection state, which is nil for plaintext connections.
+// A valid token takes precedence over a client certificate.
+// If no credentials are configured, every caller may mutate if AdminInsecure
+// is set, and is rejected otherwise.
+func (s *PeerStore) authenticate(token string, state *tls.ConnectionState) (adminIdentity, bool) {
+	if !s.cfg.adminAuthRequired() {
+		if s.cfg.AdminInsecure {
+			return adminIdentity{scope: AdminScopeMutate}, true
+		}
+		return adminIdentity{}, false
+	}
+
+	if token != "" {
+		if s.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) == 1 {
+			return adminIdentity{scope: AdminScopeMutate}, true
+		}
+		for _, t := range s.cfg.AdminTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return adminIdentity{name: t.Name, scope: t.Scope}, true
+			}
+		}
+	}
+
+	// Client certificates were verified during the handshake.
+	if state != nil && len(state.VerifiedChains) > 0 {
+		name := state.VerifiedChains[0][0].Subject.CommonName
+		if scope, ok := s.cfg.AdminTLS.ClientScopes[name]; ok {
+			return adminIdentity{name: name, scope: scope}, true
+		}
+		if len(s.cfg.AdminTLS.ClientScopes) == 0 {
+			return adminIdentity{name: name, scope: AdminScopeMutate}, true
+		}
+	}
+
+	return adminIdentity{}, false
+}
+
+type adminIdentityKey struct{}
+
+// withAdminIdentity returns a context carrying the identity of the caller.
+func withAdminIdentity(ctx context.Context, id adminIdentity) context.Context {
+	return context.WithValue(ctx, adminIdentityKey{}, id)
+}
+
+// adminIdentityFrom returns the identity of the caller stored in ctx.
+func adminIdentityFrom(ctx context.Context) adminIdentity {
+	id, _ := ctx.Value(adminIdentityKey{}).(adminIdentity)
+	return id
+}
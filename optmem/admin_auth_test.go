@@ -0,0 +1,185 @@
+package optmem
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminTokenScopes(t *testing.T) {
+	cfg := testConfig
+	cfg.AdminTokens = []AdminTokenConfig{
+		{Name: "dashboard", Token: "reader", Scope: AdminScopeRead},
+		{Name: "ops", Token: "writer", Scope: AdminScopeMutate},
+		{Name: "typo", Token: "typo", Scope: "write"},
+	}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	srv := httptest.NewServer(ps.adminHandler())
+	defer srv.Close()
+
+	do := func(method, path, token string) int {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/stats", ""))
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/stats", "reader"))
+	require.Equal(t, http.StatusForbidden, do(http.MethodPost, "/purge?ip=1.2.3.4", "reader"))
+	// Invalid scopes fall back to read.
+	require.Equal(t, http.StatusForbidden, do(http.MethodPost, "/purge?ip=1.2.3.4", "typo"))
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/purge?ip=1.2.3.4", "writer"))
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestAdminClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := testCertificate(t, "ca", nil, nil)
+	server, serverKey := testCertificate(t, "server", ca, caKey)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", server.Raw)
+	writePEM(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", marshalKey(t, serverKey))
+
+	cfg := testConfig
+	cfg.AdminTLS = AdminTLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		ClientScopes: map[string]string{"monitoring": AdminScopeRead},
+	}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	tlsCfg, err := cfg.AdminTLS.serverConfig()
+	require.Nil(t, err)
+	srv := httptest.NewUnstartedServer(ps.adminHandler())
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	client := func(name string) *http.Client {
+		tlsCfg := &tls.Config{RootCAs: pool}
+		if name != "" {
+			cert, key := testCertificate(t, name, ca, caKey)
+			tlsCfg.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	}
+
+	// Clients without certificates fail the handshake.
+	_, err = client("").Get(srv.URL + "/stats")
+	require.NotNil(t, err)
+
+	resp, err := client("monitoring").Get(srv.URL + "/stats")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client("monitoring").Post(srv.URL+"/gc", "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client("unknown").Get(srv.URL + "/stats")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Without scopes, every certificate signed by the CA may mutate.
+	ps.cfg.AdminTLS.ClientScopes = nil
+	resp, err = client("unknown").Post(srv.URL+"/gc", "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestAdminCredentialsRequired(t *testing.T) {
+	cfg := testConfig
+	cfg.AdminAddr = "127.0.0.1:0"
+	_, err := New(cfg)
+	require.Equal(t, ErrAdminCredentials, err)
+
+	// Without credentials, callers are rejected unless AdminInsecure is set.
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	_, ok := ps.authenticate("", nil)
+	require.False(t, ok)
+	ps.cfg.AdminInsecure = true
+	id, ok := ps.authenticate("", nil)
+	require.True(t, ok)
+	require.True(t, id.canMutate())
+	require.Nil(t, <-ps.Stop())
+
+	// A client CA is a credential on its own.
+	cfg.AdminTLS = AdminTLSConfig{CertFile: "server.pem", KeyFile: "server.key", ClientCAFile: "ca.pem"}
+	require.True(t, cfg.adminAuthRequired())
+}
+
+// testCertificate creates a certificate with the given common name, signed by
+// parent, or a self-signed CA certificate if parent is nil.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return der
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	require.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+}
@@ -0,0 +1,295 @@
+package optmem
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// exportChunkSize is the maximum size of a single chunk of a streamed export.
+const exportChunkSize = 1 << 20
+
+// startAdminGRPCServer starts the admin gRPC server on the configured
+// address.
+func (s *PeerStore) startAdminGRPCServer() error {
+	l, err := net.Listen("tcp", s.cfg.AdminGRPCAddr)
+	if err != nil {
+		return err
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.authorizeUnary),
+		grpc.StreamInterceptor(s.authorizeStream),
+	}
+	if s.cfg.AdminTLS.enabled() {
+		tlsCfg, err := s.cfg.AdminTLS.serverConfig()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+
+	s.adminGRPC = grpc.NewServer(opts...)
+	adminpb.RegisterAdminServer(s.adminGRPC, &adminServer{s: s})
+	go func() {
+		err := s.adminGRPC.Serve(l)
+		if err != nil {
+			log.Error("optmem: admin gRPC server failed", log.Fields{"addr": s.cfg.AdminGRPCAddr, "error": err})
+		}
+	}()
+
+	return nil
+}
+
+// bearerToken returns the bearer token of a gRPC request, or an empty string
+// if there is none.
+func bearerToken(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 && len(v[0]) > len("Bearer ") {
+			return v[0][len("Bearer "):]
+		}
+	}
+	return ""
+}
+
+// mutatingMethods are the gRPC methods that require the mutate scope.
+var mutatingMethods = map[string]bool{
+	adminpb.Admin_DeleteSwarm_FullMethodName:  true,
+	adminpb.Admin_TriggerGC_FullMethodName:    true,
+	adminpb.Admin_SetSwarmTags_FullMethodName: true,
+}
+
+// authorize checks the credentials of a gRPC request for the given method
+// and returns a context carrying the identity of the caller.
+func (s *PeerStore) authorize(ctx context.Context, method string) (context.Context, error) {
+	var state *tls.ConnectionState
+	if p, ok := grpcpeer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+
+	id, ok := s.authenticate(bearerToken(ctx), state)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if mutatingMethods[method] && !id.canMutate() {
+		return nil, status.Error(codes.PermissionDenied, "insufficient scope")
+	}
+	return withAdminIdentity(ctx, id), nil
+}
+
+func (s *PeerStore) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// identifiedStream is a grpc.ServerStream carrying the identity of the
+// caller in its context.
+type identifiedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s identifiedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *PeerStore) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, identifiedStream{ServerStream: ss, ctx: ctx})
+}
+
+// adminServer implements the admin gRPC service.
+type adminServer struct {
+	adminpb.UnimplementedAdminServer
+	s *PeerStore
+}
+
+// parseInfoHashBytes parses the raw v1 or v2 infohash of a request, see
+// InfoHashFromBytes.
+func (a *adminServer) parseInfoHashBytes(b []byte) (bittorrent.InfoHash, error) {
+	infoHash, err := a.s.InfoHashFromBytes(b)
+	if err != nil {
+		return bittorrent.InfoHash{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return infoHash, nil
+}
+
+func scrapeToProto(scrape bittorrent.Scrape) *adminpb.Scrape {
+	return &adminpb.Scrape{
+		Complete:   scrape.Complete,
+		Incomplete: scrape.Incomplete,
+		Snatches:   scrape.Snatches,
+	}
+}
+
+func (a *adminServer) GetSwarm(ctx context.Context, req *adminpb.GetSwarmRequest) (*adminpb.Swarm, error) {
+	infoHash, err := a.parseInfoHashBytes(req.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	info, ok := a.s.SwarmInfo(infoHash)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "swarm not found")
+	}
+	return &adminpb.Swarm{
+		InfoHash: infoHash[:],
+		Ipv4:     scrapeToProto(info.Stats.IPv4),
+		Ipv6:     scrapeToProto(info.Stats.IPv6),
+		Combined: scrapeToProto(info.Stats.Combined),
+		Version:  info.Version,
+		Pinned:   info.Pinned,
+		Buckets4: uint32(info.Buckets4),
+		Buckets6: uint32(info.Buckets6),
+		Tags:     info.Stats.Tags,
+	}, nil
+}
+
+func (a *adminServer) ListSwarms(req *adminpb.ListSwarmsRequest, stream adminpb.Admin_ListSwarmsServer) error {
+	return a.s.eachScrapeEntry(true, func(e scrapeEntry) error {
+		if req.Tag != "" && !hasTag(e.tags, req.Tag) {
+			return nil
+		}
+		return stream.Send(&adminpb.SwarmSummary{
+			InfoHash:   append([]byte(nil), e.ih[:]...),
+			Complete:   e.complete,
+			Incomplete: e.incomplete,
+			Downloaded: e.downloaded,
+			Tags:       e.tags,
+		})
+	})
+}
+
+func (a *adminServer) DeleteSwarm(ctx context.Context, req *adminpb.DeleteSwarmRequest) (*adminpb.DeleteSwarmResponse, error) {
+	infoHash, err := a.parseInfoHashBytes(req.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	deleted := a.s.DeleteSwarm(infoHash)
+	a.s.audit(grpcCaller(ctx), "delete_swarm", map[string]interface{}{"infohash": infoHash.String()}, map[string]interface{}{"deleted": deleted}, nil)
+	return &adminpb.DeleteSwarmResponse{Deleted: deleted}, nil
+}
+
+func (a *adminServer) Stats(ctx context.Context, req *adminpb.StatsRequest) (*adminpb.StatsResponse, error) {
+	seeders, leechers := a.s.NumTotalPeers()
+	puts4, puts6 := a.s.PutCounts()
+	return &adminpb.StatsResponse{
+		Swarms:   a.s.NumSwarms(),
+		Seeders:  seeders,
+		Leechers: leechers,
+		Load:     a.s.Load(),
+		Puts4:    &adminpb.PutCounts{Inserted: puts4.Inserted, Updated: puts4.Updated},
+		Puts6:    &adminpb.PutCounts{Inserted: puts6.Inserted, Updated: puts6.Updated},
+	}, nil
+}
+
+func (a *adminServer) TriggerGC(ctx context.Context, req *adminpb.TriggerGCRequest) (*adminpb.TriggerGCResponse, error) {
+	if a.s.isReadOnly() {
+		a.s.audit(grpcCaller(ctx), "gc", nil, nil, ErrReadOnly)
+		return nil, status.Error(codes.FailedPrecondition, ErrReadOnly.Error())
+	}
+
+	stats := a.s.collectGarbage(a.s.now().Add(-a.s.cfg.PeerLifetime))
+	a.s.audit(grpcCaller(ctx), "gc", nil, map[string]interface{}{
+		"duration":      stats.Duration.String(),
+		"peersRemoved":  stats.PeersRemoved,
+		"swarmsRemoved": stats.SwarmsRemoved,
+		"swarmsSpilled": stats.SwarmsSpilled,
+		"shardsTouched": stats.ShardsTouched,
+		"rebalances":    stats.Rebalances,
+		"aborted":       stats.Aborted,
+	}, nil)
+	return &adminpb.TriggerGCResponse{
+		DurationNanos: int64(stats.Duration),
+		PeersRemoved:  uint64(stats.PeersRemoved),
+		SwarmsRemoved: uint64(stats.SwarmsRemoved),
+		SwarmsSpilled: uint64(stats.SwarmsSpilled),
+		ShardsTouched: uint64(stats.ShardsTouched),
+		Rebalances:    uint64(stats.Rebalances),
+	}, nil
+}
+
+// exportChunkWriter sends everything written to it as export chunks.
+type exportChunkWriter struct {
+	stream adminpb.Admin_ExportServer
+}
+
+func (w exportChunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > exportChunkSize {
+			n = exportChunkSize
+		}
+		err := w.stream.Send(&adminpb.ExportChunk{Data: p[:n]})
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (a *adminServer) Export(req *adminpb.ExportRequest, stream adminpb.Admin_ExportServer) error {
+	if req.Consistent {
+		if req.SamplingThreshold != 0 || req.SamplingFraction != 0 || req.SamplingMaxPeers != 0 || req.Tag != "" {
+			return status.Error(codes.InvalidArgument, "consistent exports can not be sampled or filtered")
+		}
+		_, err := a.s.Backup(exportChunkWriter{stream: stream})
+		if err == ErrBackupRunning {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return err
+	}
+
+	sampling := ExportSampling{
+		Threshold: int(req.SamplingThreshold),
+		Fraction:  req.SamplingFraction,
+		MaxPeers:  int(req.SamplingMaxPeers),
+		Seed:      req.SamplingSeed,
+	}
+	var filter func(bittorrent.InfoHash) bool
+	if req.Tag != "" {
+		filter = a.s.TagFilter(req.Tag)
+	}
+	_, err := a.s.ExportSwarmsSampled(exportChunkWriter{stream: stream}, filter, sampling)
+	return err
+}
+
+func (a *adminServer) SetSwarmTags(ctx context.Context, req *adminpb.SetSwarmTagsRequest) (*adminpb.SetSwarmTagsResponse, error) {
+	infoHash, err := a.parseInfoHashBytes(req.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.s.SetSwarmTags(infoHash, req.Tags)
+	a.s.audit(grpcCaller(ctx), "set_swarm_tags", map[string]interface{}{"infohash": infoHash.String(), "tags": req.Tags}, nil, err)
+	switch err {
+	case nil:
+		return &adminpb.SetSwarmTagsResponse{}, nil
+	case ErrInvalidTags:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return nil, status.Error(codes.NotFound, "swarm not found")
+	}
+}
@@ -0,0 +1,73 @@
+package optmem
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem/adminpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestAdminGRPC(t *testing.T) {
+	cfg := testConfig
+	cfg.AdminToken = "secret"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(ps.authorizeUnary), grpc.StreamInterceptor(ps.authorizeStream))
+	adminpb.RegisterAdminServer(srv, &adminServer{s: ps})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	defer conn.Close()
+	client := adminpb.NewAdminClient(conn)
+
+	_, err = client.Stats(context.Background(), &adminpb.StatsRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+
+	stats, err := client.Stats(ctx, &adminpb.StatsRequest{})
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), stats.Swarms)
+	require.Equal(t, uint64(1), stats.Seeders)
+	require.Equal(t, uint64(1), stats.Leechers)
+
+	sw, err := client.GetSwarm(ctx, &adminpb.GetSwarmRequest{InfoHash: ih[:]})
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), sw.Ipv4.Complete)
+	require.Equal(t, uint32(1), sw.Ipv6.Incomplete)
+
+	list, err := client.ListSwarms(ctx, &adminpb.ListSwarmsRequest{})
+	require.Nil(t, err)
+	summary, err := list.Recv()
+	require.Nil(t, err)
+	require.Equal(t, ih[:], summary.InfoHash)
+	require.Equal(t, uint64(1), summary.Complete)
+
+	resp, err := client.DeleteSwarm(ctx, &adminpb.DeleteSwarmRequest{InfoHash: ih[:]})
+	require.Nil(t, err)
+	require.True(t, resp.Deleted)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	_, err = client.GetSwarm(ctx, &adminpb.GetSwarmRequest{InfoHash: ih[:]})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.GetSwarm(ctx, &adminpb.GetSwarmRequest{InfoHash: []byte("short")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	require.Nil(t, <-ps.Stop())
+}
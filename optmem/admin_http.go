@@ -0,0 +1,378 @@
+package optmem
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// startAdminServer starts the admin HTTP server on the configured address.
+func (s *PeerStore) startAdminServer() error {
+	l, err := net.Listen("tcp", s.cfg.AdminAddr)
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.AdminTLS.enabled() {
+		tlsCfg, err := s.cfg.AdminTLS.serverConfig()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, tlsCfg)
+	}
+
+	s.admin = &http.Server{Handler: s.adminHandler()}
+	go func() {
+		err := s.admin.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("optmem: admin server failed", log.Fields{"addr": s.cfg.AdminAddr, "error": err})
+		}
+	}()
+
+	return nil
+}
+
+// adminHandler returns the handler serving the admin endpoints.
+//
+// The endpoints are:
+//
+//	GET  /stats                       store-wide counts
+//	GET  /health?deadline=<duration>  health check, 503 if unhealthy
+//	GET  /shards                      per-shard counts
+//	GET  /history?since=<time>        recorded counts since an RFC 3339 time
+//	GET  /swarm?infohash=<hex>        information about a single swarm
+//	GET  /backup                      consistent export of all swarms
+//	POST /swarm/pin?infohash=<hex>    pin a swarm
+//	POST /swarm/unpin?infohash=<hex>  unpin a swarm
+//	POST /swarm/freeze?infohash=<hex> freeze a swarm
+//	POST /swarm/unfreeze?infohash=<hex>
+//	                                  unfreeze a swarm
+//	POST /swarm/tags?infohash=<hex>&tag=<tag>...
+//	                                  replace the tags of a swarm
+//	POST /swarm/webseeds?infohash=<hex>&url=<url>...
+//	                                  replace the web seeds of a swarm
+//	POST /purge?ip=<ip>               remove all peers with an IP
+//	POST /gc                          run garbage collection
+//
+// All responses except backups are JSON.
+// Mutations are recorded in the audit log, if one is configured.
+// If credentials are configured, requests must carry a token as a bearer
+// token in the Authorization header or present a client certificate, and
+// POST requests require the mutate scope.
+func (s *PeerStore) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", onlyMethod(http.MethodGet, s.handleStats))
+	mux.HandleFunc("/health", onlyMethod(http.MethodGet, s.handleHealth))
+	mux.HandleFunc("/shards", onlyMethod(http.MethodGet, s.handleShards))
+	mux.HandleFunc("/history", onlyMethod(http.MethodGet, s.handleHistory))
+	mux.HandleFunc("/swarm", onlyMethod(http.MethodGet, s.handleSwarm))
+	mux.HandleFunc("/backup", onlyMethod(http.MethodGet, s.handleBackup))
+	mux.HandleFunc("/swarm/pin", onlyMethod(http.MethodPost, s.handlePin))
+	mux.HandleFunc("/swarm/unpin", onlyMethod(http.MethodPost, s.handleUnpin))
+	mux.HandleFunc("/swarm/freeze", onlyMethod(http.MethodPost, s.handleFreeze))
+	mux.HandleFunc("/swarm/unfreeze", onlyMethod(http.MethodPost, s.handleUnfreeze))
+	mux.HandleFunc("/swarm/tags", onlyMethod(http.MethodPost, s.handleTags))
+	mux.HandleFunc("/swarm/webseeds", onlyMethod(http.MethodPost, s.handleWebSeeds))
+	mux.HandleFunc("/purge", onlyMethod(http.MethodPost, s.handlePurge))
+	mux.HandleFunc("/gc", onlyMethod(http.MethodPost, s.handleGC))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := s.authenticate(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), r.TLS)
+		if !ok {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && !id.canMutate() {
+			http.Error(w, "insufficient scope", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(withAdminIdentity(r.Context(), id)))
+	})
+}
+
+func onlyMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Debug("optmem: failed to write admin response", log.Fields{"error": err})
+	}
+}
+
+// parseInfoHash parses the hex-encoded v1 or v2 infohash query parameter,
+// see InfoHashFromBytes.
+func (s *PeerStore) parseInfoHash(r *http.Request) (bittorrent.InfoHash, bool) {
+	b, err := hex.DecodeString(r.URL.Query().Get("infohash"))
+	if err != nil {
+		return bittorrent.InfoHash{}, false
+	}
+	infoHash, err := s.InfoHashFromBytes(b)
+	return infoHash, err == nil
+}
+
+func (s *PeerStore) handleStats(w http.ResponseWriter, r *http.Request) {
+	seeders, leechers := s.NumTotalPeers()
+	puts4, puts6 := s.PutCounts()
+	stats := map[string]interface{}{
+		"swarms":   s.NumSwarms(),
+		"seeders":  seeders,
+		"leechers": leechers,
+		"load":     s.Load(),
+		"puts4":    puts4,
+		"puts6":    puts6,
+		"readOnly": s.isReadOnly(),
+	}
+	if e, ok := s.LastBackgroundError(); ok {
+		stats["lastBackgroundError"] = e
+	}
+	writeJSON(w, stats)
+}
+
+// defaultHealthDeadline is the deadline for locking shards in health checks
+// if none is given.
+const defaultHealthDeadline = time.Second
+
+func (s *PeerStore) handleHealth(w http.ResponseWriter, r *http.Request) {
+	deadline := defaultHealthDeadline
+	if d := r.URL.Query().Get("deadline"); d != "" {
+		var err error
+		deadline, err = time.ParseDuration(d)
+		if err != nil || deadline <= 0 {
+			http.Error(w, "invalid deadline", http.StatusBadRequest)
+			return
+		}
+	}
+
+	status := s.Health(deadline)
+	if !status.Healthy {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, status)
+}
+
+func (s *PeerStore) handleShards(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.ShardStats())
+}
+
+func (s *PeerStore) handleHistory(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	points := s.History(since)
+	if points == nil {
+		points = []HistoryPoint{}
+	}
+	writeJSON(w, points)
+}
+
+func (s *PeerStore) handleSwarm(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := s.parseInfoHash(r)
+	if !ok {
+		http.Error(w, "invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	info, ok := s.SwarmInfo(infoHash)
+	if !ok {
+		http.Error(w, "swarm not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// backupWriter tracks whether a backup has written anything to the response,
+// after which errors can not be reported with a status code anymore.
+type backupWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.w.Header().Set("Content-Type", "application/octet-stream")
+		w.written = true
+	}
+	return w.w.Write(p)
+}
+
+func (s *PeerStore) handleBackup(w http.ResponseWriter, r *http.Request) {
+	bw := &backupWriter{w: w}
+	n, err := s.Backup(bw)
+	switch {
+	case err == nil:
+		log.Info("optmem: wrote backup", log.Fields{"swarms": n})
+	case bw.written:
+		log.Error("optmem: backup failed", log.Fields{"swarms": n, "error": err})
+	case err == ErrBackupRunning || err == ErrAnonymized:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *PeerStore) handlePin(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := s.parseInfoHash(r)
+	if !ok {
+		http.Error(w, "invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	err := s.PinSwarm(infoHash)
+	s.audit(httpCaller(r), "pin_swarm", map[string]interface{}{"infohash": infoHash.String()}, nil, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]bool{"pinned": true})
+}
+
+func (s *PeerStore) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := s.parseInfoHash(r)
+	if !ok {
+		http.Error(w, "invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	err := s.UnpinSwarm(infoHash)
+	s.audit(httpCaller(r), "unpin_swarm", map[string]interface{}{"infohash": infoHash.String()}, nil, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]bool{"pinned": false})
+}
+
+func (s *PeerStore) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	s.handleSetFrozen(w, r, true)
+}
+
+func (s *PeerStore) handleUnfreeze(w http.ResponseWriter, r *http.Request) {
+	s.handleSetFrozen(w, r, false)
+}
+
+func (s *PeerStore) handleSetFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	infoHash, ok := s.parseInfoHash(r)
+	if !ok {
+		http.Error(w, "invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	op, set := "unfreeze_swarm", s.UnfreezeSwarm
+	if frozen {
+		op, set = "freeze_swarm", s.FreezeSwarm
+	}
+	if !set(infoHash) {
+		s.audit(httpCaller(r), op, map[string]interface{}{"infohash": infoHash.String()}, nil, ErrSwarmNotFound)
+		http.Error(w, "swarm not found", http.StatusNotFound)
+		return
+	}
+	s.audit(httpCaller(r), op, map[string]interface{}{"infohash": infoHash.String()}, nil, nil)
+	writeJSON(w, map[string]bool{"frozen": frozen})
+}
+
+func (s *PeerStore) handleTags(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := s.parseInfoHash(r)
+	if !ok {
+		http.Error(w, "invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	tags := r.URL.Query()["tag"]
+	err := s.SetSwarmTags(infoHash, tags)
+	s.audit(httpCaller(r), "set_swarm_tags", map[string]interface{}{"infohash": infoHash.String(), "tags": tags}, nil, err)
+	switch err {
+	case nil:
+		writeJSON(w, map[string][]string{"tags": s.SwarmTags(infoHash)})
+	case ErrInvalidTags:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrReadOnly:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "swarm not found", http.StatusNotFound)
+	}
+}
+
+func (s *PeerStore) handleWebSeeds(w http.ResponseWriter, r *http.Request) {
+	infoHash, ok := s.parseInfoHash(r)
+	if !ok {
+		http.Error(w, "invalid infohash", http.StatusBadRequest)
+		return
+	}
+
+	urls := r.URL.Query()["url"]
+	err := s.SetWebSeeds(infoHash, urls)
+	s.audit(httpCaller(r), "set_web_seeds", map[string]interface{}{"infohash": infoHash.String(), "urls": urls}, nil, err)
+	switch err {
+	case nil:
+		writeJSON(w, map[string][]string{"web_seeds": s.WebSeeds(infoHash)})
+	case ErrInvalidWebSeeds:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrReadOnly:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *PeerStore) handlePurge(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := s.PurgeIP(ip)
+	s.audit(httpCaller(r), "purge_ip", map[string]interface{}{"ip": ip.String()}, map[string]interface{}{"removed": removed}, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]int{"removed": removed})
+}
+
+func (s *PeerStore) handleGC(w http.ResponseWriter, r *http.Request) {
+	if s.isReadOnly() {
+		s.audit(httpCaller(r), "gc", nil, nil, ErrReadOnly)
+		http.Error(w, ErrReadOnly.Error(), http.StatusConflict)
+		return
+	}
+
+	stats := s.collectGarbage(s.now().Add(-s.cfg.PeerLifetime))
+	result := map[string]interface{}{
+		"duration":      stats.Duration.String(),
+		"peersRemoved":  stats.PeersRemoved,
+		"swarmsRemoved": stats.SwarmsRemoved,
+		"swarmsSpilled": stats.SwarmsSpilled,
+		"shardsTouched": stats.ShardsTouched,
+		"rebalances":    stats.Rebalances,
+		"aborted":       stats.Aborted,
+	}
+	s.audit(httpCaller(r), "gc", nil, result, nil)
+	writeJSON(w, result)
+}
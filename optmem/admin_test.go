@@ -0,0 +1,182 @@
+package optmem
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinSwarm(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p2))
+	require.Nil(t, ps.PinSwarm(ih))
+
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	require.Nil(t, ps.DeleteSeeder(ih, p2))
+	require.Equal(t, uint64(1), ps.NumSwarms())
+
+	info, ok := ps.SwarmInfo(ih)
+	require.True(t, ok)
+	require.True(t, info.Pinned)
+	require.Equal(t, uint32(1), info.Stats.Combined.Snatches)
+
+	require.Nil(t, ps.UnpinSwarm(ih))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	_, ok = ps.SwarmInfo(ih)
+	require.False(t, ok)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+// purgeIP purges an IP and returns the number of peers removed.
+func purgeIP(t *testing.T, ps *PeerStore, ip net.IP) int {
+	removed, err := ps.PurgeIP(ip)
+	require.Nil(t, err)
+	return removed
+}
+
+func TestPurgeIP(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.PutLeecher(ih2, p1))
+	p1OtherPort := p1
+	p1OtherPort.Port++
+	require.Nil(t, ps.PutLeecher(ih2, p1OtherPort))
+
+	require.Equal(t, 3, purgeIP(t, ps, net.ParseIP("1.2.3.4")))
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders)
+	require.Equal(t, uint64(1), leechers)
+	require.Equal(t, 1, ps.NumLeechers(ih))
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestShardStats(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+
+	// Shard statistics are read without taking the lock of the shard.
+	index := ps.shards.shardIndex(infohash(ih))
+	ps.shards.lockShard(index)
+	stats := ps.ShardStats()
+	ps.shards.unlockShard(index, 0)
+
+	require.Len(t, stats, 1<<testConfig.ShardCountBits)
+	require.Equal(t, ShardStats{Index: index, Swarms: 1, Seeders: 1, Leechers: 1}, stats[index])
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestAdminHandler(t *testing.T) {
+	cfg := testConfig
+	cfg.AdminInsecure = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	srv := httptest.NewServer(ps.adminHandler())
+	defer srv.Close()
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	hexIH := hex.EncodeToString(ih[:])
+
+	resp, err := http.Get(srv.URL + "/stats")
+	require.Nil(t, err)
+	var stats map[string]interface{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+	require.Equal(t, float64(1), stats["swarms"])
+	require.Equal(t, float64(1), stats["seeders"])
+
+	resp, err = http.Post(srv.URL+"/swarm/pin?infohash="+hexIH, "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/swarm?infohash=" + hexIH)
+	require.Nil(t, err)
+	var info SwarmInfo
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&info))
+	resp.Body.Close()
+	require.True(t, info.Pinned)
+	require.Equal(t, uint32(1), info.Stats.Combined.Complete)
+
+	resp, err = http.Post(srv.URL+"/purge?ip=1.2.3.4", "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 0, ps.NumSeeders(ih))
+
+	resp, err = http.Get(srv.URL + "/swarm?infohash=zz")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/gc")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// Mutations are rejected while the store is read-only.
+	ps.SetReadOnly(true)
+	for _, path := range []string{"/swarm/pin", "/swarm/unpin", "/swarm/tags", "/purge"} {
+		resp, err = http.Post(srv.URL+path+"?infohash="+hexIH+"&tag=a&ip=1.2.3.4", "", nil)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusConflict, resp.StatusCode, path)
+	}
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestAdminAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	cfg := testConfig
+	cfg.AdminInsecure = true
+	cfg.ColdStoragePath = filepath.Join(t.TempDir(), "cold.db")
+	cfg.Persistence = PersistenceConfig{Name: "test-memory"}
+	defer func() {
+		testMemDriver.mu.Lock()
+		testMemDriver.snapshot = nil
+		testMemDriver.closed = 0
+		testMemDriver.mu.Unlock()
+	}()
+
+	// Everything acquired before a server fails to start is released.
+	for i, addrs := range [][2]string{
+		{l.Addr().String(), ""},
+		{"127.0.0.1:0", l.Addr().String()},
+	} {
+		cfg.AdminAddr, cfg.AdminGRPCAddr = addrs[0], addrs[1]
+		_, err = New(cfg)
+		require.NotNil(t, err)
+		testMemDriver.mu.Lock()
+		require.Equal(t, i+1, testMemDriver.closed)
+		testMemDriver.mu.Unlock()
+	}
+
+	// The cold storage is not locked anymore.
+	cfg.AdminAddr, cfg.AdminGRPCAddr = "", ""
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, <-ps.Stop())
+}
@@ -0,0 +1,402 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: admin.proto
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Admin_GetSwarm_FullMethodName     = "/optmem.admin.Admin/GetSwarm"
+	Admin_ListSwarms_FullMethodName   = "/optmem.admin.Admin/ListSwarms"
+	Admin_DeleteSwarm_FullMethodName  = "/optmem.admin.Admin/DeleteSwarm"
+	Admin_Stats_FullMethodName        = "/optmem.admin.Admin/Stats"
+	Admin_TriggerGC_FullMethodName    = "/optmem.admin.Admin/TriggerGC"
+	Admin_Export_FullMethodName       = "/optmem.admin.Admin/Export"
+	Admin_SetSwarmTags_FullMethodName = "/optmem.admin.Admin/SetSwarmTags"
+)
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// GetSwarm returns information about a single swarm.
+	GetSwarm(ctx context.Context, in *GetSwarmRequest, opts ...grpc.CallOption) (*Swarm, error)
+	// ListSwarms streams the counts of all swarms, ordered by infohash.
+	ListSwarms(ctx context.Context, in *ListSwarmsRequest, opts ...grpc.CallOption) (Admin_ListSwarmsClient, error)
+	// DeleteSwarm removes a swarm and all its peers.
+	DeleteSwarm(ctx context.Context, in *DeleteSwarmRequest, opts ...grpc.CallOption) (*DeleteSwarmResponse, error)
+	// Stats returns store-wide counts.
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	// TriggerGC runs garbage collection with the configured peer lifetime.
+	TriggerGC(ctx context.Context, in *TriggerGCRequest, opts ...grpc.CallOption) (*TriggerGCResponse, error)
+	// Export streams an export of the store, in the format read by
+	// ImportSwarms.
+	Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (Admin_ExportClient, error)
+	// SetSwarmTags replaces the tags of a swarm.
+	SetSwarmTags(ctx context.Context, in *SetSwarmTagsRequest, opts ...grpc.CallOption) (*SetSwarmTagsResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) GetSwarm(ctx context.Context, in *GetSwarmRequest, opts ...grpc.CallOption) (*Swarm, error) {
+	out := new(Swarm)
+	err := c.cc.Invoke(ctx, Admin_GetSwarm_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListSwarms(ctx context.Context, in *ListSwarmsRequest, opts ...grpc.CallOption) (Admin_ListSwarmsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Admin_ServiceDesc.Streams[0], Admin_ListSwarms_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &adminListSwarmsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Admin_ListSwarmsClient interface {
+	Recv() (*SwarmSummary, error)
+	grpc.ClientStream
+}
+
+type adminListSwarmsClient struct {
+	grpc.ClientStream
+}
+
+func (x *adminListSwarmsClient) Recv() (*SwarmSummary, error) {
+	m := new(SwarmSummary)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *adminClient) DeleteSwarm(ctx context.Context, in *DeleteSwarmRequest, opts ...grpc.CallOption) (*DeleteSwarmResponse, error) {
+	out := new(DeleteSwarmResponse)
+	err := c.cc.Invoke(ctx, Admin_DeleteSwarm_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, Admin_Stats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) TriggerGC(ctx context.Context, in *TriggerGCRequest, opts ...grpc.CallOption) (*TriggerGCResponse, error) {
+	out := new(TriggerGCResponse)
+	err := c.cc.Invoke(ctx, Admin_TriggerGC_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (Admin_ExportClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Admin_ServiceDesc.Streams[1], Admin_Export_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &adminExportClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Admin_ExportClient interface {
+	Recv() (*ExportChunk, error)
+	grpc.ClientStream
+}
+
+type adminExportClient struct {
+	grpc.ClientStream
+}
+
+func (x *adminExportClient) Recv() (*ExportChunk, error) {
+	m := new(ExportChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *adminClient) SetSwarmTags(ctx context.Context, in *SetSwarmTagsRequest, opts ...grpc.CallOption) (*SetSwarmTagsResponse, error) {
+	out := new(SetSwarmTagsResponse)
+	err := c.cc.Invoke(ctx, Admin_SetSwarmTags_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	// GetSwarm returns information about a single swarm.
+	GetSwarm(context.Context, *GetSwarmRequest) (*Swarm, error)
+	// ListSwarms streams the counts of all swarms, ordered by infohash.
+	ListSwarms(*ListSwarmsRequest, Admin_ListSwarmsServer) error
+	// DeleteSwarm removes a swarm and all its peers.
+	DeleteSwarm(context.Context, *DeleteSwarmRequest) (*DeleteSwarmResponse, error)
+	// Stats returns store-wide counts.
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	// TriggerGC runs garbage collection with the configured peer lifetime.
+	TriggerGC(context.Context, *TriggerGCRequest) (*TriggerGCResponse, error)
+	// Export streams an export of the store, in the format read by
+	// ImportSwarms.
+	Export(*ExportRequest, Admin_ExportServer) error
+	// SetSwarmTags replaces the tags of a swarm.
+	SetSwarmTags(context.Context, *SetSwarmTagsRequest) (*SetSwarmTagsResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) GetSwarm(context.Context, *GetSwarmRequest) (*Swarm, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSwarm not implemented")
+}
+func (UnimplementedAdminServer) ListSwarms(*ListSwarmsRequest, Admin_ListSwarmsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListSwarms not implemented")
+}
+func (UnimplementedAdminServer) DeleteSwarm(context.Context, *DeleteSwarmRequest) (*DeleteSwarmResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSwarm not implemented")
+}
+func (UnimplementedAdminServer) Stats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedAdminServer) TriggerGC(context.Context, *TriggerGCRequest) (*TriggerGCResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TriggerGC not implemented")
+}
+func (UnimplementedAdminServer) Export(*ExportRequest, Admin_ExportServer) error {
+	return status.Errorf(codes.Unimplemented, "method Export not implemented")
+}
+func (UnimplementedAdminServer) SetSwarmTags(context.Context, *SetSwarmTagsRequest) (*SetSwarmTagsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSwarmTags not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_GetSwarm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSwarmRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetSwarm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetSwarm_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetSwarm(ctx, req.(*GetSwarmRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListSwarms_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListSwarmsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).ListSwarms(m, &adminListSwarmsServer{stream})
+}
+
+type Admin_ListSwarmsServer interface {
+	Send(*SwarmSummary) error
+	grpc.ServerStream
+}
+
+type adminListSwarmsServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminListSwarmsServer) Send(m *SwarmSummary) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Admin_DeleteSwarm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSwarmRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DeleteSwarm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_DeleteSwarm_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DeleteSwarm(ctx, req.(*DeleteSwarmRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_Stats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_TriggerGC_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerGCRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).TriggerGC(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_TriggerGC_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).TriggerGC(ctx, req.(*TriggerGCRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Export_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).Export(m, &adminExportServer{stream})
+}
+
+type Admin_ExportServer interface {
+	Send(*ExportChunk) error
+	grpc.ServerStream
+}
+
+type adminExportServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminExportServer) Send(m *ExportChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Admin_SetSwarmTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetSwarmTagsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetSwarmTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_SetSwarmTags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetSwarmTags(ctx, req.(*SetSwarmTagsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "optmem.admin.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetSwarm",
+			Handler:    _Admin_GetSwarm_Handler,
+		},
+		{
+			MethodName: "DeleteSwarm",
+			Handler:    _Admin_DeleteSwarm_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _Admin_Stats_Handler,
+		},
+		{
+			MethodName: "TriggerGC",
+			Handler:    _Admin_TriggerGC_Handler,
+		},
+		{
+			MethodName: "SetSwarmTags",
+			Handler:    _Admin_SetSwarmTags_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListSwarms",
+			Handler:       _Admin_ListSwarms_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Export",
+			Handler:       _Admin_Export_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "admin.proto",
+}
@@ -0,0 +1,5 @@
+// Package adminpb contains the protobuf definition and generated gRPC code of
+// the admin service of the optmem PeerStore.
+package adminpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
@@ -0,0 +1,191 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// ErrInvalidAlias is returned by AliasSwarm for aliases that would alias a
+// swarm to itself or form a chain.
+var ErrInvalidAlias = bittorrent.ClientError("invalid infohash alias")
+
+// resolveAlias returns the infohash that operations on infoHash act on, see
+// AliasSwarm.
+func (s *PeerStore) resolveAlias(infoHash bittorrent.InfoHash) bittorrent.InfoHash {
+	aliases, _ := s.aliases.Load().(map[infohash]infohash)
+	if len(aliases) == 0 {
+		return infoHash
+	}
+	if to, ok := aliases[infohash(infoHash)]; ok {
+		return bittorrent.InfoHash(to)
+	}
+	return infoHash
+}
+
+// AliasSwarm makes from an alias of to, for example for the v1 and v2
+// infohashes of a hybrid torrent.
+// Afterwards, announces, scrapes and all other operations on from act on the
+// swarm of to, and the peers stored for from are moved to the swarm of to.
+// Scrapes still report the infohash they were made for.
+//
+// If to is an alias itself, from becomes an alias of the swarm to refers to.
+// Returns ErrInvalidAlias if from and to refer to the same swarm or if other
+// infohashes are aliases of from.
+//
+// Aliases are kept in memory only and are per namespace.
+// Peers are moved without regard to MaxSwarmPeers and MaxPeers, and the
+// PeerStats and tags of from are dropped.
+// Puts to from that race with AliasSwarm may still land in the old swarm,
+// where they expire like any other peer.
+func (s *PeerStore) AliasSwarm(from, to bittorrent.InfoHash) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	s.aliasMu.Lock()
+	aliases, _ := s.aliases.Load().(map[infohash]infohash)
+	target := infohash(to)
+	if t, ok := aliases[target]; ok {
+		target = t
+	}
+	if infohash(from) == infohash(to) || target == infohash(from) {
+		s.aliasMu.Unlock()
+		return ErrInvalidAlias
+	}
+	for _, t := range aliases {
+		if t == infohash(from) {
+			s.aliasMu.Unlock()
+			return ErrInvalidAlias
+		}
+	}
+
+	updated := make(map[infohash]infohash, len(aliases)+1)
+	for k, v := range aliases {
+		updated[k] = v
+	}
+	updated[infohash(from)] = target
+	s.aliases.Store(updated)
+	s.aliasMu.Unlock()
+
+	s.flushAll()
+	s.mergeSwarm(infohash(from), target)
+	return nil
+}
+
+// mergeSwarm moves the peers and downloads, including the durable download
+// counters, of the swarm of from to the swarm of to and removes the swarm of
+// from.
+func (s *PeerStore) mergeSwarm(from, to infohash) {
+	s.faultIn(from)
+	s.faultIn(to)
+
+	shard := s.shards.lockShardByHash(from)
+	durable, hasDurable := shard.downloads[from]
+	delete(shard.downloads, from)
+	sw, ok := shard.swarms[from]
+	if !ok {
+		s.shards.unlockShardByHash(from, 0)
+		if hasDurable {
+			s.addDurableDownloads(to, durable)
+		}
+		return
+	}
+	var peers [2][]peer
+	var downloads [2]uint64
+	for i, pl := range [2]*peerList{sw.peers4, sw.peers6} {
+		if pl != nil {
+			peers[i] = pl.getAllPeers(nil)
+			downloads[i] = pl.numDownloads
+		}
+	}
+	shard.counts.subSwarm(sw)
+	s.hooks.swarmRemoved(shard, from, sw)
+	shard.deleteSwarm(from)
+	s.shards.unlockShardByHash(from, -1)
+
+	shard = s.shards.lockShardByHash(to)
+	created := false
+	for i, af := range [2]bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		for j := range peers[i] {
+			p := &peers[i][j]
+			if p.isDead() {
+				continue
+			}
+			if l := shard.swarms[to].list(af); l != nil && l.contains(p) {
+				continue
+			}
+			swarmCreated, _ := putPeerLocked(shard, to, p, af, false)
+			created = created || swarmCreated
+		}
+		if l := shard.swarms[to].list(af); l != nil {
+			l.numDownloads += downloads[i]
+		}
+	}
+	shard.countDownload(to, bittorrent.IPv4, durable[0])
+	shard.countDownload(to, bittorrent.IPv6, durable[1])
+	if sw, ok := shard.swarms[to]; ok {
+		shard.setSwarm(to, sw)
+	}
+	delta := 0
+	if created {
+		s.hooks.swarmCreated(shard, to)
+		delta = 1
+	}
+	s.shards.unlockShardByHash(to, delta)
+}
+
+// addDurableDownloads adds to the durable download counters of a swarm.
+func (s *PeerStore) addDurableDownloads(ih infohash, downloads [2]uint64) {
+	shard := s.shards.lockShardByHash(ih)
+	shard.countDownload(ih, bittorrent.IPv4, downloads[0])
+	shard.countDownload(ih, bittorrent.IPv6, downloads[1])
+	if sw, ok := shard.swarms[ih]; ok {
+		shard.setSwarm(ih, sw)
+	}
+	s.shards.unlockShardByHash(ih, 0)
+}
+
+// UnaliasSwarm removes the alias from, see AliasSwarm.
+// Peers that were moved to the aliased swarm stay there.
+// Returns false if from is not an alias.
+func (s *PeerStore) UnaliasSwarm(from bittorrent.InfoHash) bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	aliases, _ := s.aliases.Load().(map[infohash]infohash)
+	if _, ok := aliases[infohash(from)]; !ok {
+		return false
+	}
+
+	updated := make(map[infohash]infohash, len(aliases))
+	for k, v := range aliases {
+		if k != infohash(from) {
+			updated[k] = v
+		}
+	}
+	s.aliases.Store(updated)
+	return true
+}
+
+// Aliases returns the aliases of the store, mapping each alias to the
+// infohash of the swarm it refers to.
+func (s *PeerStore) Aliases() map[bittorrent.InfoHash]bittorrent.InfoHash {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	aliases, _ := s.aliases.Load().(map[infohash]infohash)
+	m := make(map[bittorrent.InfoHash]bittorrent.InfoHash, len(aliases))
+	for k, v := range aliases {
+		m[bittorrent.InfoHash(k)] = bittorrent.InfoHash(v)
+	}
+	return m
+}
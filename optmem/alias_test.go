@@ -0,0 +1,58 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAliasSwarm(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	v2 := bittorrent.InfoHashFromString("22222222222222222222")
+	other := bittorrent.InfoHashFromString("33333333333333333333")
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(v2, p2))
+	require.Nil(t, ps.PutLeecher(v2, p1))
+	require.Nil(t, ps.GraduateLeecher(v2, p3))
+
+	require.Nil(t, ps.AliasSwarm(v2, ih))
+	require.Equal(t, map[bittorrent.InfoHash]bittorrent.InfoHash{v2: ih}, ps.Aliases())
+
+	// The peers of v2 were merged, p1 stays a seeder.
+	require.Equal(t, 2, ps.NumSeeders(ih))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	require.Equal(t, 2, ps.NumSeeders(v2))
+	scrape := ps.ScrapeSwarm(v2, bittorrent.IPv6)
+	require.Equal(t, v2, scrape.InfoHash)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Snatches)
+
+	scrapes := ps.ScrapeSwarms([]bittorrent.InfoHash{ih, v2}, bittorrent.IPv4)
+	require.Equal(t, ih, scrapes[0].InfoHash)
+	require.Equal(t, v2, scrapes[1].InfoHash)
+	require.Equal(t, scrapes[0].Complete, scrapes[1].Complete)
+	require.Equal(t, scrapes[0].Incomplete, scrapes[1].Incomplete)
+
+	// Announces to either hash act on the merged swarm.
+	peers, err := ps.AnnouncePeers(v2, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.Nil(t, ps.DeleteLeecher(v2, p2))
+	require.Equal(t, 0, ps.NumLeechers(ih))
+
+	// Aliases of aliases resolve to the swarm, chains and self-aliases are rejected.
+	require.Nil(t, ps.AliasSwarm(other, v2))
+	require.Equal(t, ih, ps.Aliases()[other])
+	require.Equal(t, ErrInvalidAlias, ps.AliasSwarm(ih, v2))
+	require.Equal(t, ErrInvalidAlias, ps.AliasSwarm(v2, v2))
+
+	require.True(t, ps.UnaliasSwarm(v2))
+	require.False(t, ps.UnaliasSwarm(v2))
+	require.Equal(t, 0, ps.NumSeeders(v2))
+	require.Equal(t, 2, ps.NumSeeders(other))
+}
@@ -0,0 +1,82 @@
+package optmem
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+)
+
+// Defaults of the announce cache.
+const (
+	defaultAnnounceCacheTTL  = 500 * time.Millisecond
+	defaultAnnounceCacheSize = 512
+)
+
+// selectionKey identifies a peer list of a swarm in the announce cache of a
+// shard.
+type selectionKey struct {
+	ih infohash
+	af bittorrent.AddressFamily
+}
+
+// cachedSelection is a random sample of the peers of a large peer list, which
+// announces are served from until it expires, see AnnounceCacheThreshold.
+// The sample is never changed after the selection is stored.
+type cachedSelection struct {
+	refreshing int32 // 1 once an announce samples a replacement, accessed atomically
+	expires    int64 // unix nanoseconds
+	sample     *hotSet
+}
+
+// announceCacheSize returns the configured AnnounceCacheSize, or the
+// default.
+func (cfg Config) announceCacheSize() int {
+	if cfg.AnnounceCacheSize > 0 {
+		return int(cfg.AnnounceCacheSize)
+	}
+	return defaultAnnounceCacheSize
+}
+
+// cachedAnnouncePeers appends up to numWant peers of the cached selection of
+// a peer list for an announce to dst, in random order.
+//
+// If there is no selection yet, or it expired, the announce samples a new
+// one, which runs in linear time in regards to the number of peers.
+// Only the first announce to see an expired selection replaces it, others
+// are served from the expired selection meanwhile.
+// The shard must be locked by the caller, a read lock suffices.
+func (s *PeerStore) cachedAnnouncePeers(shard *shard, ih infohash, l *peerList, af bittorrent.AddressFamily, dst []peer, numWant int, seeder bool, s0, s1 uint64) []peer {
+	key := selectionKey{ih: ih, af: af}
+	now := s.now().UnixNano()
+
+	var sel *cachedSelection
+	if v, ok := shard.selections.Load(key); ok {
+		sel = v.(*cachedSelection)
+	}
+	if sel == nil || (sel.expires <= now && atomic.CompareAndSwapInt32(&sel.refreshing, 0, 1)) {
+		promAnnounceCacheMisses.inc(af)
+		sel = &cachedSelection{
+			expires: now + int64(s.cfg.AnnounceCacheTTL),
+			sample:  buildHotSet(l, s.cfg.announceCacheSize(), mix64(s0), mix64(s1)),
+		}
+		shard.selections.Store(key, sel)
+	} else {
+		promAnnounceCacheHits.inc(af)
+	}
+
+	start := len(dst)
+	dst = sel.sample.announcePeers(dst, numWant, seeder, s.cfg.AnnounceSeederShare, s0, s1)
+	shufflePeers(dst[start:], s1, s0)
+	return dst
+}
+
+// shufflePeers shuffles peers in place.
+func shufflePeers(peers []peer, s0, s1 uint64) {
+	var j int
+	for i := len(peers) - 1; i > 0; i-- {
+		j, s0, s1 = random.Intn(s0, s1, i+1)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+}
@@ -0,0 +1,68 @@
+package optmem
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceCache(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.AnnounceCacheThreshold = 100
+	cfg.AnnounceCacheSize = 50
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, defaultAnnounceCacheTTL, ps.cfg.AnnounceCacheTTL)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 200; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+	shard := ps.shards.shards[ps.shards.shardIndex(infohash(ih))]
+	key := selectionKey{ih: infohash(ih), af: bittorrent.IPv4}
+
+	peers, err := ps.AnnouncePeers(ih, true, 80, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 50)
+	v, ok := shard.selections.Load(key)
+	require.True(t, ok)
+	sel := v.(*cachedSelection)
+	sampled := make(map[string]bool)
+	for _, p := range sel.sample.leechers {
+		sampled[net.IP(p.ip()).String()] = true
+	}
+	for _, p := range peers {
+		require.True(t, sampled[p.IP.String()])
+	}
+
+	// Announces are served from the same sample until it expires.
+	_, err = ps.AnnouncePeers(ih, true, 80, p1)
+	require.Nil(t, err)
+	v, _ = shard.selections.Load(key)
+	require.True(t, v.(*cachedSelection) == sel)
+
+	atomic.AddInt64(&clock.unix, 1)
+	_, err = ps.AnnouncePeers(ih, true, 80, p1)
+	require.Nil(t, err)
+	v, _ = shard.selections.Load(key)
+	require.False(t, v.(*cachedSelection) == sel)
+
+	// Small swarms are not cached, and deleted swarms lose their sample.
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutLeecher(ih2, p2))
+	peers, err = ps.AnnouncePeers(ih2, true, 80, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	shard2 := ps.shards.shards[ps.shards.shardIndex(infohash(ih2))]
+	_, ok = shard2.selections.Load(selectionKey{ih: infohash(ih2), af: bittorrent.IPv4})
+	require.False(t, ok)
+
+	require.Equal(t, 200, purgeRange(ps, 0, 200))
+	_, ok = shard.selections.Load(key)
+	require.False(t, ok)
+}
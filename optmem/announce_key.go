@@ -0,0 +1,204 @@
+package optmem
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// PutSeederKey works like PutSeeder, but identifies the peer by the key it
+// announced with as well as its endpoint, if PeerIdentity is
+// "announce_key".
+// If another endpoint of the same address family announced to the swarm
+// with the same key before, that peer is replaced by p instead of being kept
+// alongside it, so that clients behind a carrier-grade NAT or with a changing
+// IP do not leave duplicates behind.
+// An empty key works like PutSeeder, and the key is ignored for other
+// PeerIdentity modes.
+func (s *PeerStore) PutSeederKey(infoHash bittorrent.InfoHash, p bittorrent.Peer, key string) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.putKeyed("optmem.PutSeeder", infoHash, p, peerFlagSeeder, false, s.identityKey(p, key))
+}
+
+// PutLeecherKey works like PutLeecher, but identifies the peer by the key it
+// announced with as well as its endpoint, see PutSeederKey.
+func (s *PeerStore) PutLeecherKey(infoHash bittorrent.InfoHash, p bittorrent.Peer, key string) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.putKeyed("optmem.PutLeecher", infoHash, p, peerFlagLeecher, false, s.identityKey(p, key))
+}
+
+// GraduateLeecherKey works like GraduateLeecher, but identifies the peer by
+// the key it announced with as well as its endpoint, see PutSeederKey.
+func (s *PeerStore) GraduateLeecherKey(infoHash bittorrent.InfoHash, p bittorrent.Peer, key string) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.graduate(infoHash, p, peerFlagSeeder, s.identityKey(p, key))
+}
+
+// putKeyedPeerLocked works like putPeerLocked, but takes the identity key of
+// the peer, see identityKey, into account.
+// For announce keys, it first removes the peer that last announced with key
+// from another endpoint, if any, which counts as an update of that peer.
+// For peer IDs, it first removes the peer stored at the endpoint of p if it
+// has a different peer ID, which counts as an insert of a new peer.
+// It then records that p holds key.
+// If the endpoints of dual-stack peers are linked, the endpoint of the
+// other address family holding key is updated along with p, see touchLinked.
+// A key of zero works like putPeerLocked.
+// Additionally returns whether a completed download turned a stored leecher
+// into a seeder, see OnLeecherGraduated.
+// The shard must be write-locked by the caller.
+func putKeyedPeerLocked(shard *shard, ih infohash, p *peer, af bittorrent.AddressFamily, completed bool, key uint64) (swarmCreated, inserted, graduated bool) {
+	graduating := completed && p.isSeeder()
+	if pl := shard.swarms[ih].list(af); pl != nil && graduating {
+		var e endpoint
+		copy(e[:], p[:peerCompareSize])
+		stored, ok := pl.lookupPeer(e)
+		graduated = ok && !stored.isSeeder()
+	}
+	if key == 0 {
+		swarmCreated, inserted = putPeerLocked(shard, ih, p, af, completed)
+		return swarmCreated, inserted, graduated
+	}
+
+	var replaced bool
+	if pl := shard.swarms[ih].list(af); pl != nil {
+		var seeder bool
+		if shard.identity == identityPeerID {
+			replaced, seeder = pl.removeReidentified(p, key)
+			// A different peer was stored at the endpoint.
+			graduated = graduated && !replaced
+		} else {
+			replaced, seeder = pl.removeKeyed(p, key)
+			// The peer moved to the endpoint of p.
+			graduated = graduated || (graduating && replaced && !seeder)
+		}
+		if replaced {
+			if af == bittorrent.IPv4 {
+				shard.counts.peers4--
+				if seeder {
+					shard.counts.seeders4--
+				}
+			} else {
+				shard.counts.peers6--
+				if seeder {
+					shard.counts.seeders6--
+				}
+			}
+		}
+	}
+
+	swarmCreated, inserted = putPeerLocked(shard, ih, p, af, completed)
+	if shard.linked {
+		touchLinked(shard, ih, p, af, key)
+	}
+	if shard.identity == identityPeerID {
+		shard.swarms[ih].list(af).setIdentity(p, key)
+		return swarmCreated, inserted, graduated
+	}
+	shard.swarms[ih].list(af).setKey(p, key)
+	return swarmCreated, inserted && !replaced, graduated
+}
+
+// removeKeyed removes the peer holding key, unless it has the endpoint of p.
+// Returns whether a peer was removed and whether it was a seeder.
+func (pl *peerList) removeKeyed(p *peer, key uint64) (removed bool, wasSeeder bool) {
+	e, ok := pl.keys[key]
+	if !ok || bytes.Equal(e[:], p[:peerCompareSize]) {
+		return false, false
+	}
+
+	var old peer
+	copy(old[:], e[:])
+	bucket := pl.peerBuckets[pl.bucketIndex(&old)]
+	match := sort.Search(len(bucket), binarySearchFunc(&old, bucket))
+	if match >= len(bucket) || bucket[match].isDead() || !bytes.Equal(old[:peerCompareSize], bucket[match][:peerCompareSize]) {
+		return false, false
+	}
+	old = bucket[match]
+	return pl.removePeer(&old)
+}
+
+// removeReidentified removes the peer stored at the endpoint of p if it was
+// stored with a different identity key.
+// Returns whether a peer was removed and whether it was a seeder.
+func (pl *peerList) removeReidentified(p *peer, key uint64) (removed bool, wasSeeder bool) {
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	old, ok := pl.keyOf[e]
+	if !ok || old == key {
+		return false, false
+	}
+
+	bucket := pl.peerBuckets[pl.bucketIndex(p)]
+	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
+	if match >= len(bucket) || bucket[match].isDead() || !bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize]) {
+		return false, false
+	}
+	stored := bucket[match]
+	return pl.removePeer(&stored)
+}
+
+// setIdentity records the identity key of p without claiming key for p
+// alone, as peer IDs, unlike announce keys, may be shared by endpoints.
+// The endpoint that last put with key is recorded as well, so that it can be
+// linked to the other address family, see touchLinked.
+func (pl *peerList) setIdentity(p *peer, key uint64) {
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	if pl.keys == nil {
+		pl.keys = make(map[uint64]endpoint)
+		pl.keyOf = make(map[endpoint]uint64)
+	}
+	if old, ok := pl.keyOf[e]; ok && old != key && pl.keys[old] == e {
+		delete(pl.keys, old)
+	}
+	pl.keys[key] = e
+	pl.keyOf[e] = key
+}
+
+// setKey records that p holds key, replacing the previous key of p, if any.
+func (pl *peerList) setKey(p *peer, key uint64) {
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	if pl.keys == nil {
+		pl.keys = make(map[uint64]endpoint)
+		pl.keyOf = make(map[endpoint]uint64)
+	}
+	if old, ok := pl.keyOf[e]; ok && old != key {
+		delete(pl.keys, old)
+	}
+	if prev, ok := pl.keys[key]; ok && prev != e {
+		delete(pl.keyOf, prev)
+	}
+	pl.keys[key] = e
+	pl.keyOf[e] = key
+}
+
+// deleteKey removes the key of the peer with endpoint e, if any.
+func (pl *peerList) deleteKey(e endpoint) {
+	if pl.keyOf == nil {
+		return
+	}
+	if key, ok := pl.keyOf[e]; ok {
+		if pl.keys[key] == e {
+			delete(pl.keys, key)
+		}
+		delete(pl.keyOf, e)
+	}
+}
@@ -0,0 +1,73 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceKeys(t *testing.T) {
+	cfg := testConfig
+	cfg.AnnounceKeys = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecherKey(ih, p1, "key"))
+	require.Nil(t, ps.PutLeecherKey(ih, p2, "other"))
+
+	// The client of p1 moves to a new IP.
+	moved := p1
+	moved.IP = bittorrent.IP{IP: net.ParseIP("5.6.7.8").To4(), AddressFamily: bittorrent.IPv4}
+	require.Nil(t, ps.GraduateLeecherKey(ih, moved, "key"))
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(1), leechers)
+	require.NotNil(t, ps.DeleteLeecher(ih, p1))
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+
+	// Puts without a key do not replace keyed peers.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Equal(t, 2, ps.NumLeechers(ih))
+
+	// Keys of removed peers are forgotten.
+	require.Nil(t, ps.DeleteSeeder(ih, moved))
+	require.Nil(t, ps.PutLeecherKey(ih, p3, "key"))
+	require.Nil(t, ps.PutLeecherKey(ih, moved, "key"))
+	require.Equal(t, 4, ps.NumLeechers(ih))
+
+	// The same endpoint may change its key.
+	require.Nil(t, ps.PutLeecherKey(ih, moved, "new"))
+	require.Nil(t, ps.PutSeederKey(ih, p2, "key"))
+	require.Equal(t, 4, ps.NumSeeders(ih)+ps.NumLeechers(ih))
+}
+
+func TestAnnounceKeysDisabled(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecherKey(ih, p1, "key"))
+	require.Nil(t, ps.PutLeecherKey(ih, p2, "key"))
+	require.Equal(t, 2, ps.NumLeechers(ih))
+}
+
+func TestAnnounceKeysBatched(t *testing.T) {
+	cfg := testConfig
+	cfg.AnnounceKeys = true
+	cfg.BatchQueueSize = 16
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecherKey(ih, p1, "key"))
+	require.Nil(t, ps.PutLeecherKey(ih, p2, "key"))
+	ps.Flush()
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	require.NotNil(t, ps.DeleteLeecher(ih, p1))
+	require.Nil(t, ps.DeleteLeecher(ih, p2))
+}
@@ -0,0 +1,139 @@
+package optmem
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AnnounceAndPut stores the announcing peer as a seeder or leecher and
+// selects peers for it.
+// This is equivalent to AnnouncePeers followed by PutSeeder or PutLeecher,
+// but the shard of the swarm is only locked once.
+//
+// Unlike AnnouncePeers, AnnounceAndPut does not fail for swarms that do not
+// exist: the swarm is created with the announcing peer and no peers are
+// returned.
+// Peers are selected before the announcing peer is stored, so a peer that
+// announces for the first time is never returned to itself.
+//
+// If batching is enabled, the put is queued as usual and the peers are
+// selected under a separate read lock.
+//
+// Throttled announces, see AnnounceRateLimit, fail with ErrThrottled and do
+// not store the peer.
+// Announces of banned peers, see BanPeer, fail with ErrPeerBanned.
+func (s *PeerStore) AnnounceAndPut(infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+	s.requests.inc()
+
+	af := announcingPeer.IP.AddressFamily
+	if af != bittorrent.IPv4 && af != bittorrent.IPv6 {
+		return nil, ErrInvalidIP
+	}
+	if s.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+	if !s.routable(announcingPeer.IP) {
+		return nil, ErrUnroutableIP
+	}
+	if s.banned(announcingPeer) {
+		return nil, ErrPeerBanned
+	}
+	promAnnounces.inc(af)
+	defer promAnnounceLatency.since(af, time.Now())
+	span := s.startSpan("optmem.AnnounceAndPut")
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attrNumWant.Int(numWant))
+	}
+
+	flag := peerFlagLeecher
+	if seeder {
+		flag = peerFlagSeeder
+	}
+	now := s.nowUnix()
+	p := makePeer(announcingPeer, flag, uint16(now))
+	ih := infohash(infoHash)
+	s0, s1 := s.selectionEntropy(infoHash, announcingPeer)
+	clamped := s.cfg.clampNumWant(numWant)
+	key := s.identityKey(announcingPeer, "")
+	op := opOfPut(infoHash, announcingPeer, flag, false, time.Unix(now, 0))
+	s.faultIn(ih)
+
+	var buf *[]peer
+	if s.batches != nil {
+		span.SetAttributes(attrBatched.Bool(true))
+		var err error
+		buf, err = s.announceSingleStack(ih, seeder, clamped, p, af, s0, s1, span)
+		if err == ErrThrottled {
+			return nil, err
+		}
+		if err != nil {
+			// The swarm or address family has no peers yet.
+			buf = peerBufferPool.Get().(*[]peer)
+			*buf = (*buf)[:0]
+		}
+		s.enqueuePut(ih, p, af, false, key, op)
+	} else {
+		var err error
+		buf, err = s.announceAndPutLocked(ih, seeder, clamped, p, af, s0, s1, key, span)
+		if err != nil {
+			return nil, err
+		}
+		s.logOp(op)
+	}
+	recordNumWant(numWant, len(*buf))
+
+	peers := appendBittorrentPeers(nil, *buf, af)
+	putPeerBuffer(buf)
+
+	return peers, nil
+}
+
+// announceAndPutLocked selects peers for an announcing peer and stores it
+// under a single write lock of its shard.
+// If the peer can not be stored because a cap is hit, no peers are returned.
+func (s *PeerStore) announceAndPutLocked(ih infohash, seeder bool, numWant int, p *peer, af bittorrent.AddressFamily, s0, s1, key uint64, span trace.Span) (*[]peer, error) {
+	start := waitStart(span)
+	shard := s.shards.lockShardByHash(ih)
+	lockWait(span, s.shards.shardIndex(ih), start)
+
+	if _, ok := shard.swarms[ih]; ok && !s.allowAnnounce(shard, ih, af) {
+		s.shards.unlockShardByHash(ih, 0)
+		return nil, ErrThrottled
+	}
+
+	err := s.admitPeer(shard, ih, p, af)
+	if err != nil {
+		s.shards.unlockShardByHash(ih, 0)
+		return nil, err
+	}
+
+	buf := peerBufferPool.Get().(*[]peer)
+	*buf = (*buf)[:0]
+
+	if l := shard.swarms[ih].list(af); l != nil {
+		*buf = s.selectPeers(shard, ih, l, *buf, numWant, seeder, p, af, s0, s1)
+	}
+	swarmCreated, inserted, _ := putKeyedPeerLocked(shard, ih, p, af, false, key)
+	swarmSize(span, shard, ih, af)
+	removed, evicted := s.sweepLocked(shard, ih, nil)
+
+	if swarmCreated {
+		s.hooks.swarmCreated(shard, ih)
+		s.shards.unlockShardByHash(ih, 1-removed)
+	} else {
+		s.shards.unlockShardByHash(ih, -removed)
+	}
+	s.finishSweep(evicted)
+	s.putCounts.record(af, inserted)
+
+	return buf, nil
+}
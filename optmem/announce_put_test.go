@@ -0,0 +1,44 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceAndPut(t *testing.T) {
+	for _, batched := range []bool{false, true} {
+		cfg := testConfig
+		if batched {
+			cfg.BatchQueueSize = 16
+			cfg.BatchFlushInterval = time.Hour
+		}
+		ps, err := New(cfg)
+		require.Nil(t, err)
+
+		// The swarm is created, the announcer gets no peers.
+		peers, err := ps.AnnounceAndPut(ih, true, 10, p1)
+		require.Nil(t, err)
+		require.Len(t, peers, 0)
+		ps.Flush()
+		require.Equal(t, uint64(1), ps.NumSwarms())
+		require.Equal(t, 1, ps.NumSeeders(ih))
+
+		peers, err = ps.AnnounceAndPut(ih, false, 10, p2)
+		require.Nil(t, err)
+		require.Len(t, peers, 1)
+		require.True(t, peers[0].Equal(p1))
+		ps.Flush()
+		require.Equal(t, 1, ps.NumLeechers(ih))
+
+		// Other address families are not returned.
+		peers, err = ps.AnnounceAndPut(ih, false, 10, p3)
+		require.Nil(t, err)
+		require.Len(t, peers, 0)
+		ps.Flush()
+		require.Equal(t, 2, ps.NumLeechers(ih))
+
+		require.Nil(t, <-ps.Stop())
+	}
+}
@@ -0,0 +1,95 @@
+package optmem
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/pkg/errors"
+)
+
+// ErrAnonymized is returned by ExportSwarms and ExportSwarmsSampled if
+// AnonymizeIPs is enabled, as exports contain the real addresses of peers.
+var ErrAnonymized = errors.New("peer addresses are anonymized")
+
+// anonymizer replaces IPs by keyed hashes, using a key that is rotated
+// periodically.
+type anonymizer struct {
+	rotation time.Duration // zero to never rotate the key
+	mu       sync.Mutex
+	key      []byte
+	created  time.Time // of the key
+}
+
+func newAnonymizer(rotation time.Duration) *anonymizer {
+	return &anonymizer{rotation: rotation}
+}
+
+// currentKey returns the key to use at now, creating a new key if the
+// current one is older than the rotation interval.
+func (a *anonymizer) currentKey(now time.Time) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.key == nil || (a.rotation > 0 && now.Sub(a.created) >= a.rotation) {
+		key := make([]byte, sha256.Size)
+		_, err := rand.Read(key)
+		if err != nil {
+			panic(errors.Wrap(err, "unable to generate anonymization key"))
+		}
+		a.key = key
+		a.created = now
+	}
+	return a.key
+}
+
+// anonymizeIP returns a pseudonym of the same length as ip: a prefix of the
+// HMAC-SHA256 of ip under the current key.
+// IPv4 addresses must be passed in their 4 byte form.
+func (a *anonymizer) anonymizeIP(ip net.IP, now time.Time) net.IP {
+	mac := hmac.New(sha256.New, a.currentKey(now))
+	mac.Write(ip)
+	return net.IP(mac.Sum(nil)[:len(ip)])
+}
+
+// anonymizePeers replaces the IPs of peers with their pseudonyms if
+// AnonymizeIPs is enabled.
+func (s *PeerStore) anonymizePeers(peers []bittorrent.Peer) {
+	if s.anon == nil {
+		return
+	}
+	now := s.now()
+	for i := range peers {
+		peers[i].IP.IP = s.anon.anonymizeIP(peers[i].IP.IP, now)
+	}
+}
+
+// anonymizePeer returns p with its IP replaced by its pseudonym if
+// AnonymizeIPs is enabled.
+func (s *PeerStore) anonymizePeer(p bittorrent.Peer) bittorrent.Peer {
+	if s.anon == nil {
+		return p
+	}
+	ip := p.IP.IP
+	if p.IP.AddressFamily == bittorrent.IPv4 {
+		ip = ip.To4()
+	}
+	p.IP.IP = s.anon.anonymizeIP(ip, s.now())
+	return p
+}
+
+// anonymizeEvictedPeers replaces the IPs of evicted peers with their
+// pseudonyms if AnonymizeIPs is enabled.
+func (s *PeerStore) anonymizeEvictedPeers(peers []EvictedPeer) {
+	if s.anon == nil {
+		return
+	}
+	now := s.now()
+	for i := range peers {
+		peers[i].Peer.IP.IP = s.anon.anonymizeIP(peers[i].Peer.IP.IP, now)
+	}
+}
@@ -0,0 +1,63 @@
+package optmem
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnonymizeIPs(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.AnonymizeIPs = true
+	cfg.AnonymizationKeyRotation = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	var graduated bittorrent.Peer
+	ps.OnLeecherGraduated(func(_ bittorrent.InfoHash, p bittorrent.Peer) { graduated = p })
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.GraduateLeecher(ih, p2))
+
+	// Announces return the real addresses.
+	peers, err := ps.AnnouncePeers(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.True(t, p1.IP.IP.Equal(peers[0].IP.IP) || p1.IP.IP.Equal(peers[1].IP.IP))
+
+	seeders4, seeders6, err := ps.GetSeeders(ih)
+	require.Nil(t, err)
+	require.Len(t, seeders4, 2)
+	require.Len(t, seeders6, 1)
+	require.Len(t, seeders6[0].IP.IP, 16)
+	require.False(t, p3.IP.IP.Equal(seeders6[0].IP.IP))
+	require.Equal(t, p3.Port, seeders6[0].Port)
+	for _, p := range seeders4 {
+		require.Len(t, p.IP.IP, 4)
+		require.False(t, p1.IP.IP.Equal(p.IP.IP))
+		require.False(t, p2.IP.IP.Equal(p.IP.IP))
+	}
+	require.Len(t, graduated.IP.IP, 4)
+	require.False(t, p2.IP.IP.Equal(graduated.IP.IP))
+
+	// Pseudonyms are stable until the key is rotated.
+	again, _, err := ps.GetSeeders(ih)
+	require.Nil(t, err)
+	require.Equal(t, seeders4, again)
+	clock.set(gcBenchStart.Add(time.Hour))
+	rotated, _, err := ps.GetSeeders(ih)
+	require.Nil(t, err)
+	require.NotEqual(t, seeders4, rotated)
+
+	_, err = ps.ExportSwarms(&bytes.Buffer{}, nil)
+	require.Equal(t, ErrAnonymized, err)
+}
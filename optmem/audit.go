@@ -0,0 +1,143 @@
+package optmem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	grpcpeer "google.golang.org/grpc/peer"
+)
+
+// AuditEntry is a record of the admin audit log, see AdminAuditLogPath.
+// The audit log contains one JSON-encoded AuditEntry per line.
+type AuditEntry struct {
+	// Time is the time the operation completed.
+	Time time.Time `json:"time"`
+
+	// Caller identifies who requested the operation.
+	Caller AuditCaller `json:"caller"`
+
+	// Operation is the name of the operation, for example "purge_ip".
+	Operation string `json:"operation"`
+
+	// Args are the arguments of the operation.
+	Args map[string]interface{} `json:"args,omitempty"`
+
+	// Result is the result of the operation, if it succeeded.
+	Result map[string]interface{} `json:"result,omitempty"`
+
+	// Error is the reason the operation failed, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditCaller identifies the caller of an admin operation.
+type AuditCaller struct {
+	// API is the API the operation was requested through, "http" or "grpc".
+	API string `json:"api"`
+
+	// Addr is the remote address of the caller.
+	Addr string `json:"addr"`
+
+	// Name is the name of the token or the common name of the client
+	// certificate the caller authenticated with, see AdminTokens and
+	// AdminTLS.
+	Name string `json:"name,omitempty"`
+
+	// Token is a fingerprint of the bearer token of the caller, the first
+	// eight bytes of its SHA-256 in hex, or empty if no token was sent.
+	Token string `json:"token,omitempty"`
+}
+
+// auditLog appends AuditEntries to a file.
+type auditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openAuditLog opens the audit log at path for appending, creating it if it
+// does not exist.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// append writes an entry and syncs it to disk.
+func (a *auditLog) append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.enc.Encode(e)
+	if err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// tokenFingerprint returns the fingerprint of a bearer token recorded in the
+// audit log.
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// httpCaller returns the caller of an admin HTTP request.
+func httpCaller(r *http.Request) AuditCaller {
+	return AuditCaller{
+		API:   "http",
+		Addr:  r.RemoteAddr,
+		Name:  adminIdentityFrom(r.Context()).name,
+		Token: tokenFingerprint(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")),
+	}
+}
+
+// grpcCaller returns the caller of an admin gRPC request.
+func grpcCaller(ctx context.Context) AuditCaller {
+	c := AuditCaller{
+		API:   "grpc",
+		Name:  adminIdentityFrom(ctx).name,
+		Token: tokenFingerprint(bearerToken(ctx)),
+	}
+	if p, ok := grpcpeer.FromContext(ctx); ok && p.Addr != nil {
+		c.Addr = p.Addr.String()
+	}
+	return c
+}
+
+// audit records an admin operation in the audit log, if one is configured.
+// A nil err records a successful operation with the given result.
+// Failing to write the entry is logged, the operation is not undone.
+func (s *PeerStore) audit(caller AuditCaller, op string, args, result map[string]interface{}, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	e := AuditEntry{Time: s.now(), Caller: caller, Operation: op, Args: args}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Result = result
+	}
+	if err := s.auditLog.append(e); err != nil {
+		log.Error("optmem: unable to write audit log entry", log.Fields{"operation": op, "error": err})
+	}
+}
@@ -0,0 +1,77 @@
+package optmem
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.AdminToken = "secret"
+	cfg.AdminAuditLogPath = filepath.Join(dir, "audit.log")
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	srv := httptest.NewServer(ps.adminHandler())
+	defer srv.Close()
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	post := func(path, token string) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, nil)
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+	}
+	post("/swarm/pin?infohash="+hex.EncodeToString(ih[:]), "secret")
+	post("/purge?ip=1.2.3.4", "secret")
+	post("/purge?ip=1.2.3.4", "wrong")
+	post("/swarm/tags?infohash="+hex.EncodeToString(ih[:])+"&tag=", "secret")
+	ps.SetReadOnly(true)
+	post("/gc", "secret")
+	require.Nil(t, <-ps.Stop())
+
+	f, err := os.Open(cfg.AdminAuditLogPath)
+	require.Nil(t, err)
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.Nil(t, scanner.Err())
+
+	// The request with the wrong token is not recorded.
+	require.Len(t, entries, 4)
+	require.Equal(t, "pin_swarm", entries[0].Operation)
+	require.Equal(t, ih.String(), entries[0].Args["infohash"])
+	require.Equal(t, "http", entries[0].Caller.API)
+	require.NotEmpty(t, entries[0].Caller.Addr)
+	require.Equal(t, tokenFingerprint("secret"), entries[0].Caller.Token)
+	require.NotContains(t, entries[0].Caller.Token, "secret")
+
+	require.Equal(t, "purge_ip", entries[1].Operation)
+	require.Equal(t, "1.2.3.4", entries[1].Args["ip"])
+	require.Equal(t, float64(1), entries[1].Result["removed"])
+
+	require.Equal(t, "set_swarm_tags", entries[2].Operation)
+	require.Equal(t, ErrInvalidTags.Error(), entries[2].Error)
+
+	require.Equal(t, "gc", entries[3].Operation)
+	require.Equal(t, ErrReadOnly.Error(), entries[3].Error)
+}
@@ -0,0 +1,95 @@
+package optmem
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBackupRunning is returned by Backup if another backup of the store is
+// being written.
+var ErrBackupRunning = errors.New("a backup is already running")
+
+// shardBackup holds a shard in a running backup, see Backup.
+type shardBackup struct {
+	once  sync.Once
+	clone *shard // the shard as of the start of the backup, see cloneShard
+}
+
+// preserve clones the shard, unless this was done before.
+// It is called by the first write lock of the shard after the backup
+// started, before the shard is changed.
+// The shard must be write-locked by the caller.
+func (b *shardBackup) preserve(sh *shard) {
+	b.once.Do(func() {
+		b.clone = sh.clone()
+	})
+}
+
+// Backup writes an export of all swarms to w, like ExportSwarms, that is a
+// consistent snapshot of the whole store.
+// It is compressed as configured by ExportCompression.
+//
+// Unlike ExportSwarms, whose exports are only consistent in read-only mode,
+// writes to the store proceed while the backup is written.
+// All shards are locked at once only to mark them for the backup.
+// The first write to a shard that was not exported yet clones the shard
+// before it is changed, see cloneShard, which takes time in regards to the
+// number of its swarms, not their peers.
+// Only one backup can be written at a time, ErrBackupRunning is returned
+// otherwise.
+//
+// Returns the number of swarms exported.
+func (s *PeerStore) Backup(w io.Writer) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if s.anon != nil {
+		return 0, ErrAnonymized
+	}
+	if !atomic.CompareAndSwapInt32(&s.backupRunning, 0, 1) {
+		return 0, ErrBackupRunning
+	}
+	defer atomic.StoreInt32(&s.backupRunning, 0)
+
+	cw, flush, err := s.cfg.compressWriter(w)
+	if err != nil {
+		return 0, err
+	}
+
+	backups := make([]*shardBackup, len(s.shards.shards))
+	for i := range backups {
+		backups[i] = &shardBackup{}
+		s.shards.lockShard(i).backup = backups[i]
+	}
+	for i := range backups {
+		s.shards.unlockShard(i, 0)
+	}
+
+	exported, err := s.writeSections(cw, len(backups), func(i int, buf []byte) ([]byte, int, uint64) {
+		// Locking the shard clones it, unless a write did so already.
+		s.shards.lockShard(i)
+		s.shards.unlockShard(i, 0)
+
+		b := backups[i]
+		var e swarmExporter
+		buf, n, peers := e.appendShard(buf, b.clone, nil)
+		b.clone = nil
+		return buf, n, peers
+	})
+	// Writes need not preserve the shards left over by a failed backup.
+	for _, b := range backups {
+		b.once.Do(func() {})
+	}
+
+	ferr := flush()
+	if err == nil {
+		err = ferr
+	}
+	return exported, err
+}
@@ -0,0 +1,61 @@
+package optmem
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupIsConsistent(t *testing.T) {
+	src, err := New(testConfig)
+	require.Nil(t, err)
+	dst, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	ih3 := bittorrent.InfoHashFromString("22222222222222222222")
+	require.Nil(t, src.PutSeeder(ih, p1))
+	require.Nil(t, src.PutLeecher(ih, p2))
+	require.Nil(t, src.PutSeeder(ih2, p1))
+
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := src.Backup(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	// Once the header is written, all shards are marked for the backup.
+	header := make([]byte, len(exportMagic)+1+4+crcLen)
+	_, err = io.ReadFull(pr, header)
+	require.Nil(t, err)
+
+	_, err = src.Backup(ioutil.Discard)
+	require.Equal(t, ErrBackupRunning, err)
+
+	// Writes proceed, but are not part of the backup.
+	require.Nil(t, src.PutSeeder(ih, p3))
+	require.Nil(t, src.DeleteLeecher(ih, p2))
+	require.True(t, src.DeleteSwarm(ih2))
+	require.Nil(t, src.PutSeeder(ih3, p1))
+
+	rest, err := ioutil.ReadAll(pr)
+	require.Nil(t, err)
+	require.Nil(t, <-done)
+
+	n, err := dst.ImportSwarms(io.MultiReader(bytes.NewReader(header), bytes.NewReader(rest)))
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, 1, dst.NumSeeders(ih))
+	require.Equal(t, 1, dst.NumLeechers(ih))
+	require.Equal(t, 1, dst.NumSeeders(ih2))
+	require.Equal(t, 0, dst.NumSeeders(ih3))
+
+	require.Nil(t, <-src.Stop())
+	require.Nil(t, <-dst.Stop())
+}
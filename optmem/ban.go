@@ -0,0 +1,182 @@
+package optmem
+
+import (
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// ErrPeerBanned is returned by puts and announces of banned peers, see
+// BanPeer.
+var ErrPeerBanned = bittorrent.ClientError("peer is banned")
+
+// Ban is a banned peer endpoint, see BanPeer.
+type Ban struct {
+	// IP is the banned IP, in its 16 byte form.
+	IP net.IP
+
+	// Port is the banned port, zero if all ports of the IP are banned.
+	Port uint16
+
+	// Expires is the time the ban expires, zero if it does not.
+	Expires time.Time
+}
+
+// banEndpoint returns the key of the ban of an IP and port.
+func banEndpoint(ip16 []byte, port uint16) endpoint {
+	var e endpoint
+	copy(e[:16], ip16)
+	e[16] = byte(port >> 8)
+	e[17] = byte(port)
+	return e
+}
+
+// BanPeer bans the peer with the given IP and port for ttl, or permanently if
+// ttl is zero, for example to keep fake seeds or poisoners out of swarms.
+// A port of zero bans all ports of the IP.
+// Banning a banned peer again replaces the expiry of its ban.
+//
+// Puts and announces of banned peers fail with ErrPeerBanned in all
+// namespaces and are counted in the operations metric.
+// Peers that are already stored are not removed, but as their announces are
+// rejected they expire after PeerLifetime, or can be removed immediately
+// with ErasePeer or EraseIP.
+//
+// Bans are kept in memory only.
+// Checking a put against the bans takes constant time, and expired bans are
+// removed during garbage collection.
+func (s *PeerStore) BanPeer(ip net.IP, port uint16, ttl time.Duration) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ErrInvalidIP
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = s.now().Add(ttl).UnixNano()
+	}
+
+	root := s.root
+	root.banMu.Lock()
+	defer root.banMu.Unlock()
+	bans, _ := root.bans.Load().(map[endpoint]int64)
+	updated := make(map[endpoint]int64, len(bans)+1)
+	for k, v := range bans {
+		updated[k] = v
+	}
+	updated[banEndpoint(ip16, port)] = expires
+	root.bans.Store(updated)
+	return nil
+}
+
+// UnbanPeer lifts the ban of the peer with the given IP and port.
+// A port of zero lifts the ban of all ports of the IP, but not the bans of
+// single ports.
+// Returns false if the peer is not banned.
+func (s *PeerStore) UnbanPeer(ip net.IP, port uint16) bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	e := banEndpoint(ip16, port)
+
+	root := s.root
+	root.banMu.Lock()
+	defer root.banMu.Unlock()
+	bans, _ := root.bans.Load().(map[endpoint]int64)
+	if _, ok := bans[e]; !ok {
+		return false
+	}
+	updated := make(map[endpoint]int64, len(bans))
+	for k, v := range bans {
+		if k != e {
+			updated[k] = v
+		}
+	}
+	root.bans.Store(updated)
+	return true
+}
+
+// Bans returns the bans that have not expired, in no particular order.
+func (s *PeerStore) Bans() []Ban {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	now := s.now().UnixNano()
+	bans, _ := s.root.bans.Load().(map[endpoint]int64)
+	toReturn := make([]Ban, 0, len(bans))
+	for e, expires := range bans {
+		if expires != 0 && expires <= now {
+			continue
+		}
+		b := Ban{
+			IP:   net.IP(append([]byte(nil), e[:16]...)),
+			Port: uint16(e[16])<<8 | uint16(e[17]),
+		}
+		if expires != 0 {
+			b.Expires = time.Unix(0, expires)
+		}
+		toReturn = append(toReturn, b)
+	}
+	return toReturn
+}
+
+// banned returns whether the peer is banned, counting a rejected put if it
+// is.
+func (s *PeerStore) banned(p bittorrent.Peer) bool {
+	bans, _ := s.root.bans.Load().(map[endpoint]int64)
+	if len(bans) == 0 {
+		return false
+	}
+	ip16 := p.IP.To16()
+	now := s.now().UnixNano()
+	expires, ok := bans[banEndpoint(ip16, p.Port)]
+	if !ok || (expires != 0 && expires <= now) {
+		expires, ok = bans[banEndpoint(ip16, 0)]
+	}
+	if !ok || (expires != 0 && expires <= now) {
+		return false
+	}
+	promBanRejects.inc(p.IP.AddressFamily)
+	return true
+}
+
+// expireBans removes expired bans.
+// It must be called on the default namespace.
+func (s *PeerStore) expireBans() {
+	now := s.now().UnixNano()
+	s.banMu.Lock()
+	defer s.banMu.Unlock()
+	bans, _ := s.bans.Load().(map[endpoint]int64)
+	expired := 0
+	for _, expires := range bans {
+		if expires != 0 && expires <= now {
+			expired++
+		}
+	}
+	if expired == 0 {
+		return
+	}
+	updated := make(map[endpoint]int64, len(bans)-expired)
+	for k, v := range bans {
+		if v == 0 || v > now {
+			updated[k] = v
+		}
+	}
+	s.bans.Store(updated)
+}
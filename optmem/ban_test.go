@@ -0,0 +1,65 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanPeer(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.BanPeer(p1.IP.IP, p1.Port, time.Minute))
+	require.Equal(t, ErrPeerBanned, ps.PutSeeder(ih, p1))
+	_, err = ps.AnnounceAndPut(ih, false, 10, p1)
+	require.Equal(t, ErrPeerBanned, err)
+	require.Equal(t, 0, ps.NumSeeders(ih)+ps.NumLeechers(ih))
+
+	// Other ports of the IP are not banned.
+	other := p1
+	other.Port++
+	require.Nil(t, ps.PutLeecher(ih, other))
+
+	bans := ps.Bans()
+	require.Len(t, bans, 1)
+	require.True(t, bans[0].IP.Equal(p1.IP.IP))
+	require.Equal(t, p1.Port, bans[0].Port)
+	require.Equal(t, clock.Now().Add(time.Minute), bans[0].Expires)
+
+	// Bans expire.
+	clock.set(clock.Now().Add(time.Minute))
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Len(t, ps.Bans(), 0)
+	ps.root.expireBans()
+	require.Len(t, ps.root.bans.Load().(map[endpoint]int64), 0)
+}
+
+func TestBanIP(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.BanPeer(p3.IP.IP, 0, 0))
+	require.Equal(t, ErrPeerBanned, ps.PutLeecher(ih, p3))
+	other := p3
+	other.Port++
+	require.Equal(t, ErrPeerBanned, ps.PutLeecher(ih, other))
+	require.Nil(t, ps.PutLeecher(ih, p1))
+
+	// Namespaces share the bans.
+	require.Equal(t, ErrPeerBanned, ps.WithNamespace("other").PutLeecher(ih, p3))
+
+	require.False(t, ps.UnbanPeer(p3.IP.IP, p3.Port))
+	require.True(t, ps.UnbanPeer(p3.IP.IP, 0))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+
+	require.Equal(t, ErrInvalidIP, ps.BanPeer(net.IP{1, 2, 3}, 0, 0))
+}
@@ -0,0 +1,247 @@
+package optmem
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// putOp is a queued put of a peer.
+type putOp struct {
+	ih        infohash
+	peer      peer
+	af        bittorrent.AddressFamily
+	completed bool
+	key       uint64 // hashed identity key, zero if none, see identityKey
+	shard     int
+	op        *Op // the put as passed by the caller, nil unless it is reported once applied, see putApplied
+}
+
+// batchQueue holds the puts queued for the shards of one batch worker.
+// Worker w of n applies the puts of the shards w, w+n, w+2n and so on.
+type batchQueue struct {
+	ops       chan putOp
+	flush     chan chan struct{}
+	heartbeat int64 // unix nanoseconds of the last flush tick, see Health
+}
+
+func newBatchQueue(size uint, now time.Time) *batchQueue {
+	return &batchQueue{
+		ops:       make(chan putOp, size),
+		flush:     make(chan chan struct{}),
+		heartbeat: now.UnixNano(),
+	}
+}
+
+// batchWorkers returns the number of goroutines applying batched puts for
+// the given number of shards, see BatchWorkers.
+func (cfg Config) batchWorkers(shards int) int {
+	n := int(cfg.BatchWorkers)
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > shards {
+		n = shards
+	}
+	return n
+}
+
+// startBatchWorkers creates the batch queues and starts their workers.
+func (s *PeerStore) startBatchWorkers() {
+	n := s.cfg.batchWorkers(len(s.shards.shards))
+	perWorker := (len(s.shards.shards) + n - 1) / n
+	s.batches = make([]*batchQueue, n)
+	for i := range s.batches {
+		s.batches[i] = newBatchQueue(s.cfg.BatchQueueSize*uint(perWorker), s.now())
+		s.wg.Add(1)
+		go s.runBatchQueue(i)
+	}
+}
+
+// queueOf returns the batch queue of the shard with the given index.
+func (s *PeerStore) queueOf(shard int) *batchQueue {
+	return s.batches[shard%len(s.batches)]
+}
+
+// enqueuePut queues a put to be applied by the batch worker of the shard
+// responsible for the infohash.
+// op is the put as passed by the caller, which is kept for graduations and
+// logged changes so that they are reported once applied, see putApplied.
+// If the queue is full, enqueuePut blocks until there is room.
+func (s *PeerStore) enqueuePut(ih infohash, p *peer, af bittorrent.AddressFamily, completed bool, key uint64, op Op) {
+	i := s.shards.shardIndex(ih)
+	queued := putOp{ih: ih, peer: *p, af: af, completed: completed, key: key, shard: i}
+	if completed || s.logsOps() {
+		queued.op = &op
+	}
+	select {
+	case s.queueOf(i).ops <- queued:
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	}
+}
+
+// runBatchQueue applies the queued puts for the shards of the worker with
+// the given index.
+// The puts of a shard are applied once enough of them are queued to fill a
+// batch, at the configured flush interval, or when a flush is requested.
+// Queued puts are applied before it returns when the store is stopped, so
+// that they are included in the snapshot.
+func (s *PeerStore) runBatchQueue(worker int) {
+	defer s.wg.Done()
+	q := s.batches[worker]
+	n := len(s.batches)
+	tick := s.after(s.cfg.BatchFlushInterval)
+
+	// pending[j] holds the puts of shard worker+j*n.
+	pending := make([][]putOp, (len(s.shards.shards)-worker+n-1)/n)
+	for {
+		select {
+		case <-s.closed:
+			s.applyPending(worker, q.drain(pending, n))
+			return
+		case op := <-q.ops:
+			j := op.shard / n
+			pending[j] = append(pending[j], op)
+			if len(pending[j]) >= int(s.cfg.BatchQueueSize) {
+				pending[j] = s.applyBatch(op.shard, pending[j])
+			}
+		case <-tick:
+			tick = s.after(s.cfg.BatchFlushInterval)
+			atomic.StoreInt64(&q.heartbeat, s.now().UnixNano())
+			s.applyPending(worker, pending)
+		case done := <-q.flush:
+			// Take everything that is queued right now, then apply.
+			s.applyPending(worker, q.drain(pending, n))
+			close(done)
+		}
+	}
+}
+
+// applyPending applies the pending puts of all shards of a worker.
+func (s *PeerStore) applyPending(worker int, pending [][]putOp) {
+	for j := range pending {
+		pending[j] = s.applyBatch(worker+j*len(s.batches), pending[j])
+	}
+}
+
+// drain adds all puts that are currently queued to the pending puts of
+// their shards, given the number of workers.
+func (q *batchQueue) drain(pending [][]putOp, workers int) [][]putOp {
+	for {
+		select {
+		case op := <-q.ops:
+			j := op.shard / workers
+			pending[j] = append(pending[j], op)
+		default:
+			return pending
+		}
+	}
+}
+
+// appliedPut is a put applied by a batch worker, which is reported once the
+// shard is unlocked, see putApplied.
+type appliedPut struct {
+	op        Op
+	graduated bool
+}
+
+// applyBatch applies the given puts to a shard under a single lock.
+// Puts rejected by caps or bans are dropped, they are counted as the
+// batch_rejected operation.
+// It returns the emptied slice for reuse.
+func (s *PeerStore) applyBatch(i int, ops []putOp) []putOp {
+	if len(ops) == 0 {
+		return ops
+	}
+
+	shard := s.shards.lockShard(i)
+	created, rejected := 0, 0
+	var evicted []EvictedPeer
+	var applied []appliedPut
+	for j := range ops {
+		if s.admitPeer(shard, ops[j].ih, &ops[j].peer, ops[j].af) != nil {
+			// Queued puts can not fail, the peer is dropped.
+			promBatchRejects.inc(ops[j].af)
+			rejected++
+			continue
+		}
+		swarmCreated, inserted, graduated := putKeyedPeerLocked(shard, ops[j].ih, &ops[j].peer, ops[j].af, ops[j].completed, ops[j].key)
+		if ops[j].op != nil {
+			applied = append(applied, appliedPut{op: *ops[j].op, graduated: graduated})
+		}
+		if swarmCreated {
+			s.hooks.swarmCreated(shard, ops[j].ih)
+			created++
+		}
+		s.putCounts.record(ops[j].af, inserted)
+
+		var removed int
+		removed, evicted = s.sweepLocked(shard, ops[j].ih, evicted)
+		created -= removed
+	}
+	s.shards.unlockShard(i, created)
+	s.finishSweep(evicted)
+	for _, a := range applied {
+		s.putApplied(a.op, a.graduated)
+	}
+	if rejected > 0 {
+		log.Debug("optmem: dropped queued puts", log.Fields{"namespace": s.name, "shard": i, "rejected": rejected})
+	}
+
+	// Do not keep copies of applied peers around, see ErasePeer.
+	for j := range ops {
+		ops[j] = putOp{}
+	}
+	return ops[:0]
+}
+
+// flushShard applies all puts queued for the shard with the given index and
+// waits for them to be applied.
+// The puts of the other shards of its worker are applied, too.
+func (s *PeerStore) flushShard(i int) {
+	s.flushQueue(s.queueOf(i))
+}
+
+// flushQueue applies all puts queued for the shards of a worker and waits
+// for them to be applied.
+func (s *PeerStore) flushQueue(q *batchQueue) {
+	done := make(chan struct{})
+	select {
+	case q.flush <- done:
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	}
+	<-done
+}
+
+// flushAll applies all queued puts and waits for them to be applied.
+func (s *PeerStore) flushAll() {
+	for _, q := range s.batches {
+		s.flushQueue(q)
+	}
+}
+
+// Flush applies all queued puts and waits for them to be applied.
+// If write batching is disabled, this is a no-op.
+func (s *PeerStore) Flush() {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	s.flushAll()
+}
+
+// batchQueueDepth returns the total number of queued puts.
+func (s *PeerStore) batchQueueDepth() int {
+	depth := 0
+	for _, q := range s.batches {
+		depth += len(q.ops)
+	}
+	return depth
+}
@@ -0,0 +1,143 @@
+package optmem
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Chaos configures faults that a PeerStore injects into its own operation,
+// to make races between requests, garbage collection and rebalancing more
+// likely to surface in tests.
+// It must not be used in production.
+type Chaos struct {
+	// Seed seeds the decisions of the chaos mode.
+	// Concurrent requests are still scheduled by the Go runtime, so runs
+	// are not reproducible.
+	Seed int64
+
+	// LockDelay is the maximum delay injected after acquiring a shard lock,
+	// while holding it.
+	// Zero disables lock delays.
+	LockDelay time.Duration
+
+	// LockDelayRatio is the share, between 0 and 1, of shard lock
+	// acquisitions that are delayed.
+	LockDelayRatio float64
+
+	// GCInterval is the mean interval of garbage collection runs forced in
+	// addition to the regular ones.
+	// Zero disables forced garbage collection.
+	GCInterval time.Duration
+
+	// ExpireEarly makes forced garbage collection runs use a random cutoff
+	// within the peer lifetime, removing peers before they expire.
+	// Tests that expect stored peers to stay cannot use it.
+	ExpireEarly bool
+
+	// RebalanceInterval is the mean interval of forced rebalances of the
+	// buckets of random swarms.
+	// Forced rebalances redistribute the peers even if the number of
+	// buckets is right, sometimes into more buckets than needed.
+	// Zero disables forced rebalances.
+	RebalanceInterval time.Duration
+}
+
+// chaosInjector injects the faults configured by a Chaos.
+type chaosInjector struct {
+	cfg Chaos
+	mu  sync.Mutex
+	r   *rand.Rand
+}
+
+// newChaosInjector returns an injector for cfg, or nil if cfg is nil.
+func newChaosInjector(cfg *Chaos) *chaosInjector {
+	if cfg == nil {
+		return nil
+	}
+	return &chaosInjector{cfg: *cfg, r: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// float64 returns a random number in [0,1).
+func (c *chaosInjector) float64() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.r.Float64()
+}
+
+// intn returns a random number in [0,n).
+func (c *chaosInjector) intn(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.r.Intn(n)
+}
+
+// interval returns a random interval with the given mean.
+func (c *chaosInjector) interval(mean time.Duration) time.Duration {
+	return time.Duration(2 * c.float64() * float64(mean))
+}
+
+// lockAcquired delays a caller that just acquired a shard lock, sometimes.
+// It is a no-op on a nil injector.
+func (c *chaosInjector) lockAcquired() {
+	if c == nil || c.cfg.LockDelay <= 0 || c.float64() >= c.cfg.LockDelayRatio {
+		return
+	}
+	time.Sleep(time.Duration(c.float64() * float64(c.cfg.LockDelay)))
+}
+
+// runChaos forces garbage collection runs and rebalances until the store is
+// closed.
+func (s *PeerStore) runChaos() {
+	c := s.shards.chaos
+	var gc, rebalance <-chan time.Time
+	if c.cfg.GCInterval > 0 {
+		gc = s.after(c.interval(c.cfg.GCInterval))
+	}
+	if c.cfg.RebalanceInterval > 0 {
+		rebalance = s.after(c.interval(c.cfg.RebalanceInterval))
+	}
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-gc:
+			gc = s.after(c.interval(c.cfg.GCInterval))
+			if s.isReadOnly() {
+				continue
+			}
+			lifetime := s.cfg.PeerLifetime
+			if c.cfg.ExpireEarly {
+				lifetime = time.Duration(c.float64() * float64(lifetime))
+			}
+			stats := s.collectGarbage(s.now().Add(-lifetime))
+			log.Debug("optmem: forced garbage collection", log.Fields{"namespace": s.name, "lifetime": lifetime, "peersRemoved": stats.PeersRemoved})
+		case <-rebalance:
+			rebalance = s.after(c.interval(c.cfg.RebalanceInterval))
+			s.forceRebalance(c.intn(len(s.shards.shards)))
+		}
+	}
+}
+
+// forceRebalance redistributes the peers of a random swarm of a shard into
+// either the number of buckets they need or twice as many.
+func (s *PeerStore) forceRebalance(i int) {
+	c := s.shards.chaos
+	shard := s.shards.lockShard(i)
+	defer s.shards.unlockShard(i, 0)
+
+	// Map iteration order is random.
+	for _, sw := range shard.swarms {
+		for _, pl := range [2]*peerList{sw.peers4, sw.peers6} {
+			if pl == nil {
+				continue
+			}
+			target, _ := computeTargetBuckets(pl.numPeers)
+			pl.redistribute(target << uint(c.intn(2)))
+		}
+		return
+	}
+}
@@ -0,0 +1,156 @@
+package optmem
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// ErrCircuitOpen is returned by expensive operations while the circuit
+// breaker rejects them, see ExpensiveOpSLO.
+var ErrCircuitOpen = errors.New("expensive operations are temporarily rejected")
+
+// Expensive operations, as counted in the breaker metrics.
+const (
+	opFullScrape  = "full_scrape"
+	opGetSeeders  = "get_seeders"
+	opGetLeechers = "get_leechers"
+)
+
+// breakerTripAfter is the number of consecutive expensive operations that
+// have to violate the SLO for the breaker to open.
+const breakerTripAfter = 3
+
+// circuitBreaker rejects expensive operations for a while after they
+// repeatedly took longer than their SLO.
+//
+// It starts closed, letting all operations through.
+// After breakerTripAfter consecutive violations it opens, rejecting all
+// operations for the cooldown.
+// It then lets a single probe through: if the probe meets the SLO the
+// breaker closes, otherwise it opens again.
+//
+// Latencies and the cooldown are measured with the system clock.
+// A nil circuitBreaker lets all operations through.
+type circuitBreaker struct {
+	slo      time.Duration
+	cooldown time.Duration
+
+	mu         sync.Mutex
+	violations int       // consecutive violations while closed
+	openUntil  time.Time // zero while closed
+	probing    bool      // whether a probe is running
+}
+
+func newCircuitBreaker(cfg Config) *circuitBreaker {
+	if cfg.ExpensiveOpSLO <= 0 {
+		return nil
+	}
+	return &circuitBreaker{slo: cfg.ExpensiveOpSLO, cooldown: cfg.BreakerCooldown}
+}
+
+// admit returns whether an expensive operation may run, counting it as shed
+// if not.
+// Every admitted operation must be finished with done.
+func (b *circuitBreaker) admit(op string) (start time.Time, ok bool) {
+	if b == nil {
+		return time.Time{}, true
+	}
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return now, true
+	case now.Before(b.openUntil) || b.probing:
+		promBreakerShed.WithLabelValues(op).Inc()
+		metricsReporters.count("breaker.shed."+op, 1)
+		return time.Time{}, false
+	}
+	b.probing = true
+	return now, true
+}
+
+// done records the latency of an operation admitted at start.
+func (b *circuitBreaker) done(start time.Time) {
+	if b == nil {
+		return
+	}
+	took := time.Since(start)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.probing {
+		b.probing = false
+		if took > b.slo {
+			b.openUntil = time.Now().Add(b.cooldown)
+			return
+		}
+		b.openUntil = time.Time{}
+		b.violations = 0
+		promBreakerOpen.Dec()
+		log.Info("optmem: circuit breaker closed", log.Fields{"latency": took})
+		return
+	}
+	if !b.openUntil.IsZero() {
+		// Admitted before the breaker opened.
+		return
+	}
+	if took <= b.slo {
+		b.violations = 0
+		return
+	}
+	b.violations++
+	if b.violations >= breakerTripAfter {
+		b.openUntil = time.Now().Add(b.cooldown)
+		promBreakerOpen.Inc()
+		log.Warn("optmem: circuit breaker opened", log.Fields{"latency": took, "slo": b.slo, "cooldown": b.cooldown})
+	}
+}
+
+// open returns whether the breaker currently rejects operations.
+func (b *circuitBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// close resets the breaker to let all operations through, for example when
+// the store is stopped.
+func (b *circuitBreaker) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.openUntil.IsZero() {
+		promBreakerOpen.Dec()
+	}
+	b.openUntil = time.Time{}
+	b.violations = 0
+	b.probing = false
+}
+
+// numPeers returns the number of peers of both address families.
+func (sw swarm) numPeers() int {
+	n := 0
+	if sw.peers4 != nil {
+		n += sw.peers4.numPeers
+	}
+	if sw.peers6 != nil {
+		n += sw.peers6.numPeers
+	}
+	return n
+}
+
+// expensiveSwarm returns whether listing all peers of a swarm with the given
+// number of peers is an expensive operation.
+func (s *PeerStore) expensiveSwarm(numPeers int) bool {
+	return s.breaker != nil && numPeers > int(s.cfg.ExpensiveSwarmSize)
+}
@@ -0,0 +1,82 @@
+package optmem
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{slo: time.Hour, cooldown: 50 * time.Millisecond}
+
+	// Operations meeting the SLO keep the breaker closed.
+	for i := 0; i < 2*breakerTripAfter; i++ {
+		start, ok := b.admit(opFullScrape)
+		require.True(t, ok)
+		b.done(start)
+	}
+	require.False(t, b.open())
+
+	// Consecutive violations open it.
+	b.slo = time.Nanosecond
+	for i := 0; i < breakerTripAfter; i++ {
+		start, ok := b.admit(opFullScrape)
+		require.True(t, ok)
+		b.done(start.Add(-time.Millisecond))
+	}
+	require.True(t, b.open())
+	_, ok := b.admit(opFullScrape)
+	require.False(t, ok)
+
+	// After the cooldown, a single probe is let through.
+	time.Sleep(b.cooldown)
+	start, ok := b.admit(opFullScrape)
+	require.True(t, ok)
+	_, ok = b.admit(opFullScrape)
+	require.False(t, ok)
+
+	// A failing probe opens the breaker again.
+	b.done(start.Add(-time.Millisecond))
+	_, ok = b.admit(opFullScrape)
+	require.False(t, ok)
+
+	// A successful probe closes it.
+	time.Sleep(b.cooldown)
+	b.slo = time.Hour
+	start, ok = b.admit(opFullScrape)
+	require.True(t, ok)
+	b.done(start)
+	require.False(t, b.open())
+	_, ok = b.admit(opFullScrape)
+	require.True(t, ok)
+}
+
+func TestCircuitBreakerStore(t *testing.T) {
+	cfg := testConfig
+	cfg.ExpensiveOpSLO = time.Nanosecond
+	cfg.BreakerCooldown = time.Hour
+	cfg.ExpensiveSwarmSize = 1
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	ps.breaker.violations = breakerTripAfter - 1
+	require.Nil(t, ps.FullScrape(&bytes.Buffer{}, FormatBencode))
+	require.True(t, ps.breaker.open())
+
+	require.Equal(t, ErrCircuitOpen, ps.FullScrape(&bytes.Buffer{}, FormatBencode))
+	_, _, err = ps.GetSeeders(ih)
+	require.Equal(t, ErrCircuitOpen, err)
+
+	// Small swarms are not expensive.
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutSeeder(ih2, p1))
+	seeders4, _, err := ps.GetSeeders(ih2)
+	require.Nil(t, err)
+	require.Len(t, seeders4, 1)
+}
@@ -0,0 +1,64 @@
+package optmem
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/timecache"
+)
+
+// Clock provides the current time and timers to a PeerStore.
+// Implementations must be safe for concurrent use.
+//
+// The clock determines the announce times of peers, the ages of swarms and
+// when the background goroutines wake up, i.e. garbage collection, batch
+// flushes, the garbage collection watchdog and restarts after panics.
+// Durations of work, like the time spent waiting for locks, are always
+// measured with the system clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once d has
+	// passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock used if none is configured.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock returns the configured clock, or the system clock.
+func (cfg Config) clock() Clock {
+	if cfg.Clock != nil {
+		return cfg.Clock
+	}
+	return systemClock{}
+}
+
+// now returns the current time of the configured clock.
+func (s *PeerStore) now() time.Time {
+	if s.cfg.Clock != nil {
+		return s.cfg.Clock.Now()
+	}
+	return time.Now()
+}
+
+// nowUnix returns the current unix time of the configured clock, in seconds.
+// Without a clock, the cached time of timecache is used.
+func (s *PeerStore) nowUnix() int64 {
+	if s.cfg.Clock != nil {
+		return s.cfg.Clock.Now().Unix()
+	}
+	return timecache.NowUnix()
+}
+
+// after returns a channel that receives the time of the configured clock
+// once d has passed.
+func (s *PeerStore) after(d time.Duration) <-chan time.Time {
+	if s.cfg.Clock != nil {
+		return s.cfg.Clock.After(d)
+	}
+	return time.After(d)
+}
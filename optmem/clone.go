@@ -0,0 +1,82 @@
+package optmem
+
+// cloneShard returns an immutable snapshot of the swarms of a shard, for
+// example to export it without holding its lock.
+// The snapshot is a shard holding only the swarms, their tags and web seeds,
+// the counts and the seed of the shard, it must not be changed.
+//
+// The peer lists of the snapshot share their buckets with the shard until
+// the shard changes them, see peerList.own, so cloning runs in linear time
+// in regards to the number of swarms of the shard, not their peers.
+// The shard is write-locked while it is cloned.
+func (s *shardContainer) cloneShard(i int) *shard {
+	shard := s.lockShard(i)
+	defer s.unlockShard(i, 0)
+	return shard.clone()
+}
+
+// clone implements cloneShard.
+// The shard must be write-locked by the caller.
+func (s *shard) clone() *shard {
+	c := &shard{
+		swarms:    make(map[infohash]swarm, len(s.swarms)),
+		counts:    s.counts,
+		published: s.counts,
+		numSwarms: uint64(len(s.swarms)),
+		seed:      s.seed,
+		version:   s.version,
+	}
+	for ih, sw := range s.swarms {
+		sw.peers4 = sw.peers4.clone()
+		sw.peers6 = sw.peers6.clone()
+		c.swarms[ih] = sw
+	}
+	if len(s.tags) > 0 {
+		// Tags are replaced, never changed, see setTags.
+		c.tags = make(map[infohash][]string, len(s.tags))
+		for ih, tags := range s.tags {
+			c.tags[ih] = tags
+		}
+	}
+	if len(s.webSeeds) > 0 {
+		c.webSeeds = make(map[infohash][]string, len(s.webSeeds))
+		for ih, urls := range s.webSeeds {
+			c.webSeeds[ih] = urls
+		}
+	}
+	return c
+}
+
+// clone returns a copy of the counts and buckets of a peerList, which shares
+// the buckets until the peerList changes them.
+// Statistics, scores, keys and the hot set are not copied.
+// Returns nil for a nil peerList.
+func (pl *peerList) clone() *peerList {
+	if pl == nil {
+		return nil
+	}
+	pl.shared = true
+	return &peerList{
+		numSeeders:   pl.numSeeders,
+		numPeers:     pl.numPeers,
+		numDead:      pl.numDead,
+		numWebRTC:    pl.numWebRTC,
+		numDownloads: pl.numDownloads,
+		peerBuckets:  pl.peerBuckets,
+		seed:         pl.seed,
+	}
+}
+
+// own copies the buckets of the peerList if they are shared with a clone.
+// It must be called before the buckets are changed.
+func (pl *peerList) own() {
+	if !pl.shared {
+		return
+	}
+	buckets := make([]bucket, len(pl.peerBuckets))
+	for i, b := range pl.peerBuckets {
+		buckets[i] = append(getBucket(), b...)
+	}
+	pl.peerBuckets = buckets
+	pl.shared = false
+}
@@ -0,0 +1,49 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneShard(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.SetSwarmTags(ih, []string{"a"}))
+
+	idx := ps.shards.shardIndex(infohash(ih))
+	clone := ps.shards.cloneShard(idx)
+	sw := clone.swarms[infohash(ih)]
+	require.Equal(t, 1000, sw.peers4.numPeers)
+	require.Equal(t, []string{"a"}, clone.tags[infohash(ih)])
+
+	// The clone shares the buckets until the shard changes them.
+	shard := ps.shards.rLockShard(idx)
+	live := shard.swarms[infohash(ih)].peers4
+	require.True(t, live.shared)
+	require.True(t, &live.peerBuckets[0][0] == &sw.peers4.peerBuckets[0][0])
+	ps.shards.rUnlockShard(idx)
+
+	for i := 0; i < 500; i++ {
+		require.Nil(t, ps.DeleteSeeder(ih, benchPeer(i)))
+	}
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	require.Nil(t, ps.SetSwarmTags(ih, []string{"b"}))
+	require.Equal(t, 501, ps.NumSeeders(ih))
+
+	var report ConsistencyReport
+	checkShard(clone, idx, &report)
+	require.True(t, report.OK(), "%v", report.Problems)
+	require.Equal(t, 1, report.Swarms)
+	require.Equal(t, 1000, sw.peers4.numSeeders)
+	require.Equal(t, 1, sw.peers6.numPeers)
+	require.Equal(t, []string{"a"}, clone.tags[infohash(ih)])
+	require.True(t, ps.CheckConsistency().OK())
+
+	require.Nil(t, <-ps.Stop())
+}
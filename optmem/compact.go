@@ -0,0 +1,56 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Compact peer representations, as used in the peers and peers6 keys of
+// announce responses.
+const (
+	compactPeer4Len = 4 + portLen     // BEP 23
+	compactPeer6Len = ipLen + portLen // BEP 7
+)
+
+// AnnouncePeersCompact works like AnnouncePeers, but returns the peers in
+// their compact representation, ready to be used in an announce response.
+// IPv4 peers are returned in peers4 as defined in BEP 23, IPv6 peers are
+// returned in peers6 as defined in BEP 7.
+//
+// As with AnnouncePeers, only peers of the address family of the announcing
+// peer are returned, the other slice is always nil.
+// The compact representation is copied directly from the stored peers, which
+// avoids the conversion to bittorrent.Peer.
+func (s *PeerStore) AnnouncePeersCompact(infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer) (peers4, peers6 []byte, err error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	buf, err := s.announceRecords(infoHash, seeder, numWant, announcingPeer, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if announcingPeer.IP.AddressFamily == bittorrent.IPv4 {
+		peers4 = appendCompactPeers(make([]byte, 0, len(*buf)*compactPeer4Len), *buf, bittorrent.IPv4)
+	} else {
+		peers6 = appendCompactPeers(make([]byte, 0, len(*buf)*compactPeer6Len), *buf, bittorrent.IPv6)
+	}
+	putPeerBuffer(buf)
+
+	return peers4, peers6, nil
+}
+
+// appendCompactPeers appends the compact representation of peers of an
+// address family to dst.
+func appendCompactPeers(dst []byte, ps []peer, af bittorrent.AddressFamily) []byte {
+	for i := range ps {
+		if af == bittorrent.IPv4 {
+			dst = append(dst, ps[i][12:ipLen+portLen]...)
+		} else {
+			dst = append(dst, ps[i][:ipLen+portLen]...)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,40 @@
+package optmem
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncePeersCompact(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	_, _, err = ps.AnnouncePeersCompact(ih, false, 10, p1)
+	require.Equal(t, s.ErrResourceDoesNotExist, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+
+	peers4, peers6, err := ps.AnnouncePeersCompact(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Nil(t, peers6)
+	require.Len(t, peers4, compactPeer4Len)
+	require.True(t, p1.IP.Equal(net.IP(peers4[:4])))
+	require.Equal(t, p1.Port, binary.BigEndian.Uint16(peers4[4:]))
+
+	v6 := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("2001:db8::2"), AddressFamily: bittorrent.IPv6}, Port: 1}
+	peers4, peers6, err = ps.AnnouncePeersCompact(ih, false, 10, v6)
+	require.Nil(t, err)
+	require.Nil(t, peers4)
+	require.Len(t, peers6, compactPeer6Len)
+	require.True(t, p3.IP.Equal(net.IP(peers6[:16])))
+	require.Equal(t, p3.Port, binary.BigEndian.Uint16(peers6[16:]))
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
@@ -0,0 +1,91 @@
+package optmem
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of exports and snapshots, see
+// Config.ExportCompression.
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Magic bytes at the start of compressed streams.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// validCompressionLevel returns whether level is a valid level for the
+// compression algorithm, zero selects the default level of all algorithms.
+func validCompressionLevel(compression string, level int) bool {
+	switch {
+	case level == 0:
+		return true
+	case compression == compressionGzip:
+		return level >= gzip.HuffmanOnly && level <= gzip.BestCompression
+	case compression == compressionZstd:
+		return level >= 1 && level <= 22
+	}
+	return false
+}
+
+// compressWriter wraps w to compress everything written to it as configured
+// by ExportCompression.
+// The returned function must be called after the last write, to flush the
+// compressed stream.
+func (cfg Config) compressWriter(w io.Writer) (io.Writer, func() error, error) {
+	switch cfg.ExportCompression {
+	case compressionGzip:
+		level := cfg.ExportCompressionLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zw, zw.Close, nil
+	case compressionZstd:
+		level := zstd.SpeedDefault
+		if cfg.ExportCompressionLevel != 0 {
+			level = zstd.EncoderLevelFromZstd(cfg.ExportCompressionLevel)
+		}
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zw, zw.Close, nil
+	}
+	return w, func() error { return nil }, nil
+}
+
+// decompressReader detects compressed exports by their magic bytes and
+// returns a reader of the decompressed stream.
+// Uncompressed exports are returned as is.
+// The returned function releases the decompressor.
+func decompressReader(br *bufio.Reader) (*bufio.Reader, func(), error) {
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, ErrInvalidExport
+		}
+		return bufio.NewReader(zr), func() { zr.Close() }, nil
+	case bytes.Equal(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, ErrInvalidExport
+		}
+		return bufio.NewReader(zr), zr.Close, nil
+	}
+	return br, func() {}, nil
+}
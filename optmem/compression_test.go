@@ -0,0 +1,115 @@
+package optmem
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportCompression(t *testing.T) {
+	var plainLen int
+	for _, compression := range []string{compressionNone, compressionGzip, compressionZstd} {
+		t.Run(fmt.Sprintf("compression=%q", compression), func(t *testing.T) {
+			cfg := testConfig
+			cfg.ExportCompression = compression
+			src, err := New(cfg)
+			require.Nil(t, err)
+			defer func() { require.Nil(t, <-src.Stop()) }()
+			dst, err := New(testConfig)
+			require.Nil(t, err)
+			defer func() { require.Nil(t, <-dst.Stop()) }()
+
+			for i := 0; i < 1000; i++ {
+				require.Nil(t, src.PutSeeder(ih, benchPeer(i)))
+			}
+
+			var buf bytes.Buffer
+			n, err := src.ExportSwarms(&buf, nil)
+			require.Nil(t, err)
+			require.Equal(t, 1, n)
+			switch compression {
+			case compressionNone:
+				plainLen = buf.Len()
+				require.True(t, bytes.HasPrefix(buf.Bytes(), []byte(exportMagic)))
+			case compressionGzip:
+				require.True(t, bytes.HasPrefix(buf.Bytes(), gzipMagic))
+				require.True(t, buf.Len() < plainLen)
+			case compressionZstd:
+				require.True(t, bytes.HasPrefix(buf.Bytes(), zstdMagic))
+				require.True(t, buf.Len() < plainLen)
+			}
+
+			n, err = dst.ImportSwarms(&buf)
+			require.Nil(t, err)
+			require.Equal(t, 1, n)
+			require.Equal(t, 1000, dst.NumSeeders(ih))
+		})
+	}
+}
+
+func TestExportCompressionCorrupt(t *testing.T) {
+	cfg := testConfig
+	cfg.ExportCompression = compressionZstd
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	var buf bytes.Buffer
+	_, err = ps.ExportSwarms(&buf, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.RemoveSwarms(func(bittorrent.InfoHash) bool { return true }))
+
+	n, err := ps.ImportSwarms(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	require.Equal(t, ErrInvalidExport, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+}
+
+func TestSnapshotCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	cfg.ExportCompression = compressionGzip
+	cfg.ExportCompressionLevel = 9
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, <-ps.Stop())
+
+	// Compressed snapshots are loaded with compression disabled.
+	cfg.ExportCompression = compressionNone
+	cfg.ExportCompressionLevel = 0
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestValidateExportCompression(t *testing.T) {
+	cfg := testConfig
+	cfg.ExportCompression = "lz4"
+	cfg.ExportCompressionLevel = 5
+	cfg = cfg.Validate()
+	require.Equal(t, compressionNone, cfg.ExportCompression)
+	require.Equal(t, 0, cfg.ExportCompressionLevel)
+
+	cfg.ExportCompression = compressionGzip
+	cfg.ExportCompressionLevel = 10
+	require.Equal(t, 0, cfg.Validate().ExportCompressionLevel)
+	cfg.ExportCompressionLevel = -2
+	require.Equal(t, -2, cfg.Validate().ExportCompressionLevel)
+
+	cfg.ExportCompression = compressionZstd
+	cfg.ExportCompressionLevel = 22
+	require.Equal(t, 22, cfg.Validate().ExportCompressionLevel)
+}
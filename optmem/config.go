@@ -1,6 +1,9 @@
 package optmem
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"math"
 	"time"
 
 	"github.com/chihaya/chihaya/pkg/log"
@@ -13,12 +16,25 @@ const Name = "optmem"
 
 // Default config constants.
 const (
-	defaultShardCountBits              = 10
-	defaultPrometheusReportingInterval = time.Second * 1
-	defaultGarbageCollectionInterval   = time.Minute * 3
-	defaultPeerLifetime                = time.Minute * 30
+	defaultShardCountBits            = 10
+	defaultGarbageCollectionInterval = time.Minute * 3
+	defaultPeerLifetime              = time.Minute * 30
+	defaultBatchFlushInterval        = time.Millisecond * 100
+	defaultHotSetRefreshInterval     = time.Second * 10
+	defaultMetricsInterval           = time.Second * 10
+	defaultDownloadCountersInterval  = time.Minute
+	defaultAnnounceInterval          = time.Minute * 30
+	defaultLargeSwarmSize            = 1000
+	defaultLoadReferenceRate         = 50000
+	defaultSeederCompactionSample    = 64
+	defaultBreakerCooldown           = time.Second * 30
+	defaultExpensiveSwarmSize        = 10000
 )
 
+// maxSwarmLifetime is the limit of MinSwarmLifetime, given by the 16-bit
+// creation timestamps of swarms.
+const maxSwarmLifetime = time.Second * math.MaxUint16
+
 func init() {
 	// Register the storage driver.
 	storage.RegisterDriver(Name, driver{})
@@ -69,18 +85,629 @@ type Config struct {
 	// announcing before being marked for garbage collection.
 	PeerLifetime time.Duration `yaml:"peer_lifetime"`
 
-	// PrometheusReportingInterval is the interval at which metrics will be
-	// aggregated and reported to prometheus.
+	// LazyExpiration replaces the periodic garbage collection sweeps.
+	// Announces, scrapes and peer counts skip peers that outlived
+	// PeerLifetime instead, and puts and reads remove the expired peers of
+	// their swarm and of LazyExpirationBudget other swarms of its shard,
+	// each swarm at most once per GarbageCollectionInterval. Reads only do
+	// so if the shard is not locked.
+	// Swarms that are left alone are swept every four and a half hours, so
+	// that peer times do not wrap around.
+	// This keeps latency-sensitive deployments free of GC pauses, at the
+	// cost of NumTotalPeers and NumPeers walking all swarms.
+	// It can not be combined with SpillAfter, SeederCompactionAfter or
+	// LockFreeScrapes, and PeerLifetime plus GarbageCollectionInterval must
+	// be shorter than nine hours.
+	LazyExpiration bool `yaml:"lazy_expiration"`
+
+	// LazyExpirationBudget is the number of other swarms of its shard a put
+	// or read sweeps if LazyExpiration is set.
+	// Zero selects 2.
+	LazyExpirationBudget uint `yaml:"lazy_expiration_budget"`
+
+	// TimingWheel replaces the periodic garbage collection sweeps over all
+	// swarms with a timing wheel, which indexes peers by the garbage
+	// collection run at which they expire, so that every run only visits
+	// peers that were put one PeerLifetime earlier, not whole swarms.
+	// Peers may be kept for up to two GarbageCollectionIntervals longer
+	// than PeerLifetime.
+	// Every peer put within the last PeerLifetime is indexed once per
+	// GarbageCollectionInterval it was put in.
+	// It can not be combined with LazyExpiration, nor with SpillAfter or
+	// SeederCompactionAfter, which are disabled.
+	TimingWheel bool `yaml:"timing_wheel"`
+
+	// PrometheusReportingInterval is ignored.
+	//
+	// Deprecated: metrics are computed whenever they are scraped.
 	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
+
+	// DisablePrometheus disables reporting the number of swarms, seeders
+	// and leechers to Prometheus.
+	DisablePrometheus bool `yaml:"disable_prometheus"`
+
+	// StatsD configures reporting metrics to StatsD, alongside or, with
+	// DisablePrometheus, instead of Prometheus.
+	StatsD StatsDConfig `yaml:"statsd"`
+
+	// MetricsReporter receives the metrics of the store, like StatsD does.
+	// It is meant for custom backends, nil disables it.
+	MetricsReporter MetricsReporter `yaml:"-"`
+
+	// MetricsInterval is the interval at which the numbers of swarms,
+	// seeders and leechers are reported to StatsD and the MetricsReporter,
+	// and StatsD is sent the counters aggregated since the last interval.
+	MetricsInterval time.Duration `yaml:"metrics_interval"`
+
+	// BatchQueueSize is the number of puts that can be queued per shard.
+	// If this is non-zero, puts are not applied immediately but queued and
+	// applied in batches by BatchWorkers goroutines, each applying the puts
+	// of an equal share of the shards.
+	// This increases put throughput at the cost of puts becoming visible
+	// with a delay of up to BatchFlushInterval.
+	// Queued puts that are rejected once applied, for example by caps, are
+	// dropped without an error and are not logged, see
+	// PersistenceConfig.LogOps.
+	// Zero disables write batching.
+	BatchQueueSize uint `yaml:"batch_queue_size"`
+
+	// BatchFlushInterval is the maximum time a queued put waits before
+	// it is applied.
+	// Only used if BatchQueueSize is non-zero.
+	BatchFlushInterval time.Duration `yaml:"batch_flush_interval"`
+
+	// BatchWorkers is the number of goroutines applying batched puts, at
+	// most one per shard.
+	// Every worker has a single queue of BatchQueueSize puts per shard it
+	// applies, so puts block once the shards of a worker queued that many
+	// puts between them.
+	// Zero selects GOMAXPROCS.
+	BatchWorkers uint `yaml:"batch_workers"`
+
+	// AnnounceInterval is the announce interval suggested by
+	// SuggestInterval for small swarms under normal load.
+	AnnounceInterval time.Duration `yaml:"announce_interval"`
+
+	// MaxAnnounceInterval is the maximum announce interval suggested by
+	// SuggestInterval.
+	// Defaults to four times the AnnounceInterval.
+	MaxAnnounceInterval time.Duration `yaml:"max_announce_interval"`
+
+	// LargeSwarmSize is the number of peers above which SuggestInterval
+	// suggests longer announce intervals.
+	LargeSwarmSize uint `yaml:"large_swarm_size"`
+
+	// LoadReferenceRate is the number of requests per second at which the
+	// store is considered to be under a load of 1.
+	LoadReferenceRate uint `yaml:"load_reference_rate"`
+
+	// LoadMemoryLimit is the amount of heap memory, in bytes, at which the
+	// store is considered to be under a load of 1, see LoadReport.
+	// Zero leaves memory out of the load.
+	LoadMemoryLimit uint64 `yaml:"load_memory_limit"`
+
+	// ShedLoadAbove makes announces fail with ErrOverloaded while the load
+	// of the store, see Load, is above it.
+	// The load is checked once per second.
+	// Zero disables load shedding.
+	ShedLoadAbove float64 `yaml:"shed_load_above"`
+
+	// ExpensiveOpSLO is the latency objective of expensive operations: full
+	// scrapes, and GetSeeders and GetLeechers on swarms with more than
+	// ExpensiveSwarmSize peers.
+	// If three expensive operations in a row take longer, they are rejected
+	// with ErrCircuitOpen for the BreakerCooldown.
+	// Zero disables the circuit breaker.
+	ExpensiveOpSLO time.Duration `yaml:"expensive_op_slo"`
+
+	// BreakerCooldown is the time for which the circuit breaker rejects
+	// expensive operations once it opened, see ExpensiveOpSLO.
+	// Defaults to 30 seconds.
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+
+	// ExpensiveSwarmSize is the number of peers above which listing all
+	// seeders or leechers of a swarm counts as an expensive operation, see
+	// ExpensiveOpSLO.
+	// Defaults to 10000.
+	ExpensiveSwarmSize uint `yaml:"expensive_swarm_size"`
+
+	// AdminAddr is the address the admin HTTP server listens on.
+	// An empty address disables the admin server.
+	AdminAddr string `yaml:"admin_addr"`
+
+	// AdminGRPCAddr is the address the admin gRPC server listens on.
+	// An empty address disables the admin gRPC server.
+	AdminGRPCAddr string `yaml:"admin_grpc_addr"`
+
+	// AdminToken is a bearer token granting the mutate scope on the admin
+	// HTTP and gRPC servers.
+	// If neither AdminToken, AdminTokens nor client certificates are
+	// configured, the admin servers are not started unless AdminInsecure is
+	// set.
+	AdminToken string `yaml:"admin_token"`
+
+	// AdminTokens are additional named bearer tokens for the admin servers,
+	// each with its own scope.
+	AdminTokens []AdminTokenConfig `yaml:"admin_tokens"`
+
+	// AdminInsecure allows the admin servers to run without credentials,
+	// granting every caller the mutate scope.
+	// It has no effect if credentials are configured.
+	AdminInsecure bool `yaml:"admin_insecure"`
+
+	// AdminTLS configures TLS and client certificates for the admin
+	// servers.
+	AdminTLS AdminTLSConfig `yaml:"admin_tls"`
+
+	// AdminAuditLogPath is the path of a file mutations made through the
+	// admin servers are appended to, one JSON-encoded AuditEntry per line.
+	// An empty path disables the audit log.
+	AdminAuditLogPath string `yaml:"admin_audit_log_path"`
+
+	// AllowedUnroutableNetworks are networks, in CIDR notation, from which
+	// peers are stored even though their IPs are not globally routable.
+	// By default, peers with loopback, link-local, private, unique local or
+	// multicast IPs are rejected.
+	// This is mostly useful for test environments.
+	AllowedUnroutableNetworks []string `yaml:"allowed_unroutable_networks"`
+
+	// TraceSampleRatio is the ratio, between 0 and 1, of puts, announces and
+	// garbage collections that are traced using OpenTelemetry.
+	// Spans are recorded using the global TracerProvider.
+	// Zero disables tracing.
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio"`
+
+	// LockFreeScrapes makes ScrapeSwarm read from counters that are
+	// maintained separately for every swarm, instead of locking the shard.
+	// This keeps scrapes fast when their shards are busy with announces,
+	// at the cost of additional memory per swarm and slightly slower puts
+	// and deletes.
+	LockFreeScrapes bool `yaml:"lock_free_scrapes"`
+
+	// ScrapeCacheTTL is the duration the results of ScrapeSwarm are cached
+	// for, so that floods of scrapes for the same swarms neither lock their
+	// shards nor read their counters over and over.
+	// Scrapes may be stale by up to the TTL.
+	// Zero disables the cache.
+	ScrapeCacheTTL time.Duration `yaml:"scrape_cache_ttl"`
+
+	// ScrapeCacheSize is the number of scrapes cached, rounded up to a power
+	// of two.
+	// Every infohash and address family maps to one entry, so scrapes of
+	// different swarms may evict each other.
+	// Zero selects 65536.
+	ScrapeCacheSize uint `yaml:"scrape_cache_size"`
+
+	// NegativeCacheSize is the number of counters, rounded up to a power of
+	// two, of a filter of the infohashes of the swarms of every shard.
+	// Announces and scrapes for infohashes the filter rules out are answered
+	// without locking the shard, which keeps floods of requests for garbage
+	// infohashes from contending with legitimate ones.
+	// Every counter takes four bytes, about ten counters per swarm of a
+	// shard keep the share of infohashes that pass the filter although they
+	// are not stored below two percent.
+	// The filter is not used while a ColdStorage is set.
+	// Zero disables the filter.
+	NegativeCacheSize uint `yaml:"negative_cache_size"`
+
+	// ShardSeed seeds the hashes used to assign infohashes to shards and
+	// peers to buckets.
+	// It should be kept secret, otherwise infohashes or peers that all end
+	// up in the same shard or bucket can be computed.
+	// Zero chooses a random seed at startup.
+	ShardSeed uint64 `yaml:"shard_seed"`
+
+	// AnnounceSeederShare is the share, between 0 and 1, of seeders in the
+	// peers returned to leecher announces, as long as enough seeders and
+	// leechers are available.
+	// Zero returns as many seeders as possible, and only fills up with
+	// leechers.
+	AnnounceSeederShare float64 `yaml:"announce_seeder_share"`
+
+	// DualStackIPv4Share is the share, between 0 and 1, of IPv4 peers in the
+	// peers returned by AnnouncePeersDualStack, as long as enough peers of
+	// both address families are available.
+	// Zero splits proportionally to the number of peers of each address
+	// family in the swarm, so that the dominant family is not starved.
+	DualStackIPv4Share float64 `yaml:"dual_stack_ipv4_share"`
+
+	// ScrapeEpsilon adds Laplace noise with a scale of 1/ScrapeEpsilon to
+	// the counts returned by scrapes, making them differentially private
+	// with respect to a single peer.
+	// Smaller values add more noise.
+	// Zero disables the noise.
+	ScrapeEpsilon float64 `yaml:"scrape_epsilon"`
+
+	// ScrapeRoundBelow rounds scrape counts smaller than it, after adding
+	// noise, to either zero or ScrapeRoundBelow, whichever is closer.
+	// Zero disables the rounding.
+	ScrapeRoundBelow uint32 `yaml:"scrape_round_below"`
+
+	// ErasureSigningKey is the hex-encoded 32 byte ed25519 seed of the key
+	// signing ErasureReports.
+	// If empty, a random key is generated on every start, see
+	// ErasurePublicKey.
+	ErasureSigningKey string `yaml:"erasure_signing_key"`
+
+	// V2InfoHashes selects how 32 byte BitTorrent v2 infohashes passed to
+	// InfoHashFromBytes and the admin servers are handled: "truncate" keys
+	// their swarms by the first 20 bytes, like v2 clients do in tracker
+	// requests, "keyed" keys them by the HMAC-SHA-256 of all 32 bytes,
+	// truncated to 20 bytes, and "reject" rejects them.
+	// Swarms are always keyed by 20 bytes, as that is the size of chihaya's
+	// InfoHash, so the full 32 byte infohash is not stored.
+	// Empty selects "truncate".
+	V2InfoHashes string `yaml:"v2_infohashes"`
+
+	// V2InfoHashKey is the hex-encoded key of at least 16 bytes v2
+	// infohashes are hashed with if V2InfoHashes is "keyed".
+	// It must not change while swarms are persisted, as their infohashes
+	// depend on it.
+	// "keyed" falls back to "truncate" without a valid key.
+	V2InfoHashKey string `yaml:"v2_infohash_key"`
+
+	// PeerSelector is the name of the Selector choosing the peers returned
+	// to announces: "random", "seeder_first", "subnet_affinity",
+	// "stable_first" or the name of a Selector registered with
+	// RegisterSelector.
+	// Empty selects "random".
+	PeerSelector string `yaml:"peer_selector"`
+
+	// AnnounceKeys enables identifying peers by the key they announce with,
+	// see PutSeederKey, so that clients with a changing IP replace their
+	// previous peer instead of leaving a duplicate behind.
+	// Keys are hashed and kept in memory only, they are not persisted.
+	// It is a shorthand for PeerIdentity "announce_key", which takes
+	// precedence if set.
+	AnnounceKeys bool `yaml:"announce_keys"`
+
+	// PeerIdentity selects what identifies a peer: "endpoint" identifies
+	// peers by their IP and port, "endpoint_peer_id" also by their peer ID,
+	// so that a client restarting on the same endpoint with a new peer ID
+	// is a new peer without the stats, score or announce history of the
+	// old one, and "announce_key" by the key they announce with, see
+	// AnnounceKeys.
+	// Identity keys are hashed and kept in memory only, so peers are
+	// identified by their endpoint until they announce again after a
+	// restart or a change of the mode.
+	// Empty selects "endpoint".
+	PeerIdentity string `yaml:"peer_identity"`
+
+	// LinkDualStackPeers links the IPv4 and IPv6 endpoints of a peer that
+	// announces over both address families with the same identity key, see
+	// PeerIdentity, so that they are kept as one logical peer: a put of
+	// either endpoint refreshes the lifetime and role of the other one, and
+	// deleting either endpoint deletes both.
+	// It has no effect if peers are identified by their endpoint only.
+	LinkDualStackPeers bool `yaml:"link_dual_stack_peers"`
+
+	// PeerScoring enables scoring peers by the regularity of their
+	// announces, see Candidate.Score.
+	// Scores are kept in memory only and are not persisted.
+	PeerScoring bool `yaml:"peer_scoring"`
+
+	// PeerScoreMinInterval is the minimum time between two announces of a
+	// peer for the second one to count as regular.
+	// Defaults to half the AnnounceInterval.
+	PeerScoreMinInterval time.Duration `yaml:"peer_score_min_interval"`
+
+	// MaxSwarmPeers is the maximum number of peers of each address family
+	// in a swarm.
+	// Zero disables the limit.
+	MaxSwarmPeers uint `yaml:"max_swarm_peers"`
+
+	// MaxPeers is the maximum number of peers in the store.
+	// The limit is approximate, as the peers of other shards are counted
+	// when their locks are released.
+	// Zero disables the limit.
+	MaxPeers uint64 `yaml:"max_peers"`
+
+	// Evictor is the name of the Evictor choosing the peer removed to make
+	// room for a new one if MaxSwarmPeers or MaxPeers is hit:
+	// "oldest_first", "leecher_first", "random" or the name of an Evictor
+	// registered with RegisterEvictor.
+	// Empty selects "oldest_first".
+	Evictor string `yaml:"evictor"`
+
+	// MaxNumWant is the maximum number of peers returned by an announce,
+	// regardless of the numWant requested.
+	// Zero disables the limit.
+	MaxNumWant uint `yaml:"max_numwant"`
+
+	// DefaultNumWant is the number of peers returned by announces that
+	// request zero or fewer peers.
+	// Zero disables the default, such announces then receive no peers.
+	DefaultNumWant uint `yaml:"default_numwant"`
+
+	// AnnounceRateLimit is the number of announces per second a single swarm
+	// accepts, beyond which announces fail with ErrThrottled.
+	// Zero disables the limit.
+	AnnounceRateLimit float64 `yaml:"announce_rate_limit"`
+
+	// AnnounceBurst is the number of announces a swarm accepts at once
+	// before AnnounceRateLimit applies.
+	// Zero uses AnnounceRateLimit, rounded up.
+	AnnounceBurst uint `yaml:"announce_burst"`
+
+	// HotSetThreshold is the number of peers of an address family above
+	// which a swarm keeps a hot set, a periodically refreshed random sample
+	// of its peers that announces are served from.
+	// Zero disables hot sets.
+	HotSetThreshold uint `yaml:"hot_set_threshold"`
+
+	// HotSetSize is the number of seeders and of leechers sampled into a hot
+	// set.
+	// Zero selects 1024.
+	HotSetSize uint `yaml:"hot_set_size"`
+
+	// HotSetRefreshInterval is the interval at which hot sets are sampled
+	// anew.
+	HotSetRefreshInterval time.Duration `yaml:"hot_set_refresh_interval"`
+
+	// AnnounceCacheThreshold is the number of peers of an address family at
+	// or above which announces to a swarm are served from a cached random
+	// sample of its peers, shuffled for every response.
+	// Unlike hot sets, the sample is taken by the first announce after the
+	// previous one expired, under the read lock of the shard, and takes
+	// precedence over the hot set.
+	// Zero disables the cache.
+	AnnounceCacheThreshold uint `yaml:"announce_cache_threshold"`
+
+	// AnnounceCacheTTL is the duration a cached sample is used for.
+	// Zero selects 500 milliseconds.
+	AnnounceCacheTTL time.Duration `yaml:"announce_cache_ttl"`
+
+	// AnnounceCacheSize is the number of seeders and of leechers sampled
+	// into the cache of a swarm.
+	// Zero selects 512.
+	AnnounceCacheSize uint `yaml:"announce_cache_size"`
+
+	// DownloadCountersPath is the path of a file the download counters of
+	// all swarms are written to, so that they survive the removal of swarms
+	// without peers and restarts, independently of Persistence.
+	// Namespaces use the path suffixed by a dot and their name.
+	// An empty path disables durable download counters.
+	DownloadCountersPath string `yaml:"download_counters_path"`
+
+	// DownloadCountersInterval is the interval at which the download
+	// counters are written.
+	// They are also written when the store is stopped.
+	DownloadCountersInterval time.Duration `yaml:"download_counters_interval"`
+
+	// HistoryInterval is the interval at which the aggregate counts of the
+	// store are recorded for History.
+	// Zero disables the history.
+	HistoryInterval time.Duration `yaml:"history_interval"`
+
+	// HistorySize is the number of recorded counts kept for History.
+	// Zero selects 360.
+	HistorySize uint `yaml:"history_size"`
+
+	// HistoryPinnedSwarms also records the counts of every pinned swarm for
+	// History.
+	HistoryPinnedSwarms bool `yaml:"history_pinned_swarms"`
+
+	// Federation configures announcing pinned swarms to upstream trackers
+	// and merging the peers they return.
+	Federation FederationConfig `yaml:"federation"`
+
+	// MinSwarmLifetime is the minimum duration a swarm is kept after it was
+	// created, even if all of its peers are garbage collected.
+	// This keeps the download counters of short-lived swarms.
+	// Must be shorter than 18 hours, zero disables the minimum.
+	MinSwarmLifetime time.Duration `yaml:"min_swarm_lifetime"`
+
+	// SpillAfter is the duration after which swarms without announces are
+	// moved to the cold storage set with SetColdStorage during garbage
+	// collection.
+	// Must be shorter than PeerLifetime, zero disables spilling.
+	SpillAfter time.Duration `yaml:"spill_after"`
+
+	// ColdStoragePath is the path of a Bolt database that swarms are
+	// spilled to, see SpillAfter and BoltColdStorage.
+	// The database is opened when the store is created and closed when it
+	// is stopped.
+	// Empty uses the cold storage set with SetColdStorage, if any.
+	ColdStoragePath string `yaml:"cold_storage_path"`
+
+	// SeederCompactionAfter is the duration after which swarms without
+	// leechers are compacted during garbage collection: only a random
+	// sample of SeederCompactionSample seeders per address family is kept,
+	// the others are counted, but not stored.
+	// Seeders that are not in the sample are assumed to leave at the same
+	// rate as the sampled ones, and new seeders are not counted until the
+	// first leecher expands the swarm again.
+	// Must be shorter than 18 hours, zero disables compaction.
+	SeederCompactionAfter time.Duration `yaml:"seeder_compaction_after"`
+
+	// SeederCompactionSample is the number of seeders per address family
+	// kept by compacted swarms.
+	// Swarms with fewer seeders are not compacted.
+	SeederCompactionSample uint `yaml:"seeder_compaction_sample"`
+
+	// SnapshotPath is the path of a file the swarms are exported to when the
+	// store is stopped and imported from when it is created.
+	// Empty disables snapshots.
+	SnapshotPath string `yaml:"snapshot_path"`
+
+	// SnapshotEncryptionKey is the hex-encoded 16, 24 or 32 byte AES key
+	// snapshots are encrypted with, using AES-GCM.
+	// A value of the form "env:NAME" reads the key from the environment
+	// variable NAME instead.
+	// Invalid keys make New fail.
+	// Empty disables encryption.
+	SnapshotEncryptionKey string `yaml:"snapshot_encryption_key"`
+
+	// ExportCompression compresses exports and snapshots with "gzip" or
+	// "zstd".
+	// Imports detect compressed exports regardless of it.
+	// Empty disables compression.
+	ExportCompression string `yaml:"export_compression"`
+
+	// ExportCompressionLevel is the compression level of ExportCompression,
+	// -2 to 9 for gzip and 1 to 22 for zstd.
+	// Zero selects the default level of the algorithm.
+	ExportCompressionLevel int `yaml:"export_compression_level"`
+
+	// AnonymizeIPs replaces the IPs of peers returned by GetSeeders,
+	// GetLeechers and lifecycle callbacks with keyed hashes, and makes
+	// ExportSwarms fail.
+	// Announces still return the real addresses.
+	AnonymizeIPs bool `yaml:"anonymize_ips"`
+
+	// AnonymizationKeyRotation is the interval at which the key of the
+	// hashes used by AnonymizeIPs is replaced, after which the same IP maps
+	// to a different pseudonym.
+	// Zero only replaces the key when the store is restarted.
+	AnonymizationKeyRotation time.Duration `yaml:"anonymization_key_rotation"`
+
+	// Persistence selects a registered persistence driver the swarms are
+	// saved to when the store is stopped and loaded from when it is created.
+	// It takes precedence over SnapshotPath, which is a shorthand for the
+	// file driver.
+	Persistence PersistenceConfig `yaml:"persistence"`
+
+	// GCDeadline is the duration after which a garbage collection pass is
+	// considered stuck and reported by a watchdog.
+	// Zero disables the watchdog.
+	GCDeadline time.Duration `yaml:"gc_deadline"`
+
+	// GCAbortStuck makes the watchdog abort stuck garbage collection passes.
+	// Aborted passes skip their remaining shards once the current shard is
+	// done.
+	GCAbortStuck bool `yaml:"gc_abort_stuck"`
+
+	// DistinctNotFoundErrors makes deletes, announces and GetSeeders and
+	// GetLeechers return ErrSwarmNotFound, ErrNoPeersForAddressFamily or
+	// ErrPeerNotFound instead of storage.ErrResourceDoesNotExist.
+	// Frontends and middleware of chihaya expect
+	// storage.ErrResourceDoesNotExist, so this is disabled by default.
+	DistinctNotFoundErrors bool `yaml:"distinct_not_found_errors"`
+
+	// Clock is the clock the announce times of peers and the ages of swarms
+	// are taken from, and the background goroutines wait on.
+	// It is meant for tests and simulations, nil uses the system clock.
+	Clock Clock `yaml:"-"`
+
+	// SelectionSeed makes the peers returned to announces depend only on the
+	// seed and the order of requests, so that responses can be asserted in
+	// tests and replayed for debugging.
+	// The shard seed defaults to it as well.
+	// Zero derives the selection from the infohash and peer ID of each
+	// announce instead.
+	SelectionSeed uint64 `yaml:"selection_seed"`
+
+	// Rand is the source of randomness peers are selected with, taking
+	// precedence over SelectionSeed.
+	// It is meant for tests, nil uses SelectionSeed.
+	Rand Rand `yaml:"-"`
+
+	// Chaos enables injecting faults to flush out races in tests, see Chaos.
+	// It must not be used in production, nil disables it.
+	Chaos *Chaos `yaml:"-"`
+
+	// Namespaces holds settings for namespaces created using
+	// WithNamespace, by name.
+	// Namespaces without settings inherit all settings of the store.
+	Namespaces map[string]NamespaceConfig `yaml:"namespaces"`
 }
 
 // LogFields implements log.LogFielder for a Config.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
-		"shardCountBits":              cfg.ShardCountBits,
-		"gcInterval":                  cfg.GarbageCollectionInterval,
-		"peerLifetime":                cfg.PeerLifetime,
-		"prometheusReportingInterval": cfg.PrometheusReportingInterval,
+		"shardCountBits":            cfg.ShardCountBits,
+		"gcInterval":                cfg.GarbageCollectionInterval,
+		"peerLifetime":              cfg.PeerLifetime,
+		"lazyExpiration":            cfg.LazyExpiration,
+		"lazyExpirationBudget":      cfg.LazyExpirationBudget,
+		"timingWheel":               cfg.TimingWheel,
+		"disablePrometheus":         cfg.DisablePrometheus,
+		"statsDAddr":                cfg.StatsD.Addr,
+		"statsDPrefix":              cfg.StatsD.Prefix,
+		"metricsReporterSet":        cfg.MetricsReporter != nil,
+		"metricsInterval":           cfg.MetricsInterval,
+		"batchQueueSize":            cfg.BatchQueueSize,
+		"batchFlushInterval":        cfg.BatchFlushInterval,
+		"batchWorkers":              cfg.BatchWorkers,
+		"announceInterval":          cfg.AnnounceInterval,
+		"maxAnnounceInterval":       cfg.MaxAnnounceInterval,
+		"largeSwarmSize":            cfg.LargeSwarmSize,
+		"loadReferenceRate":         cfg.LoadReferenceRate,
+		"loadMemoryLimit":           cfg.LoadMemoryLimit,
+		"shedLoadAbove":             cfg.ShedLoadAbove,
+		"expensiveOpSLO":            cfg.ExpensiveOpSLO,
+		"breakerCooldown":           cfg.BreakerCooldown,
+		"expensiveSwarmSize":        cfg.ExpensiveSwarmSize,
+		"adminAddr":                 cfg.AdminAddr,
+		"adminGRPCAddr":             cfg.AdminGRPCAddr,
+		"adminTokenSet":             cfg.AdminToken != "",
+		"adminTokens":               len(cfg.AdminTokens),
+		"adminInsecure":             cfg.AdminInsecure,
+		"adminTLS":                  cfg.AdminTLS.enabled(),
+		"adminClientCAFile":         cfg.AdminTLS.ClientCAFile,
+		"adminClientScopes":         cfg.AdminTLS.ClientScopes,
+		"adminAuditLogPath":         cfg.AdminAuditLogPath,
+		"shardSeedSet":              cfg.ShardSeed != 0,
+		"allowedUnroutableNetworks": cfg.AllowedUnroutableNetworks,
+		"traceSampleRatio":          cfg.TraceSampleRatio,
+		"lockFreeScrapes":           cfg.LockFreeScrapes,
+		"scrapeCacheTTL":            cfg.ScrapeCacheTTL,
+		"scrapeCacheSize":           cfg.ScrapeCacheSize,
+		"negativeCacheSize":         cfg.NegativeCacheSize,
+		"announceSeederShare":       cfg.AnnounceSeederShare,
+		"dualStackIPv4Share":        cfg.DualStackIPv4Share,
+		"scrapeEpsilon":             cfg.ScrapeEpsilon,
+		"scrapeRoundBelow":          cfg.ScrapeRoundBelow,
+		"erasureSigningKeySet":      cfg.ErasureSigningKey != "",
+		"v2InfoHashes":              cfg.V2InfoHashes,
+		"v2InfoHashKeySet":          cfg.V2InfoHashKey != "",
+		"peerSelector":              cfg.PeerSelector,
+		"announceKeys":              cfg.AnnounceKeys,
+		"peerIdentity":              cfg.PeerIdentity,
+		"linkDualStackPeers":        cfg.LinkDualStackPeers,
+		"peerScoring":               cfg.PeerScoring,
+		"peerScoreMinInterval":      cfg.PeerScoreMinInterval,
+		"maxSwarmPeers":             cfg.MaxSwarmPeers,
+		"maxPeers":                  cfg.MaxPeers,
+		"evictor":                   cfg.Evictor,
+		"maxNumWant":                cfg.MaxNumWant,
+		"announceRateLimit":         cfg.AnnounceRateLimit,
+		"announceBurst":             cfg.AnnounceBurst,
+		"hotSetThreshold":           cfg.HotSetThreshold,
+		"hotSetSize":                cfg.HotSetSize,
+		"hotSetRefreshInterval":     cfg.HotSetRefreshInterval,
+		"announceCacheThreshold":    cfg.AnnounceCacheThreshold,
+		"announceCacheTTL":          cfg.AnnounceCacheTTL,
+		"announceCacheSize":         cfg.AnnounceCacheSize,
+		"downloadCountersPath":      cfg.DownloadCountersPath,
+		"downloadCountersInterval":  cfg.DownloadCountersInterval,
+		"historyInterval":           cfg.HistoryInterval,
+		"historySize":               cfg.HistorySize,
+		"historyPinnedSwarms":       cfg.HistoryPinnedSwarms,
+		"federationTrackers":        cfg.Federation.Trackers,
+		"federationInterval":        cfg.Federation.Interval,
+		"defaultNumWant":            cfg.DefaultNumWant,
+		"minSwarmLifetime":          cfg.MinSwarmLifetime,
+		"spillAfter":                cfg.SpillAfter,
+		"coldStoragePath":           cfg.ColdStoragePath,
+		"seederCompactionAfter":     cfg.SeederCompactionAfter,
+		"seederCompactionSample":    cfg.SeederCompactionSample,
+		"snapshotPath":              cfg.SnapshotPath,
+		"snapshotEncryptionKeySet":  cfg.SnapshotEncryptionKey != "",
+		"exportCompression":         cfg.ExportCompression,
+		"exportCompressionLevel":    cfg.ExportCompressionLevel,
+		"persistence":               cfg.Persistence.Name,
+		"anonymizeIPs":              cfg.AnonymizeIPs,
+		"anonymizationKeyRotation":  cfg.AnonymizationKeyRotation,
+		"persistenceLogOps":         cfg.Persistence.LogOps,
+		"gcDeadline":                cfg.GCDeadline,
+		"gcAbortStuck":              cfg.GCAbortStuck,
+		"distinctNotFoundErrors":    cfg.DistinctNotFoundErrors,
+		"clockSet":                  cfg.Clock != nil,
+		"selectionSeedSet":          cfg.SelectionSeed != 0,
+		"randSet":                   cfg.Rand != nil,
+		"chaos":                     cfg.Chaos != nil,
+		"namespaces":                cfg.Namespaces,
 	}
 }
 
@@ -109,15 +736,6 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
-	if cfg.PrometheusReportingInterval <= 0 {
-		validcfg.PrometheusReportingInterval = defaultPrometheusReportingInterval
-		log.Warn("falling back to default configuration", log.Fields{
-			"name":     Name + ".PrometheusReportingInterval",
-			"provided": cfg.PrometheusReportingInterval,
-			"default":  validcfg.PrometheusReportingInterval,
-		})
-	}
-
 	if cfg.PeerLifetime <= 0 {
 		validcfg.PeerLifetime = defaultPeerLifetime
 		log.Warn("falling back to default configuration", log.Fields{
@@ -127,5 +745,442 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.LazyExpiration && validcfg.PeerLifetime+validcfg.GarbageCollectionInterval >= maxLazyLifetime {
+		validcfg.LazyExpiration = false
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".LazyExpiration",
+			"provided": cfg.LazyExpiration,
+			"default":  validcfg.LazyExpiration,
+		})
+	}
+
+	if cfg.TimingWheel && validcfg.LazyExpiration {
+		validcfg.TimingWheel = false
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".TimingWheel",
+			"provided": cfg.TimingWheel,
+			"default":  validcfg.TimingWheel,
+		})
+	}
+
+	if cfg.BatchQueueSize > 0 && cfg.BatchFlushInterval <= 0 {
+		validcfg.BatchFlushInterval = defaultBatchFlushInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BatchFlushInterval",
+			"provided": cfg.BatchFlushInterval,
+			"default":  validcfg.BatchFlushInterval,
+		})
+	}
+
+	if cfg.AnnounceInterval <= 0 {
+		validcfg.AnnounceInterval = defaultAnnounceInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".AnnounceInterval",
+			"provided": cfg.AnnounceInterval,
+			"default":  validcfg.AnnounceInterval,
+		})
+	}
+
+	if cfg.MaxAnnounceInterval < validcfg.AnnounceInterval {
+		validcfg.MaxAnnounceInterval = validcfg.AnnounceInterval * 4
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxAnnounceInterval",
+			"provided": cfg.MaxAnnounceInterval,
+			"default":  validcfg.MaxAnnounceInterval,
+		})
+	}
+
+	if cfg.LargeSwarmSize <= 0 {
+		validcfg.LargeSwarmSize = defaultLargeSwarmSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".LargeSwarmSize",
+			"provided": cfg.LargeSwarmSize,
+			"default":  validcfg.LargeSwarmSize,
+		})
+	}
+
+	if cfg.LoadReferenceRate <= 0 {
+		validcfg.LoadReferenceRate = defaultLoadReferenceRate
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".LoadReferenceRate",
+			"provided": cfg.LoadReferenceRate,
+			"default":  validcfg.LoadReferenceRate,
+		})
+	}
+
+	if cfg.ShedLoadAbove < 0 {
+		validcfg.ShedLoadAbove = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ShedLoadAbove",
+			"provided": cfg.ShedLoadAbove,
+			"default":  validcfg.ShedLoadAbove,
+		})
+	}
+
+	if cfg.ExpensiveOpSLO < 0 {
+		validcfg.ExpensiveOpSLO = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ExpensiveOpSLO",
+			"provided": cfg.ExpensiveOpSLO,
+			"default":  validcfg.ExpensiveOpSLO,
+		})
+	}
+
+	if cfg.BreakerCooldown <= 0 {
+		validcfg.BreakerCooldown = defaultBreakerCooldown
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BreakerCooldown",
+			"provided": cfg.BreakerCooldown,
+			"default":  validcfg.BreakerCooldown,
+		})
+	}
+
+	if cfg.ExpensiveSwarmSize <= 0 {
+		validcfg.ExpensiveSwarmSize = defaultExpensiveSwarmSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ExpensiveSwarmSize",
+			"provided": cfg.ExpensiveSwarmSize,
+			"default":  validcfg.ExpensiveSwarmSize,
+		})
+	}
+
+	if nets, invalid := parseCIDRs(cfg.AllowedUnroutableNetworks); len(invalid) > 0 {
+		validcfg.AllowedUnroutableNetworks = make([]string, len(nets))
+		for i, n := range nets {
+			validcfg.AllowedUnroutableNetworks[i] = n.String()
+		}
+		log.Warn("ignoring invalid networks", log.Fields{
+			"name":     Name + ".AllowedUnroutableNetworks",
+			"provided": cfg.AllowedUnroutableNetworks,
+			"invalid":  invalid,
+		})
+	}
+
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		validcfg.TraceSampleRatio = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".TraceSampleRatio",
+			"provided": cfg.TraceSampleRatio,
+			"default":  validcfg.TraceSampleRatio,
+		})
+	}
+
+	if cfg.AnnounceSeederShare < 0 || cfg.AnnounceSeederShare > 1 {
+		validcfg.AnnounceSeederShare = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".AnnounceSeederShare",
+			"provided": cfg.AnnounceSeederShare,
+			"default":  validcfg.AnnounceSeederShare,
+		})
+	}
+
+	if cfg.DualStackIPv4Share < 0 || cfg.DualStackIPv4Share > 1 {
+		validcfg.DualStackIPv4Share = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".DualStackIPv4Share",
+			"provided": cfg.DualStackIPv4Share,
+			"default":  validcfg.DualStackIPv4Share,
+		})
+	}
+
+	switch cfg.ExportCompression {
+	case compressionNone, compressionGzip, compressionZstd:
+	default:
+		validcfg.ExportCompression = compressionNone
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ExportCompression",
+			"provided": cfg.ExportCompression,
+			"default":  validcfg.ExportCompression,
+		})
+	}
+
+	if !validCompressionLevel(validcfg.ExportCompression, cfg.ExportCompressionLevel) {
+		validcfg.ExportCompressionLevel = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ExportCompressionLevel",
+			"provided": cfg.ExportCompressionLevel,
+			"default":  validcfg.ExportCompressionLevel,
+		})
+	}
+
+	if cfg.AnonymizationKeyRotation < 0 {
+		validcfg.AnonymizationKeyRotation = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".AnonymizationKeyRotation",
+			"provided": cfg.AnonymizationKeyRotation,
+			"default":  validcfg.AnonymizationKeyRotation,
+		})
+	}
+
+	if (cfg.StatsD.Addr != "" || cfg.MetricsReporter != nil) && cfg.MetricsInterval <= 0 {
+		validcfg.MetricsInterval = defaultMetricsInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MetricsInterval",
+			"provided": cfg.MetricsInterval,
+			"default":  validcfg.MetricsInterval,
+		})
+	}
+
+	if cfg.PeerScoring && cfg.PeerScoreMinInterval <= 0 {
+		validcfg.PeerScoreMinInterval = validcfg.AnnounceInterval / 2
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerScoreMinInterval",
+			"provided": cfg.PeerScoreMinInterval,
+			"default":  validcfg.PeerScoreMinInterval,
+		})
+	}
+
+	if cfg.DownloadCountersPath != "" && cfg.DownloadCountersInterval <= 0 {
+		validcfg.DownloadCountersInterval = defaultDownloadCountersInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".DownloadCountersInterval",
+			"provided": cfg.DownloadCountersInterval,
+			"default":  validcfg.DownloadCountersInterval,
+		})
+	}
+
+	if cfg.HotSetThreshold > 0 && cfg.HotSetRefreshInterval <= 0 {
+		validcfg.HotSetRefreshInterval = defaultHotSetRefreshInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".HotSetRefreshInterval",
+			"provided": cfg.HotSetRefreshInterval,
+			"default":  validcfg.HotSetRefreshInterval,
+		})
+	}
+
+	if cfg.AnnounceRateLimit < 0 || math.IsNaN(cfg.AnnounceRateLimit) || math.IsInf(cfg.AnnounceRateLimit, 0) {
+		validcfg.AnnounceRateLimit = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".AnnounceRateLimit",
+			"provided": cfg.AnnounceRateLimit,
+			"default":  validcfg.AnnounceRateLimit,
+		})
+	}
+
+	if cfg.ScrapeEpsilon < 0 || math.IsNaN(cfg.ScrapeEpsilon) {
+		validcfg.ScrapeEpsilon = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ScrapeEpsilon",
+			"provided": cfg.ScrapeEpsilon,
+			"default":  validcfg.ScrapeEpsilon,
+		})
+	}
+
+	validcfg.AdminTokens = nil
+	for i, t := range cfg.AdminTokens {
+		if t.Token == "" {
+			log.Warn("ignoring admin token without token", log.Fields{
+				"name":  Name + ".AdminTokens",
+				"index": i,
+			})
+			continue
+		}
+		if t.Scope != AdminScopeRead && t.Scope != AdminScopeMutate {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".AdminTokens.Scope",
+				"token":    t.Name,
+				"provided": t.Scope,
+				"default":  AdminScopeRead,
+			})
+			t.Scope = AdminScopeRead
+		}
+		validcfg.AdminTokens = append(validcfg.AdminTokens, t)
+	}
+
+	if len(cfg.AdminTLS.ClientScopes) > 0 {
+		validcfg.AdminTLS.ClientScopes = make(map[string]string, len(cfg.AdminTLS.ClientScopes))
+		for name, scope := range cfg.AdminTLS.ClientScopes {
+			if scope != AdminScopeRead && scope != AdminScopeMutate {
+				log.Warn("falling back to default configuration", log.Fields{
+					"name":     Name + ".AdminTLS.ClientScopes",
+					"client":   name,
+					"provided": scope,
+					"default":  AdminScopeRead,
+				})
+				scope = AdminScopeRead
+			}
+			validcfg.AdminTLS.ClientScopes[name] = scope
+		}
+	}
+
+	if seed, err := hex.DecodeString(cfg.ErasureSigningKey); err != nil || (cfg.ErasureSigningKey != "" && len(seed) != ed25519.SeedSize) {
+		validcfg.ErasureSigningKey = ""
+		// The provided key is not logged, as it is secret.
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":    Name + ".ErasureSigningKey",
+			"default": validcfg.ErasureSigningKey,
+		})
+	}
+
+	switch cfg.V2InfoHashes {
+	case "", V2InfoHashesTruncate, V2InfoHashesReject:
+	case V2InfoHashesKeyed:
+		if key, err := hex.DecodeString(cfg.V2InfoHashKey); err != nil || len(key) < 16 {
+			validcfg.V2InfoHashes = V2InfoHashesTruncate
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".V2InfoHashes",
+				"provided": cfg.V2InfoHashes,
+				"default":  validcfg.V2InfoHashes,
+			})
+		}
+	default:
+		validcfg.V2InfoHashes = V2InfoHashesTruncate
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".V2InfoHashes",
+			"provided": cfg.V2InfoHashes,
+			"default":  validcfg.V2InfoHashes,
+		})
+	}
+
+	switch cfg.PeerIdentity {
+	case "", PeerIdentityEndpoint, PeerIdentityEndpointPeerID, PeerIdentityAnnounceKey:
+	default:
+		validcfg.PeerIdentity = PeerIdentityEndpoint
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerIdentity",
+			"provided": cfg.PeerIdentity,
+			"default":  validcfg.PeerIdentity,
+		})
+	}
+
+	if _, ok := lookupSelector(cfg.PeerSelector); cfg.PeerSelector != "" && !ok {
+		validcfg.PeerSelector = "random"
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerSelector",
+			"provided": cfg.PeerSelector,
+			"default":  validcfg.PeerSelector,
+		})
+	}
+
+	if _, ok := lookupEvictor(cfg.Evictor); cfg.Evictor != "" && !ok {
+		validcfg.Evictor = "oldest_first"
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Evictor",
+			"provided": cfg.Evictor,
+			"default":  validcfg.Evictor,
+		})
+	}
+
+	if cfg.MaxNumWant > 0 && cfg.DefaultNumWant > cfg.MaxNumWant {
+		validcfg.DefaultNumWant = cfg.MaxNumWant
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".DefaultNumWant",
+			"provided": cfg.DefaultNumWant,
+			"default":  validcfg.DefaultNumWant,
+		})
+	}
+
+	if cfg.Federation.enabled() {
+		if cfg.Federation.Interval <= 0 {
+			validcfg.Federation.Interval = validcfg.PeerLifetime / 2
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".Federation.Interval",
+				"provided": cfg.Federation.Interval,
+				"default":  validcfg.Federation.Interval,
+			})
+		}
+		if cfg.Federation.NumWant == 0 {
+			validcfg.Federation.NumWant = defaultFederationNumWant
+		}
+		if cfg.Federation.Port == 0 {
+			validcfg.Federation.Port = defaultFederationPort
+		}
+		if cfg.Federation.Timeout <= 0 {
+			validcfg.Federation.Timeout = defaultFederationTimeout
+		}
+	}
+
+	if cfg.MinSwarmLifetime < 0 || cfg.MinSwarmLifetime >= maxSwarmLifetime {
+		validcfg.MinSwarmLifetime = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MinSwarmLifetime",
+			"provided": cfg.MinSwarmLifetime,
+			"default":  validcfg.MinSwarmLifetime,
+		})
+	}
+
+	if cfg.SpillAfter < 0 || cfg.SpillAfter >= validcfg.PeerLifetime || cfg.SpillAfter >= maxSwarmLifetime {
+		validcfg.SpillAfter = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SpillAfter",
+			"provided": cfg.SpillAfter,
+			"default":  validcfg.SpillAfter,
+		})
+	}
+
+	if cfg.SeederCompactionAfter < 0 || cfg.SeederCompactionAfter >= maxSwarmLifetime {
+		validcfg.SeederCompactionAfter = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SeederCompactionAfter",
+			"provided": cfg.SeederCompactionAfter,
+			"default":  validcfg.SeederCompactionAfter,
+		})
+	}
+
+	if validcfg.SeederCompactionAfter > 0 && cfg.SeederCompactionSample == 0 {
+		validcfg.SeederCompactionSample = defaultSeederCompactionSample
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SeederCompactionSample",
+			"provided": cfg.SeederCompactionSample,
+			"default":  validcfg.SeederCompactionSample,
+		})
+	}
+
+	// Lazy expiration and the timing wheel neither spill nor compact swarms,
+	// and lazy expiration can not expire the counters of lock-free scrapes.
+	if (validcfg.LazyExpiration || validcfg.TimingWheel) && validcfg.SpillAfter > 0 {
+		validcfg.SpillAfter = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SpillAfter",
+			"provided": cfg.SpillAfter,
+			"default":  validcfg.SpillAfter,
+		})
+	}
+
+	if (validcfg.LazyExpiration || validcfg.TimingWheel) && validcfg.SeederCompactionAfter > 0 {
+		validcfg.SeederCompactionAfter = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SeederCompactionAfter",
+			"provided": cfg.SeederCompactionAfter,
+			"default":  validcfg.SeederCompactionAfter,
+		})
+	}
+
+	if validcfg.LazyExpiration && cfg.LockFreeScrapes {
+		validcfg.LockFreeScrapes = false
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".LockFreeScrapes",
+			"provided": cfg.LockFreeScrapes,
+			"default":  validcfg.LockFreeScrapes,
+		})
+	}
+
+	if cfg.AnnounceCacheThreshold > 0 && cfg.AnnounceCacheTTL <= 0 {
+		validcfg.AnnounceCacheTTL = defaultAnnounceCacheTTL
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".AnnounceCacheTTL",
+			"provided": cfg.AnnounceCacheTTL,
+			"default":  validcfg.AnnounceCacheTTL,
+		})
+	}
+
+	if cfg.ScrapeCacheTTL < 0 {
+		validcfg.ScrapeCacheTTL = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ScrapeCacheTTL",
+			"provided": cfg.ScrapeCacheTTL,
+			"default":  validcfg.ScrapeCacheTTL,
+		})
+	}
+
+	if cfg.GCDeadline < 0 {
+		validcfg.GCDeadline = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GCDeadline",
+			"provided": cfg.GCDeadline,
+			"default":  validcfg.GCDeadline,
+		})
+	}
+
 	return validcfg
 }
@@ -0,0 +1,184 @@
+package optmem
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// ConsistencyProblem describes an inconsistency found by CheckConsistency.
+type ConsistencyProblem struct {
+	// Shard is the index of the shard the problem was found in, or -1 for
+	// problems with the store-wide counts.
+	Shard int
+
+	// InfoHash is the infohash of the swarm the problem was found in, if
+	// any.
+	InfoHash bittorrent.InfoHash
+
+	// Description describes the problem.
+	Description string
+}
+
+// ConsistencyReport holds the results of CheckConsistency.
+type ConsistencyReport struct {
+	Shards   int
+	Swarms   int
+	Peers    uint64
+	Seeders  uint64
+	Problems []ConsistencyProblem
+}
+
+// OK returns whether no problems were found.
+func (r ConsistencyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// CheckConsistency verifies the internal data structures of the PeerStore.
+// For every swarm it checks that the peer and seeder counts match the
+// contents of its buckets, that the buckets are sorted and that every peer is
+// in the bucket it belongs to.
+// For every shard it checks that the counts of the shard match the sum of its
+// swarms.
+//
+// Shards are checked one at a time and only read-locked while they are being
+// checked.
+// The store-wide counts are compared with the sum of all shards as well,
+// which is only exact if there are no writes during the check.
+//
+// Runs in linear time in regards to the number of peers tracked.
+func (s *PeerStore) CheckConsistency() ConsistencyReport {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	report := ConsistencyReport{Shards: len(s.shards.shards)}
+	var total peerCounts
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.rLockShard(i)
+		counts := checkShard(shard, i, &report)
+		s.shards.rUnlockShard(i)
+
+		total.peers4 += counts.peers4
+		total.seeders4 += counts.seeders4
+		total.peers6 += counts.peers6
+		total.seeders6 += counts.seeders6
+	}
+
+	seeders, leechers := total.total()
+	report.Seeders = seeders
+	report.Peers = seeders + leechers
+
+	if n := s.shards.getTorrentCount(); n != uint64(report.Swarms) {
+		report.problem(-1, infohash{}, "store counts %d swarms, shards contain %d", n, report.Swarms)
+	}
+	if published := s.shards.getPeerCounts(); published != total {
+		report.problem(-1, infohash{}, "store counts %+v, shards contain %+v", published, total)
+	}
+
+	return report
+}
+
+// problem adds a problem to the report.
+func (r *ConsistencyReport) problem(shard int, ih infohash, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, ConsistencyProblem{
+		Shard:       shard,
+		InfoHash:    bittorrent.InfoHash(ih),
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkShard checks the swarms of a shard and returns their actual counts.
+// The shard must be read-locked by the caller.
+func checkShard(shard *shard, index int, report *ConsistencyReport) peerCounts {
+	var counts peerCounts
+	for ih, sw := range shard.swarms {
+		report.Swarms++
+		if !sw.retained() && sw.peers4 == nil && sw.peers6 == nil {
+			report.problem(index, ih, "swarm is neither pinned nor has web seeds or peer lists")
+		}
+		if sw.webSeeded != (len(shard.webSeeds[ih]) > 0) {
+			report.problem(index, ih, "swarm web seed flag does not match its web seeds")
+		}
+		if shard.known != nil && !shard.known.mayContain(ih) {
+			report.problem(index, ih, "swarm is missing from the negative cache")
+		}
+		if sw.peers4 != nil {
+			peers, seeders := sw.peers4.check(index, ih, report)
+			hidden := sw.hiddenSeeders(bittorrent.IPv4)
+			counts.peers4 += uint64(peers + hidden)
+			counts.seeders4 += uint64(seeders + hidden)
+		}
+		if sw.peers6 != nil {
+			peers, seeders := sw.peers6.check(index, ih, report)
+			hidden := sw.hiddenSeeders(bittorrent.IPv6)
+			counts.peers6 += uint64(peers + hidden)
+			counts.seeders6 += uint64(seeders + hidden)
+		}
+		if sw.compacted != nil && sw.hasLeechers() {
+			report.problem(index, ih, "compacted swarm has leechers")
+		}
+	}
+
+	for ih := range shard.tags {
+		if _, ok := shard.swarms[ih]; !ok {
+			report.problem(index, ih, "tags of a swarm that does not exist")
+		}
+	}
+	if shard.counts != counts {
+		report.problem(index, infohash{}, "shard counts %+v, swarms contain %+v", shard.counts, counts)
+	}
+	if shard.published != shard.counts {
+		report.problem(index, infohash{}, "shard published %+v, but counts %+v", shard.published, shard.counts)
+	}
+	if n := atomic.LoadUint64(&shard.numSwarms); n != uint64(len(shard.swarms)) {
+		report.problem(index, infohash{}, "shard counts %d swarms, but contains %d", n, len(shard.swarms))
+	}
+
+	return counts
+}
+
+// check checks the buckets of a peerList against its counts and returns the
+// actual number of peers and seeders.
+func (pl *peerList) check(index int, ih infohash, report *ConsistencyReport) (peers, seeders int) {
+	dead, webRTC := 0, 0
+	for j, b := range pl.peerBuckets {
+		for i := range b {
+			if i > 0 && !b.Less(i-1, i) {
+				report.problem(index, ih, "bucket %d is not sorted at position %d", j, i)
+			}
+			if pl.bucketIndex(&b[i]) != j {
+				report.problem(index, ih, "peer at position %d of bucket %d belongs in bucket %d", i, j, pl.bucketIndex(&b[i]))
+			}
+			if b[i].isDead() {
+				dead++
+				continue
+			}
+			peers++
+			if b[i].isSeeder() {
+				seeders++
+			}
+			if b[i].isWebRTC() {
+				webRTC++
+			}
+		}
+	}
+
+	if peers != pl.numPeers {
+		report.problem(index, ih, "swarm counts %d peers, buckets contain %d", pl.numPeers, peers)
+	}
+	if seeders != pl.numSeeders {
+		report.problem(index, ih, "swarm counts %d seeders, buckets contain %d", pl.numSeeders, seeders)
+	}
+	if webRTC != pl.numWebRTC {
+		report.problem(index, ih, "swarm counts %d WebRTC peers, buckets contain %d", pl.numWebRTC, webRTC)
+	}
+	if dead != pl.numDead {
+		report.problem(index, ih, "swarm counts %d tombstones, buckets contain %d", pl.numDead, dead)
+	}
+
+	return peers, seeders
+}
@@ -0,0 +1,53 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		p := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(1, 0, byte(i>>8), byte(i)).To4(), AddressFamily: bittorrent.IPv4}, Port: uint16(i)}
+		if i%3 == 0 {
+			require.Nil(t, ps.PutSeeder(ih, p))
+		} else {
+			require.Nil(t, ps.PutLeecher(ih, p))
+		}
+	}
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.DeleteLeecher(ih, p3))
+	require.Nil(t, ps.DeleteLeecher(ih, bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(1, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}))
+	require.Nil(t, ps.PinSwarm(bittorrent.InfoHashFromString("11111111111111111111")))
+
+	report := ps.CheckConsistency()
+	require.True(t, report.OK(), "%+v", report.Problems)
+	require.Equal(t, 2, report.Swarms)
+	require.Equal(t, uint64(1999), report.Peers)
+	require.Equal(t, uint64(667), report.Seeders)
+
+	// Introduce counter drift and an unsorted bucket.
+	// The lock is released directly, unlockShard would panic in debug builds.
+	index := ps.shards.shardIndex(infohash(ih))
+	shard := ps.shards.lockShard(index)
+	pl := shard.swarms[infohash(ih)].peers4
+	pl.numSeeders++
+	b := pl.peerBuckets[0]
+	b[0], b[1] = b[1], b[0]
+	ps.shards.shardLocks[index].Unlock()
+
+	report = ps.CheckConsistency()
+	require.Len(t, report.Problems, 2)
+	for _, problem := range report.Problems {
+		require.Equal(t, index, problem.Shard)
+		require.Equal(t, ih, problem.InfoHash)
+	}
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
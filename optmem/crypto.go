@@ -0,0 +1,166 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+)
+
+// CryptoLevel is the support of a peer for protocol encryption, as announced
+// using the supportcrypto and requirecrypto parameters (BEP 8 style).
+type CryptoLevel byte
+
+// Protocol encryption support levels.
+const (
+	// CryptoUnknown is used for peers that did not announce their support
+	// for protocol encryption.
+	CryptoUnknown CryptoLevel = iota
+
+	// CryptoSupported is used for peers that support, but do not require,
+	// protocol encryption.
+	CryptoSupported
+
+	// CryptoRequired is used for peers that only accept encrypted
+	// connections.
+	CryptoRequired
+)
+
+// peerFlag returns the peer flag representing the crypto level.
+func (c CryptoLevel) peerFlag() peerFlag {
+	switch c {
+	case CryptoSupported:
+		return peerFlagCryptoSupported
+	case CryptoRequired:
+		return peerFlagCryptoRequired
+	}
+	return 0
+}
+
+// cryptoLevelOf returns the crypto level represented by the flags of a peer.
+func cryptoLevelOf(flag peerFlag) CryptoLevel {
+	switch {
+	case flag&peerFlagCryptoRequired != 0:
+		return CryptoRequired
+	case flag&peerFlagCryptoSupported != 0:
+		return CryptoSupported
+	}
+	return CryptoUnknown
+}
+
+// supportsCrypto returns whether a peer accepts encrypted connections.
+func (p *peer) supportsCrypto() bool {
+	return p.peerFlag()&(peerFlagCryptoSupported|peerFlagCryptoRequired) != 0
+}
+
+// requiresCrypto returns whether a peer only accepts encrypted connections.
+func (p *peer) requiresCrypto() bool {
+	return p.peerFlag()&peerFlagCryptoRequired != 0
+}
+
+// PutSeederCrypto works like PutSeeder, but also stores the crypto level of
+// the peer.
+// PutSeeder stores peers with CryptoUnknown.
+func (s *PeerStore) PutSeederCrypto(infoHash bittorrent.InfoHash, p bittorrent.Peer, crypto CryptoLevel) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.put("optmem.PutSeeder", infoHash, p, peerFlagSeeder|crypto.peerFlag(), false)
+}
+
+// PutLeecherCrypto works like PutLeecher, but also stores the crypto level of
+// the peer.
+// PutLeecher stores peers with CryptoUnknown.
+func (s *PeerStore) PutLeecherCrypto(infoHash bittorrent.InfoHash, p bittorrent.Peer, crypto CryptoLevel) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.put("optmem.PutLeecher", infoHash, p, peerFlagLeecher|crypto.peerFlag(), false)
+}
+
+// GraduateLeecherCrypto works like GraduateLeecher, but also stores the crypto
+// level of the peer.
+// GraduateLeecher stores peers with CryptoUnknown.
+func (s *PeerStore) GraduateLeecherCrypto(infoHash bittorrent.InfoHash, p bittorrent.Peer, crypto CryptoLevel) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.graduate(infoHash, p, peerFlagSeeder|crypto.peerFlag(), s.identityKey(p, ""))
+}
+
+// AnnouncePeersCrypto works like AnnouncePeers, but takes the crypto level of
+// the announcing peer into account: peers that require encryption only
+// receive peers that support it.
+// Announces of such peers run in linear time in regards to the number of
+// peers in the swarm.
+func (s *PeerStore) AnnouncePeersCrypto(infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer, crypto CryptoLevel) ([]bittorrent.Peer, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.announce(nil, infoHash, seeder, numWant, announcingPeer, crypto.peerFlag())
+}
+
+// getEncryptedAnnouncePeers works like getAnnouncePeers, but only appends
+// peers that support encryption.
+func (pl *peerList) getEncryptedAnnouncePeers(dst []peer, numWant int, seeder bool, seederShare float64, s0, s1 uint64) []peer {
+	return pl.getFilteredAnnouncePeers(dst, numWant, seeder, seederShare, s0, s1, (*peer).supportsCrypto)
+}
+
+// getFilteredAnnouncePeers works like getAnnouncePeers, but only appends
+// peers for which keep returns true.
+// It runs in linear time in regards to the number of peers.
+func (pl *peerList) getFilteredAnnouncePeers(dst []peer, numWant int, seeder bool, seederShare float64, s0, s1 uint64, keep func(p *peer) bool) []peer {
+	var seeders, leechers []peer
+	for _, b := range pl.peerBuckets {
+		for i := range b {
+			p := &b[i]
+			if p.isDead() || !keep(p) {
+				continue
+			}
+			if p.isSeeder() {
+				seeders = append(seeders, *p)
+			} else {
+				leechers = append(leechers, *p)
+			}
+		}
+	}
+
+	if seeder {
+		// seeder announces: only leechers
+		return append(dst, samplePeers(leechers, numWant, s0, s1)...)
+	}
+
+	// leecher announces: seeders and leechers as split by splitNumWant
+	if numWant > len(seeders)+len(leechers) {
+		numWant = len(seeders) + len(leechers)
+	}
+	wantSeeders, wantLeechers := splitNumWant(numWant, len(seeders), len(leechers), seederShare)
+	dst = append(dst, samplePeers(seeders, wantSeeders, s0, s1)...)
+	return append(dst, samplePeers(leechers, wantLeechers, s0, s1)...)
+}
+
+// samplePeers returns k randomly chosen peers, reordering peers in place.
+func samplePeers(peers []peer, k int, s0, s1 uint64) []peer {
+	if k >= len(peers) {
+		return peers
+	}
+
+	// Partial Fisher-Yates shuffle: the first k peers are a uniform sample.
+	for i := 0; i < k; i++ {
+		var j int
+		j, s0, s1 = random.Intn(s0, s1, len(peers)-i)
+		j += i
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	return peers[:k]
+}
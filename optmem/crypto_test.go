@@ -0,0 +1,61 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCryptoAnnounce(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	p4 := bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.ParseIP("3.4.5.6"), AddressFamily: bittorrent.IPv4},
+		Port: 4567,
+	}
+	announcer := bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.ParseIP("4.5.6.7"), AddressFamily: bittorrent.IPv4},
+		Port: 5678,
+	}
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeederCrypto(ih, p2, CryptoSupported))
+	require.Nil(t, ps.PutLeecherCrypto(ih, p4, CryptoRequired))
+
+	peers, err := ps.AnnouncePeers(ih, false, 10, announcer)
+	require.Nil(t, err)
+	require.Len(t, peers, 3)
+
+	peers, err = ps.AnnouncePeersCrypto(ih, false, 10, announcer, CryptoSupported)
+	require.Nil(t, err)
+	require.Len(t, peers, 3)
+
+	peers, err = ps.AnnouncePeersCrypto(ih, false, 10, announcer, CryptoRequired)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.Equal(t, p2.Port, peers[0].Port)
+	require.Equal(t, p4.Port, peers[1].Port)
+
+	peers, err = ps.AnnouncePeersCrypto(ih, false, 1, announcer, CryptoRequired)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, p2.Port, peers[0].Port)
+
+	peers, err = ps.AnnouncePeersCrypto(ih, true, 10, announcer, CryptoRequired)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, p4.Port, peers[0].Port)
+
+	// Deleting does not require the crypto level.
+	require.Nil(t, ps.DeleteSeeder(ih, p2))
+	require.Nil(t, ps.DeleteLeecher(ih, p4))
+	peers, err = ps.AnnouncePeersCrypto(ih, false, 10, announcer, CryptoRequired)
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
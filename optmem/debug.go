@@ -0,0 +1,54 @@
+package optmem
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// checkShardInvariants checks a shard like CheckConsistency and panics with a
+// dump of the affected swarms if it is inconsistent.
+// It is called after every mutation if the optmem_debug build tag is set.
+// The shard must be locked by the caller.
+func checkShardInvariants(shard *shard, index int) {
+	var report ConsistencyReport
+	checkShard(shard, index, &report)
+	if report.OK() {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "optmem: invariants of shard %d violated:\n", index)
+	dumped := make(map[infohash]bool)
+	for _, problem := range report.Problems {
+		fmt.Fprintf(&b, "  %x: %s\n", problem.InfoHash[:], problem.Description)
+	}
+	for _, problem := range report.Problems {
+		ih := infohash(problem.InfoHash)
+		sw, ok := shard.swarms[ih]
+		if !ok || dumped[ih] {
+			continue
+		}
+		dumped[ih] = true
+		fmt.Fprintf(&b, "swarm %x (pinned: %t, frozen: %t, created: %d):\n", ih[:], sw.pinned, sw.frozen, sw.created)
+		sw.peers4.dump(&b, "IPv4")
+		sw.peers6.dump(&b, "IPv6")
+	}
+
+	panic(b.String())
+}
+
+// dump writes the counts and peers of a peerList to b.
+func (pl *peerList) dump(b *strings.Builder, name string) {
+	if pl == nil {
+		return
+	}
+
+	fmt.Fprintf(b, "  %s: %d peers, %d seeders, %d tombstones, %d buckets\n", name, pl.numPeers, pl.numSeeders, pl.numDead, len(pl.peerBuckets))
+	for j, bucket := range pl.peerBuckets {
+		for i := range bucket {
+			p := &bucket[i]
+			fmt.Fprintf(b, "    %d/%d: %s:%d flags %08b time %d\n", j, i, net.IP(p[:ipLen]), p.port(), p.peerFlag(), p.peerTime())
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !optmem_debug
+// +build !optmem_debug
+
+package optmem
+
+// debugChecks enables checking the invariants of a shard after every
+// mutation, see checkShardInvariants.
+// Build with the optmem_debug tag to enable it.
+const debugChecks = false
@@ -0,0 +1,8 @@
+//go:build optmem_debug
+// +build optmem_debug
+
+package optmem
+
+// debugChecks enables checking the invariants of a shard after every
+// mutation, see checkShardInvariants.
+const debugChecks = true
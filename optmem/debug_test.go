@@ -0,0 +1,33 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckShardInvariants(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+
+	index := ps.shards.shardIndex(infohash(ih))
+	shard := ps.shards.lockShard(index)
+	require.NotPanics(t, func() { checkShardInvariants(shard, index) })
+
+	shard.swarms[infohash(ih)].peers6.numPeers++
+	var dump string
+	func() {
+		defer func() { dump, _ = recover().(string) }()
+		checkShardInvariants(shard, index)
+	}()
+	require.Contains(t, dump, "swarm counts 2 peers, buckets contain 1")
+	require.Contains(t, dump, "IPv6: 2 peers, 0 seeders, 0 tombstones, 1 buckets")
+	require.Contains(t, dump, "0/0: 2001:db8::1:3456")
+	ps.shards.shardLocks[index].Unlock()
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
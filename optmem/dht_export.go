@@ -0,0 +1,190 @@
+package optmem
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultDHTPeers is the number of peers exported per address family of a
+// swarm by ExportDHT if DHTExport.MaxPeers is zero.
+const defaultDHTPeers = 50
+
+// DHTExport configures ExportDHT.
+type DHTExport struct {
+	// Format is FormatBencode or FormatJSON.
+	Format Format
+
+	// MaxPeers is the maximum number of peers exported per address family
+	// of a swarm, they are sampled randomly from larger swarms.
+	// Zero exports up to 50 peers.
+	MaxPeers int
+
+	// PinnedOnly restricts the export to pinned swarms.
+	PinnedOnly bool
+
+	// Rate is the maximum number of swarms written per second.
+	// Zero writes them as fast as w accepts them.
+	Rate float64
+
+	// Seed seeds the random selection of peers.
+	Seed uint64
+}
+
+// dhtEntry holds the compact peers of a single swarm for ExportDHT.
+type dhtEntry struct {
+	ih    infohash
+	peers [][]byte
+}
+
+// ExportDHT writes the infohashes of all swarms with a random sample of
+// their peers to w, for DHT indexers and bootstrappers.
+// Swarms without peers are skipped.
+//
+// With FormatBencode, every swarm is written as a bencoded dictionary with
+// the raw infohash as "info_hash" and the list of compact peers as "values",
+// like the values of a get_peers response of BEP 5: 6 bytes for IPv4 peers
+// and 18 bytes for IPv6 peers, as in BEP 32.
+// With FormatJSON, every swarm is written as a JSON object on its own line,
+// with the hex-encoded infohash as "info_hash" and the peers as "ip:port"
+// strings as "values".
+//
+// Shards are read one at a time and only locked while their peers are
+// sampled, the swarms are written after the shard is unlocked, at the
+// configured rate.
+// Returns the number of swarms written, or ErrAnonymized if peer addresses
+// are anonymized.
+func (s *PeerStore) ExportDHT(w io.Writer, opts DHTExport) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if opts.Format != FormatBencode && opts.Format != FormatJSON {
+		return 0, ErrUnknownFormat
+	}
+	if s.anon != nil {
+		return 0, ErrAnonymized
+	}
+	maxPeers := opts.MaxPeers
+	if maxPeers <= 0 {
+		maxPeers = defaultDHTPeers
+	}
+	var interval time.Duration
+	if opts.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.Rate)
+	}
+
+	e := swarmExporter{
+		sampling: ExportSampling{MaxPeers: maxPeers},
+		s0:       opts.Seed,
+		s1:       opts.Seed ^ 0x9e3779b97f4a7c15,
+	}
+	bw := bufio.NewWriter(w)
+	written := 0
+	next := s.now()
+	var entries []dhtEntry
+	for i := 0; i < len(s.shards.shards); i++ {
+		entries = s.shardDHTEntries(i, &e, opts.PinnedOnly, entries[:0])
+		for _, entry := range entries {
+			if interval > 0 {
+				if d := next.Sub(s.now()); d > 0 {
+					err := bw.Flush()
+					if err != nil {
+						return written, err
+					}
+					<-s.after(d)
+				}
+				next = next.Add(interval)
+			}
+
+			if opts.Format == FormatBencode {
+				writeBencodeDHTEntry(bw, entry)
+			} else {
+				writeJSONDHTEntry(bw, entry)
+			}
+			written++
+		}
+	}
+
+	return written, bw.Flush()
+}
+
+// shardDHTEntries appends the sampled compact peers of every swarm of the
+// shard with the given index to entries.
+func (s *PeerStore) shardDHTEntries(i int, e *swarmExporter, pinnedOnly bool, entries []dhtEntry) []dhtEntry {
+	var raw []byte
+	shard := s.shards.rLockShard(i)
+	defer s.shards.rUnlockShard(i)
+
+	for ih, sw := range shard.swarms {
+		if pinnedOnly && !sw.pinned {
+			continue
+		}
+
+		entry := dhtEntry{ih: ih}
+		for _, pl := range [2]*peerList{sw.peers4, sw.peers6} {
+			if pl == nil {
+				continue
+			}
+			k := e.sampling.sampleSize(pl.numPeers)
+			raw, e.scratch, e.s0, e.s1 = pl.appendSampledPeers(raw[:0], e.scratch, k, e.s0, e.s1)
+			for j := 0; j+len(peer{}) <= len(raw); j += len(peer{}) {
+				var p peer
+				copy(p[:], raw[j:])
+				entry.peers = append(entry.peers, compactPeer(&p, pl == sw.peers4))
+			}
+		}
+		if len(entry.peers) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// compactPeer returns the compact representation of a peer: its IPv4 or
+// IPv6 address followed by its port in network byte order.
+func compactPeer(p *peer, v4 bool) []byte {
+	ip := p[:ipLen]
+	if v4 {
+		ip = ip[ipLen-net.IPv4len:]
+	}
+	compact := make([]byte, 0, len(ip)+portLen)
+	compact = append(compact, ip...)
+	return append(compact, p[ipLen:ipLen+portLen]...)
+}
+
+func writeBencodeDHTEntry(bw *bufio.Writer, e dhtEntry) {
+	bw.WriteString("d9:info_hash")
+	bw.WriteString(strconv.Itoa(len(e.ih)))
+	bw.WriteByte(':')
+	bw.Write(e.ih[:])
+	bw.WriteString("6:valuesl")
+	for _, p := range e.peers {
+		bw.WriteString(strconv.Itoa(len(p)))
+		bw.WriteByte(':')
+		bw.Write(p)
+	}
+	bw.WriteString("ee")
+}
+
+func writeJSONDHTEntry(bw *bufio.Writer, e dhtEntry) {
+	bw.WriteString(`{"info_hash":"`)
+	bw.WriteString(hex.EncodeToString(e.ih[:]))
+	bw.WriteString(`","values":[`)
+	for i, p := range e.peers {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		ip := net.IP(p[:len(p)-portLen])
+		port := int(p[len(p)-portLen])<<8 | int(p[len(p)-1])
+		bw.WriteByte('"')
+		bw.WriteString(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		bw.WriteByte('"')
+	}
+	bw.WriteString("]}\n")
+}
@@ -0,0 +1,57 @@
+package optmem
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportDHT(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	for i := 0; i < 100; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.PutSeeder(ih2, p1))
+	require.Nil(t, ps.PinSwarm(ih2))
+
+	var buf bytes.Buffer
+	n, err := ps.ExportDHT(&buf, DHTExport{Format: FormatBencode, MaxPeers: 10, PinnedOnly: true})
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "d9:info_hash20:"+string(ih2[:])+"6:valuesl6:\x01\x02\x03\x04\x04\xd2ee", buf.String())
+
+	buf.Reset()
+	n, err = ps.ExportDHT(&buf, DHTExport{Format: FormatJSON, MaxPeers: 10})
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		if strings.Contains(line, hex.EncodeToString(ih[:])) {
+			// 10 sampled IPv4 peers and the IPv6 peer.
+			require.Equal(t, 10, strings.Count(line, ":1234\""))
+			require.Contains(t, line, `"[2001:db8::1]:3456"`)
+		}
+	}
+
+	// Two swarms at 20 per second take at least 50ms.
+	start := time.Now()
+	n, err = ps.ExportDHT(&bytes.Buffer{}, DHTExport{Rate: 20})
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	_, err = ps.ExportDHT(&buf, DHTExport{Format: Format(-1)})
+	require.Equal(t, ErrUnknownFormat, err)
+
+	require.Nil(t, <-ps.Stop())
+}
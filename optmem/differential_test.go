@@ -0,0 +1,380 @@
+package optmem
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// The differential test applies random sequences of operations to a
+// PeerStore and to refStore, a trivial map-based implementation of the same
+// semantics, and compares everything observable after every operation.
+
+// refPeer is a peer of a refStore.
+type refPeer struct {
+	seeder bool
+	time   int64 // unix seconds of the last put
+}
+
+// refFamily holds the peers of an address family of a swarm of a refStore.
+type refFamily struct {
+	peers     map[string]refPeer // by endpoint
+	downloads int
+}
+
+// refStore is the reference implementation the PeerStore is compared to.
+// Swarms exist as long as one of their address families has peers, address
+// families as long as they have peers.
+type refStore struct {
+	swarms map[bittorrent.InfoHash]map[bittorrent.AddressFamily]*refFamily
+}
+
+func newRefStore() *refStore {
+	return &refStore{swarms: make(map[bittorrent.InfoHash]map[bittorrent.AddressFamily]*refFamily)}
+}
+
+func refEndpoint(p bittorrent.Peer) string {
+	return fmt.Sprintf("%s:%d", p.IP.IP, p.Port)
+}
+
+func (r *refStore) put(ih bittorrent.InfoHash, p bittorrent.Peer, seeder, completed bool, now int64) {
+	sw, ok := r.swarms[ih]
+	if !ok {
+		sw = make(map[bittorrent.AddressFamily]*refFamily)
+		r.swarms[ih] = sw
+	}
+	f, ok := sw[p.IP.AddressFamily]
+	if !ok {
+		f = &refFamily{peers: make(map[string]refPeer)}
+		sw[p.IP.AddressFamily] = f
+	}
+	f.peers[refEndpoint(p)] = refPeer{seeder: seeder, time: now}
+	if completed {
+		f.downloads++
+	}
+}
+
+func (r *refStore) delete(ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	sw, ok := r.swarms[ih]
+	if !ok {
+		return ErrSwarmNotFound
+	}
+	f, ok := sw[p.IP.AddressFamily]
+	if !ok {
+		return ErrNoPeersForAddressFamily
+	}
+	stored, ok := f.peers[refEndpoint(p)]
+	if !ok || stored.seeder != seeder {
+		return ErrPeerNotFound
+	}
+	delete(f.peers, refEndpoint(p))
+	r.dropEmpty(ih)
+	return nil
+}
+
+// announceErr returns the error of an announce for an address family of a
+// swarm.
+func (r *refStore) announceErr(ih bittorrent.InfoHash, af bittorrent.AddressFamily) error {
+	sw, ok := r.swarms[ih]
+	if !ok {
+		return ErrSwarmNotFound
+	}
+	if _, ok := sw[af]; !ok {
+		return ErrNoPeersForAddressFamily
+	}
+	return nil
+}
+
+// collectGarbage removes all peers that were put at or before cutoff.
+func (r *refStore) collectGarbage(cutoff int64) {
+	for ih, sw := range r.swarms {
+		for _, f := range sw {
+			for endpoint, p := range f.peers {
+				if p.time <= cutoff {
+					delete(f.peers, endpoint)
+				}
+			}
+		}
+		r.dropEmpty(ih)
+	}
+}
+
+// dropEmpty removes the empty address families of a swarm and the swarm
+// itself if it is empty.
+func (r *refStore) dropEmpty(ih bittorrent.InfoHash) {
+	sw := r.swarms[ih]
+	for af, f := range sw {
+		if len(f.peers) == 0 {
+			delete(sw, af)
+		}
+	}
+	if len(sw) == 0 {
+		delete(r.swarms, ih)
+	}
+}
+
+// scrape returns the scrape of a swarm for an address family.
+func (r *refStore) scrape(ih bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	scrape := bittorrent.Scrape{InfoHash: ih}
+	f, ok := r.swarms[ih][af]
+	if !ok {
+		return scrape
+	}
+	for _, p := range f.peers {
+		if p.seeder {
+			scrape.Complete++
+		} else {
+			scrape.Incomplete++
+		}
+	}
+	scrape.Snatches = uint32(f.downloads)
+	return scrape
+}
+
+// endpoints returns the sorted endpoints of the seeders or leechers of a
+// swarm for an address family.
+func (r *refStore) endpoints(ih bittorrent.InfoHash, af bittorrent.AddressFamily, seeders bool) []string {
+	var endpoints []string
+	for endpoint, p := range r.swarms[ih][af].peersOrNil() {
+		if p.seeder == seeders {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+func (f *refFamily) peersOrNil() map[string]refPeer {
+	if f == nil {
+		return nil
+	}
+	return f.peers
+}
+
+func (r *refStore) totals() (swarms int, seeders, leechers uint64) {
+	for _, sw := range r.swarms {
+		for _, f := range sw {
+			for _, p := range f.peers {
+				if p.seeder {
+					seeders++
+				} else {
+					leechers++
+				}
+			}
+		}
+	}
+	return len(r.swarms), seeders, leechers
+}
+
+func sortedEndpoints(peers []bittorrent.Peer) []string {
+	var endpoints []string
+	for _, p := range peers {
+		endpoints = append(endpoints, refEndpoint(p))
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+// diffClock is a Clock for the differential test, moved in whole seconds.
+type diffClock struct {
+	unix int64
+}
+
+func (c *diffClock) Now() time.Time                         { return time.Unix(atomic.LoadInt64(&c.unix), 0) }
+func (c *diffClock) After(d time.Duration) <-chan time.Time { return nil }
+
+// diffPeer returns one of a fixed pool of peers.
+// Half of the pool is IPv4, half IPv6, and only a few ports are used per IP,
+// so that operations often hit existing peers.
+func diffPeer(r *rand.Rand, poolSize int) bittorrent.Peer {
+	i := r.Intn(poolSize)
+	port := uint16(6881 + i%3)
+	i /= 3
+	if i%2 == 0 {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, byte(i>>8), byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	ip := net.ParseIP("2001:db8::")
+	ip[14], ip[15] = byte(i>>8), byte(i)
+	return bittorrent.Peer{
+		IP:   bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv6},
+		Port: port,
+	}
+}
+
+func TestDifferential(t *testing.T) {
+	seeds := 8
+	steps := 1500
+	if testing.Short() {
+		seeds = 3
+	}
+	for seed := 0; seed < seeds; seed++ {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			runDifferential(t, int64(seed), steps)
+		})
+	}
+}
+
+func runDifferential(t *testing.T, seed int64, steps int) {
+	r := rand.New(rand.NewSource(seed))
+	clock := &diffClock{unix: 1577836800}
+	cfg := testConfig
+	cfg.ShardCountBits = 2
+	cfg.Clock = clock
+	cfg.DisablePrometheus = true
+	cfg.DistinctNotFoundErrors = true
+	cfg.PeerLifetime = 5 * time.Minute
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	ref := newRefStore()
+
+	// A few swarms with few peers and one hot swarm with enough peers to
+	// need several buckets, so that puts, deletes and garbage collection
+	// rebalance it.
+	infoHashes := make([]bittorrent.InfoHash, 6)
+	for i := range infoHashes {
+		infoHashes[i] = randomInfoHash(r)
+	}
+	hot := infoHashes[0]
+	maxBuckets := 0
+
+	for step := 0; step < steps; step++ {
+		ih := infoHashes[r.Intn(len(infoHashes))]
+		poolSize := 24
+		if ih == hot {
+			poolSize = 6000
+		}
+		p := diffPeer(r, poolSize)
+		now := clock.Now().Unix()
+
+		var op string
+		switch x := r.Intn(100); {
+		case x < 28:
+			op = "PutLeecher"
+			require.Nil(t, ps.PutLeecher(ih, p))
+			ref.put(ih, p, false, false, now)
+		case x < 48:
+			op = "PutSeeder"
+			require.Nil(t, ps.PutSeeder(ih, p))
+			ref.put(ih, p, true, false, now)
+		case x < 58:
+			op = "GraduateLeecher"
+			require.Nil(t, ps.GraduateLeecher(ih, p))
+			ref.put(ih, p, true, true, now)
+		case x < 72:
+			op = "DeleteLeecher"
+			require.Equal(t, ref.delete(ih, p, false), ps.DeleteLeecher(ih, p))
+		case x < 82:
+			op = "DeleteSeeder"
+			require.Equal(t, ref.delete(ih, p, true), ps.DeleteSeeder(ih, p))
+		case x < 92:
+			op = "AnnouncePeers"
+			numWant := r.Intn(60)
+			seeder := r.Intn(2) == 0
+			peers, err := ps.AnnouncePeers(ih, seeder, numWant, p)
+			require.Equal(t, ref.announceErr(ih, p.IP.AddressFamily), err)
+			requireAnnouncePeers(t, ref, ih, p.IP.AddressFamily, seeder, numWant, peers)
+		case x < 95:
+			// Grow the hot swarm past a bucket, puts and announces alone
+			// rarely get there before garbage collection shrinks it.
+			op = "Burst"
+			ih = hot
+			for i := 0; i < 300; i++ {
+				p := diffPeer(r, 6000)
+				require.Nil(t, ps.PutLeecher(ih, p))
+				ref.put(ih, p, false, false, now)
+			}
+			if buckets := numBuckets(ps, hot); buckets > maxBuckets {
+				maxBuckets = buckets
+			}
+		default:
+			op = "CollectGarbage"
+			cutoff := clock.Now().Add(-cfg.PeerLifetime)
+			_, err := ps.CollectGarbage(cutoff)
+			require.Nil(t, err)
+			ref.collectGarbage(cutoff.Unix())
+		}
+
+		requireSameState(t, ps, ref, ih, fmt.Sprintf("step %d: %s %s %s", step, op, bittorrent.InfoHash(ih).String(), refEndpoint(p)))
+		atomic.AddInt64(&clock.unix, int64(r.Intn(10)))
+	}
+
+	for _, ih := range infoHashes {
+		requireSameState(t, ps, ref, ih, "final state")
+	}
+	require.True(t, ps.CheckConsistency().OK())
+	require.True(t, maxBuckets > 1, "the hot swarm never needed more than one bucket")
+}
+
+// numBuckets returns the number of buckets of the IPv4 peers of a swarm.
+func numBuckets(ps *PeerStore, infoHash bittorrent.InfoHash) int {
+	ih := infohash(infoHash)
+	shard := ps.shards.rLockShardByHash(ih)
+	defer ps.shards.rUnlockShardByHash(ih)
+	if pl := shard.swarms[ih].peers4; pl != nil {
+		return len(pl.peerBuckets)
+	}
+	return 0
+}
+
+// requireAnnouncePeers checks the peers returned to an announce.
+// Peers are sampled with replacement, so the same peer may be returned more
+// than once, but only peers of the swarm with the right role are returned,
+// as many as requested if the swarm has enough of them.
+func requireAnnouncePeers(t *testing.T, ref *refStore, ih bittorrent.InfoHash, af bittorrent.AddressFamily, seeder bool, numWant int, peers []bittorrent.Peer) {
+	stored := ref.swarms[ih][af].peersOrNil()
+	available := 0
+	for _, p := range stored {
+		if !seeder || !p.seeder {
+			available++
+		}
+	}
+	if numWant > available {
+		numWant = available
+	}
+	require.Len(t, peers, numWant)
+
+	for _, p := range peers {
+		storedPeer, ok := stored[refEndpoint(p)]
+		require.True(t, ok, "announce returned unknown peer %s", refEndpoint(p))
+		require.False(t, seeder && storedPeer.seeder, "seeder announce returned seeder %s", refEndpoint(p))
+	}
+}
+
+// requireSameState compares the totals of a PeerStore and a refStore and
+// the scrapes and peers of a swarm.
+func requireSameState(t *testing.T, ps *PeerStore, ref *refStore, ih bittorrent.InfoHash, msg string) {
+	swarms, seeders, leechers := ref.totals()
+	require.Equal(t, uint64(swarms), ps.NumSwarms(), msg)
+	gotSeeders, gotLeechers := ps.NumTotalPeers()
+	require.Equal(t, seeders, gotSeeders, msg)
+	require.Equal(t, leechers, gotLeechers, msg)
+
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		require.Equal(t, ref.scrape(ih, af), ps.ScrapeSwarm(ih, af), msg)
+	}
+
+	seeders4, seeders6, err := ps.GetSeeders(ih)
+	leechers4, leechers6, err2 := ps.GetLeechers(ih)
+	if _, ok := ref.swarms[ih]; !ok {
+		require.Equal(t, ErrSwarmNotFound, err, msg)
+		require.Equal(t, ErrSwarmNotFound, err2, msg)
+		return
+	}
+	require.Nil(t, err, msg)
+	require.Nil(t, err2, msg)
+	require.Equal(t, ref.endpoints(ih, bittorrent.IPv4, true), sortedEndpoints(seeders4), msg)
+	require.Equal(t, ref.endpoints(ih, bittorrent.IPv6, true), sortedEndpoints(seeders6), msg)
+	require.Equal(t, ref.endpoints(ih, bittorrent.IPv4, false), sortedEndpoints(leechers4), msg)
+	require.Equal(t, ref.endpoints(ih, bittorrent.IPv6, false), sortedEndpoints(leechers6), msg)
+}
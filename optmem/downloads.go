@@ -0,0 +1,182 @@
+package optmem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// downloadCountersMagic starts every download counters file.
+const downloadCountersMagic = "optmem-downloads-v1\n"
+
+// downloadRecordSize is the size of a record of a download counters file:
+// the infohash followed by the IPv4 and IPv6 downloads as big-endian
+// uint64s.
+const downloadRecordSize = len(infohash{}) + 16
+
+// countDownload counts a download of a swarm in the durable download
+// counters.
+// It is a no-op if durable download counters are disabled.
+// The shard must be write-locked by the caller.
+func (s *shard) countDownload(ih infohash, af bittorrent.AddressFamily, n uint64) {
+	if s.downloads == nil || n == 0 {
+		return
+	}
+	d := s.downloads[ih]
+	d[afIndex(af)] += n
+	s.downloads[ih] = d
+}
+
+// snatches returns the number of downloads of an address family of a swarm.
+// If durable download counters are enabled, they are used, which also count
+// downloads of swarms that were removed.
+// The shard must be locked by the caller.
+func (s *shard) snatches(ih infohash, pl *peerList, af bittorrent.AddressFamily) uint64 {
+	if s.downloads != nil {
+		return s.downloads[ih][afIndex(af)]
+	}
+	if pl == nil {
+		return 0
+	}
+	return pl.numDownloads
+}
+
+// afIndex returns 0 for IPv4 and 1 for IPv6.
+func afIndex(af bittorrent.AddressFamily) int {
+	if af == bittorrent.IPv4 {
+		return 0
+	}
+	return 1
+}
+
+// downloadCountersPath returns the path the durable download counters of
+// the store are written to, or an empty string if they are disabled.
+// Namespaces use the path of the default namespace, suffixed by their name.
+func (s *PeerStore) downloadCountersPath() string {
+	if s.cfg.DownloadCountersPath == "" || s.name == "" {
+		return s.cfg.DownloadCountersPath
+	}
+	return s.cfg.DownloadCountersPath + "." + url.PathEscape(s.name)
+}
+
+// runDownloadCounters writes the download counters at the configured
+// interval until the store is closed.
+func (s *PeerStore) runDownloadCounters() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(s.cfg.DownloadCountersInterval):
+			err := s.writeDownloadCounters()
+			if err != nil {
+				log.Error("optmem: unable to write download counters", log.Fields{"namespace": s.name, "error": err})
+			}
+		}
+	}
+}
+
+// writeDownloadCounters writes the download counters to a temporary file
+// first, which then replaces the previous one.
+// Shards are copied one at a time.
+func (s *PeerStore) writeDownloadCounters() error {
+	path := s.downloadCountersPath()
+	if path == "" {
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	bw.WriteString(downloadCountersMagic)
+	var record [downloadRecordSize]byte
+	var records [][downloadRecordSize]byte
+	for i := 0; i < len(s.shards.shards); i++ {
+		records = records[:0]
+		shard := s.shards.rLockShard(i)
+		for ih, d := range shard.downloads {
+			copy(record[:], ih[:])
+			binary.BigEndian.PutUint64(record[len(ih):], d[0])
+			binary.BigEndian.PutUint64(record[len(ih)+8:], d[1])
+			records = append(records, record)
+		}
+		s.shards.rUnlockShard(i)
+		for j := range records {
+			bw.Write(records[j][:])
+		}
+	}
+
+	err = bw.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadDownloadCounters reads the download counters written by
+// writeDownloadCounters and adds them to the counters of the store.
+// A missing file is not an error.
+func (s *PeerStore) loadDownloadCounters() error {
+	path := s.downloadCountersPath()
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(downloadCountersMagic))
+	_, err = io.ReadFull(br, magic)
+	if err != nil || string(magic) != downloadCountersMagic {
+		return errors.New("invalid download counters file")
+	}
+
+	n := 0
+	var record [downloadRecordSize]byte
+	for {
+		_, err = io.ReadFull(br, record[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "truncated download counters file")
+		}
+
+		var ih infohash
+		copy(ih[:], record[:len(ih)])
+		shard := s.shards.lockShardByHash(ih)
+		shard.countDownload(ih, bittorrent.IPv4, binary.BigEndian.Uint64(record[len(ih):]))
+		shard.countDownload(ih, bittorrent.IPv6, binary.BigEndian.Uint64(record[len(ih)+8:]))
+		if sw, ok := shard.swarms[ih]; ok {
+			shard.setSwarm(ih, sw)
+		}
+		s.shards.unlockShardByHash(ih, 0)
+		n++
+	}
+	log.Info("optmem: loaded download counters", log.Fields{"namespace": s.name, "swarms": n})
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package optmem
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurableDownloadCounters(t *testing.T) {
+	for _, lockFree := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "downloads")
+		cfg := testConfig
+		cfg.DownloadCountersPath = path
+		cfg.LockFreeScrapes = lockFree
+		cfg.MinSwarmLifetime = time.Nanosecond
+		ps, err := New(cfg)
+		require.Nil(t, err)
+
+		require.Nil(t, ps.PutLeecher(ih, p1))
+		require.Nil(t, ps.GraduateLeecher(ih, p1))
+		require.Nil(t, ps.GraduateLeecher(ih, p3))
+		require.Nil(t, ps.WithNamespace("private").GraduateLeecher(ih, p1))
+
+		// The counters survive the removal of the swarm.
+		require.Nil(t, ps.DeleteSeeder(ih, p1))
+		require.Nil(t, ps.DeleteSeeder(ih, p3))
+		require.Equal(t, uint64(0), ps.NumSwarms())
+		require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+		require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv6).Snatches)
+
+		// And restarts.
+		require.Nil(t, <-ps.Stop())
+		_, err = os.Stat(path + ".private")
+		require.Nil(t, err)
+		ps, err = New(cfg)
+		require.Nil(t, err)
+		require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+		require.Nil(t, ps.GraduateLeecher(ih, p1))
+		require.Equal(t, uint32(2), ps.ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+		require.Equal(t, uint32(3), ps.ScrapeSwarmBoth(ih).Combined.Snatches)
+		require.Equal(t, uint32(1), ps.WithNamespace("private").ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+
+		// Deleting the swarm removes them.
+		require.True(t, ps.DeleteSwarm(ih))
+		require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+		require.Nil(t, <-ps.Stop())
+	}
+}
+
+func TestLoadDownloadCountersInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "downloads")
+	require.Nil(t, os.WriteFile(path, []byte("garbage"), 0600))
+	cfg := testConfig
+	cfg.DownloadCountersPath = path
+	_, err := New(cfg)
+	require.NotNil(t, err)
+}
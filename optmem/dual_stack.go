@@ -0,0 +1,145 @@
+package optmem
+
+import (
+	"math"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// AnnouncePeersDualStack works like AnnouncePeers, but returns peers of both
+// address families, for example for clients that announce over one family,
+// but are reachable over both.
+// numWant is split between the families as configured by
+// DualStackIPv4Share. If a family has fewer peers than its share, the other
+// family fills in for it.
+//
+// The swarm is locked once for both families.
+// Rate limits apply to the address family of the announcing peer.
+func (s *PeerStore) AnnouncePeersDualStack(infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer) (peers4, peers6 []bittorrent.Peer, err error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	infoHash = s.resolveAlias(infoHash)
+	s.requests.inc()
+
+	af := announcingPeer.IP.AddressFamily
+	if af != bittorrent.IPv4 && af != bittorrent.IPv6 {
+		return nil, nil, ErrInvalidIP
+	}
+	promAnnounces.inc(af)
+	defer promAnnounceLatency.since(af, time.Now())
+	if s.overloaded(af) {
+		return nil, nil, ErrOverloaded
+	}
+	span := s.startSpan("optmem.AnnouncePeersDualStack")
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attrNumWant.Int(numWant))
+	}
+
+	ih := infohash(infoHash)
+	s0, s1 := s.selectionEntropy(infoHash, announcingPeer)
+	s.faultIn(ih)
+
+	if !s.swarmMayExist(s.shards.shards[s.shards.shardIndex(ih)], ih, af) {
+		recordNumWant(numWant, 0)
+		return nil, nil, s.notFound(ErrSwarmNotFound)
+	}
+
+	p := &peer{}
+	p.setPort(announcingPeer.Port)
+	p.setIP(announcingPeer.IP.To16())
+
+	start := waitStart(span)
+	shard := s.shards.rLockShardByHash(ih)
+	lockWait(span, s.shards.shardIndex(ih), start)
+
+	sw, ok := shard.swarms[ih]
+	if !ok {
+		s.shards.rUnlockShardByHash(ih)
+		recordNumWant(numWant, 0)
+		return nil, nil, s.notFound(ErrSwarmNotFound)
+	}
+	if !s.allowAnnounce(shard, ih, af) {
+		s.shards.rUnlockShardByHash(ih)
+		recordNumWant(numWant, 0)
+		return nil, nil, ErrThrottled
+	}
+	if sw.peers4 == nil && sw.peers6 == nil && s.cfg.DistinctNotFoundErrors {
+		s.shards.rUnlockShardByHash(ih)
+		recordNumWant(numWant, 0)
+		return nil, nil, ErrNoPeersForAddressFamily
+	}
+
+	cutoff := s.peerCutoff(sw)
+	want4, want6 := splitDualStack(s.cfg.clampNumWant(numWant), sw.peers4.candidates(seeder, cutoff), sw.peers6.candidates(seeder, cutoff), s.cfg.DualStackIPv4Share)
+	buf4 := peerBufferPool.Get().(*[]peer)
+	buf6 := peerBufferPool.Get().(*[]peer)
+	*buf4, *buf6 = (*buf4)[:0], (*buf6)[:0]
+	if sw.peers4 != nil && want4 > 0 {
+		*buf4 = s.selectPeers(shard, ih, sw.peers4, *buf4, want4, seeder, p, bittorrent.IPv4, s0, s1)
+	}
+	if sw.peers6 != nil && want6 > 0 {
+		*buf6 = s.selectPeers(shard, ih, sw.peers6, *buf6, want6, seeder, p, bittorrent.IPv6, s0, s1)
+	}
+	due := s.sweepDue(sw)
+	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
+
+	recordNumWant(numWant, len(*buf4)+len(*buf6))
+	if len(*buf4) > 0 {
+		peers4 = appendBittorrentPeers(nil, *buf4, bittorrent.IPv4)
+	}
+	if len(*buf6) > 0 {
+		peers6 = appendBittorrentPeers(nil, *buf6, bittorrent.IPv6)
+	}
+	putPeerBuffer(buf4)
+	putPeerBuffer(buf6)
+
+	return peers4, peers6, nil
+}
+
+// candidates returns the number of peers of the list that can be returned
+// to an announce: all peers for leechers, only leechers for seeders.
+// Peers selected by cutoff are not counted.
+// The list may be nil.
+func (pl *peerList) candidates(seeder bool, cutoff peerCutoff) int {
+	if pl == nil {
+		return 0
+	}
+	expired, expiredSeeders := cutoff.count(pl)
+	if seeder {
+		return pl.numPeers - pl.numSeeders - (expired - expiredSeeders)
+	}
+	return pl.numPeers - expired
+}
+
+// splitDualStack splits numWant between IPv4 and IPv6 peers, given the
+// number of candidates of each family.
+// ipv4Share is the share of IPv4 peers, zero splits proportionally to the
+// number of candidates.
+func splitDualStack(numWant, n4, n6 int, ipv4Share float64) (want4, want6 int) {
+	if numWant > n4+n6 {
+		numWant = n4 + n6
+	}
+	if numWant <= 0 {
+		return 0, 0
+	}
+	if ipv4Share == 0 {
+		ipv4Share = float64(n4) / float64(n4+n6)
+	}
+	want4 = int(math.Round(float64(numWant) * ipv4Share))
+	if want4 > n4 {
+		want4 = n4
+	}
+	want6 = numWant - want4
+	if want6 > n6 {
+		want6 = n6
+		want4 = numWant - want6
+	}
+	return
+}
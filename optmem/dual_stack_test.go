@@ -0,0 +1,64 @@
+package optmem
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitDualStack(t *testing.T) {
+	var table = []struct {
+		numWant, n4, n6 int
+		share           float64
+		want4, want6    int
+	}{
+		{50, 90, 10, 0, 45, 5},
+		{50, 10, 90, 0, 5, 45},
+		{50, 90, 10, 0.5, 40, 10},
+		{50, 100, 100, 0.5, 25, 25},
+		{50, 100, 100, 0.8, 40, 10},
+		{50, 20, 10, 0, 20, 10},
+		{50, 0, 100, 0.5, 0, 50},
+		{50, 0, 0, 0, 0, 0},
+		{0, 10, 10, 0, 0, 0},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%d of %d/%d at %v", tt.numWant, tt.n4, tt.n6, tt.share), func(t *testing.T) {
+			want4, want6 := splitDualStack(tt.numWant, tt.n4, tt.n6, tt.share)
+			require.Equal(t, tt.want4, want4)
+			require.Equal(t, tt.want6, want6)
+		})
+	}
+}
+
+func TestAnnouncePeersDualStack(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 30; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	for i := 0; i < 10; i++ {
+		p := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP(fmt.Sprintf("2001:db8::%x", i+2)), AddressFamily: bittorrent.IPv6}, Port: 1234}
+		require.Nil(t, ps.PutSeeder(ih, p))
+	}
+
+	peers4, peers6, err := ps.AnnouncePeersDualStack(ih, false, 20, p3)
+	require.Nil(t, err)
+	require.Len(t, peers4, 15)
+	require.Len(t, peers6, 5)
+	for _, p := range peers4 {
+		require.Equal(t, bittorrent.IPv4, p.IP.AddressFamily)
+	}
+	for _, p := range peers6 {
+		require.Equal(t, bittorrent.IPv6, p.IP.AddressFamily)
+	}
+
+	_, _, err = ps.AnnouncePeersDualStack(bittorrent.InfoHash{}, false, 20, p1)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,291 @@
+package optmem
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// ErasureReport documents the erasure of the data of an IP or a peer.
+type ErasureReport struct {
+	// IP is the erased IP, in its 16 byte form.
+	IP net.IP
+
+	// Port is the erased port, zero if all ports of the IP were erased.
+	Port uint16
+
+	// Time is the time of the erasure.
+	Time time.Time
+
+	// PeersRemoved is the number of peers removed, over all swarms and
+	// namespaces.
+	PeersRemoved int
+
+	// SwarmsAffected is the number of swarms peers were removed from.
+	SwarmsAffected int
+
+	// SnapshotRewritten is true if the persisted snapshot was replaced by
+	// one without the erased peers, which also drops the op log.
+	// It is false if persistence is disabled.
+	SnapshotRewritten bool
+
+	// ColdStorageSkipped is true if a ColdStorage is set.
+	// Swarms spilled to it can not be enumerated, so they are not erased.
+	ColdStorageSkipped bool
+
+	// Signature is the ed25519 signature of the report by the key returned
+	// by ErasurePublicKey, see VerifyErasureReport.
+	Signature []byte
+}
+
+// erasureReportMagic prefixes the signed encoding of an ErasureReport.
+const erasureReportMagic = "optmem-erasure-report-v1"
+
+// signedBytes returns the encoding of the report that is signed.
+func (r ErasureReport) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(erasureReportMagic)
+	buf.Write(r.IP.To16())
+	var b [8]byte
+	binary.BigEndian.PutUint16(b[:2], r.Port)
+	buf.Write(b[:2])
+	binary.BigEndian.PutUint64(b[:], uint64(r.Time.UnixNano()))
+	buf.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], uint64(r.PeersRemoved))
+	buf.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], uint64(r.SwarmsAffected))
+	buf.Write(b[:])
+	for _, flag := range []bool{r.SnapshotRewritten, r.ColdStorageSkipped} {
+		if flag {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+// VerifyErasureReport returns whether the report was signed by the private
+// key of pub.
+func VerifyErasureReport(pub ed25519.PublicKey, r ErasureReport) bool {
+	return len(pub) == ed25519.PublicKeySize && ed25519.Verify(pub, r.signedBytes(), r.Signature)
+}
+
+// erasureKey returns the key erasure reports are signed with, derived from
+// the configured seed or random if none is configured.
+// The config must be validated.
+func (cfg Config) erasureKey() ed25519.PrivateKey {
+	if cfg.ErasureSigningKey != "" {
+		seed, _ := hex.DecodeString(cfg.ErasureSigningKey)
+		return ed25519.NewKeyFromSeed(seed)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(errors.Wrap(err, "unable to generate erasure signing key"))
+	}
+	return key
+}
+
+// ErasurePublicKey returns the public key of the key erasure reports are
+// signed with.
+func (s *PeerStore) ErasurePublicKey() ed25519.PublicKey {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.root.erasureKey.Public().(ed25519.PublicKey)
+}
+
+// EraseIP removes all peers with the given IP, on any port, from all swarms
+// of all namespaces, and returns a signed report.
+// See ErasePeer.
+func (s *PeerStore) EraseIP(ip net.IP) (ErasureReport, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.root.erase(ip, 0)
+}
+
+// ErasePeer removes the peer with the given IP and port from all swarms of
+// all namespaces, and returns a signed report.
+//
+// Along with the peers, their tombstones and statistics are removed and the
+// memory they used is overwritten.
+// Queued puts are applied first, so they do not restore erased peers.
+// If persistence is enabled, the snapshot is rewritten without the erased
+// peers, which also drops the op log.
+// Swarms in a ColdStorage are not erased, which is noted in the report.
+// Announces of the peer after the erasure store it again.
+//
+// Erasure locks every shard once and runs in linear time in regards to the
+// number of peers in the store.
+// It works in read-only mode.
+// If rewriting the snapshot fails, the signed report is returned along with
+// the error.
+func (s *PeerStore) ErasePeer(ip net.IP, port uint16) (ErasureReport, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if port == 0 {
+		return ErasureReport{}, errors.New("port must not be zero, use EraseIP to erase all ports")
+	}
+	return s.root.erase(ip, port)
+}
+
+// erase implements EraseIP and ErasePeer on the default namespace.
+// A port of zero matches all ports.
+func (s *PeerStore) erase(ip net.IP, port uint16) (ErasureReport, error) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ErasureReport{}, ErrInvalidIP
+	}
+	report := ErasureReport{IP: ip16, Port: port, Time: s.now()}
+	match := func(p *peer) bool {
+		return bytes.Equal(p[:ipLen], ip16) && (port == 0 || p.port() == port)
+	}
+
+	s.nsMu.Lock()
+	stores := []*PeerStore{s}
+	for _, ns := range s.namespaces {
+		stores = append(stores, ns)
+	}
+	s.nsMu.Unlock()
+
+	for _, store := range stores {
+		select {
+		case <-store.closed:
+			// A namespace that was stopped in the meantime.
+			continue
+		default:
+		}
+		store.flushAll()
+		peers, swarms := store.erasePeers(match)
+		report.PeersRemoved += peers
+		report.SwarmsAffected += swarms
+		if store.coldStorage() != nil {
+			report.ColdStorageSkipped = true
+		}
+	}
+
+	var err error
+	if s.persistence != nil {
+		err = s.writeSnapshot()
+		report.SnapshotRewritten = err == nil
+	}
+
+	report.Signature = ed25519.Sign(s.erasureKey, report.signedBytes())
+	log.Info("optmem: erased peers", log.Fields{"peersRemoved": report.PeersRemoved, "swarmsAffected": report.SwarmsAffected, "snapshotRewritten": report.SnapshotRewritten})
+
+	return report, errors.Wrap(err, "unable to rewrite snapshot")
+}
+
+// erasePeers removes the peers matching match from all swarms.
+// Returns the number of peers removed and the number of swarms they were
+// removed from.
+func (s *PeerStore) erasePeers(match func(p *peer) bool) (peers, swarms int) {
+	for i := 0; i < len(s.shards.shards); i++ {
+		deltaTorrents := 0
+		shard := s.shards.lockShard(i)
+		for ih, sw := range shard.swarms {
+			final := sw
+			var removed4, removed6 int
+			sw.peers4, removed4 = eraseFromList(shard, sw.peers4, bittorrent.IPv4, match, sw.retained())
+			sw.peers6, removed6 = eraseFromList(shard, sw.peers6, bittorrent.IPv6, match, sw.retained())
+			if removed4+removed6 == 0 {
+				continue
+			}
+			peers += removed4 + removed6
+			swarms++
+
+			if !sw.retained() && sw.peers4 == nil && sw.peers6 == nil {
+				s.hooks.swarmRemoved(shard, ih, final)
+				shard.deleteSwarm(ih)
+				deltaTorrents--
+				continue
+			}
+			sw.version = shard.nextVersion()
+			shard.setSwarm(ih, sw)
+		}
+		s.shards.unlockShard(i, deltaTorrents)
+	}
+	return
+}
+
+// eraseFromList works like purgeIPFromList, but uses erase.
+// A list that only contained tombstones of matching peers is kept, as the
+// removal of the peers was already accounted for.
+func eraseFromList(shard *shard, pl *peerList, af bittorrent.AddressFamily, match func(p *peer) bool, retained bool) (*peerList, int) {
+	if pl == nil {
+		return nil, 0
+	}
+
+	removed, removedSeeders := pl.erase(match)
+	if removed == 0 {
+		return pl, 0
+	}
+	shard.counts.sub(af, removed, removedSeeders)
+
+	if pl.numPeers == 0 && !retained {
+		return nil, removed
+	}
+	pl.rebalanceBuckets()
+	return pl, removed
+}
+
+// erase removes all peers matching match, including tombstones and their
+// statistics, and overwrites the entries they used with zeros.
+// Returns the number of live peers and seeders removed.
+func (pl *peerList) erase(match func(p *peer) bool) (removed, removedSeeders int) {
+	pl.own()
+	for j, b := range pl.peerBuckets {
+		kept := b[:0]
+		for i := range b {
+			p := &b[i]
+			if !match(p) {
+				kept = append(kept, *p)
+				continue
+			}
+			if p.isDead() {
+				pl.numDead--
+				continue
+			}
+			removed++
+			if p.isSeeder() {
+				removedSeeders++
+			}
+			if p.isWebRTC() {
+				pl.numWebRTC--
+			}
+			pl.deleteStats(p)
+		}
+		tail := b[len(kept):]
+		for i := range tail {
+			tail[i] = peer{}
+		}
+		pl.peerBuckets[j] = kept
+	}
+	pl.numPeers -= removed
+	pl.numSeeders -= removedSeeders
+	if removed > 0 {
+		// The hot set might hold copies of the removed peers.
+		pl.hot = nil
+	}
+	return
+}
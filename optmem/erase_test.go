@@ -0,0 +1,92 @@
+package optmem
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseIP(t *testing.T) {
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	cfg := testConfig
+	cfg.Persistence = PersistenceConfig{Name: "test-memory", LogOps: true}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	p1b := p1
+	p1b.Port = 1
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p1b))
+	require.Nil(t, ps.DeleteLeecher(ih, p1b)) // leaves a tombstone
+	require.Nil(t, ps.PutLeecher(ih2, p1))
+	require.Nil(t, ps.PutLeecher(ih2, p2))
+	require.Nil(t, ps.WithNamespace("other").PutSeeder(ih, p1))
+
+	report, err := ps.EraseIP(p1.IP.IP)
+	require.Nil(t, err)
+	require.Equal(t, 3, report.PeersRemoved)
+	require.Equal(t, 3, report.SwarmsAffected)
+	require.True(t, report.SnapshotRewritten)
+	require.False(t, report.ColdStorageSkipped)
+	require.True(t, VerifyErasureReport(ps.ErasurePublicKey(), report))
+
+	report.PeersRemoved++
+	require.False(t, VerifyErasureReport(ps.ErasurePublicKey(), report))
+
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	require.Equal(t, 1, ps.NumLeechers(ih2))
+	require.Equal(t, uint64(0), ps.WithNamespace("other").NumSwarms())
+
+	// No trace of the IP is left, not even in tombstones, the snapshot or
+	// the op log.
+	ip := p1.IP.IP.To16()
+	for _, shard := range ps.shards.shards {
+		for _, sw := range shard.swarms {
+			for _, b := range sw.peers4.peerBuckets {
+				for _, p := range b {
+					require.False(t, bytes.Equal(p[:ipLen], ip))
+				}
+			}
+		}
+	}
+	testMemDriver.mu.Lock()
+	require.False(t, bytes.Contains(testMemDriver.snapshot, p1.IP.IP.To4()))
+	require.Len(t, testMemDriver.ops, 0)
+	testMemDriver.mu.Unlock()
+
+	_, err = ps.ErasePeer(p2.IP.IP, 0)
+	require.NotNil(t, err)
+	report, err = ps.ErasePeer(p2.IP.IP, p2.Port+1)
+	require.Nil(t, err)
+	require.Equal(t, 0, report.PeersRemoved)
+	report, err = ps.ErasePeer(p2.IP.IP, p2.Port)
+	require.Nil(t, err)
+	require.Equal(t, 1, report.PeersRemoved)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	require.Nil(t, <-ps.Stop())
+	testMemDriver.mu.Lock()
+	testMemDriver.snapshot = nil
+	testMemDriver.closed = 0
+	testMemDriver.mu.Unlock()
+}
+
+func TestErasureSigningKey(t *testing.T) {
+	cfg := testConfig
+	cfg.ErasureSigningKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	other, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, ps.ErasurePublicKey(), other.ErasurePublicKey())
+
+	report, err := ps.ErasePeer(p1.IP.IP, p1.Port)
+	require.Nil(t, err)
+	require.True(t, VerifyErasureReport(other.ErasurePublicKey(), report))
+	require.Nil(t, <-ps.Stop())
+	require.Nil(t, <-other.Stop())
+
+	require.Equal(t, "", Config{ErasureSigningKey: "abc"}.Validate().ErasureSigningKey)
+}
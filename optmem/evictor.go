@@ -0,0 +1,256 @@
+package optmem
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+)
+
+// Errors returned by puts of new peers if a cap is hit and the Evictor does
+// not remove a peer to make room.
+var (
+	// ErrSwarmFull is returned if the swarm has MaxSwarmPeers peers of the
+	// address family of the peer.
+	ErrSwarmFull = bittorrent.ClientError("swarm is full")
+
+	// ErrStoreFull is returned if the store has MaxPeers peers.
+	ErrStoreFull = bittorrent.ClientError("peer store is full")
+)
+
+// An Evictor decides which peer is removed to make room for a new peer if
+// storing it would exceed MaxSwarmPeers or MaxPeers.
+//
+// Peers are only evicted from the swarm the new peer is stored in, so new
+// swarms are rejected with ErrStoreFull while the store is full.
+// Evictors run while the shard of the swarm is locked, so they should be fast
+// and must not call the PeerStore.
+type Evictor interface {
+	// Evict returns the peer of the view to remove.
+	// Returning false rejects the new peer instead.
+	Evict(v *EvictionView, newPeer Candidate) (Candidate, bool)
+}
+
+// EvictionView gives an Evictor access to the peers of one address family of
+// a swarm.
+// It is only valid during the call to Evict.
+type EvictionView struct {
+	pl     *peerList
+	af     bittorrent.AddressFamily
+	now    uint16
+	s0, s1 uint64
+}
+
+// NumPeers returns the number of peers in the swarm.
+func (v *EvictionView) NumPeers() int {
+	return v.pl.numPeers
+}
+
+// NumSeeders returns the number of seeders in the swarm.
+func (v *EvictionView) NumSeeders() int {
+	return v.pl.numSeeders
+}
+
+// Each calls f for every peer in the swarm, in no particular order, until f
+// returns false.
+// It runs in linear time in regards to the number of peers in the swarm.
+func (v *EvictionView) Each(f func(c Candidate) bool) {
+	for _, b := range v.pl.peerBuckets {
+		for _, p := range b {
+			if p.isDead() {
+				continue
+			}
+			if !f(Candidate{p: p, af: v.af}) {
+				return
+			}
+		}
+	}
+}
+
+// Age returns the time since the last announce of a peer.
+func (v *EvictionView) Age(c Candidate) time.Duration {
+	return time.Duration(v.now-c.p.peerTime()) * time.Second
+}
+
+// Entropy returns random seeds for the eviction.
+func (v *EvictionView) Entropy() (uint64, uint64) {
+	return v.s0, v.s1
+}
+
+// OldestFirst is the default Evictor, removing the peer that announced least
+// recently.
+type OldestFirst struct{}
+
+// Evict implements Evictor.
+func (OldestFirst) Evict(v *EvictionView, _ Candidate) (Candidate, bool) {
+	return oldest(v, func(Candidate) bool { return true })
+}
+
+// LeecherFirst is an Evictor removing the leecher that announced least
+// recently, and only removing seeders if the swarm has no leechers.
+// It suits trackers that care more about availability than about new
+// downloads.
+type LeecherFirst struct{}
+
+// Evict implements Evictor.
+func (LeecherFirst) Evict(v *EvictionView, _ Candidate) (Candidate, bool) {
+	if v.NumSeeders() == v.NumPeers() {
+		return oldest(v, func(Candidate) bool { return true })
+	}
+	return oldest(v, func(c Candidate) bool { return !c.Seeder() })
+}
+
+// RandomEviction is an Evictor removing a random peer.
+type RandomEviction struct{}
+
+// Evict implements Evictor.
+func (RandomEviction) Evict(v *EvictionView, _ Candidate) (Candidate, bool) {
+	s0, s1 := v.Entropy()
+	n, _, _ := random.Intn(s0, s1, v.NumPeers())
+
+	var victim Candidate
+	var found bool
+	v.Each(func(c Candidate) bool {
+		if n == 0 {
+			victim, found = c, true
+			return false
+		}
+		n--
+		return true
+	})
+	return victim, found
+}
+
+// oldest returns the least recently announced peer matching f.
+func oldest(v *EvictionView, f func(c Candidate) bool) (Candidate, bool) {
+	var victim Candidate
+	var found bool
+	v.Each(func(c Candidate) bool {
+		if f(c) && (!found || v.Age(c) > v.Age(victim)) {
+			victim, found = c, true
+		}
+		return true
+	})
+	return victim, found
+}
+
+var (
+	evictorsM sync.RWMutex
+	evictors  = map[string]Evictor{
+		"oldest_first":  OldestFirst{},
+		"leecher_first": LeecherFirst{},
+		"random":        RandomEviction{},
+	}
+)
+
+// RegisterEvictor makes an Evictor available by the provided name, to be
+// selected with Config.Evictor.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// Evictor is nil, this function panics.
+func RegisterEvictor(name string, e Evictor) {
+	if name == "" {
+		panic("optmem: could not register an Evictor with an empty name")
+	}
+	if e == nil {
+		panic("optmem: could not register a nil Evictor")
+	}
+
+	evictorsM.Lock()
+	defer evictorsM.Unlock()
+
+	if _, dup := evictors[name]; dup {
+		panic("optmem: RegisterEvictor called twice for " + name)
+	}
+
+	evictors[name] = e
+}
+
+// lookupEvictor returns the Evictor registered by the given name.
+func lookupEvictor(name string) (Evictor, bool) {
+	evictorsM.RLock()
+	defer evictorsM.RUnlock()
+	e, ok := evictors[name]
+	return e, ok
+}
+
+// evictor returns the configured Evictor, OldestFirst by default.
+func (cfg Config) evictor() Evictor {
+	e, ok := lookupEvictor(cfg.Evictor)
+	if !ok {
+		return OldestFirst{}
+	}
+	return e
+}
+
+// contains returns whether the peer list contains a live peer with the
+// endpoint of p.
+func (pl *peerList) contains(p *peer) bool {
+	bucket := pl.peerBuckets[pl.bucketIndex(p)]
+	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
+	return match < len(bucket) && !bucket[match].isDead() && bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize])
+}
+
+// numPeersLocked returns the number of peers in the store, including the
+// unpublished changes of a locked shard.
+// The changes of other shards are only counted once they are unlocked, so
+// the number might be slightly off.
+func (s *PeerStore) numPeersLocked(shard *shard) uint64 {
+	c := s.shards.getPeerCounts()
+	return c.peers4 + c.peers6 +
+		(shard.counts.peers4 - shard.published.peers4) +
+		(shard.counts.peers6 - shard.published.peers6)
+}
+
+// makeRoom evicts a peer from a swarm if storing p would exceed MaxSwarmPeers
+// or MaxPeers.
+// Updates of stored peers never evict.
+// Returns ErrSwarmFull or ErrStoreFull if the new peer must be rejected.
+// The shard must be write-locked by the caller.
+func (s *PeerStore) makeRoom(shard *shard, ih infohash, p *peer, af bittorrent.AddressFamily) error {
+	if s.cfg.MaxSwarmPeers == 0 && s.cfg.MaxPeers == 0 {
+		return nil
+	}
+
+	l := shard.swarms[ih].list(af)
+	if l != nil && l.contains(p) {
+		return nil
+	}
+	swarmFull := l != nil && s.cfg.MaxSwarmPeers > 0 && uint(l.numPeers) >= s.cfg.MaxSwarmPeers
+	storeFull := s.cfg.MaxPeers > 0 && s.numPeersLocked(shard) >= s.cfg.MaxPeers
+	if !swarmFull && !storeFull {
+		return nil
+	}
+
+	errFull := ErrStoreFull
+	if swarmFull {
+		errFull = ErrSwarmFull
+	}
+	if l == nil || l.numPeers == 0 {
+		return errFull
+	}
+
+	now := p.peerTime()
+	s0 := seededHash(uint64(now), p[:peerCompareSize])
+	v := EvictionView{pl: l, af: af, now: now, s0: s0, s1: seededHash(s0, ih[:])}
+	victim, ok := s.evictor.Evict(&v, Candidate{p: *p, af: af})
+	if !ok {
+		return errFull
+	}
+
+	found, seeder := l.removePeer(&victim.p)
+	if !found {
+		return errFull
+	}
+	removedSeeders := 0
+	if seeder {
+		removedSeeders = 1
+	}
+	shard.counts.sub(af, 1, removedSeeders)
+	promEvictions.inc(af)
+
+	return nil
+}
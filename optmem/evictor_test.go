@@ -0,0 +1,86 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvictorOldestFirst(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.MaxSwarmPeers = 3
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+		clock.set(clock.Now().Add(time.Second))
+	}
+	// Updates do not evict.
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(0)))
+	require.Equal(t, 3, ps.NumSeeders(ih)+ps.NumLeechers(ih))
+
+	// The oldest peer, benchPeer(1), is evicted.
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(3)))
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Equal(t, 2, ps.NumLeechers(ih))
+	require.NotNil(t, ps.DeleteLeecher(ih, benchPeer(1)))
+	require.Nil(t, ps.DeleteLeecher(ih, benchPeer(2)))
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(1), leechers)
+}
+
+func TestEvictorLeecherFirst(t *testing.T) {
+	cfg := testConfig
+	cfg.MaxSwarmPeers = 2
+	cfg.Evictor = "leecher_first"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(0)))
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(1)))
+	_, err = ps.AnnounceAndPut(ih, true, 10, benchPeer(2))
+	require.Nil(t, err)
+	require.Equal(t, 2, ps.NumSeeders(ih))
+	require.Equal(t, 0, ps.NumLeechers(ih))
+}
+
+// rejectingEvictor is an Evictor that never evicts.
+type rejectingEvictor struct{}
+
+func (rejectingEvictor) Evict(*EvictionView, Candidate) (Candidate, bool) {
+	return Candidate{}, false
+}
+
+func TestEvictorReject(t *testing.T) {
+	RegisterEvictor("test-reject", rejectingEvictor{})
+	require.Panics(t, func() { RegisterEvictor("test-reject", rejectingEvictor{}) })
+
+	cfg := testConfig
+	cfg.MaxPeers = 2
+	cfg.Evictor = "test-reject"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(0)))
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(1)))
+	require.Equal(t, ErrStoreFull, ps.PutSeeder(ih, benchPeer(2)))
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(1)))
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(1), leechers)
+}
+
+func TestEvictorUnknown(t *testing.T) {
+	cfg := testConfig
+	cfg.Evictor = "does-not-exist"
+	require.Equal(t, "oldest_first", cfg.Validate().Evictor)
+}
@@ -0,0 +1,626 @@
+package optmem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidExport is returned if an import is attempted from data that was
+// not produced by ExportSwarms.
+var ErrInvalidExport = errors.New("invalid export")
+
+// The export format consists of a header followed by sections of swarm
+// records, one section per shard, and an end record.
+//
+// The header is the magic string followed by a version byte, the number of
+// sections as a big-endian uint32 and the CRC-32 (IEEE) of the preceding
+// bytes.
+// Every section starts with a marker byte of 2, followed by the length of
+// its swarm records as a big-endian uint32, the swarm records and the CRC-32
+// of the swarm records.
+// Every swarm record starts with a marker byte of 1, followed by the infohash,
+// the number of IPv4 peers and the number of IPv6 peers as big-endian
+// uint32s, the tags of the swarm, and the raw IPv4 and then IPv6 peers.
+// The tags are written as the number of tags in a byte, followed by each tag
+// prefixed with its length in a byte.
+// The end record is a marker byte of 0, followed by the number of swarms and
+// the number of peers of the export as big-endian uint64s and the CRC-32 of
+// the end record.
+// The counts are written at the end, as shards are exported one at a time
+// while writes to the store proceed.
+//
+// Version 1 and 2 exports consist of the header without the section count
+// and checksum, followed by the swarm records and the end marker byte of 0.
+// Version 1 exports do not contain tags.
+// Both can still be imported, but truncation or corruption of their swarm
+// records is not always detected.
+const (
+	exportMagic   = "OPTM"
+	exportVersion = 3
+
+	exportMarkerSwarm   = 1
+	exportMarkerEnd     = 0
+	exportMarkerSection = 2
+)
+
+// appendPeers appends the raw representation of all peers to buf.
+func (pl *peerList) appendPeers(buf []byte) []byte {
+	for _, b := range pl.peerBuckets {
+		for i := range b {
+			if !b[i].isDead() {
+				buf = append(buf, b[i][:]...)
+			}
+		}
+	}
+	return buf
+}
+
+// ExportSampling configures the sampling of peers of large swarms in exports.
+// The zero value exports all peers.
+type ExportSampling struct {
+	// Threshold is the number of peers per address family up to which the
+	// peers of a swarm are exported completely.
+	Threshold int
+
+	// Fraction is the fraction of peers, between 0 and 1, exported for
+	// address families of a swarm with more than Threshold peers.
+	// Zero keeps all peers.
+	Fraction float64
+
+	// MaxPeers is the maximum number of peers exported per address family
+	// of a swarm with more than Threshold peers.
+	// It is applied after Fraction.
+	// Zero means no limit.
+	MaxPeers int
+
+	// Seed seeds the random selection of peers.
+	Seed uint64
+}
+
+// sampleSize returns the number of peers to export out of n.
+func (es ExportSampling) sampleSize(n int) int {
+	if n <= es.Threshold {
+		return n
+	}
+
+	k := n
+	if es.Fraction > 0 && es.Fraction < 1 {
+		k = int(math.Ceil(float64(n) * es.Fraction))
+	}
+	if es.MaxPeers > 0 && k > es.MaxPeers {
+		k = es.MaxPeers
+	}
+	return k
+}
+
+// appendSampledPeers appends the raw representation of k randomly chosen
+// peers to buf.
+// scratch is used to hold all peers and returned for reuse.
+func (pl *peerList) appendSampledPeers(buf, scratch []byte, k int, s0, s1 uint64) ([]byte, []byte, uint64, uint64) {
+	if k >= pl.numPeers {
+		return pl.appendPeers(buf), scratch, s0, s1
+	}
+
+	// Partial Fisher-Yates shuffle: the first k peers are a uniform sample.
+	scratch = pl.appendPeers(scratch[:0])
+	var p peer
+	for i := 0; i < k; i++ {
+		var j int
+		j, s0, s1 = random.Intn(s0, s1, pl.numPeers-i)
+		j += i
+		copy(p[:], scratch[i*len(p):])
+		copy(scratch[i*len(p):(i+1)*len(p)], scratch[j*len(p):])
+		copy(scratch[j*len(p):], p[:])
+	}
+	return append(buf, scratch[:k*len(p)]...), scratch, s0, s1
+}
+
+// swarmExporter appends export records of swarms, sampling their peers.
+type swarmExporter struct {
+	sampling ExportSampling
+	scratch  []byte
+	s0, s1   uint64
+}
+
+// appendSwarmRecord appends the export record of a swarm to buf.
+func (e *swarmExporter) appendSwarmRecord(buf []byte, ih infohash, sw swarm, tags []string) []byte {
+	var n4, n6 int
+	if sw.peers4 != nil {
+		n4 = e.sampling.sampleSize(sw.peers4.numPeers)
+	}
+	if sw.peers6 != nil {
+		n6 = e.sampling.sampleSize(sw.peers6.numPeers)
+	}
+
+	var counts [8]byte
+	binary.BigEndian.PutUint32(counts[:4], uint32(n4))
+	binary.BigEndian.PutUint32(counts[4:], uint32(n6))
+
+	buf = append(buf, exportMarkerSwarm)
+	buf = append(buf, ih[:]...)
+	buf = append(buf, counts[:]...)
+	buf = append(buf, byte(len(tags)))
+	for _, tag := range tags {
+		buf = append(buf, byte(len(tag)))
+		buf = append(buf, tag...)
+	}
+	if sw.peers4 != nil {
+		buf, e.scratch, e.s0, e.s1 = sw.peers4.appendSampledPeers(buf, e.scratch, n4, e.s0, e.s1)
+	}
+	if sw.peers6 != nil {
+		buf, e.scratch, e.s0, e.s1 = sw.peers6.appendSampledPeers(buf, e.scratch, n6, e.s0, e.s1)
+	}
+	return buf
+}
+
+// ExportSwarms writes all swarms matching the filter to w.
+// A nil filter matches all swarms.
+// The output can be imported into another PeerStore using ImportSwarms.
+// It is compressed as configured by ExportCompression.
+//
+// Shards are exported one at a time and only locked while they are being
+// copied, writes to the PeerStore can proceed while the export is written.
+// The export is therefore not a consistent snapshot of the whole store.
+// Writes to swarms that have already been exported are not reflected in the
+// export, so callers moving swarms to another instance should stop writes to
+// them first.
+// Backup writes consistent exports without stopping writes.
+//
+// Returns the number of swarms exported.
+func (s *PeerStore) ExportSwarms(w io.Writer, filter func(bittorrent.InfoHash) bool) (int, error) {
+	return s.ExportSwarmsSampled(w, filter, ExportSampling{})
+}
+
+// ExportSwarmsSampled works like ExportSwarms, but only exports a random
+// sample of the peers of large swarms, as configured by sampling.
+// This produces much smaller exports that are still representative of the
+// swarms, for example for analysis.
+// Exports containing sampled swarms should not be used to move swarms between
+// instances.
+func (s *PeerStore) ExportSwarmsSampled(w io.Writer, filter func(bittorrent.InfoHash) bool, sampling ExportSampling) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if s.anon != nil {
+		return 0, ErrAnonymized
+	}
+
+	return s.exportSwarms(w, filter, sampling)
+}
+
+// exportSwarms implements ExportSwarmsSampled without checking whether the
+// store is closed, so that it can be used while stopping.
+// The export is compressed as configured by ExportCompression.
+func (s *PeerStore) exportSwarms(w io.Writer, filter func(bittorrent.InfoHash) bool, sampling ExportSampling) (int, error) {
+	cw, flush, err := s.cfg.compressWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	exported, err := s.writeExport(cw, filter, sampling)
+	ferr := flush()
+	if err == nil {
+		err = ferr
+	}
+	return exported, err
+}
+
+// writeExport writes the uncompressed export to w.
+func (s *PeerStore) writeExport(w io.Writer, filter func(bittorrent.InfoHash) bool, sampling ExportSampling) (int, error) {
+	e := swarmExporter{sampling: sampling, s0: sampling.Seed, s1: sampling.Seed ^ 0x9e3779b97f4a7c15}
+	return s.writeSections(w, len(s.shards.shards), func(i int, buf []byte) ([]byte, int, uint64) {
+		shard := s.shards.rLockShard(i)
+		defer s.shards.rUnlockShard(i)
+		return e.appendShard(buf, shard, filter)
+	})
+}
+
+// appendShard appends the export records of all swarms of a shard matching
+// the filter to buf.
+// Returns the number of swarms and peers appended.
+// The shard must be read-locked by the caller.
+func (e *swarmExporter) appendShard(buf []byte, shard *shard, filter func(bittorrent.InfoHash) bool) ([]byte, int, uint64) {
+	var swarms int
+	var peers uint64
+	for ih, sw := range shard.swarms {
+		if filter != nil && !filter(bittorrent.InfoHash(ih)) {
+			continue
+		}
+		before := len(buf)
+		buf = e.appendSwarmRecord(buf, ih, sw, shard.tags[ih])
+		peers += uint64(swarmRecordPeers(buf[before:]))
+		swarms++
+	}
+	return buf, swarms, peers
+}
+
+// writeSections writes an uncompressed export of n sections to w, the swarm
+// records of the i-th section are appended by section.
+func (s *PeerStore) writeSections(w io.Writer, n int, section func(i int, buf []byte) ([]byte, int, uint64)) (int, error) {
+	header := append([]byte(exportMagic), exportVersion, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(exportMagic)+1:], uint32(n))
+	_, err := w.Write(appendCRC(header))
+	if err != nil {
+		return 0, err
+	}
+
+	// buf holds the section header, the swarm records and the checksum.
+	buf := make([]byte, sectionHeaderLen)
+	exported := 0
+	var peers uint64
+	for i := 0; i < n; i++ {
+		var swarms int
+		var p uint64
+		buf, swarms, p = section(i, buf[:sectionHeaderLen])
+		exported += swarms
+		peers += p
+
+		records := len(buf) - sectionHeaderLen
+		if records > math.MaxUint32 {
+			return exported, errors.New("shard too large to export")
+		}
+		buf[0] = exportMarkerSection
+		binary.BigEndian.PutUint32(buf[1:sectionHeaderLen], uint32(records))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[sectionHeaderLen:]))
+		_, err = w.Write(buf)
+		if err != nil {
+			return exported, err
+		}
+	}
+
+	end := make([]byte, endRecordLen)
+	end[0] = exportMarkerEnd
+	binary.BigEndian.PutUint64(end[1:], uint64(exported))
+	binary.BigEndian.PutUint64(end[9:], peers)
+	_, err = w.Write(appendCRC(end))
+	return exported, err
+}
+
+// Lengths of the parts of an export, without checksums.
+const (
+	sectionHeaderLen = 1 + 4     // marker, length of the swarm records
+	endRecordLen     = 1 + 8 + 8 // marker, number of swarms, number of peers
+	crcLen           = 4
+)
+
+// appendCRC appends the CRC-32 of b to b.
+func appendCRC(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// checkCRC returns b without its trailing CRC-32, or false if the checksum
+// does not match.
+func checkCRC(b []byte) ([]byte, bool) {
+	if len(b) < crcLen {
+		return nil, false
+	}
+	data := b[:len(b)-crcLen]
+	return data, binary.BigEndian.Uint32(b[len(data):]) == crc32.ChecksumIEEE(data)
+}
+
+// swarmRecordPeers returns the number of peers of an encoded swarm record.
+func swarmRecordPeers(record []byte) int {
+	counts := record[1+len(infohash{}):]
+	return int(binary.BigEndian.Uint32(counts)) + int(binary.BigEndian.Uint32(counts[4:]))
+}
+
+// ImportSwarms reads swarms produced by ExportSwarms from r and adds their
+// peers to the PeerStore.
+// Peers that already exist are overwritten.
+// The last announce times of the peers are kept.
+// Exports compressed with gzip or zstd are detected and decompressed,
+// regardless of ExportCompression.
+//
+// Returns the number of swarms imported, or ErrReadOnly if the store is
+// read-only.
+func (s *PeerStore) ImportSwarms(r io.Reader) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	br, release, err := decompressReader(bufio.NewReader(r))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	header, err := readExportHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	version := header[len(exportMagic)]
+	if version >= 3 {
+		return s.importVerified(br, header)
+	}
+
+	imported := 0
+	var marker [1]byte
+	var peers []peer
+	for {
+		_, err = io.ReadFull(br, marker[:])
+		if err != nil {
+			return imported, ErrInvalidExport
+		}
+		if marker[0] == exportMarkerEnd {
+			return imported, nil
+		}
+		if marker[0] != exportMarkerSwarm {
+			return imported, ErrInvalidExport
+		}
+
+		var ih infohash
+		var n4 int
+		var tags []string
+		ih, n4, peers, tags, err = readSwarmRecord(br, version, peers)
+		if err != nil {
+			return imported, ErrInvalidExport
+		}
+
+		s.importSwarm(ih, peers[:n4], peers[n4:], tags)
+		imported++
+	}
+}
+
+// readExportHeader reads the magic string and version byte of an export.
+func readExportHeader(br *bufio.Reader) ([]byte, error) {
+	header := make([]byte, len(exportMagic)+1)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+	version := header[len(exportMagic)]
+	if string(header[:len(exportMagic)]) != exportMagic || version < 1 || version > exportVersion {
+		return nil, ErrInvalidExport
+	}
+	return header, nil
+}
+
+// importedSwarm is a swarm read from an export, see readVerified.
+type importedSwarm struct {
+	ih    infohash
+	n4    int
+	peers []peer
+	tags  []string
+}
+
+// importVerified imports an export of version 3 or later, following the
+// magic string and version byte in header.
+// All sections are read and their checksums and the counts of the end record
+// verified before any swarm is imported, so a truncated or corrupt export
+// does not change the store.
+// This takes memory for all peers of the export.
+func (s *PeerStore) importVerified(br *bufio.Reader, header []byte) (int, error) {
+	swarms, err := readVerified(br, header)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sw := range swarms {
+		s.importSwarm(sw.ih, sw.peers[:sw.n4], sw.peers[sw.n4:], sw.tags)
+	}
+	return len(swarms), nil
+}
+
+// readVerified reads all swarms of an export of version 3 or later, following
+// the magic string and version byte in header, and verifies the checksums of
+// its sections and the counts of its end record.
+func readVerified(br *bufio.Reader, header []byte) ([]importedSwarm, error) {
+	header = append(header, make([]byte, 4+crcLen)...)
+	_, err := io.ReadFull(br, header[len(exportMagic)+1:])
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+	header, ok := checkCRC(header)
+	if !ok {
+		return nil, ErrInvalidExport
+	}
+	sections := binary.BigEndian.Uint32(header[len(exportMagic)+1:])
+
+	var swarms []importedSwarm
+	var numPeers uint64
+	var section []byte
+	for i := uint32(0); i < sections; i++ {
+		var sectionHeader [sectionHeaderLen]byte
+		_, err = io.ReadFull(br, sectionHeader[:])
+		if err != nil || sectionHeader[0] != exportMarkerSection {
+			return nil, ErrInvalidExport
+		}
+		n := int(binary.BigEndian.Uint32(sectionHeader[1:]))
+		// Grow the buffer as the data arrives, so that a corrupt length
+		// does not allocate.
+		section = section[:0]
+		_, err = io.CopyN(sliceWriter{&section}, br, int64(n+crcLen))
+		if err != nil {
+			return nil, ErrInvalidExport
+		}
+		records, ok := checkCRC(section)
+		if !ok {
+			return nil, ErrInvalidExport
+		}
+
+		rr := bufio.NewReader(bytes.NewReader(records))
+		for {
+			marker, err := rr.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil || marker != exportMarkerSwarm {
+				return nil, ErrInvalidExport
+			}
+			var sw importedSwarm
+			sw.ih, sw.n4, sw.peers, sw.tags, err = readSwarmRecord(rr, exportVersion, nil)
+			if err != nil {
+				return nil, ErrInvalidExport
+			}
+			numPeers += uint64(len(sw.peers))
+			swarms = append(swarms, sw)
+		}
+	}
+
+	end := make([]byte, endRecordLen+crcLen)
+	_, err = io.ReadFull(br, end)
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+	end, ok = checkCRC(end)
+	if !ok || end[0] != exportMarkerEnd ||
+		binary.BigEndian.Uint64(end[1:]) != uint64(len(swarms)) ||
+		binary.BigEndian.Uint64(end[9:]) != numPeers {
+		return nil, ErrInvalidExport
+	}
+
+	return swarms, nil
+}
+
+// sliceWriter appends everything written to it to a byte slice.
+type sliceWriter struct {
+	b *[]byte
+}
+
+func (w sliceWriter) Write(p []byte) (int, error) {
+	*w.b = append(*w.b, p...)
+	return len(p), nil
+}
+
+// readSwarmRecord reads a swarm record of the given export version, following
+// its marker byte.
+// The IPv4 and then IPv6 peers of the swarm are read into peers, which is
+// returned for reuse, n4 is the number of IPv4 peers.
+func readSwarmRecord(br *bufio.Reader, version byte, peers []peer) (ih infohash, n4 int, _ []peer, tags []string, err error) {
+	var record [len(infohash{}) + 8]byte
+	_, err = io.ReadFull(br, record[:])
+	if err != nil {
+		return ih, 0, peers, nil, err
+	}
+	copy(ih[:], record[:len(ih)])
+	n4 = int(binary.BigEndian.Uint32(record[len(ih):]))
+	n6 := int(binary.BigEndian.Uint32(record[len(ih)+4:]))
+
+	if version >= 2 {
+		tags, err = readTags(br)
+		if err != nil {
+			return ih, 0, peers, nil, err
+		}
+	}
+
+	peers = peers[:0]
+	for i := 0; i < n4+n6; i++ {
+		var p peer
+		_, err = io.ReadFull(br, p[:])
+		if err != nil {
+			return ih, 0, peers, nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	return ih, n4, peers, tags, nil
+}
+
+// readTags reads the tags of a swarm record.
+func readTags(br *bufio.Reader) ([]string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, n)
+	for i := range tags {
+		l, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		tag := make([]byte, l)
+		_, err = io.ReadFull(br, tag)
+		if err != nil {
+			return nil, err
+		}
+		tags[i] = string(tag)
+	}
+	if !validTags(tags) {
+		return nil, ErrInvalidTags
+	}
+
+	return normalizeTags(tags), nil
+}
+
+// importSwarm adds the given peers to the swarm of an infohash and sets its
+// tags, if any.
+func (s *PeerStore) importSwarm(ih infohash, peers4, peers6 []peer, tags []string) {
+	if len(peers4)+len(peers6) == 0 {
+		return
+	}
+
+	shard := s.shards.lockShardByHash(ih)
+	if s.importSwarmLocked(shard, ih, peers4, peers6, tags) {
+		s.shards.unlockShardByHash(ih, 1)
+	} else {
+		s.shards.unlockShardByHash(ih, 0)
+	}
+}
+
+// importSwarmLocked implements importSwarm.
+// Returns whether the swarm was created.
+// The shard must be write-locked by the caller.
+func (s *PeerStore) importSwarmLocked(shard *shard, ih infohash, peers4, peers6 []peer, tags []string) bool {
+	_, existed := shard.swarms[ih]
+	for i := range peers4 {
+		putPeerLocked(shard, ih, &peers4[i], bittorrent.IPv4, false)
+	}
+	for i := range peers6 {
+		putPeerLocked(shard, ih, &peers6[i], bittorrent.IPv6, false)
+	}
+	if len(tags) > 0 {
+		shard.setTags(ih, tags)
+	}
+
+	if !existed {
+		s.hooks.swarmCreated(shard, ih)
+	}
+	return !existed
+}
+
+// RemoveSwarms removes all swarms matching the filter from the PeerStore,
+// including their durable download counters.
+// Returns the number of swarms removed.
+func (s *PeerStore) RemoveSwarms(filter func(bittorrent.InfoHash) bool) int {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	removed := 0
+	for i := 0; i < len(s.shards.shards); i++ {
+		removedFromShard := 0
+		shard := s.shards.lockShard(i)
+		for ih, sw := range shard.swarms {
+			if !filter(bittorrent.InfoHash(ih)) {
+				continue
+			}
+			shard.counts.subSwarm(sw)
+			s.hooks.swarmRemoved(shard, ih, sw)
+			shard.deleteSwarm(ih)
+			delete(shard.downloads, ih)
+			removedFromShard++
+		}
+		s.shards.unlockShard(i, -removedFromShard)
+		removed += removedFromShard
+	}
+
+	return removed
+}
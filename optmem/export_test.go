@@ -0,0 +1,159 @@
+package optmem
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportSwarms(t *testing.T) {
+	src, err := New(testConfig)
+	require.Nil(t, err)
+	dst, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, src.PutSeeder(ih, p1))
+	require.Nil(t, src.PutLeecher(ih, p2))
+	require.Nil(t, src.PutLeecher(ih, p3))
+	require.Nil(t, src.PutSeeder(ih2, p1))
+
+	var buf bytes.Buffer
+	onlyIH := func(infoHash bittorrent.InfoHash) bool { return infoHash == ih }
+	n, err := src.ExportSwarms(&buf, onlyIH)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = dst.ImportSwarms(&buf)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, uint64(1), dst.NumSwarms())
+	require.Equal(t, src.ScrapeSwarmBoth(ih), dst.ScrapeSwarmBoth(ih))
+
+	seeders, leechers := dst.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(2), leechers)
+
+	require.Equal(t, 1, src.RemoveSwarms(onlyIH))
+	require.Equal(t, uint64(1), src.NumSwarms())
+	seeders, leechers = src.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(0), leechers)
+
+	require.Nil(t, <-src.Stop())
+	require.Nil(t, <-dst.Stop())
+}
+
+func TestImportInvalid(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	_, err = ps.ExportSwarms(&buf, nil)
+	require.Nil(t, err)
+
+	// Truncated exports must be detected.
+	_, err = ps.ImportSwarms(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.Equal(t, ErrInvalidExport, err)
+
+	_, err = ps.ImportSwarms(bytes.NewReader([]byte("garbage")))
+	require.Equal(t, ErrInvalidExport, err)
+
+	p := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("11.0.0.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	require.Nil(t, ps.PutSeeder(ih, p))
+	buf.Reset()
+	_, err = ps.ExportSwarms(&buf, nil)
+	require.Nil(t, err)
+	_, err = ps.ImportSwarms(bytes.NewReader(buf.Bytes()[:buf.Len()-5]))
+	require.Equal(t, ErrInvalidExport, err)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestExportSwarmsSampled(t *testing.T) {
+	src, err := New(testConfig)
+	require.Nil(t, err)
+	dst, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	for i := 0; i < 1000; i++ {
+		p := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(11, 0, byte(i>>8), byte(i)).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+		require.Nil(t, src.PutLeecher(ih, p))
+	}
+	require.Nil(t, src.PutSeeder(ih2, p1))
+	require.Nil(t, src.PutSeeder(ih2, p2))
+
+	var buf bytes.Buffer
+	n, err := src.ExportSwarmsSampled(&buf, nil, ExportSampling{Threshold: 10, Fraction: 0.1, Seed: 1})
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	_, err = dst.ImportSwarms(&buf)
+	require.Nil(t, err)
+	require.Equal(t, 100, dst.NumLeechers(ih))
+	require.Equal(t, 2, dst.NumSeeders(ih2))
+
+	buf.Reset()
+	_, err = src.ExportSwarmsSampled(&buf, nil, ExportSampling{Threshold: 10, Fraction: 0.5, MaxPeers: 20, Seed: 1})
+	require.Nil(t, err)
+	require.Equal(t, 2, dst.RemoveSwarms(func(bittorrent.InfoHash) bool { return true }))
+	_, err = dst.ImportSwarms(&buf)
+	require.Nil(t, err)
+	require.Equal(t, 20, dst.NumLeechers(ih))
+
+	require.Nil(t, <-src.Stop())
+	require.Nil(t, <-dst.Stop())
+}
+
+func TestImportCorrupt(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	var buf bytes.Buffer
+	_, err = ps.ExportSwarms(&buf, nil)
+	require.Nil(t, err)
+	export := buf.Bytes()
+	require.Equal(t, 1, ps.RemoveSwarms(func(bittorrent.InfoHash) bool { return true }))
+
+	// Flipping any byte is detected, and nothing is imported.
+	for i := range export {
+		corrupt := append([]byte(nil), export...)
+		corrupt[i] ^= 0x40
+		n, err := ps.ImportSwarms(bytes.NewReader(corrupt))
+		require.Equal(t, ErrInvalidExport, err, "byte %d", i)
+		require.Equal(t, 0, n)
+		require.Equal(t, uint64(0), ps.NumSwarms())
+	}
+
+	n, err := ps.ImportSwarms(bytes.NewReader(export))
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 2, ps.NumSeeders(ih)+ps.NumLeechers(ih))
+}
+
+func TestImportVersion2(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	p := makePeer(p1, peerFlagSeeder, 0)
+	export := append([]byte(exportMagic), 2, exportMarkerSwarm)
+	export = append(export, ih[:]...)
+	export = append(export, 0, 0, 0, 1, 0, 0, 0, 0)
+	export = append(export, 1, 3, 'f', 'o', 'o')
+	export = append(export, p[:]...)
+	export = append(export, exportMarkerEnd)
+
+	n, err := ps.ImportSwarms(bytes.NewReader(export))
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Equal(t, []string{"foo"}, ps.SwarmTags(ih))
+}
@@ -0,0 +1,377 @@
+package optmem
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// Federation defaults.
+const (
+	defaultFederationNumWant = 50
+	defaultFederationPort    = 6881
+	defaultFederationTimeout = time.Second * 15
+
+	// maxUpstreamResponseSize is the maximum size of announce responses
+	// read from upstream trackers.
+	maxUpstreamResponseSize = 1 << 20
+
+	// maxBencodeDepth is the maximum nesting of lists and dictionaries in
+	// announce responses of upstream trackers.
+	maxBencodeDepth = 8
+)
+
+// ErrInvalidUpstreamResponse is returned for announce responses of upstream
+// trackers that are not valid bencoded dictionaries.
+var ErrInvalidUpstreamResponse = errors.New("invalid upstream tracker response")
+
+// FederationConfig configures announcing the pinned swarms to upstream
+// trackers and merging the peers they return into the local swarms, so that
+// small trackers can bootstrap swarms from bigger ones.
+//
+// Peers learned from upstream trackers are flagged as external: they are
+// returned to announces like other peers, but never replace peers that
+// announced locally, and expire after PeerLifetime unless an upstream
+// tracker returns them again.
+// As compact responses do not tell seeders from leechers, external peers
+// are stored and counted as leechers.
+type FederationConfig struct {
+	// Trackers are the HTTP or HTTPS announce URLs of the upstream
+	// trackers.
+	// Empty disables federation.
+	Trackers []string `yaml:"trackers"`
+
+	// Interval is the interval at which every pinned swarm is announced to
+	// every upstream tracker.
+	// Zero selects half of PeerLifetime, so that external peers returned
+	// again do not expire in between.
+	Interval time.Duration `yaml:"interval"`
+
+	// NumWant is the number of peers requested from upstream trackers per
+	// announce.
+	// Zero selects 50.
+	NumWant uint `yaml:"numwant"`
+
+	// Port is the port announced to upstream trackers.
+	// The store is announced as a leecher, so that upstream trackers return
+	// seeders as well, but does not accept connections.
+	// Zero selects 6881.
+	Port uint16 `yaml:"port"`
+
+	// Timeout is the timeout of a single announce to an upstream tracker.
+	// Zero selects 15 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// enabled returns whether federation is configured.
+func (cfg FederationConfig) enabled() bool {
+	return len(cfg.Trackers) > 0
+}
+
+// isExternal returns whether a peer was learned from an upstream tracker.
+func (p *peer) isExternal() bool {
+	return p.peerFlag()&peerFlagExternal != 0
+}
+
+// hasLocalPeer returns whether the endpoint of p is stored as a peer that
+// announced locally, i.e. was not learned from an upstream tracker.
+func (pl *peerList) hasLocalPeer(p *peer) bool {
+	bucket := pl.peerBuckets[pl.bucketIndex(p)]
+	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
+	return match < len(bucket) && !bucket[match].isDead() && !bucket[match].isExternal() && bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize])
+}
+
+// runFederation announces the pinned swarms to the upstream trackers at the
+// configured interval until the store is closed.
+func (s *PeerStore) runFederation() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	peerID := make([]byte, 20)
+	copy(peerID, "-OM0001-")
+	_, err := rand.Read(peerID[8:])
+	if err != nil {
+		log.Error("optmem: unable to generate federation peer ID", log.Fields{"error": err})
+		return
+	}
+	client := &http.Client{Timeout: s.cfg.Federation.Timeout}
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(s.cfg.Federation.Interval):
+			s.federate(ctx, client, peerID)
+		}
+	}
+}
+
+// federate announces every pinned swarm once to every upstream tracker and
+// merges the returned peers.
+// Returns the number of external peers merged.
+func (s *PeerStore) federate(ctx context.Context, client *http.Client, peerID []byte) int {
+	merged := 0
+	for _, ih := range s.pinnedInfoHashes() {
+		for _, tracker := range s.cfg.Federation.Trackers {
+			if ctx.Err() != nil {
+				return merged
+			}
+			peers, err := s.announceUpstream(ctx, client, tracker, ih, peerID)
+			if err != nil {
+				log.Warn("optmem: upstream announce failed", log.Fields{"tracker": tracker, "infoHash": bittorrent.InfoHash(ih), "error": err})
+				continue
+			}
+			merged += s.mergeExternal(ih, peers)
+		}
+	}
+	return merged
+}
+
+// pinnedInfoHashes returns the infohashes of all pinned swarms.
+func (s *PeerStore) pinnedInfoHashes() []infohash {
+	var infoHashes []infohash
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.rLockShard(i)
+		for ih, sw := range shard.swarms {
+			if sw.pinned {
+				infoHashes = append(infoHashes, ih)
+			}
+		}
+		s.shards.rUnlockShard(i)
+	}
+	return infoHashes
+}
+
+// announceUpstream announces the swarm of the given infohash to an upstream
+// tracker and returns the peers of its response.
+func (s *PeerStore) announceUpstream(ctx context.Context, client *http.Client, tracker string, ih infohash, peerID []byte) ([]bittorrent.Peer, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("info_hash", string(ih[:]))
+	q.Set("peer_id", string(peerID))
+	q.Set("port", strconv.Itoa(int(s.cfg.Federation.Port)))
+	q.Set("uploaded", "0")
+	q.Set("downloaded", "0")
+	q.Set("left", "1")
+	q.Set("compact", "1")
+	q.Set("numwant", strconv.Itoa(int(s.cfg.Federation.NumWant)))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("upstream tracker returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpstreamResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUpstreamResponse(body)
+}
+
+// parseUpstreamResponse returns the peers of a bencoded announce response,
+// in the compact or the dictionary model, or the failure reason of the
+// response as an error.
+func parseUpstreamResponse(body []byte) ([]bittorrent.Peer, error) {
+	v, rest, err := decodeBencode(body, 0)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrInvalidUpstreamResponse
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidUpstreamResponse
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, errors.Errorf("upstream tracker failure: %s", reason)
+	}
+
+	var peers []bittorrent.Peer
+	switch p := dict["peers"].(type) {
+	case string:
+		peers = appendUpstreamPeers(peers, p, net.IPv4len)
+	case []interface{}:
+		for _, e := range p {
+			d, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip := net.ParseIP(stringOf(d["ip"]))
+			port, ok := d["port"].(int64)
+			if ip == nil || !ok || port <= 0 || port > 65535 {
+				continue
+			}
+			peers = append(peers, makeBittorrentPeer(ip, uint16(port)))
+		}
+	}
+	if p, ok := dict["peers6"].(string); ok {
+		peers = appendUpstreamPeers(peers, p, net.IPv6len)
+	}
+	return peers, nil
+}
+
+// appendUpstreamPeers appends the compact peers, with IPs of the given
+// length, of a peers string of an upstream response to dst.
+func appendUpstreamPeers(dst []bittorrent.Peer, compact string, size int) []bittorrent.Peer {
+	for i := 0; i+size+portLen <= len(compact); i += size + portLen {
+		ip := net.IP([]byte(compact[i : i+size]))
+		port := uint16(compact[i+size])<<8 | uint16(compact[i+size+1])
+		dst = append(dst, makeBittorrentPeer(ip, port))
+	}
+	return dst
+}
+
+// makeBittorrentPeer returns the bittorrent.Peer of an IP and port.
+func makeBittorrentPeer(ip net.IP, port uint16) bittorrent.Peer {
+	af := bittorrent.IPv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, af = ip4, bittorrent.IPv4
+	}
+	return bittorrent.Peer{IP: bittorrent.IP{IP: ip, AddressFamily: af}, Port: port}
+}
+
+// stringOf returns v if it is a string, or the empty string.
+func stringOf(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// mergeExternal stores peers learned from an upstream tracker in the swarm
+// of the given infohash, flagged as external.
+// Peers that announced locally are not replaced, and nothing is merged if
+// the swarm does not exist anymore, is frozen or the store is read-only.
+// Unroutable and banned peers are skipped.
+// Returns the number of peers merged.
+func (s *PeerStore) mergeExternal(ih infohash, peers []bittorrent.Peer) int {
+	if s.isReadOnly() {
+		return 0
+	}
+	now := uint16(s.nowUnix())
+
+	merged := 0
+	shard := s.shards.lockShardByHash(ih)
+	defer s.shards.unlockShardByHash(ih, 0)
+	if _, ok := shard.swarms[ih]; !ok {
+		return 0
+	}
+	for _, p := range peers {
+		if !s.routable(p.IP) || s.banned(p) {
+			continue
+		}
+		af := p.IP.AddressFamily
+		ep := makePeer(p, peerFlagLeecher|peerFlagExternal, now)
+		if l := shard.swarms[ih].list(af); l != nil && l.hasLocalPeer(ep) {
+			continue
+		}
+		if s.admitPeer(shard, ih, ep, af) != nil {
+			continue
+		}
+		putPeerLocked(shard, ih, ep, af, false)
+		promFederated.inc(af)
+		merged++
+	}
+	return merged
+}
+
+// decodeBencode decodes the first bencoded value of b, returning strings as
+// string, integers as int64, lists as []interface{} and dictionaries as
+// map[string]interface{}, along with the rest of b.
+// depth is the nesting of the value, which is limited to maxBencodeDepth.
+func decodeBencode(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 || depth > maxBencodeDepth {
+		return nil, nil, ErrInvalidUpstreamResponse
+	}
+
+	switch {
+	case b[0] == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, ErrInvalidUpstreamResponse
+		}
+		n, err := strconv.ParseInt(string(b[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, ErrInvalidUpstreamResponse
+		}
+		return n, b[end+1:], nil
+	case b[0] == 'l':
+		var list []interface{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			var v interface{}
+			var err error
+			v, b, err = decodeBencode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+		}
+		if len(b) == 0 {
+			return nil, nil, ErrInvalidUpstreamResponse
+		}
+		return list, b[1:], nil
+	case b[0] == 'd':
+		dict := make(map[string]interface{})
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			var k, v interface{}
+			var err error
+			k, b, err = decodeBencode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, ErrInvalidUpstreamResponse
+			}
+			v, b, err = decodeBencode(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[key] = v
+		}
+		if len(b) == 0 {
+			return nil, nil, ErrInvalidUpstreamResponse
+		}
+		return dict, b[1:], nil
+	case b[0] >= '0' && b[0] <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, ErrInvalidUpstreamResponse
+		}
+		n, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || n < 0 || n > len(b)-colon-1 {
+			return nil, nil, ErrInvalidUpstreamResponse
+		}
+		return string(b[colon+1 : colon+1+n]), b[colon+1+n:], nil
+	}
+	return nil, nil, ErrInvalidUpstreamResponse
+}
@@ -0,0 +1,89 @@
+package optmem
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFederation(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		q := r.URL.Query()
+		if q.Get("info_hash") != string(ih[:]) || q.Get("compact") != "1" || q.Get("passkey") != "secret" {
+			w.Write([]byte("d14:failure reason13:wrong requeste"))
+			return
+		}
+		peers := string(compactPeer(makePeer(p1, 0, 0), true)) +
+			string(compactPeer(makePeer(p2, 0, 0), true)) +
+			"\x0a\x00\x00\x01\x00\x50" // 10.0.0.1:80 is unroutable
+		peers6 := string(compactPeer(makePeer(p3, 0, 0), false))
+		w.Write([]byte("d8:intervali1800e5:peers18:" + peers + "6:peers618:" + peers6 + "e"))
+	}))
+	defer srv.Close()
+
+	cfg := testConfig
+	cfg.Federation.Trackers = []string{srv.URL + "/announce?passkey=secret"}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint(defaultFederationNumWant), ps.cfg.Federation.NumWant)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih2, p2))
+	require.Nil(t, ps.PinSwarm(ih))
+
+	// Only pinned swarms are federated, and local peers are kept.
+	peerID := []byte("-OM0001-000000000000")
+	require.Equal(t, 2, ps.federate(context.Background(), srv.Client(), peerID))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	stats := ps.ScrapeSwarmBoth(ih)
+	require.Equal(t, uint32(1), stats.Combined.Complete)
+	require.Equal(t, uint32(2), stats.Combined.Incomplete)
+
+	peers, err := ps.AnnouncePeers(ih, true, 10, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, p2.Port, peers[0].Port)
+
+	// Merging again refreshes the external peers.
+	require.Equal(t, 2, ps.federate(context.Background(), srv.Client(), peerID))
+	require.Equal(t, uint32(2), ps.ScrapeSwarmBoth(ih).Combined.Incomplete)
+	require.True(t, ps.CheckConsistency().OK())
+
+	// External peers are replaced once they announce locally.
+	isLocal := func(p bittorrent.Peer) bool {
+		shard := ps.shards.rLockShardByHash(infohash(ih))
+		defer ps.shards.rUnlockShardByHash(infohash(ih))
+		return shard.swarms[infohash(ih)].peers4.hasLocalPeer(makePeer(p, 0, 0))
+	}
+	require.True(t, isLocal(p1))
+	require.False(t, isLocal(p2))
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	require.True(t, isLocal(p2))
+	require.Equal(t, uint32(2), ps.ScrapeSwarmBoth(ih).Combined.Complete)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestParseUpstreamResponse(t *testing.T) {
+	_, err := parseUpstreamResponse([]byte("d14:failure reason6:bannede"))
+	require.EqualError(t, err, "upstream tracker failure: banned")
+
+	_, err = parseUpstreamResponse([]byte("d5:peers"))
+	require.Equal(t, ErrInvalidUpstreamResponse, err)
+
+	_, err = parseUpstreamResponse([]byte("llllllllllllllllllllee"))
+	require.Equal(t, ErrInvalidUpstreamResponse, err)
+
+	peers, err := parseUpstreamResponse([]byte("d5:peersld2:ip7:1.2.3.44:porti1234eed2:ip3:foo4:porti1eeee"))
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.True(t, peers[0].Equal(p1))
+}
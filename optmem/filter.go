@@ -0,0 +1,67 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// PeerFilter decides whether a stored peer may be returned to announces,
+// for example to drop peers on banned ports or peers that were not verified.
+// It is called while the shard of the swarm is locked, so it should be fast,
+// must not call the PeerStore and must be safe for concurrent use.
+type PeerFilter func(c Candidate) bool
+
+// peerFilterHolder wraps a PeerFilter to store it in an atomic.Value.
+type peerFilterHolder struct {
+	f PeerFilter
+}
+
+// SetPeerFilter sets a filter applied while selecting peers for announces.
+// Peers the filter rejects are skipped, so they do not count towards the
+// numWant of the announce.
+// Announces run in linear time in regards to the number of peers in the swarm
+// while a filter is set.
+// A nil filter returns all peers again.
+func (s *PeerStore) SetPeerFilter(f PeerFilter) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	s.filter.Store(peerFilterHolder{f})
+}
+
+// peerFilter returns the PeerFilter, or nil if none is set.
+func (s *PeerStore) peerFilter() PeerFilter {
+	h, _ := s.filter.Load().(peerFilterHolder)
+	return h.f
+}
+
+// peerKeeper returns the predicate the peers of l returned to an announcing
+// peer must match, or nil if all peers may be returned.
+// It combines the PeerFilter with the encryption requirement and the
+// transport of the announcing peer, see Transport.
+func (s *PeerStore) peerKeeper(l *peerList, announcer *peer, af bittorrent.AddressFamily) func(p *peer) bool {
+	f := s.peerFilter()
+	crypto := announcer.requiresCrypto()
+	var keep func(p *peer) bool
+	switch {
+	case f == nil && !crypto:
+	case f == nil:
+		keep = (*peer).supportsCrypto
+	case !crypto:
+		keep = func(p *peer) bool { return f(Candidate{p: *p, af: af}) }
+	default:
+		keep = func(p *peer) bool { return p.supportsCrypto() && f(Candidate{p: *p, af: af}) }
+	}
+
+	webRTC := announcer.isWebRTC()
+	if !webRTC && l.numWebRTC == 0 {
+		// Classic announces only need to skip WebRTC peers if there are any.
+		return keep
+	}
+	if keep == nil {
+		return func(p *peer) bool { return p.isWebRTC() == webRTC }
+	}
+	return func(p *peer) bool { return p.isWebRTC() == webRTC && keep(p) }
+}
@@ -0,0 +1,46 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerFilter(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.PutLeecherCrypto(ih, benchPeer(i), CryptoSupported))
+	}
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(21)))
+
+	// Only odd peers without encryption support are returned.
+	ps.SetPeerFilter(func(c Candidate) bool { return c.IP()[3]%2 == 1 })
+	peers, err := ps.AnnouncePeers(ih, true, 10, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 10)
+	for _, p := range peers {
+		require.Equal(t, byte(1), p.IP.IP[3]%2)
+	}
+
+	// The filter is combined with the encryption requirement.
+	peers, err = ps.AnnouncePeersCrypto(ih, true, 20, p1, CryptoRequired)
+	require.Nil(t, err)
+	require.Len(t, peers, 10)
+
+	// numWant is not wasted on filtered peers with a Selector either.
+	ps.selector = SubnetAffinity{}
+	peers, err = ps.AnnouncePeers(ih, true, 11, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 11)
+	for _, p := range peers {
+		require.Equal(t, byte(1), p.IP.IP[3]%2)
+	}
+
+	ps.SetPeerFilter(nil)
+	peers, err = ps.AnnouncePeers(ih, true, 50, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 21)
+}
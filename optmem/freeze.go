@@ -0,0 +1,69 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// ErrSwarmFrozen is returned by puts of new peers to a frozen swarm.
+var ErrSwarmFrozen = bittorrent.ClientError("swarm does not accept new peers")
+
+// FreezeSwarm freezes the swarm of the given infohash, for example while
+// investigating abuse of a torrent.
+// Frozen swarms keep their peers, which may still announce, update, graduate
+// and leave, but reject new peers with ErrSwarmFrozen.
+// Rejected puts are counted in the operations metric.
+//
+// A frozen swarm is removed like any other swarm once its last peer is
+// gone, which also unfreezes it, unless it is pinned.
+// Returns false if the swarm does not exist.
+func (s *PeerStore) FreezeSwarm(infoHash bittorrent.InfoHash) bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	return s.setFrozen(infohash(infoHash), true)
+}
+
+// UnfreezeSwarm unfreezes the swarm of the given infohash.
+// Returns false if the swarm does not exist.
+func (s *PeerStore) UnfreezeSwarm(infoHash bittorrent.InfoHash) bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	return s.setFrozen(infohash(infoHash), false)
+}
+
+func (s *PeerStore) setFrozen(ih infohash, frozen bool) bool {
+	shard := s.shards.lockShardByHash(ih)
+	defer s.shards.unlockShardByHash(ih, 0)
+
+	sw, ok := shard.swarms[ih]
+	if !ok {
+		return false
+	}
+	sw.frozen = frozen
+	shard.setSwarm(ih, sw)
+	return true
+}
+
+// admitPeer checks whether p may be stored in the swarm and makes room for it,
+// see makeRoom.
+// Returns ErrSwarmFrozen if the swarm is frozen and p is not stored yet.
+// The shard must be write-locked by the caller.
+func (s *PeerStore) admitPeer(shard *shard, ih infohash, p *peer, af bittorrent.AddressFamily) error {
+	if sw := shard.swarms[ih]; sw.frozen {
+		l := sw.list(af)
+		if l == nil || !l.contains(p) {
+			promFrozenRejects.inc(af)
+			return ErrSwarmFrozen
+		}
+	}
+	return s.makeRoom(shard, ih, p, af)
+}
@@ -0,0 +1,41 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreezeSwarm(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.False(t, ps.FreezeSwarm(ih))
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.True(t, ps.FreezeSwarm(ih))
+	info, ok := ps.SwarmInfo(ih)
+	require.True(t, ok)
+	require.True(t, info.Frozen)
+
+	// Existing peers may update, graduate and announce.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	_, err = ps.AnnounceAndPut(ih, true, 10, p1)
+	require.Nil(t, err)
+
+	// New peers are rejected, but receive peers.
+	require.Equal(t, ErrSwarmFrozen, ps.PutLeecher(ih, p2))
+	require.Equal(t, ErrSwarmFrozen, ps.PutSeeder(ih, p3))
+	_, err = ps.AnnounceAndPut(ih, false, 10, p2)
+	require.Equal(t, ErrSwarmFrozen, err)
+	peers, err := ps.AnnouncePeers(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Equal(t, 0, ps.NumLeechers(ih))
+
+	require.True(t, ps.UnfreezeSwarm(ih))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+}
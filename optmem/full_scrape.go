@@ -0,0 +1,187 @@
+package optmem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/pkg/errors"
+)
+
+// Format is an output format for FullScrape.
+type Format int
+
+// Output formats for FullScrape.
+const (
+	// FormatBencode produces a bencoded full scrape, as served by the
+	// scrape endpoint of an HTTP tracker when no infohash is given.
+	// The infohashes are raw bytes.
+	FormatBencode Format = iota
+
+	// FormatJSON produces a JSON document with the same structure as
+	// FormatBencode.
+	// The infohashes are hex-encoded.
+	FormatJSON
+)
+
+// ErrUnknownFormat is returned if an unknown output format was specified.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// scrapeEntry holds the counts of a single swarm for a full scrape.
+type scrapeEntry struct {
+	ih                               infohash
+	complete, incomplete, downloaded uint64
+	tags                             []string // only set for ListSwarms
+}
+
+// counts returns the combined seeder, leecher and download counts of the
+// swarm, without the peers selected by cutoff.
+func (sw swarm) counts(cutoff peerCutoff) (complete, incomplete, downloaded uint64) {
+	// Unsigned overflow takes care of subtracting the expired peers first.
+	expired := cutoff.countSwarm(sw)
+	seeders, leechers := expired.total()
+	complete = uint64(sw.hiddenSeeders(bittorrent.IPv4)+sw.hiddenSeeders(bittorrent.IPv6)) - seeders
+	incomplete -= leechers
+	if sw.peers4 != nil {
+		complete += uint64(sw.peers4.numSeeders)
+		incomplete += uint64(sw.peers4.numPeers - sw.peers4.numSeeders)
+		downloaded += sw.peers4.numDownloads
+	}
+	if sw.peers6 != nil {
+		complete += uint64(sw.peers6.numSeeders)
+		incomplete += uint64(sw.peers6.numPeers - sw.peers6.numSeeders)
+		downloaded += sw.peers6.numDownloads
+	}
+	return
+}
+
+// FullScrape writes the scrape data of every swarm, combined over both
+// address families, to w.
+//
+// Shards are read one at a time and only locked while their counts are
+// copied, so writers are never blocked for the whole duration.
+// The output is therefore not a consistent snapshot of the whole store.
+//
+// The output is streamed shard by shard, so only the counts of one shard are
+// held in memory at a time. Infohashes are in ascending order within every
+// shard, but not across shards.
+// Runs in linear time in regards to the number of swarms tracked.
+func (s *PeerStore) FullScrape(w io.Writer, format Format) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if format != FormatBencode && format != FormatJSON {
+		return ErrUnknownFormat
+	}
+	s.requests.inc()
+	start, ok := s.breaker.admit(opFullScrape)
+	if !ok {
+		return ErrCircuitOpen
+	}
+	defer s.breaker.done(start)
+
+	bw := bufio.NewWriter(w)
+	if format == FormatBencode {
+		bw.WriteString("d5:filesd")
+	} else {
+		bw.WriteString(`{"files":{`)
+	}
+
+	first := true
+	s.eachScrapeEntry(false, func(e scrapeEntry) error {
+		if format == FormatBencode {
+			writeBencodeScrapeEntry(bw, e)
+		} else {
+			writeJSONScrapeEntry(bw, e, first)
+		}
+		first = false
+		return nil
+	})
+
+	if format == FormatBencode {
+		bw.WriteString("ee")
+	} else {
+		bw.WriteString("}}")
+	}
+
+	return bw.Flush()
+}
+
+// eachScrapeEntry calls fn with the counts of every swarm, shard by shard,
+// and the tags of the swarms if withTags is set.
+// The counts of a shard are copied under its read lock and sorted by
+// infohash, fn is called once the shard is unlocked.
+// Returns the first error returned by fn.
+func (s *PeerStore) eachScrapeEntry(withTags bool, fn func(e scrapeEntry) error) error {
+	var entries []scrapeEntry
+	for i := 0; i < len(s.shards.shards); i++ {
+		entries = s.shardScrapeEntries(i, entries[:0], withTags)
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].ih[:], entries[j].ih[:]) < 0 })
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shardScrapeEntries appends the counts of every swarm of the shard with the
+// given index to entries, with their tags if withTags is set.
+func (s *PeerStore) shardScrapeEntries(i int, entries []scrapeEntry, withTags bool) []scrapeEntry {
+	start := len(entries)
+	shard := s.shards.rLockShard(i)
+	for ih, sw := range shard.swarms {
+		e := scrapeEntry{ih: ih}
+		if withTags {
+			e.tags = shard.tags[ih]
+		}
+		e.complete, e.incomplete, e.downloaded = sw.counts(s.peerCutoff(sw))
+		if shard.downloads != nil {
+			e.downloaded = shard.downloads[ih][0] + shard.downloads[ih][1]
+		}
+		entries = append(entries, e)
+	}
+	s.shards.rUnlockShard(i)
+
+	for j := start; j < len(entries); j++ {
+		s.privacy.perturbEntry(&entries[j])
+	}
+
+	return entries
+}
+
+func writeBencodeScrapeEntry(bw *bufio.Writer, e scrapeEntry) {
+	bw.WriteString(strconv.Itoa(len(e.ih)))
+	bw.WriteByte(':')
+	bw.Write(e.ih[:])
+	bw.WriteString("d8:completei")
+	bw.WriteString(strconv.FormatUint(e.complete, 10))
+	bw.WriteString("e10:downloadedi")
+	bw.WriteString(strconv.FormatUint(e.downloaded, 10))
+	bw.WriteString("e10:incompletei")
+	bw.WriteString(strconv.FormatUint(e.incomplete, 10))
+	bw.WriteString("ee")
+}
+
+func writeJSONScrapeEntry(bw *bufio.Writer, e scrapeEntry, first bool) {
+	if !first {
+		bw.WriteByte(',')
+	}
+	bw.WriteByte('"')
+	bw.WriteString(hex.EncodeToString(e.ih[:]))
+	bw.WriteString(`":{"complete":`)
+	bw.WriteString(strconv.FormatUint(e.complete, 10))
+	bw.WriteString(`,"downloaded":`)
+	bw.WriteString(strconv.FormatUint(e.downloaded, 10))
+	bw.WriteString(`,"incomplete":`)
+	bw.WriteString(strconv.FormatUint(e.incomplete, 10))
+	bw.WriteByte('}')
+}
@@ -0,0 +1,54 @@
+package optmem
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFullScrape(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutLeecher(ih2, p1))
+	require.Nil(t, ps.GraduateLeecher(ih2, p1))
+	require.Nil(t, ps.PutLeecher(ih2, p3))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+
+	var buf bytes.Buffer
+	err = ps.FullScrape(&buf, FormatBencode)
+	require.Nil(t, err)
+	// Swarms are written shard by shard, so their order depends on the shard
+	// seed.
+	entry1 := "20:00000000000000000000d8:completei0e10:downloadedi0e10:incompletei1ee"
+	entry2 := "20:11111111111111111111d8:completei1e10:downloadedi1e10:incompletei1ee"
+	require.Contains(t, []string{
+		"d5:filesd" + entry1 + entry2 + "ee",
+		"d5:filesd" + entry2 + entry1 + "ee",
+	}, buf.String())
+
+	buf.Reset()
+	err = ps.FullScrape(&buf, FormatJSON)
+	require.Nil(t, err)
+	var decoded struct {
+		Files map[string]struct {
+			Complete   int `json:"complete"`
+			Downloaded int `json:"downloaded"`
+			Incomplete int `json:"incomplete"`
+		} `json:"files"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(decoded.Files))
+	require.Equal(t, 1, decoded.Files["3131313131313131313131313131313131313131"].Downloaded)
+	require.Equal(t, 1, decoded.Files["3030303030303030303030303030303030303030"].Incomplete)
+
+	err = ps.FullScrape(&buf, Format(-1))
+	require.Equal(t, ErrUnknownFormat, err)
+
+	require.Nil(t, <-ps.Stop())
+}
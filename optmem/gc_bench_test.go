@@ -0,0 +1,184 @@
+package optmem
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// The benchmarks in this file populate stores with millions of peers, so
+// they take a while to set up. Run them with, for example:
+//
+//	go test -run NONE -bench 'CollectGarbage|RebalanceBucketsLarge' -benchtime 5x
+//
+// All of them report allocations, a regression in the GC path usually shows
+// up there first.
+
+// benchClock is a Clock for benchmarks, set with atomic stores.
+type benchClock struct {
+	unix int64
+}
+
+func (c *benchClock) Now() time.Time {
+	return time.Unix(atomic.LoadInt64(&c.unix), 0)
+}
+
+func (c *benchClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *benchClock) set(t time.Time) {
+	atomic.StoreInt64(&c.unix, t.Unix())
+}
+
+// gcBenchStart is the time the peers of the GC benchmarks announce at.
+var gcBenchStart = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// gcBenchPeer returns the IPv4 peer with the given index, with a public
+// address.
+func gcBenchPeer(i int) bittorrent.Peer {
+	return bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.IPv4(byte(20+i>>24%64), byte(i>>16), byte(i>>8), byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		Port: uint16(i),
+	}
+}
+
+// gcBenchStore is a store populated with peers in a number of swarms.
+type gcBenchStore struct {
+	ps         *PeerStore
+	clock      *benchClock
+	infoHashes []bittorrent.InfoHash
+}
+
+func newGCBenchStore(b *testing.B, numSwarms int) *gcBenchStore {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.GarbageCollectionInterval = 24 * time.Hour
+	cfg.PeerLifetime = time.Hour
+	cfg.DisablePrometheus = true
+	ps, err := New(cfg)
+	require.Nil(b, err)
+
+	r := rand.New(rand.NewSource(0))
+	infoHashes := make([]bittorrent.InfoHash, numSwarms)
+	for i := range infoHashes {
+		infoHashes[i] = randomInfoHash(r)
+	}
+
+	return &gcBenchStore{ps: ps, clock: clock, infoHashes: infoHashes}
+}
+
+// populate puts the peers with indices in [from,to) at time t.
+// Peers are spread evenly across the swarms, every other one a seeder.
+func (g *gcBenchStore) populate(b *testing.B, from, to int, t time.Time) {
+	g.clock.set(t)
+	for i := from; i < to; i++ {
+		ih := g.infoHashes[i%len(g.infoHashes)]
+		var err error
+		if i%2 == 0 {
+			err = g.ps.PutSeeder(ih, gcBenchPeer(i))
+		} else {
+			err = g.ps.PutLeecher(ih, gcBenchPeer(i))
+		}
+		require.Nil(b, err)
+	}
+}
+
+var gcBenchSizes = []struct {
+	swarms, peers int
+}{
+	{100000, 1000000}, // many small swarms
+	{10000, 1000000},
+	{100, 1000000}, // few large swarms, with many buckets each
+	{1, 1000000},   // a single huge swarm
+}
+
+// BenchmarkCollectGarbageScan measures garbage collection runs that do not
+// expire any peers, the common case for stores with stable swarms.
+func BenchmarkCollectGarbageScan(b *testing.B) {
+	for _, size := range gcBenchSizes {
+		b.Run(fmt.Sprintf("%d-peers-in-%d-swarms", size.peers, size.swarms), func(b *testing.B) {
+			g := newGCBenchStore(b, size.swarms)
+			defer func() { require.Nil(b, <-g.ps.Stop()) }()
+			g.populate(b, 0, size.peers, gcBenchStart)
+			cutoff := gcBenchStart.Add(-time.Minute)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stats := g.ps.collectGarbage(cutoff)
+				if stats.PeersRemoved != 0 {
+					b.Fatalf("expected no peers to be removed, got %d", stats.PeersRemoved)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCollectGarbageExpireHalf measures garbage collection runs that
+// expire half of the peers of every swarm, which rebalances the buckets of
+// large swarms.
+// The expired peers are put again between iterations, outside the timer.
+func BenchmarkCollectGarbageExpireHalf(b *testing.B) {
+	for _, size := range gcBenchSizes {
+		b.Run(fmt.Sprintf("%d-peers-in-%d-swarms", size.peers, size.swarms), func(b *testing.B) {
+			g := newGCBenchStore(b, size.swarms)
+			defer func() { require.Nil(b, <-g.ps.Stop()) }()
+			half := size.peers / 2
+			g.populate(b, half, size.peers, gcBenchStart.Add(time.Hour))
+			cutoff := gcBenchStart.Add(30 * time.Minute)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			var rebalances int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				g.populate(b, 0, half, gcBenchStart)
+				g.clock.set(gcBenchStart.Add(time.Hour))
+				b.StartTimer()
+
+				stats := g.ps.collectGarbage(cutoff)
+				if stats.PeersRemoved != half {
+					b.Fatalf("expected %d peers to be removed, got %d", half, stats.PeersRemoved)
+				}
+				rebalances += stats.Rebalances
+			}
+			b.ReportMetric(float64(rebalances)/float64(b.N), "rebalances/op")
+		})
+	}
+}
+
+// BenchmarkCollectGarbageExpireAll measures garbage collection runs that
+// remove every swarm.
+// The store is populated again between iterations, outside the timer.
+func BenchmarkCollectGarbageExpireAll(b *testing.B) {
+	for _, size := range gcBenchSizes {
+		b.Run(fmt.Sprintf("%d-peers-in-%d-swarms", size.peers, size.swarms), func(b *testing.B) {
+			g := newGCBenchStore(b, size.swarms)
+			defer func() { require.Nil(b, <-g.ps.Stop()) }()
+			cutoff := gcBenchStart.Add(30 * time.Minute)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				g.populate(b, 0, size.peers, gcBenchStart)
+				g.clock.set(gcBenchStart.Add(time.Hour))
+				b.StartTimer()
+
+				stats := g.ps.collectGarbage(cutoff)
+				if stats.SwarmsRemoved != size.swarms {
+					b.Fatalf("expected %d swarms to be removed, got %d", size.swarms, stats.SwarmsRemoved)
+				}
+			}
+		})
+	}
+}
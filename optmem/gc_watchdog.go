@@ -0,0 +1,108 @@
+package optmem
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// gcPass tracks the progress of a running garbage collection pass for the
+// watchdog.
+type gcPass struct {
+	start      time.Time
+	shard      int64 // index of the shard being collected
+	shardStart int64 // unix nanoseconds at which the shard was started
+	locked     int32 // 1 if the shard is locked, 0 while waiting for the lock
+	abort      int32 // set to 1 by the watchdog to abort the pass
+	stuck      bool  // only accessed by the watchdog, under gcMu
+}
+
+// enterShard records that the pass started collecting a shard.
+func (p *gcPass) enterShard(i int, now time.Time) {
+	atomic.StoreInt32(&p.locked, 0)
+	atomic.StoreInt64(&p.shardStart, now.UnixNano())
+	atomic.StoreInt64(&p.shard, int64(i))
+}
+
+// shardLocked records that the pass acquired the lock of its shard.
+func (p *gcPass) shardLocked() {
+	atomic.StoreInt32(&p.locked, 1)
+}
+
+// aborted returns whether the watchdog aborted the pass.
+func (p *gcPass) aborted() bool {
+	return atomic.LoadInt32(&p.abort) == 1
+}
+
+// beginGCPass registers a garbage collection pass with the watchdog.
+func (s *PeerStore) beginGCPass() *gcPass {
+	p := &gcPass{start: s.now(), shard: -1}
+	s.gcMu.Lock()
+	if s.gcPasses == nil {
+		s.gcPasses = make(map[*gcPass]struct{})
+	}
+	s.gcPasses[p] = struct{}{}
+	s.gcMu.Unlock()
+	return p
+}
+
+// endGCPass removes a finished pass from the watchdog.
+func (s *PeerStore) endGCPass(p *gcPass) {
+	s.gcMu.Lock()
+	delete(s.gcPasses, p)
+	if p.stuck {
+		promGCStuck.Dec()
+		log.Info("optmem: stuck garbage collection finished", log.Fields{"namespace": s.name, "duration": s.now().Sub(p.start), "aborted": p.aborted()})
+	}
+	s.gcMu.Unlock()
+}
+
+// runGCWatchdog periodically checks for garbage collection passes running
+// longer than the configured deadline.
+func (s *PeerStore) runGCWatchdog() {
+	interval := s.cfg.GCDeadline / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(interval):
+			s.checkGCPasses(s.now())
+		}
+	}
+}
+
+// checkGCPasses reports passes that have been running longer than the
+// configured deadline and aborts them if configured to.
+// Every pass is reported once.
+func (s *PeerStore) checkGCPasses(now time.Time) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	for p := range s.gcPasses {
+		if p.stuck || now.Sub(p.start) <= s.cfg.GCDeadline {
+			continue
+		}
+		p.stuck = true
+		promGCStuck.Inc()
+
+		shard := atomic.LoadInt64(&p.shard)
+		log.Error("optmem: garbage collection exceeded deadline", log.Fields{
+			"namespace":      s.name,
+			"deadline":       s.cfg.GCDeadline,
+			"running":        now.Sub(p.start),
+			"shard":          shard,
+			"numShards":      len(s.shards.shards),
+			"timeInShard":    now.Sub(time.Unix(0, atomic.LoadInt64(&p.shardStart))),
+			"waitingForLock": atomic.LoadInt32(&p.locked) == 0,
+			"aborting":       s.cfg.GCAbortStuck,
+		})
+
+		if s.cfg.GCAbortStuck {
+			atomic.StoreInt32(&p.abort, 1)
+		}
+	}
+}
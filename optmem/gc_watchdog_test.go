@@ -0,0 +1,47 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCWatchdog(t *testing.T) {
+	cfg := testConfig
+	cfg.GCDeadline = 50 * time.Millisecond
+	cfg.GCAbortStuck = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	// Wedge a shard, the pass gets stuck on it.
+	ps.shards.lockShard(5)
+	result := make(chan GCStats)
+	go func() {
+		result <- ps.collectGarbage(time.Now())
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	ps.gcMu.Lock()
+	require.Len(t, ps.gcPasses, 1)
+	for p := range ps.gcPasses {
+		require.True(t, p.stuck)
+		require.True(t, p.aborted())
+	}
+	ps.gcMu.Unlock()
+
+	// The pass is aborted once the wedged shard is released.
+	ps.shards.unlockShard(5, 0)
+	stats := <-result
+	require.True(t, stats.Aborted)
+
+	ps.gcMu.Lock()
+	require.Len(t, ps.gcPasses, 0)
+	ps.gcMu.Unlock()
+
+	// Passes within the deadline are not affected.
+	stats = ps.collectGarbage(time.Now())
+	require.False(t, stats.Aborted)
+
+	require.Nil(t, <-ps.Stop())
+}
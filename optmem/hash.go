@@ -0,0 +1,47 @@
+package optmem
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// mix64 is the finalizer of splitmix64, a bijection in which every input bit
+// affects every output bit.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// seededHash hashes b with a seed.
+// Every word of b is mixed with the state derived from the seed and the
+// preceding words, so collisions can not be found without knowing the seed.
+// It is not a cryptographic hash.
+func seededHash(seed uint64, b []byte) uint64 {
+	h := mix64(seed)
+	for len(b) >= 8 {
+		h = mix64(h ^ binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	}
+	var tail [8]byte
+	copy(tail[:], b)
+	return mix64(h ^ binary.LittleEndian.Uint64(tail[:]) ^ uint64(len(b))<<56)
+}
+
+// bucketSeed derives the seed used for bucket indices from the shard seed.
+func bucketSeed(seed uint64) uint64 {
+	return mix64(seed ^ 0x9e3779b97f4a7c15)
+}
+
+// randomSeed returns a random seed.
+func randomSeed() uint64 {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic("optmem: unable to read random seed: " + err.Error())
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
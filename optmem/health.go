@@ -0,0 +1,101 @@
+package optmem
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// HealthStatus is the result of a health check.
+type HealthStatus struct {
+	// Healthy is true if no problems were found.
+	Healthy bool
+
+	// ReadOnly is true if the store is read-only.
+	// A read-only store is still healthy.
+	ReadOnly bool
+
+	// LastGCActivity is the time the garbage collection goroutine last
+	// woke up or made progress.
+	LastGCActivity time.Time
+
+	// ShardsChecked is the number of shards that could be locked within the
+	// deadline.
+	ShardsChecked int
+
+	// Problems describes the problems that were found.
+	Problems []string
+}
+
+// Health checks whether the PeerStore is able to serve requests.
+//
+// It verifies that the garbage collection goroutine and, if batching is
+// enabled, the batch goroutines are alive, and that every shard can be locked
+// within the given deadline.
+// Shards are locked one at a time, the check takes at most about deadline.
+// If a shard cannot be locked in time, the check gives up on it, but keeps
+// waiting for it in the background.
+// The deadline is measured with the system clock, the activity of the
+// background goroutines with the configured Clock.
+//
+// Only the namespace Health is called on is checked.
+func (s *PeerStore) Health(deadline time.Duration) HealthStatus {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	status := HealthStatus{
+		ReadOnly:       s.isReadOnly(),
+		LastGCActivity: time.Unix(0, atomic.LoadInt64(&s.gcHeartbeat)),
+	}
+	now := s.now()
+
+	// Garbage collection wakes up every interval and makes progress on
+	// every shard, so it is considered dead if it was silent for two
+	// intervals.
+	if since := now.Sub(status.LastGCActivity); since > 2*s.cfg.GarbageCollectionInterval+deadline {
+		status.problem("garbage collection has not been active for %v", since)
+	}
+
+	for i, q := range s.batches {
+		last := time.Unix(0, atomic.LoadInt64(&q.heartbeat))
+		if since := now.Sub(last); since > 2*s.cfg.BatchFlushInterval+deadline {
+			status.problem("batch worker %d has not been active for %v", i, since)
+		}
+	}
+
+	// Walk the shards in a separate goroutine, so that a stuck lock does not
+	// block the caller.
+	var checked int64
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < len(s.shards.shards); i++ {
+			s.shards.rLockShard(i)
+			s.shards.rUnlockShard(i)
+			atomic.AddInt64(&checked, 1)
+		}
+		close(done)
+	}()
+
+	t := time.NewTimer(deadline)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		n := atomic.LoadInt64(&checked)
+		if n < int64(len(s.shards.shards)) {
+			status.problem("unable to lock shard %d within %v", n, deadline)
+		}
+	}
+	status.ShardsChecked = int(atomic.LoadInt64(&checked))
+
+	status.Healthy = len(status.Problems) == 0
+	return status
+}
+
+// problem adds a problem to the status.
+func (h *HealthStatus) problem(format string, args ...interface{}) {
+	h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,58 @@
+package optmem
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	cfg := testConfig
+	cfg.BatchQueueSize = 16
+	cfg.BatchFlushInterval = 100 * time.Millisecond
+	cfg.AdminInsecure = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	status := ps.Health(time.Second)
+	require.True(t, status.Healthy, "%v", status.Problems)
+	require.Equal(t, len(ps.shards.shards), status.ShardsChecked)
+
+	// A held lock is reported.
+	ps.shards.lockShard(3)
+	status = ps.Health(10 * time.Millisecond)
+	require.False(t, status.Healthy)
+	require.Equal(t, 3, status.ShardsChecked)
+	require.Len(t, status.Problems, 1)
+	ps.shards.unlockShard(3, 0)
+
+	// So is a silent garbage collection goroutine.
+	atomic.StoreInt64(&ps.gcHeartbeat, time.Now().Add(-time.Hour).UnixNano())
+	status = ps.Health(time.Second)
+	require.False(t, status.Healthy)
+	require.Len(t, status.Problems, 1)
+
+	srv := httptest.NewServer(ps.adminHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/health")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	atomic.StoreInt64(&ps.gcHeartbeat, time.Now().UnixNano())
+	resp, err = http.Get(srv.URL + "/health?deadline=1s")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/health?deadline=x")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	require.Nil(t, <-ps.Stop())
+}
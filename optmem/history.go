@@ -0,0 +1,145 @@
+package optmem
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// defaultHistorySize is the number of HistoryPoints kept if HistorySize is
+// not set.
+const defaultHistorySize = 360
+
+// HistoryPoint holds the aggregate counts of the store at a point in time,
+// see History.
+type HistoryPoint struct {
+	Time      time.Time
+	Swarms    uint64
+	Seeders4  uint64
+	Leechers4 uint64
+	Seeders6  uint64
+	Leechers6 uint64
+	Load      float64
+
+	// Pinned holds the counts of the pinned swarms, combined over both
+	// address families, if HistoryPinnedSwarms is set.
+	Pinned []bittorrent.Scrape `json:",omitempty"`
+}
+
+// history is a ring buffer of HistoryPoints.
+type history struct {
+	sync.Mutex
+	points []HistoryPoint
+	next   int // index the next point is written to
+	full   bool
+}
+
+func newHistory(size int) *history {
+	return &history{points: make([]HistoryPoint, size)}
+}
+
+// add appends a point, overwriting the oldest one if the buffer is full.
+func (h *history) add(p HistoryPoint) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.points[h.next] = p
+	h.next++
+	if h.next == len(h.points) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// since returns the points recorded after t, oldest first.
+func (h *history) since(t time.Time) []HistoryPoint {
+	h.Lock()
+	defer h.Unlock()
+
+	var ps []HistoryPoint
+	if h.full {
+		ps = append(ps, h.points[h.next:]...)
+	}
+	ps = append(ps, h.points[:h.next]...)
+
+	i := 0
+	for i < len(ps) && !ps[i].Time.After(t) {
+		i++
+	}
+	return ps[i:]
+}
+
+// historySize returns the configured HistorySize, or the default.
+func (cfg Config) historySize() int {
+	if cfg.HistorySize > 0 {
+		return int(cfg.HistorySize)
+	}
+	return defaultHistorySize
+}
+
+// History returns the HistoryPoints recorded after since, oldest first.
+// Points are recorded every HistoryInterval, and the last HistorySize of
+// them are kept.
+// Returns nil if HistoryInterval is not set.
+func (s *PeerStore) History(since time.Time) []HistoryPoint {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if s.history == nil {
+		return nil
+	}
+	return s.history.since(since)
+}
+
+// runHistory records a HistoryPoint at the configured interval until the
+// store is closed.
+func (s *PeerStore) runHistory() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(s.cfg.HistoryInterval):
+			s.history.add(s.historyPoint())
+		}
+	}
+}
+
+// historyPoint collects the current counts of the store.
+func (s *PeerStore) historyPoint() HistoryPoint {
+	p := HistoryPoint{
+		Time:   s.now(),
+		Swarms: s.NumSwarms(),
+		Load:   s.Load(),
+	}
+	p.Seeders4, p.Leechers4 = s.NumPeers(bittorrent.IPv4)
+	p.Seeders6, p.Leechers6 = s.NumPeers(bittorrent.IPv6)
+	if s.cfg.HistoryPinnedSwarms {
+		p.Pinned = s.pinnedScrapes()
+	}
+	return p
+}
+
+// pinnedScrapes returns the exact counts of all pinned swarms, combined over
+// both address families.
+// It read-locks every shard in turn.
+func (s *PeerStore) pinnedScrapes() []bittorrent.Scrape {
+	var scrapes []bittorrent.Scrape
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.rLockShard(i)
+		for ih, sw := range shard.swarms {
+			if !sw.pinned {
+				continue
+			}
+			cutoff := s.peerCutoff(sw)
+			combined := scrapeLocked64(shard, ih, bittorrent.IPv4, cutoff).Add(scrapeLocked64(shard, ih, bittorrent.IPv6, cutoff))
+			combined.InfoHash = bittorrent.InfoHash(ih)
+			scrapes = append(scrapes, combined.Scrape())
+		}
+		s.shards.rUnlockShard(i)
+	}
+	return scrapes
+}
@@ -0,0 +1,61 @@
+package optmem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	cfg := testConfig
+	cfg.HistoryInterval = time.Hour
+	cfg.HistorySize = 3
+	cfg.HistoryPinnedSwarms = true
+	cfg.AdminInsecure = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Len(t, ps.History(time.Time{}), 0)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.PinSwarm(ih))
+	ps.history.add(ps.historyPoint())
+
+	points := ps.History(time.Time{})
+	require.Len(t, points, 1)
+	require.Equal(t, uint64(1), points[0].Swarms)
+	require.Equal(t, uint64(1), points[0].Seeders4)
+	require.Equal(t, uint64(1), points[0].Leechers6)
+	require.Len(t, points[0].Pinned, 1)
+	require.Equal(t, ih, points[0].Pinned[0].InfoHash)
+	require.Equal(t, uint32(1), points[0].Pinned[0].Complete)
+	require.Equal(t, uint32(1), points[0].Pinned[0].Incomplete)
+
+	// Only the last HistorySize points are kept, oldest first.
+	start := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		ps.history.add(HistoryPoint{Time: start.Add(time.Duration(i) * time.Minute), Swarms: uint64(i)})
+	}
+	points = ps.History(time.Time{})
+	require.Len(t, points, 3)
+	for i, p := range points {
+		require.Equal(t, uint64(i+2), p.Swarms)
+	}
+	require.Len(t, ps.History(start.Add(3*time.Minute)), 1)
+
+	rec := httptest.NewRecorder()
+	ps.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history?since="+start.Add(2*time.Minute).Format(time.RFC3339), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &points))
+	require.Len(t, points, 2)
+
+	rec = httptest.NewRecorder()
+	ps.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history?since=yesterday", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,137 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// defaultHotSetSize is the number of seeders and leechers sampled into a hot
+// set if HotSetSize is not set.
+const defaultHotSetSize = 1024
+
+// hotSet is a random sample of the peers of a large swarm, which announces
+// are served from instead of the buckets, see HotSetThreshold.
+type hotSet struct {
+	seeders  []peer
+	leechers []peer
+}
+
+// buildHotSet samples up to size seeders and up to size leechers of a
+// peerList.
+// It runs in linear time in regards to the number of peers in the list.
+func buildHotSet(pl *peerList, size int, s0, s1 uint64) *hotSet {
+	h := &hotSet{
+		seeders:  make([]peer, 0, size),
+		leechers: make([]peer, 0, size),
+	}
+
+	// Reservoir sampling, separately for seeders and leechers.
+	var seen [2]int
+	var j int
+	for _, b := range pl.peerBuckets {
+		for _, p := range b {
+			if p.isDead() {
+				continue
+			}
+			sample, i := &h.leechers, 0
+			if p.isSeeder() {
+				sample, i = &h.seeders, 1
+			}
+			seen[i]++
+			if len(*sample) < size {
+				*sample = append(*sample, p)
+				continue
+			}
+			j, s0, s1 = random.Intn(s0, s1, seen[i])
+			if j < size {
+				(*sample)[j] = p
+			}
+		}
+	}
+
+	return h
+}
+
+// announcePeers appends up to numWant peers of the hot set for an announce to
+// dst, split into seeders and leechers like getRandomAnnouncePeers does.
+// The peers are taken from a random offset of the sample, so they are
+// distinct.
+func (h *hotSet) announcePeers(dst []peer, numWant int, seeder bool, seederShare float64, s0, s1 uint64) []peer {
+	if seeder {
+		return appendWindow(dst, h.leechers, numWant, s0, s1)
+	}
+
+	if numWant > len(h.seeders)+len(h.leechers) {
+		numWant = len(h.seeders) + len(h.leechers)
+	}
+	wantSeeders, wantLeechers := splitNumWant(numWant, len(h.seeders), len(h.leechers), seederShare)
+	dst = growPeers(dst, numWant)
+	dst = appendWindow(dst, h.seeders, wantSeeders, s0, s1)
+	return appendWindow(dst, h.leechers, wantLeechers, s1, s0)
+}
+
+// appendWindow appends n consecutive peers of ps, starting at a random offset
+// and wrapping around, to dst.
+func appendWindow(dst, ps []peer, n int, s0, s1 uint64) []peer {
+	if n > len(ps) {
+		n = len(ps)
+	}
+	if n == 0 {
+		return dst
+	}
+	offset, _, _ := random.Intn(s0, s1, len(ps))
+	if offset+n <= len(ps) {
+		return append(dst, ps[offset:offset+n]...)
+	}
+	dst = append(dst, ps[offset:]...)
+	return append(dst, ps[:n-(len(ps)-offset)]...)
+}
+
+// hotSetSize returns the configured HotSetSize, or the default.
+func (cfg Config) hotSetSize() int {
+	if cfg.HotSetSize > 0 {
+		return int(cfg.HotSetSize)
+	}
+	return defaultHotSetSize
+}
+
+// runHotSetRefresh refreshes the hot sets at the configured interval until
+// the store is closed.
+func (s *PeerStore) runHotSetRefresh() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(s.cfg.HotSetRefreshInterval):
+			refreshed := s.refreshHotSets()
+			log.Debug("optmem: refreshed hot sets", log.Fields{"namespace": s.name, "swarms": refreshed})
+		}
+	}
+}
+
+// refreshHotSets samples new hot sets for all peer lists with at least
+// HotSetThreshold peers and drops the hot sets of smaller lists.
+// Returns the number of hot sets sampled.
+func (s *PeerStore) refreshHotSets() int {
+	threshold := int(s.cfg.HotSetThreshold)
+	size := s.cfg.hotSetSize()
+	refreshed := 0
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.lockShard(i)
+		for _, sw := range shard.swarms {
+			for _, pl := range [2]*peerList{sw.peers4, sw.peers6} {
+				if pl == nil {
+					continue
+				}
+				if pl.numPeers < threshold {
+					pl.hot = nil
+					continue
+				}
+				pl.hot = buildHotSet(pl, size, randomSeed(), randomSeed())
+				refreshed++
+			}
+		}
+		s.shards.unlockShard(i, 0)
+	}
+	return refreshed
+}
@@ -0,0 +1,68 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotSets(t *testing.T) {
+	cfg := testConfig
+	cfg.HotSetThreshold = 2000
+	cfg.HotSetSize = 100
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 3000; i++ {
+		if i%3 == 0 {
+			require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+		} else {
+			require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+		}
+	}
+	require.Equal(t, 1, ps.refreshHotSets())
+
+	shard := ps.shards.shards[ps.shards.shardIndex(infohash(ih))]
+	hot := shard.swarms[infohash(ih)].peers4.hot
+	require.NotNil(t, hot)
+	require.Len(t, hot.seeders, 100)
+	require.Len(t, hot.leechers, 100)
+	for _, p := range hot.seeders {
+		require.True(t, p.isSeeder())
+	}
+
+	peers, err := ps.AnnouncePeers(ih, false, 150, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 150)
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		seen[p.IP.String()] = true
+	}
+	require.Len(t, seen, 150)
+
+	peers, err = ps.AnnouncePeers(ih, true, 150, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 100)
+
+	// Purging peers drops the hot set, which might hold them.
+	require.Equal(t, 1, purgeIP(t, ps, net.IPv4(1, 2, 0, 1)))
+	require.Nil(t, shard.swarms[infohash(ih)].peers4.hot)
+
+	// Swarms below the threshold lose their hot set.
+	require.Equal(t, 1, ps.refreshHotSets())
+	require.Equal(t, 1000, purgeRange(ps, 2, 1002))
+	require.Equal(t, 0, ps.refreshHotSets())
+	require.Nil(t, shard.swarms[infohash(ih)].peers4.hot)
+}
+
+// purgeRange purges the IPs of benchPeer(from) to benchPeer(to-1).
+func purgeRange(ps *PeerStore, from, to int) int {
+	removed := 0
+	for i := from; i < to; i++ {
+		n, _ := ps.PurgeIP(benchPeer(i).IP.IP)
+		removed += n
+	}
+	return removed
+}
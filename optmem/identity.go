@@ -0,0 +1,70 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Modes of identifying peers, see Config.PeerIdentity.
+const (
+	// PeerIdentityEndpoint identifies peers by their IP and port only.
+	PeerIdentityEndpoint = "endpoint"
+
+	// PeerIdentityEndpointPeerID identifies peers by their IP, port and
+	// peer ID.
+	PeerIdentityEndpointPeerID = "endpoint_peer_id"
+
+	// PeerIdentityAnnounceKey identifies peers by their IP and port, or
+	// the key they announce with, see PutSeederKey.
+	PeerIdentityAnnounceKey = "announce_key"
+)
+
+// identityMode is the parsed form of Config.PeerIdentity.
+type identityMode uint8
+
+const (
+	identityEndpoint identityMode = iota
+	identityPeerID
+	identityAnnounceKey
+)
+
+// identityMode returns the configured mode of identifying peers.
+// AnnounceKeys selects "announce_key" if PeerIdentity is not set.
+func (cfg Config) identityMode() identityMode {
+	switch cfg.PeerIdentity {
+	case PeerIdentityEndpointPeerID:
+		return identityPeerID
+	case PeerIdentityAnnounceKey:
+		return identityAnnounceKey
+	case "":
+		if cfg.AnnounceKeys {
+			return identityAnnounceKey
+		}
+	}
+	return identityEndpoint
+}
+
+// identityKey returns the hashed identity key of a peer putting with the
+// given announce key: its peer ID or its announce key, depending on
+// PeerIdentity.
+// Returns zero if peers are identified by their endpoint only, or if the
+// announce key is empty.
+// Keys are hashed with a random seed, so that clients can not craft keys
+// colliding with the keys of other peers.
+func (s *PeerStore) identityKey(p bittorrent.Peer, key string) uint64 {
+	var h uint64
+	switch s.identity {
+	case identityPeerID:
+		h = seededHash(s.keySeed, p.ID[:])
+	case identityAnnounceKey:
+		if key == "" {
+			return 0
+		}
+		h = seededHash(s.keySeed, []byte(key))
+	default:
+		return 0
+	}
+	if h == 0 {
+		h = 1
+	}
+	return h
+}
@@ -0,0 +1,62 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerIdentityPeerID(t *testing.T) {
+	cfg := testConfig
+	cfg.PeerIdentity = PeerIdentityEndpointPeerID
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutPeerStats(ih, p1, PeerStats{Uploaded: 1}))
+
+	// The same peer ID updates the peer.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	stats, err := ps.GetPeerStats(ih, p1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), stats.Uploaded)
+
+	// A new peer ID on the same endpoint is a new peer.
+	restarted := p1
+	restarted.ID = bittorrent.PeerIDFromString("-XX0001-restarted001")
+	_, err = ps.AnnounceAndPut(ih, false, 10, restarted)
+	require.Nil(t, err)
+	_, err = ps.GetPeerStats(ih, p1)
+	require.NotNil(t, err)
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders)
+	require.Equal(t, uint64(1), leechers)
+	ipv4, _ := ps.PutCounts()
+	require.Equal(t, PutCounts{Inserted: 2, Updated: 1}, ipv4)
+}
+
+func TestPeerIdentityAnnounceKey(t *testing.T) {
+	cfg := testConfig
+	cfg.PeerIdentity = PeerIdentityAnnounceKey
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecherKey(ih, p1, "key"))
+	require.Nil(t, ps.PutLeecherKey(ih, p2, "key"))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+}
+
+func TestPeerIdentityConfig(t *testing.T) {
+	cfg := testConfig
+	require.Equal(t, identityEndpoint, cfg.Validate().identityMode())
+	cfg.AnnounceKeys = true
+	require.Equal(t, identityAnnounceKey, cfg.Validate().identityMode())
+	cfg.PeerIdentity = PeerIdentityEndpoint
+	require.Equal(t, identityEndpoint, cfg.Validate().identityMode())
+	cfg.PeerIdentity = "unknown"
+	require.Equal(t, PeerIdentityEndpoint, cfg.Validate().PeerIdentity)
+}
@@ -0,0 +1,82 @@
+package optmem
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Modes of handling BitTorrent v2 infohashes, see Config.V2InfoHashes.
+const (
+	// V2InfoHashesTruncate truncates v2 infohashes to 20 bytes.
+	V2InfoHashesTruncate = "truncate"
+
+	// V2InfoHashesReject rejects v2 infohashes.
+	V2InfoHashesReject = "reject"
+
+	// V2InfoHashesKeyed maps v2 infohashes to 20 bytes using HMAC-SHA-256
+	// keyed with V2InfoHashKey, so that all 32 bytes select the swarm.
+	V2InfoHashesKeyed = "keyed"
+)
+
+// ErrV2InfoHash is returned for v2 infohashes if V2InfoHashes is "reject".
+var ErrV2InfoHash = bittorrent.ClientError("v2 infohashes are not supported")
+
+// InfoHashV2 is the 32 byte SHA-256 infohash of a BitTorrent v2 torrent, see
+// BEP 52.
+//
+// The store keys swarms by chihaya's 20 byte InfoHash, so v2 infohashes are
+// mapped to 20 bytes before they reach it, as configured by V2InfoHashes.
+// Swarms are not keyed by the full 32 bytes.
+type InfoHashV2 [32]byte
+
+// Truncate returns the first 20 bytes of h, which v2 clients send in tracker
+// requests.
+func (h InfoHashV2) Truncate() bittorrent.InfoHash {
+	return bittorrent.InfoHashFromBytes(h[:len(bittorrent.InfoHash{})])
+}
+
+// Keyed returns the first 20 bytes of the HMAC-SHA-256 of h with the given
+// key.
+// Unlike Truncate, it depends on all 32 bytes of h, and infohashes differing
+// only in their last 12 bytes are kept apart.
+func (h InfoHashV2) Keyed(key []byte) bittorrent.InfoHash {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(h[:])
+	return bittorrent.InfoHashFromBytes(mac.Sum(nil)[:len(bittorrent.InfoHash{})])
+}
+
+// InfoHashFromBytes returns the infohash the store keeps the swarm of a v1 or
+// v2 infohash under.
+// v1 infohashes are 20 bytes long and returned as they are.
+// v2 infohashes are 32 bytes long and handled as configured by V2InfoHashes.
+// Returns ErrV2InfoHash if v2 infohashes are rejected and an error for other
+// lengths.
+func (s *PeerStore) InfoHashFromBytes(b []byte) (bittorrent.InfoHash, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	switch len(b) {
+	case len(bittorrent.InfoHash{}):
+		return bittorrent.InfoHashFromBytes(b), nil
+	case len(InfoHashV2{}):
+		var h InfoHashV2
+		copy(h[:], b)
+		switch s.cfg.V2InfoHashes {
+		case V2InfoHashesReject:
+			return bittorrent.InfoHash{}, ErrV2InfoHash
+		case V2InfoHashesKeyed:
+			key, _ := hex.DecodeString(s.cfg.V2InfoHashKey)
+			return h.Keyed(key), nil
+		default:
+			return h.Truncate(), nil
+		}
+	default:
+		return bittorrent.InfoHash{}, bittorrent.ClientError("invalid infohash length")
+	}
+}
@@ -0,0 +1,61 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfoHashFromBytes(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	var v2 InfoHashV2
+	for i := range v2 {
+		v2[i] = byte(i)
+	}
+
+	got, err := ps.InfoHashFromBytes(ih[:])
+	require.Nil(t, err)
+	require.Equal(t, ih, got)
+
+	got, err = ps.InfoHashFromBytes(v2[:])
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.InfoHashFromBytes(v2[:20]), got)
+	require.Equal(t, v2.Truncate(), got)
+
+	_, err = ps.InfoHashFromBytes(v2[:31])
+	require.NotNil(t, err)
+
+	cfg := testConfig
+	cfg.V2InfoHashes = V2InfoHashesReject
+	ps2, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps2.Stop()) }()
+	_, err = ps2.InfoHashFromBytes(v2[:])
+	require.Equal(t, ErrV2InfoHash, err)
+	_, err = ps2.InfoHashFromBytes(ih[:])
+	require.Nil(t, err)
+
+	cfg.V2InfoHashes = V2InfoHashesKeyed
+	cfg.V2InfoHashKey = "000102030405060708090a0b0c0d0e0f"
+	ps3, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps3.Stop()) }()
+	got, err = ps3.InfoHashFromBytes(v2[:])
+	require.Nil(t, err)
+	require.Equal(t, v2.Keyed([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}), got)
+	require.NotEqual(t, v2.Truncate(), got)
+	// All 32 bytes select the swarm.
+	other := v2
+	other[31]++
+	got2, err := ps3.InfoHashFromBytes(other[:])
+	require.Nil(t, err)
+	require.NotEqual(t, got, got2)
+
+	// Without a valid key, keyed falls back to truncate.
+	cfg.V2InfoHashKey = "short"
+	require.Equal(t, V2InfoHashesTruncate, cfg.Validate().V2InfoHashes)
+}
@@ -0,0 +1,89 @@
+package optmem
+
+import (
+	"math"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// SuggestInterval suggests an announce interval for the given infohash.
+//
+// Swarms with up to LargeSwarmSize peers get the configured AnnounceInterval.
+// For larger swarms, every doubling of the swarm size adds half of the
+// AnnounceInterval.
+// If the store is under a load higher than 1 (see Load), the interval is
+// additionally multiplied by the load.
+// The result never exceeds MaxAnnounceInterval.
+func (s *PeerStore) SuggestInterval(infoHash bittorrent.InfoHash) time.Duration {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	ih := infohash(infoHash)
+	numPeers := 0
+	shard := s.shards.rLockShardByHash(ih)
+	if pl, ok := shard.swarms[ih]; ok {
+		if pl.peers4 != nil {
+			numPeers += pl.peers4.numPeers
+		}
+		if pl.peers6 != nil {
+			numPeers += pl.peers6.numPeers
+		}
+	}
+	s.shards.rUnlockShardByHash(ih)
+
+	return suggestInterval(s.cfg, numPeers, s.Load())
+}
+
+func suggestInterval(cfg Config, numPeers int, load float64) time.Duration {
+	factor := 1.0
+	if numPeers > int(cfg.LargeSwarmSize) {
+		factor += math.Log2(float64(numPeers)/float64(cfg.LargeSwarmSize)) / 2
+	}
+	if load > 1 {
+		factor *= load
+	}
+
+	interval := float64(cfg.AnnounceInterval) * factor
+	if interval > float64(cfg.MaxAnnounceInterval) {
+		return cfg.MaxAnnounceInterval
+	}
+	return time.Duration(interval)
+}
+
+// ExpiringSoon returns the number of peers of the given infohash that will
+// expire within the given window unless they announce again.
+// Runs in linear time in regards to the number of peers in the swarm.
+func (s *PeerStore) ExpiringSoon(infoHash bittorrent.InfoHash, window time.Duration) int {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	minAge := s.cfg.PeerLifetime - window
+	if minAge < 0 {
+		minAge = 0
+	}
+	now := uint16(s.nowUnix())
+
+	ih := infohash(infoHash)
+	expiring := 0
+	shard := s.shards.rLockShardByHash(ih)
+	if pl, ok := shard.swarms[ih]; ok {
+		if pl.peers4 != nil {
+			expiring += pl.peers4.countOlderThan(now, uint16(minAge/time.Second))
+		}
+		if pl.peers6 != nil {
+			expiring += pl.peers6.countOlderThan(now, uint16(minAge/time.Second))
+		}
+	}
+	s.shards.rUnlockShardByHash(ih)
+
+	return expiring
+}
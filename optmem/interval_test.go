@@ -0,0 +1,33 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var suggestIntervalData = []struct {
+	numPeers int
+	load     float64
+	expected time.Duration
+}{
+	{0, 0, 10 * time.Minute},
+	{1000, 0, 10 * time.Minute},
+	{2000, 0, 15 * time.Minute},
+	{4000, 0.5, 20 * time.Minute},
+	{1000, 2, 20 * time.Minute},
+	{2000, 2, 30 * time.Minute},
+	{1 << 30, 0, 40 * time.Minute},
+	{0, 100, 40 * time.Minute},
+}
+
+func TestSuggestInterval(t *testing.T) {
+	cfg := Config{AnnounceInterval: 10 * time.Minute, LargeSwarmSize: 1000}.Validate()
+	require.Equal(t, 40*time.Minute, cfg.MaxAnnounceInterval)
+
+	for _, c := range suggestIntervalData {
+		got := suggestInterval(cfg, c.numPeers, c.load)
+		require.Equal(t, c.expected, got, "numPeers: %d, load: %f", c.numPeers, c.load)
+	}
+}
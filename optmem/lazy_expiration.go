@@ -0,0 +1,359 @@
+package optmem
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// defaultLazyExpirationBudget is the number of other swarms of a shard a put
+// or read sweeps if LazyExpirationBudget is zero.
+const defaultLazyExpirationBudget = 2
+
+// staleSweepAge is the number of seconds after which swarms are swept by
+// sweepStale, a quarter of the range of peer times.
+const staleSweepAge = 1 << 14
+
+// maxLazyLifetime bounds PeerLifetime plus GarbageCollectionInterval if
+// LazyExpiration is set, so that peers are swept by sweepStale before their
+// peer times wrap around.
+const maxLazyLifetime = (1<<16 - 2*staleSweepAge) * time.Second
+
+// lifetime returns PeerLifetime in seconds.
+func (cfg Config) lifetime() uint16 {
+	return uint16(cfg.PeerLifetime / time.Second)
+}
+
+// peerCutoff selects the peers of a swarm that outlived PeerLifetime, but were
+// not swept yet, see LazyExpiration.
+// The zero peerCutoff selects no peers.
+type peerCutoff struct {
+	now      uint16
+	lifetime uint16
+}
+
+// expiryCutoff returns a peerCutoff selecting all peers that outlived
+// PeerLifetime if LazyExpiration is set.
+func (s *PeerStore) expiryCutoff() peerCutoff {
+	if !s.cfg.LazyExpiration {
+		return peerCutoff{}
+	}
+	return peerCutoff{now: uint16(s.nowUnix()), lifetime: s.cfg.lifetime()}
+}
+
+// peerCutoff works like expiryCutoff, but returns the zero peerCutoff if no
+// peer of the swarm can have outlived PeerLifetime, so that reads of the
+// swarm need not check its peers.
+func (s *PeerStore) peerCutoff(sw swarm) peerCutoff {
+	return s.expiryCutoff().forSwarm(sw)
+}
+
+// forSwarm returns c, or the zero peerCutoff if no peer of the swarm can be
+// selected by c.
+func (c peerCutoff) forSwarm(sw swarm) peerCutoff {
+	if c.now-sw.oldest < c.lifetime {
+		return peerCutoff{}
+	}
+	return c
+}
+
+// active returns whether the peerCutoff selects any peers.
+func (c peerCutoff) active() bool {
+	return c.lifetime != 0
+}
+
+// expired returns whether p is selected by the peerCutoff.
+func (c peerCutoff) expired(p *peer) bool {
+	return c.active() && c.now-p.peerTime() >= c.lifetime
+}
+
+// keep extends keep to reject the selected peers.
+// keep may be nil, nil is returned if the peerCutoff is not active.
+func (c peerCutoff) keep(keep func(p *peer) bool) func(p *peer) bool {
+	switch {
+	case !c.active():
+		return keep
+	case keep == nil:
+		return func(p *peer) bool { return !c.expired(p) }
+	default:
+		return func(p *peer) bool { return !c.expired(p) && keep(p) }
+	}
+}
+
+// filter removes the selected peers from ps[start:], keeping the order of
+// the others.
+func (c peerCutoff) filter(ps []peer, start int) []peer {
+	if !c.active() {
+		return ps
+	}
+	n := start
+	for i := start; i < len(ps); i++ {
+		if !c.expired(&ps[i]) {
+			ps[n] = ps[i]
+			n++
+		}
+	}
+	return ps[:n]
+}
+
+// count returns the number of selected peers and seeders of l, which may be
+// nil.
+// It runs in linear time in regards to the number of peers in l, unless the
+// peerCutoff is not active.
+func (c peerCutoff) count(l *peerList) (peers, seeders int) {
+	if !c.active() || l == nil {
+		return 0, 0
+	}
+	for _, b := range l.peerBuckets {
+		for i := range b {
+			if !b[i].isDead() && c.expired(&b[i]) {
+				peers++
+				if b[i].isSeeder() {
+					seeders++
+				}
+			}
+		}
+	}
+	return peers, seeders
+}
+
+// countSwarm returns the selected peers and seeders of both address families
+// of a swarm.
+func (c peerCutoff) countSwarm(sw swarm) (counts peerCounts) {
+	peers, seeders := c.count(sw.peers4)
+	counts.peers4, counts.seeders4 = uint64(peers), uint64(seeders)
+	peers, seeders = c.count(sw.peers6)
+	counts.peers6, counts.seeders6 = uint64(peers), uint64(seeders)
+	return counts
+}
+
+// unexpiredPeerCounts returns the counts of all shards without the peers
+// that outlived PeerLifetime, if LazyExpiration is set.
+// Every shard is read-locked in turn to find the swarms holding expired
+// peers, only their peers are walked.
+func (s *PeerStore) unexpiredPeerCounts() peerCounts {
+	counts := s.shards.getPeerCounts()
+	if !s.cfg.LazyExpiration {
+		return counts
+	}
+	cutoff := s.expiryCutoff()
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.rLockShard(i)
+		for _, sw := range shard.swarms {
+			expired := cutoff.forSwarm(sw).countSwarm(sw)
+			counts.sub(bittorrent.IPv4, int(expired.peers4), int(expired.seeders4))
+			counts.sub(bittorrent.IPv6, int(expired.peers6), int(expired.seeders6))
+		}
+		s.shards.rUnlockShard(i)
+	}
+	return counts
+}
+
+// sweepDue returns whether the swarm is swept by the next put or read, see
+// sweepLocked.
+func (s *PeerStore) sweepDue(sw swarm) bool {
+	return s.cfg.LazyExpiration && uint16(s.nowUnix())-sw.swept >= uint16(s.cfg.GarbageCollectionInterval/time.Second)
+}
+
+// sweepAfterRead sweeps the shard of ih like a put does, if the swarm of ih
+// was found due by a read, see sweepDue.
+// Reads do not wait for the write lock, the shard is left to later reads and
+// puts if it is locked.
+// The shard must not be locked by the caller.
+func (s *PeerStore) sweepAfterRead(ih infohash, due bool) {
+	if !due || s.isReadOnly() {
+		return
+	}
+	i := s.shards.shardIndex(ih)
+	shard, ok := s.shards.tryLockShard(i)
+	if !ok {
+		return
+	}
+	removed, evicted := s.sweepLocked(shard, ih, nil)
+	s.shards.unlockShard(i, -removed)
+	s.finishSweep(evicted)
+}
+
+// sweepLocked removes expired peers from the swarm of ih and up to
+// LazyExpirationBudget other swarms of the shard, if LazyExpiration is set.
+// Every swarm is swept at most once per GarbageCollectionInterval, so puts
+// and reads of large swarms do not walk all their peers every time.
+// Returns the number of swarms removed and the evicted peers appended to
+// evicted, which must be passed to finishSweep once the shard is unlocked.
+// The shard must be write-locked by the caller.
+func (s *PeerStore) sweepLocked(shard *shard, ih infohash, evicted []EvictedPeer) (removed int, _ []EvictedPeer) {
+	if !s.cfg.LazyExpiration {
+		return 0, evicted
+	}
+
+	now := uint16(s.nowUnix())
+	interval := uint16(s.cfg.GarbageCollectionInterval / time.Second)
+	var buf *[]peer
+	if s.hooks.hasEvictionCallbacks() {
+		buf = new([]peer)
+	}
+	sweep := func(ih infohash, sw swarm) {
+		if now-sw.swept < interval || sw.compacted != nil {
+			return
+		}
+		var deleted bool
+		evicted, deleted = s.sweepSwarmLocked(shard, ih, sw, now, buf, evicted)
+		if deleted {
+			removed++
+		}
+	}
+
+	if sw, ok := shard.swarms[ih]; ok {
+		sweep(ih, sw)
+	}
+	budget := int(s.cfg.LazyExpirationBudget)
+	if budget == 0 {
+		budget = defaultLazyExpirationBudget
+	}
+	// Map iteration starts at a random swarm, so idle swarms are eventually
+	// swept by puts and reads of other swarms of their shard, or else by
+	// sweepStale.
+	for other, sw := range shard.swarms {
+		if budget == 0 {
+			break
+		}
+		budget--
+		if other != ih {
+			sweep(other, sw)
+		}
+	}
+	return removed, evicted
+}
+
+// sweepSwarmLocked removes the expired peers of a swarm, and the swarm if it
+// is left without peers and is neither retained nor young.
+// Returns the evicted peers appended to evicted, and whether the swarm was
+// removed.
+// The shard must be write-locked by the caller.
+func (s *PeerStore) sweepSwarmLocked(shard *shard, ih infohash, sw swarm, now uint16, buf *[]peer, evicted []EvictedPeer) ([]EvictedPeer, bool) {
+	lifetime := s.cfg.lifetime()
+	cutoff := now - lifetime
+	final := sw
+	keep := sw.retained() || sw.young(now, uint16(s.cfg.MinSwarmLifetime/time.Second))
+
+	var expired4, expired6 int
+	var changed bool
+	if sw.peers4 != nil {
+		peers, seeders := sw.peers4.numPeers, sw.peers4.numSeeders
+		if sw.peers4.collectGarbage(cutoff, lifetime, buf) {
+			changed = true
+			evicted = takeEvictedPeers(evicted, ih, bittorrent.IPv4, buf)
+			expired4 = peers - sw.peers4.numPeers
+			shard.counts.sub(bittorrent.IPv4, expired4, seeders-sw.peers4.numSeeders)
+			if sw.peers4.numPeers == 0 && !keep {
+				sw.peers4 = nil
+			} else {
+				sw.peers4.rebalanceBuckets()
+			}
+		}
+	}
+	if sw.peers6 != nil {
+		peers, seeders := sw.peers6.numPeers, sw.peers6.numSeeders
+		if sw.peers6.collectGarbage(cutoff, lifetime, buf) {
+			changed = true
+			evicted = takeEvictedPeers(evicted, ih, bittorrent.IPv6, buf)
+			expired6 = peers - sw.peers6.numPeers
+			shard.counts.sub(bittorrent.IPv6, expired6, seeders-sw.peers6.numSeeders)
+			if sw.peers6.numPeers == 0 && !keep {
+				sw.peers6 = nil
+			} else {
+				sw.peers6.rebalanceBuckets()
+			}
+		}
+	}
+	if expired4+expired6 > 0 {
+		promGCExpired4.Add(float64(expired4))
+		promGCExpired6.Add(float64(expired6))
+		metricsReporters.count("gc.expired_peers.ipv4", int64(expired4))
+		metricsReporters.count("gc.expired_peers.ipv6", int64(expired6))
+	}
+
+	if !keep && sw.peers4 == nil && sw.peers6 == nil {
+		s.hooks.swarmRemoved(shard, ih, final)
+		shard.deleteSwarm(ih)
+		return evicted, true
+	}
+
+	if !changed && !s.cfg.LazyExpiration {
+		return evicted, false
+	}
+	if s.cfg.LazyExpiration {
+		sw.oldest = now
+		for _, l := range [2]*peerList{sw.peers4, sw.peers6} {
+			if l != nil {
+				sw.oldest = l.oldestPeerTime(now, sw.oldest)
+			}
+		}
+	}
+	sw.swept = now
+	if changed {
+		sw.version = shard.nextVersion()
+		// Samples might hold the expired peers, see selectPeers.
+		for _, l := range [2]*peerList{sw.peers4, sw.peers6} {
+			if l != nil {
+				l.hot = nil
+			}
+		}
+		if shard.selections != nil {
+			shard.selections.Delete(selectionKey{ih: ih, af: bittorrent.IPv4})
+			shard.selections.Delete(selectionKey{ih: ih, af: bittorrent.IPv6})
+		}
+	}
+	shard.setSwarm(ih, sw)
+	return evicted, false
+}
+
+// sweepStale sweeps the swarms that were not swept for staleSweepAge
+// seconds, if sweepStale did not run for that long.
+// Puts and reads only sweep the swarms of their shards, this bounds the age
+// of the peers of swarms that are left alone, so that their peer times do not
+// wrap around, see maxLazyLifetime.
+// Returns the number of swarms swept.
+func (s *PeerStore) sweepStale() int {
+	now := s.nowUnix()
+	if now-s.lastStaleSweep < staleSweepAge {
+		return 0
+	}
+	s.lastStaleSweep = now
+
+	swept := 0
+	var buf *[]peer
+	if s.hooks.hasEvictionCallbacks() {
+		buf = new([]peer)
+	}
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.lockShard(i)
+		removed := 0
+		var evicted []EvictedPeer
+		for ih, sw := range shard.swarms {
+			if uint16(now)-sw.swept < staleSweepAge {
+				continue
+			}
+			var deleted bool
+			evicted, deleted = s.sweepSwarmLocked(shard, ih, sw, uint16(now), buf, evicted)
+			if deleted {
+				removed++
+			}
+			swept++
+		}
+		s.shards.unlockShard(i, -removed)
+		s.finishSweep(evicted)
+	}
+	return swept
+}
+
+// finishSweep hands the peers evicted by sweepLocked to the eviction
+// callbacks.
+// The shard must not be locked.
+func (s *PeerStore) finishSweep(evicted []EvictedPeer) {
+	if len(evicted) == 0 {
+		return
+	}
+	s.anonymizeEvictedPeers(evicted)
+	s.hooks.peersEvicted(evicted)
+}
@@ -0,0 +1,183 @@
+package optmem
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyExpiration(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.ShardCountBits = 1
+	cfg.PeerLifetime = 5 * time.Minute
+	cfg.LazyExpiration = true
+	cfg.LazyExpirationBudget = 100
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	// Find a second infohash in the same shard.
+	var ih2 bittorrent.InfoHash
+	for i := 0; ; i++ {
+		ih2 = bittorrent.InfoHashFromString(fmt.Sprintf("%020d", i+1))
+		if ps.shards.shardIndex(infohash(ih2)) == ps.shards.shardIndex(infohash(ih)) {
+			break
+		}
+	}
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih2, p2))
+	atomic.AddInt64(&clock.unix, 300)
+
+	// Expired peers are stored until their swarm is due, but neither
+	// returned nor counted.
+	peers, err := ps.AnnouncePeers(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+	require.Equal(t, 0, ps.NumSeeders(ih2))
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders)
+	require.Equal(t, uint64(0), leechers)
+	seeders, leechers = ps.shards.getPeerCounts().total()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(1), leechers)
+	require.Equal(t, uint64(2), ps.NumSwarms())
+
+	// Reads of due swarms remove expired peers and empty swarms of their
+	// shard.
+	atomic.AddInt64(&clock.unix, 300)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	// So do puts.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih2, p2))
+	atomic.AddInt64(&clock.unix, 600)
+	require.Nil(t, ps.PutSeeder(ih, p3))
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	seeders, leechers = ps.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(0), leechers)
+	require.True(t, ps.CheckConsistency().OK())
+
+	// Swarms left alone are swept before their peer times wrap around.
+	require.Equal(t, 0, ps.sweepStale())
+	atomic.AddInt64(&clock.unix, staleSweepAge)
+	require.Equal(t, 1, ps.sweepStale())
+	require.Equal(t, uint64(0), ps.NumSwarms())
+}
+
+func TestLazyExpirationGetPeers(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.PeerLifetime = 5 * time.Minute
+	cfg.LazyExpiration = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+	atomic.AddInt64(&clock.unix, 300)
+
+	peers4, peers6, err := ps.GetSeeders(ih)
+	require.Nil(t, err)
+	require.Len(t, peers4, 0)
+	require.Len(t, peers6, 0)
+	peers4, peers6, err = ps.GetLeechers(ih)
+	require.Nil(t, err)
+	require.Len(t, peers4, 0)
+	require.Len(t, peers6, 0)
+	require.Equal(t, uint64(1), ps.NumSwarms())
+
+	// Reads of due swarms remove them.
+	atomic.AddInt64(&clock.unix, 300)
+	_, _, err = ps.GetSeeders(ih)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+}
+
+func TestLazyExpirationNumWant(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.PeerLifetime = 5 * time.Minute
+	cfg.LazyExpiration = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+	atomic.AddInt64(&clock.unix, 300)
+	for i := 100; i < 104; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+	require.Nil(t, ps.PutSeeder(ih, p3))
+
+	// Expired peers do not take the place of the others.
+	peers, err := ps.AnnouncePeers(ih, false, 5, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 4)
+	for _, p := range peers {
+		require.True(t, p.IP.To4()[3] >= 100)
+	}
+
+	// Nor do they count when numWant is split between address families.
+	peers4, peers6, err := ps.AnnouncePeersDualStack(ih, false, 5, p2)
+	require.Nil(t, err)
+	require.Len(t, peers4, 4)
+	require.Len(t, peers6, 1)
+}
+
+func TestLazyExpirationAnnounceCache(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.PeerLifetime = 5 * time.Minute
+	cfg.LazyExpiration = true
+	cfg.AnnounceCacheThreshold = 1
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	atomic.AddInt64(&clock.unix, 300)
+	require.Nil(t, ps.PutSeeder(ih, p2))
+
+	// The sample holds the expired peer, which is not returned.
+	peers, err := ps.AnnouncePeers(ih, false, 10, benchPeer(1))
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.True(t, peers[0].IP.Equal(p2.IP.IP))
+	shard := ps.shards.shards[ps.shards.shardIndex(infohash(ih))]
+	_, ok := shard.selections.Load(selectionKey{ih: infohash(ih), af: bittorrent.IPv4})
+	require.True(t, ok)
+}
+
+func TestLazyExpirationValidate(t *testing.T) {
+	cfg := testConfig
+	cfg.LazyExpiration = true
+	cfg.SpillAfter = time.Minute
+	cfg.SeederCompactionAfter = time.Minute
+	cfg.LockFreeScrapes = true
+	valid := cfg.Validate()
+	require.True(t, valid.LazyExpiration)
+	require.Equal(t, time.Duration(0), valid.SpillAfter)
+	require.Equal(t, time.Duration(0), valid.SeederCompactionAfter)
+	require.False(t, valid.LockFreeScrapes)
+
+	// Peer times must not wrap around before sweepStale runs.
+	cfg.PeerLifetime = 9 * time.Hour
+	require.False(t, cfg.Validate().LazyExpiration)
+}
@@ -0,0 +1,283 @@
+package optmem
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// lifecycleHooks holds the callbacks registered for swarm creation and
+// removal.
+// Callbacks are only ever appended, so the slices read under mu may be
+// iterated after releasing it. Callbacks are called without holding mu, so
+// that they can register further callbacks.
+type lifecycleHooks struct {
+	mu        sync.RWMutex
+	created   []func(bittorrent.InfoHash)
+	removed   []func(bittorrent.InfoHash, SwarmStats)
+	evicted   []func([]EvictedPeer)
+	graduated []func(bittorrent.InfoHash, bittorrent.Peer)
+
+	// Set to 1 once a callback of the respective kind is registered, so that
+	// the hot paths can skip the lock.
+	hasCreated   int32
+	hasRemoved   int32
+	hasEvicted   int32
+	hasGraduated int32
+}
+
+// swarmEvent is the creation or removal of a swarm.
+type swarmEvent struct {
+	ih      infohash
+	removed bool
+	final   SwarmStats // final counters of a removed swarm
+}
+
+// swarmEvents queues the swarm events of a shard while it is locked, until
+// they are passed to the callbacks after it is unlocked, see unlockShard.
+type swarmEvents struct {
+	pending    int32 // number of queued events, accessed atomically
+	mu         sync.Mutex
+	queue      []swarmEvent
+	delivering bool // whether a goroutine is passing events to the callbacks
+}
+
+// push queues an event.
+// The shard must be write-locked by the caller.
+func (q *swarmEvents) push(e swarmEvent) {
+	q.mu.Lock()
+	q.queue = append(q.queue, e)
+	atomic.AddInt32(&q.pending, 1)
+	q.mu.Unlock()
+}
+
+// swarmCreated queues a call of the registered creation callbacks.
+// The shard must be write-locked by the caller.
+func (h *lifecycleHooks) swarmCreated(shard *shard, ih infohash) {
+	if atomic.LoadInt32(&h.hasCreated) == 0 {
+		return
+	}
+	shard.events.push(swarmEvent{ih: ih})
+}
+
+// swarmRemoved queues a call of the registered removal callbacks with the
+// final counters of the swarm.
+// It must be called before the swarm is deleted from its shard, which must be
+// write-locked by the caller.
+func (h *lifecycleHooks) swarmRemoved(shard *shard, ih infohash, sw swarm) {
+	if atomic.LoadInt32(&h.hasRemoved) == 0 {
+		return
+	}
+
+	final := sw.stats(bittorrent.InfoHash(ih))
+	final.Tags = append([]string(nil), shard.tags[ih]...)
+	shard.events.push(swarmEvent{ih: ih, removed: true, final: final})
+}
+
+// deliver passes the queued events of a shard to the callbacks.
+// Only one goroutine delivers the events of a shard at a time, others leave
+// their events to it, so events are passed on in the order they were queued
+// although the shard is not locked meanwhile.
+// The shard must not be locked.
+func (h *lifecycleHooks) deliver(q *swarmEvents) {
+	q.mu.Lock()
+	if q.delivering {
+		q.mu.Unlock()
+		return
+	}
+	q.delivering = true
+	for len(q.queue) > 0 {
+		events := q.queue
+		q.queue = nil
+		atomic.AddInt32(&q.pending, -int32(len(events)))
+		q.mu.Unlock()
+
+		h.mu.RLock()
+		created, removed := h.created, h.removed
+		h.mu.RUnlock()
+		for _, e := range events {
+			if e.removed {
+				for _, f := range removed {
+					f(bittorrent.InfoHash(e.ih), e.final)
+				}
+			} else {
+				for _, f := range created {
+					f(bittorrent.InfoHash(e.ih))
+				}
+			}
+		}
+
+		q.mu.Lock()
+	}
+	q.delivering = false
+	q.mu.Unlock()
+}
+
+// stats returns the scrape data of the swarm.
+// Counts that do not fit into 32 bits are saturated.
+func (sw swarm) stats(infoHash bittorrent.InfoHash) SwarmStats {
+	var stats SwarmStats64
+	stats.IPv4.InfoHash = infoHash
+	stats.IPv6.InfoHash = infoHash
+	if sw.peers4 != nil {
+		stats.IPv4.Snatches = sw.peers4.numDownloads
+		stats.IPv4.Complete = uint64(sw.peers4.numSeeders + sw.hiddenSeeders(bittorrent.IPv4))
+		stats.IPv4.Incomplete = uint64(sw.peers4.numPeers - sw.peers4.numSeeders)
+	}
+	if sw.peers6 != nil {
+		stats.IPv6.Snatches = sw.peers6.numDownloads
+		stats.IPv6.Complete = uint64(sw.peers6.numSeeders + sw.hiddenSeeders(bittorrent.IPv6))
+		stats.IPv6.Incomplete = uint64(sw.peers6.numPeers - sw.peers6.numSeeders)
+	}
+	stats.Combined = stats.IPv4.Add(stats.IPv6)
+	return stats.swarmStats()
+}
+
+// OnSwarmCreated registers a callback that is called whenever a swarm is
+// created, i.e. when the first peer is added to it or it is pinned.
+//
+// Callbacks are called after the shard of the swarm is unlocked, by the
+// goroutine that created the swarm or by one that changed another swarm of
+// the same shard meanwhile.
+// The callbacks for the swarms of a shard are called in order, one at a time.
+// They may call into the PeerStore, but should return quickly, because they
+// delay the operations that call them.
+func (s *PeerStore) OnSwarmCreated(f func(infoHash bittorrent.InfoHash)) {
+	s.hooks.mu.Lock()
+	s.hooks.created = append(s.hooks.created, f)
+	atomic.StoreInt32(&s.hooks.hasCreated, 1)
+	s.hooks.mu.Unlock()
+}
+
+// OnSwarmRemoved registers a callback that is called whenever a swarm is
+// removed, because its last peer was deleted or garbage collected, it was
+// unpinned without peers, or it was removed explicitly.
+// The callback receives the final counters of the swarm.
+//
+// Every swarm for which the creation callbacks were called is eventually
+// passed to the removal callbacks, unless the PeerStore is stopped first.
+// The same restrictions as for OnSwarmCreated apply.
+func (s *PeerStore) OnSwarmRemoved(f func(infoHash bittorrent.InfoHash, final SwarmStats)) {
+	s.hooks.mu.Lock()
+	s.hooks.removed = append(s.hooks.removed, f)
+	atomic.StoreInt32(&s.hooks.hasRemoved, 1)
+	s.hooks.mu.Unlock()
+}
+
+// EvictedPeer is a peer removed by garbage collection because it did not
+// announce within the peer lifetime.
+type EvictedPeer struct {
+	InfoHash bittorrent.InfoHash
+
+	// Peer holds the IP and port of the peer.
+	// Peer IDs are not stored, so the ID is always zero.
+	Peer bittorrent.Peer
+
+	// Seeder is true if the peer was a seeder, false if it was a leecher.
+	Seeder bool
+
+	// CryptoSupported and CryptoRequired are the encryption flags the peer
+	// announced with.
+	CryptoSupported bool
+	CryptoRequired  bool
+
+	// WebRTC is true if the peer was stored with TransportWebRTC.
+	WebRTC bool
+
+	// External is true if the peer was learned from an upstream tracker,
+	// see FederationConfig.
+	External bool
+}
+
+// hasEvictionCallbacks returns whether eviction callbacks are registered,
+// i.e. whether garbage collection has to collect the evicted peers.
+func (h *lifecycleHooks) hasEvictionCallbacks() bool {
+	return atomic.LoadInt32(&h.hasEvicted) == 1
+}
+
+// peersEvicted calls the registered eviction callbacks.
+// It must be called without holding a shard lock.
+func (h *lifecycleHooks) peersEvicted(peers []EvictedPeer) {
+	h.mu.RLock()
+	evicted := h.evicted
+	h.mu.RUnlock()
+	for _, f := range evicted {
+		f(peers)
+	}
+}
+
+// takeEvictedPeers appends the peers of an address family of a swarm
+// removed by garbage collection to dst and truncates removed.
+// removed may be nil if no eviction callbacks are registered.
+func takeEvictedPeers(dst []EvictedPeer, ih infohash, af bittorrent.AddressFamily, removed *[]peer) []EvictedPeer {
+	if removed == nil {
+		return dst
+	}
+	peers := appendBittorrentPeers(nil, *removed, af)
+	for i := range *removed {
+		p := &(*removed)[i]
+		dst = append(dst, EvictedPeer{
+			InfoHash:        bittorrent.InfoHash(ih),
+			Peer:            peers[i],
+			Seeder:          p.isSeeder(),
+			CryptoSupported: p.peerFlag()&peerFlagCryptoSupported != 0,
+			CryptoRequired:  p.requiresCrypto(),
+			WebRTC:          p.isWebRTC(),
+			External:        p.isExternal(),
+		})
+	}
+	*removed = (*removed)[:0]
+	return dst
+}
+
+// OnPeersEvicted registers a callback that is called with the peers removed
+// by garbage collection, for example to mark them inactive in a database.
+//
+// Callbacks are called once per shard and garbage collection run with all
+// peers evicted from the shard, after the shard is unlocked.
+// They may call into the PeerStore, but should return quickly, because
+// garbage collection waits for them.
+// The slice passed to a callback is not reused and may be retained.
+// Peers removed by deletes, or together with their swarm by spilling or by
+// explicit removal, are not passed to the callbacks.
+func (s *PeerStore) OnPeersEvicted(f func(peers []EvictedPeer)) {
+	s.hooks.mu.Lock()
+	s.hooks.evicted = append(s.hooks.evicted, f)
+	atomic.StoreInt32(&s.hooks.hasEvicted, 1)
+	s.hooks.mu.Unlock()
+}
+
+// leecherGraduated calls the registered graduation callbacks.
+func (h *lifecycleHooks) leecherGraduated(infoHash bittorrent.InfoHash, p bittorrent.Peer) {
+	if atomic.LoadInt32(&h.hasGraduated) == 0 {
+		return
+	}
+
+	h.mu.RLock()
+	graduated := h.graduated
+	h.mu.RUnlock()
+	for _, f := range graduated {
+		f(infoHash, p)
+	}
+}
+
+// OnLeecherGraduated registers a callback that is called whenever
+// GraduateLeecher, or one of its variants, turns a stored leecher into a
+// seeder.
+// Completed downloads of peers that were already seeders, or were not stored,
+// are counted in the snatches of the swarm, but not reported.
+// The callback receives the peer as passed to GraduateLeecher, including its
+// ID.
+//
+// Callbacks are called synchronously by GraduateLeecher after the peer is
+// stored and the shard is unlocked, so they may call into the PeerStore, but
+// delay the announce until they return.
+// If batching is enabled, they are called by the batch worker once the
+// graduation is applied, and not at all if it is rejected.
+func (s *PeerStore) OnLeecherGraduated(f func(infoHash bittorrent.InfoHash, p bittorrent.Peer)) {
+	s.hooks.mu.Lock()
+	s.hooks.graduated = append(s.hooks.graduated, f)
+	atomic.StoreInt32(&s.hooks.hasGraduated, 1)
+	s.hooks.mu.Unlock()
+}
@@ -0,0 +1,230 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleCallbacks(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	var created []bittorrent.InfoHash
+	var removed []SwarmStats
+	ps.OnSwarmCreated(func(infoHash bittorrent.InfoHash) { created = append(created, infoHash) })
+	ps.OnSwarmRemoved(func(infoHash bittorrent.InfoHash, final SwarmStats) { removed = append(removed, final) })
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Equal(t, []bittorrent.InfoHash{ih}, created)
+	require.Len(t, removed, 0)
+
+	require.Nil(t, ps.DeleteLeecher(ih, p3))
+	require.Len(t, removed, 0)
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	require.Len(t, removed, 1)
+	require.Equal(t, ih, removed[0].Combined.InfoHash)
+	require.Equal(t, uint32(1), removed[0].IPv4.Snatches)
+	require.Equal(t, uint32(0), removed[0].Combined.Complete)
+
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	require.Len(t, created, 2)
+	require.Equal(t, 1, ps.RemoveSwarms(func(bittorrent.InfoHash) bool { return true }))
+	require.Len(t, removed, 2)
+	require.Equal(t, uint32(1), removed[1].Combined.Complete)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestLifecycleCallbacksCallIntoStore(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	var created []bittorrent.InfoHash
+	var removed []bittorrent.InfoHash
+	ps.OnSwarmCreated(func(infoHash bittorrent.InfoHash) {
+		created = append(created, infoHash)
+		// The shard is unlocked, so the callback can use the store, even to
+		// create and remove other swarms.
+		if infoHash == ih {
+			require.Equal(t, 1, ps.NumLeechers(ih))
+			// The totals include the swarm and its peer.
+			require.Equal(t, uint64(1), ps.NumSwarms())
+			_, leechers := ps.NumTotalPeers()
+			require.Equal(t, uint64(1), leechers)
+			require.Nil(t, ps.PinSwarm(ih2))
+		}
+	})
+	ps.OnSwarmRemoved(func(infoHash bittorrent.InfoHash, final SwarmStats) {
+		removed = append(removed, infoHash)
+		if infoHash == ih {
+			_, leechers := ps.NumTotalPeers()
+			require.Equal(t, uint64(0), leechers)
+			require.Nil(t, ps.UnpinSwarm(ih2))
+		}
+	})
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Equal(t, []bittorrent.InfoHash{ih, ih2}, created)
+	require.Nil(t, ps.DeleteLeecher(ih, p1))
+	require.Equal(t, []bittorrent.InfoHash{ih, ih2}, removed)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestLifecycleCallbacksRegister(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	var created, graduated []bittorrent.InfoHash
+	ps.OnSwarmCreated(func(infoHash bittorrent.InfoHash) {
+		// Callbacks can register further callbacks, which are called from
+		// the next event on.
+		if len(created) == 0 {
+			ps.OnSwarmCreated(func(infoHash bittorrent.InfoHash) { created = append(created, infoHash) })
+		}
+		created = append(created, infoHash)
+	})
+	ps.OnLeecherGraduated(func(infoHash bittorrent.InfoHash, _ bittorrent.Peer) {
+		if len(graduated) == 0 {
+			ps.OnLeecherGraduated(func(infoHash bittorrent.InfoHash, _ bittorrent.Peer) { graduated = append(graduated, infoHash) })
+		}
+		graduated = append(graduated, infoHash)
+	})
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih2, p1))
+	require.Equal(t, []bittorrent.InfoHash{ih, ih2, ih2}, created)
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih2, p1))
+	require.Equal(t, []bittorrent.InfoHash{ih, ih2, ih2}, graduated)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestEvictionCallback(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	var evicted []EvictedPeer
+	ps.OnPeersEvicted(func(peers []EvictedPeer) {
+		// The shard is unlocked, so the callback can read from the store.
+		require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+		evicted = append(evicted, peers...)
+	})
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.DeleteSeeder(ih, p2))
+
+	// Nothing expires.
+	_, err = ps.CollectGarbage(time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	require.Len(t, evicted, 0)
+
+	_, err = ps.CollectGarbage(time.Now())
+	require.Nil(t, err)
+	require.Len(t, evicted, 2)
+	byFamily := make(map[bittorrent.AddressFamily]EvictedPeer)
+	for _, e := range evicted {
+		require.Equal(t, ih, e.InfoHash)
+		require.False(t, e.Seeder)
+		byFamily[e.Peer.IP.AddressFamily] = e
+	}
+	require.True(t, byFamily[bittorrent.IPv4].Peer.EqualEndpoint(p1))
+	require.True(t, byFamily[bittorrent.IPv6].Peer.EqualEndpoint(p3))
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestGraduationCallback(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	var graduated []bittorrent.Peer
+	ps.OnLeecherGraduated(func(infoHash bittorrent.InfoHash, p bittorrent.Peer) {
+		require.Equal(t, ih, infoHash)
+		require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, p.IP.AddressFamily).Snatches)
+		graduated = append(graduated, p)
+	})
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	require.Len(t, graduated, 0)
+
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Equal(t, []bittorrent.Peer{p1}, graduated)
+
+	// Seeders and peers that are not stored do not graduate.
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p2))
+	require.Nil(t, ps.GraduateLeecher(ih, p3))
+	require.Len(t, graduated, 1)
+
+	ps.SetReadOnly(true)
+	require.Equal(t, ErrReadOnly, ps.GraduateLeecher(ih, p1))
+	require.Len(t, graduated, 1)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestGraduationCallbackVariants(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	var graduated []bittorrent.Peer
+	ps.OnLeecherGraduated(func(_ bittorrent.InfoHash, p bittorrent.Peer) {
+		graduated = append(graduated, p)
+	})
+
+	variants := map[string]func(p bittorrent.Peer) error{
+		"GraduateLeecher":          func(p bittorrent.Peer) error { return ps.GraduateLeecher(ih, p) },
+		"GraduateLeecherKey":       func(p bittorrent.Peer) error { return ps.GraduateLeecherKey(ih, p, "key") },
+		"GraduateLeecherCrypto":    func(p bittorrent.Peer) error { return ps.GraduateLeecherCrypto(ih, p, CryptoSupported) },
+		"GraduateLeecherTransport": func(p bittorrent.Peer) error { return ps.GraduateLeecherTransport(ih, p, TransportWebRTC) },
+	}
+	for name, graduate := range variants {
+		graduated = nil
+		require.Nil(t, ps.PutLeecher(ih, p1))
+		require.Nil(t, graduate(p1), name)
+		require.Equal(t, []bittorrent.Peer{p1}, graduated, name)
+	}
+}
+
+func TestGraduationCallbackBatched(t *testing.T) {
+	cfg := testConfig
+	cfg.BatchQueueSize = 16
+	cfg.BatchFlushInterval = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	var graduated []bittorrent.Peer
+	ps.OnLeecherGraduated(func(_ bittorrent.InfoHash, p bittorrent.Peer) {
+		graduated = append(graduated, p)
+	})
+
+	// Graduations are reported once they are applied.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Len(t, graduated, 0)
+	ps.Flush()
+	require.Equal(t, []bittorrent.Peer{p1}, graduated)
+
+	// Graduations that are dropped are not.
+	require.True(t, ps.FreezeSwarm(ih))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.GraduateLeecher(ih, p2))
+	ps.Flush()
+	require.Len(t, graduated, 1)
+}
@@ -0,0 +1,93 @@
+package optmem
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// otherFamily returns the address family that is not af.
+func otherFamily(af bittorrent.AddressFamily) bittorrent.AddressFamily {
+	if af == bittorrent.IPv4 {
+		return bittorrent.IPv6
+	}
+	return bittorrent.IPv4
+}
+
+// linkedPeer returns the peer of the list holding key, see
+// Config.LinkDualStackPeers.
+func (pl *peerList) linkedPeer(key uint64) (p peer, ok bool) {
+	if pl == nil || key == 0 {
+		return p, false
+	}
+	e, ok := pl.keys[key]
+	if !ok {
+		return p, false
+	}
+	copy(p[:], e[:])
+	bucket := pl.peerBuckets[pl.bucketIndex(&p)]
+	match := sort.Search(len(bucket), binarySearchFunc(&p, bucket))
+	if match >= len(bucket) || bucket[match].isDead() || !bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize]) {
+		return p, false
+	}
+	return bucket[match], true
+}
+
+// touchLinked updates the endpoint of the other address family of the
+// logical peer of p, if any, with the time and role of p, so that the
+// endpoints of a dual-stack peer expire and graduate together.
+// Its crypto flags are kept.
+// The shard must be write-locked by the caller.
+func touchLinked(shard *shard, ih infohash, p *peer, af bittorrent.AddressFamily, key uint64) {
+	other := otherFamily(af)
+	linked, ok := shard.swarms[ih].list(other).linkedPeer(key)
+	if !ok {
+		return
+	}
+	linked.setPeerFlag(linked.peerFlag()&^peerFlagRole | p.peerFlag()&peerFlagRole)
+	linked.setPeerTime(p.peerTime())
+	putPeerLocked(shard, ih, &linked, other, false)
+}
+
+// removeLinked removes the endpoint of the other address family of the
+// logical peer holding key from sw, if any.
+// The peer list is dropped from sw if it becomes empty, unless the swarm is
+// pinned or has web seeds.
+// The shard must be write-locked by the caller.
+func removeLinked(shard *shard, sw *swarm, af bittorrent.AddressFamily, key uint64) {
+	other := otherFamily(af)
+	pl := sw.list(other)
+	linked, ok := pl.linkedPeer(key)
+	if !ok {
+		return
+	}
+	_, seeder := pl.removePeer(&linked)
+	if seeder {
+		shard.counts.sub(other, 1, 1)
+	} else {
+		shard.counts.sub(other, 1, 0)
+	}
+
+	if pl.numPeers == 0 && !sw.retained() {
+		dropHiddenSeeders(shard, *sw, other)
+		if other == bittorrent.IPv4 {
+			sw.peers4 = nil
+		} else {
+			sw.peers6 = nil
+		}
+	} else {
+		pl.rebalanceBuckets()
+	}
+}
+
+// identityOf returns the identity key of the stored peer with the endpoint
+// of p, or zero if it has none.
+func (pl *peerList) identityOf(p *peer) uint64 {
+	if pl == nil || pl.keyOf == nil {
+		return 0
+	}
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	return pl.keyOf[e]
+}
@@ -0,0 +1,63 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkDualStackPeers(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.PeerIdentity = PeerIdentityAnnounceKey
+	cfg.LinkDualStackPeers = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecherKey(ih, p3, "key"))
+	require.Nil(t, ps.PutLeecherKey(ih, p2, "other"))
+
+	// A put of the IPv4 endpoint refreshes the IPv6 endpoint.
+	clock.set(gcBenchStart.Add(time.Hour))
+	require.Nil(t, ps.PutLeecherKey(ih, p1, "key"))
+	_, err = ps.CollectGarbage(gcBenchStart.Add(time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 2, ps.NumLeechers(ih))
+
+	// Graduating one endpoint graduates both.
+	require.Nil(t, ps.GraduateLeecherKey(ih, p1, "key"))
+	require.Equal(t, 2, ps.NumSeeders(ih))
+	require.Equal(t, 0, ps.NumLeechers(ih))
+
+	// Deleting one endpoint deletes both.
+	require.Nil(t, ps.DeleteSeeder(ih, p3))
+	require.Equal(t, 0, ps.NumSeeders(ih)+ps.NumLeechers(ih))
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders+leechers)
+	require.True(t, ps.CheckConsistency().OK())
+}
+
+func TestLinkDualStackPeersPeerID(t *testing.T) {
+	cfg := testConfig
+	cfg.PeerIdentity = PeerIdentityEndpointPeerID
+	cfg.LinkDualStackPeers = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	other := p2
+	other.ID = bittorrent.PeerIDFromString("-XX0001-other0000001")
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.PutSeeder(ih, other))
+
+	require.Nil(t, ps.DeleteLeecher(ih, p1))
+	require.Equal(t, 0, ps.NumLeechers(ih))
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.True(t, ps.CheckConsistency().OK())
+}
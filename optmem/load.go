@@ -0,0 +1,195 @@
+package optmem
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// rateMeter measures the rate of events.
+// The rate is computed lazily when it is requested, averaged over the time
+// since the previous measurement.
+type rateMeter struct {
+	count uint64 // accessed atomically, first for alignment
+
+	clock     Clock
+	mu        sync.Mutex
+	lastCount uint64
+	lastTime  time.Time
+	rate      float64
+}
+
+// minRateWindow is the minimum time over which a rate is averaged.
+const minRateWindow = time.Second
+
+func newRateMeter(clock Clock) *rateMeter {
+	return &rateMeter{clock: clock, lastTime: clock.Now()}
+}
+
+// inc counts one event.
+// It is a no-op on a nil rateMeter.
+func (m *rateMeter) inc() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.count, 1)
+}
+
+// perSecond returns the rate of events per second.
+// If the previous measurement is less than minRateWindow ago, the previous
+// rate is returned.
+// A nil rateMeter has a rate of zero.
+func (m *rateMeter) perSecond() float64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	elapsed := now.Sub(m.lastTime)
+	if elapsed < minRateWindow {
+		return m.rate
+	}
+
+	count := atomic.LoadUint64(&m.count)
+	m.rate = float64(count-m.lastCount) / elapsed.Seconds()
+	m.lastCount = count
+	m.lastTime = now
+	return m.rate
+}
+
+// ErrOverloaded is returned by announces while the load of the store is
+// above ShedLoadAbove.
+// Frontends should answer with a longer announce interval, see
+// SuggestInterval, or ask the client to retry later.
+var ErrOverloaded = errors.New("store is overloaded")
+
+// LoadReport breaks the load of a PeerStore down by its sources.
+// For every source, a load of 1 means the store is at its capacity.
+type LoadReport struct {
+	// Requests is the rate of puts, deletes, announces and scrapes relative
+	// to LoadReferenceRate.
+	Requests float64
+
+	// LockContention is the number of shard lock acquisitions that had to
+	// wait for another holder per request, since the previous report.
+	LockContention float64
+
+	// GCBacklog is the duration of the last garbage collection run, or of
+	// the running one if it takes longer, relative to the
+	// GarbageCollectionInterval.
+	// Above 1, garbage collection does not keep up.
+	GCBacklog float64
+
+	// Memory is the heap memory in use relative to LoadMemoryLimit, or zero
+	// if no limit is configured.
+	Memory float64
+}
+
+// Max returns the highest load of all sources.
+func (r LoadReport) Max() float64 {
+	return math.Max(math.Max(r.Requests, r.LockContention), math.Max(r.GCBacklog, r.Memory))
+}
+
+// Load returns the current load of the PeerStore, the highest load of all
+// sources of a LoadReport.
+// A load of 1 means the store is at its capacity.
+func (s *PeerStore) Load() float64 {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.loadReport().Max()
+}
+
+// LoadReport returns the current load of the PeerStore by its sources.
+func (s *PeerStore) LoadReport() LoadReport {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.loadReport()
+}
+
+func (s *PeerStore) loadReport() LoadReport {
+	requests := s.requests.perSecond()
+	r := LoadReport{
+		Requests: requests / float64(s.cfg.LoadReferenceRate),
+	}
+	if contended := s.shards.contention.perSecond(); requests > 0 {
+		r.LockContention = contended / requests
+	}
+
+	gc := time.Duration(atomic.LoadInt64(&s.lastGCDuration))
+	now := s.now()
+	s.gcMu.Lock()
+	for p := range s.gcPasses {
+		if running := now.Sub(p.start); running > gc {
+			gc = running
+		}
+	}
+	s.gcMu.Unlock()
+	r.GCBacklog = float64(gc) / float64(s.cfg.GarbageCollectionInterval)
+
+	if s.cfg.LoadMemoryLimit > 0 {
+		r.Memory = float64(heapInUse()) / float64(s.cfg.LoadMemoryLimit)
+	}
+	return r
+}
+
+// heapInUse returns the number of bytes of heap memory occupied by objects,
+// live or not yet collected.
+func heapInUse() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// overloaded returns whether announces are shed, counting a rejected
+// announce if they are.
+func (s *PeerStore) overloaded(af bittorrent.AddressFamily) bool {
+	if atomic.LoadInt32(&s.shedding) == 0 {
+		return false
+	}
+	promOverloadRejects.inc(af)
+	return true
+}
+
+// runLoadShedding periodically compares the load of the store to
+// ShedLoadAbove until the store is closed.
+func (s *PeerStore) runLoadShedding() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(minRateWindow):
+			s.updateShedding()
+		}
+	}
+}
+
+// updateShedding starts or stops shedding announces depending on the load.
+func (s *PeerStore) updateShedding() {
+	r := s.loadReport()
+	shed := int32(0)
+	if r.Max() > s.cfg.ShedLoadAbove {
+		shed = 1
+	}
+	if atomic.SwapInt32(&s.shedding, shed) != shed {
+		log.Warn("optmem: load shedding changed", log.Fields{"namespace": s.name, "shedding": shed == 1, "load": r})
+	}
+}
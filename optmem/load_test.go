@@ -0,0 +1,71 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadReportMax(t *testing.T) {
+	r := LoadReport{Requests: 0.5, LockContention: 0.1, GCBacklog: 1.5, Memory: 0.2}
+	require.Equal(t, 1.5, r.Max())
+}
+
+func TestLoadReport(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.LoadReferenceRate = 10
+	cfg.LoadMemoryLimit = 1
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	clock.set(gcBenchStart.Add(time.Second))
+	r := ps.LoadReport()
+	require.InDelta(t, 2, r.Requests, 0.01)
+	require.True(t, r.Memory > 1)
+	require.Equal(t, r.Max(), ps.Load())
+
+	// A running garbage collection pass counts towards the backlog.
+	pass := ps.beginGCPass()
+	clock.set(gcBenchStart.Add(6 * time.Minute))
+	require.InDelta(t, 0.5, ps.LoadReport().GCBacklog, 0.1)
+	ps.endGCPass(pass)
+}
+
+func TestShedLoad(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.LoadReferenceRate = 10
+	cfg.ShedLoadAbove = 1
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	clock.set(gcBenchStart.Add(time.Second))
+	ps.updateShedding()
+	_, err = ps.AnnouncePeers(ih, false, 10, p1)
+	require.Equal(t, ErrOverloaded, err)
+	_, _, err = ps.AnnouncePeersDualStack(ih, false, 10, p1)
+	require.Equal(t, ErrOverloaded, err)
+
+	// Puts are never shed.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+
+	clock.set(gcBenchStart.Add(time.Hour))
+	ps.updateShedding()
+	peers, err := ps.AnnouncePeers(ih, false, 10, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 10)
+}
@@ -0,0 +1,144 @@
+package optmem
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// A MetricsReporter receives the metrics of the store, alongside or instead
+// of Prometheus, for example to forward them to StatsD or Graphite.
+//
+// Names are dot-separated, like "operations.announce.ipv4".
+// Counters are reported as they change, from the goroutines of requests, so
+// Count must be safe for concurrent use and should not block.
+// Gauges are reported periodically.
+type MetricsReporter interface {
+	// Count adds delta to the counter name.
+	Count(name string, delta int64)
+
+	// Gauge sets the gauge name to value.
+	Gauge(name string, value float64)
+}
+
+// metricsReporters are the MetricsReporters of all running stores.
+// Counters are global, like the Prometheus ones, so every running reporter
+// receives the counters of all stores.
+var metricsReporters = &reporterSet{}
+
+// reporterSet is a set of MetricsReporters that is cheap to read.
+type reporterSet struct {
+	mu        sync.Mutex
+	reporters atomic.Value // []MetricsReporter, replaced on change
+}
+
+// add starts reporting counters to r.
+func (rs *reporterSet) add(r MetricsReporter) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	old, _ := rs.reporters.Load().([]MetricsReporter)
+	rs.reporters.Store(append(append([]MetricsReporter(nil), old...), r))
+}
+
+// remove stops reporting counters to r.
+func (rs *reporterSet) remove(r MetricsReporter) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	old, _ := rs.reporters.Load().([]MetricsReporter)
+	updated := make([]MetricsReporter, 0, len(old))
+	for _, o := range old {
+		if o != r {
+			updated = append(updated, o)
+		}
+	}
+	rs.reporters.Store(updated)
+}
+
+// count reports a counter to all reporters.
+func (rs *reporterSet) count(name string, delta int64) {
+	reporters, _ := rs.reporters.Load().([]MetricsReporter)
+	for _, r := range reporters {
+		r.Count(name, delta)
+	}
+}
+
+// familyName returns name suffixed by the address family.
+func familyName(name string, af bittorrent.AddressFamily) string {
+	if af == bittorrent.IPv4 {
+		return name + ".ipv4"
+	}
+	return name + ".ipv6"
+}
+
+// reporters returns the MetricsReporters configured for the store.
+func (cfg Config) reporters() ([]MetricsReporter, error) {
+	var reporters []MetricsReporter
+	if cfg.MetricsReporter != nil {
+		reporters = append(reporters, cfg.MetricsReporter)
+	}
+	if cfg.StatsD.Addr != "" {
+		r, err := newStatsDReporter(cfg.StatsD)
+		if err != nil {
+			return nil, err
+		}
+		reporters = append(reporters, r)
+	}
+	return reporters, nil
+}
+
+// runMetrics reports the gauges of the store and its namespaces at the
+// configured interval until the store is closed.
+// It also flushes the StatsD reporter, if any.
+func (s *PeerStore) runMetrics() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(s.cfg.MetricsInterval):
+			s.reportGauges()
+		}
+	}
+}
+
+// reportGauges reports the gauges of the store and its namespaces to the
+// reporters of the store and flushes them.
+func (s *PeerStore) reportGauges() {
+	s.nsMu.Lock()
+	stores := []*PeerStore{s}
+	for _, ns := range s.namespaces {
+		stores = append(stores, ns)
+	}
+	s.nsMu.Unlock()
+
+	for _, store := range stores {
+		select {
+		case <-store.closed:
+			continue
+		default:
+		}
+		prefix := ""
+		if store.name != "" {
+			prefix = "namespaces." + store.name + "."
+		}
+		counts := store.shards.getPeerCounts()
+		seeders4, leechers4 := counts.family(bittorrent.IPv4)
+		seeders6, leechers6 := counts.family(bittorrent.IPv6)
+		load := store.loadReport().Max()
+		for _, r := range s.reporters {
+			r.Gauge(prefix+"swarms", float64(store.shards.getTorrentCount()))
+			r.Gauge(prefix+"seeders.ipv4", float64(seeders4))
+			r.Gauge(prefix+"leechers.ipv4", float64(leechers4))
+			r.Gauge(prefix+"seeders.ipv6", float64(seeders6))
+			r.Gauge(prefix+"leechers.ipv6", float64(leechers6))
+			r.Gauge(prefix+"batch_queue_depth", float64(store.batchQueueDepth()))
+			r.Gauge(prefix+"load", load)
+		}
+	}
+
+	for _, r := range s.reporters {
+		if f, ok := r.(*statsDReporter); ok {
+			f.flush()
+		}
+	}
+}
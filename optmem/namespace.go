@@ -0,0 +1,139 @@
+package optmem
+
+import (
+	"sort"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// NamespaceConfig holds the settings of a namespace that differ from the
+// settings of the store.
+// Zero values are inherited from the store.
+type NamespaceConfig struct {
+	GarbageCollectionInterval time.Duration `yaml:"gc_interval"`
+	PeerLifetime              time.Duration `yaml:"peer_lifetime"`
+}
+
+// namespace returns the config of the namespace with the given name.
+// Namespaces inherit the config of the store, but do not run admin servers,
+// are not snapshotted and do not federate.
+func (cfg Config) namespace(name string) Config {
+	nsCfg := cfg
+	nsCfg.AdminAddr = ""
+	nsCfg.AdminGRPCAddr = ""
+	nsCfg.SnapshotPath = ""
+	nsCfg.Persistence = PersistenceConfig{}
+	nsCfg.Federation = FederationConfig{}
+	nsCfg.Namespaces = nil
+
+	override := cfg.Namespaces[name]
+	if override.GarbageCollectionInterval > 0 {
+		nsCfg.GarbageCollectionInterval = override.GarbageCollectionInterval
+	}
+	if override.PeerLifetime > 0 {
+		nsCfg.PeerLifetime = override.PeerLifetime
+	}
+
+	return nsCfg
+}
+
+// WithNamespace returns the PeerStore of the namespace with the given name,
+// creating it if it does not exist yet.
+// The empty name refers to the default namespace, i.e. the store returned by
+// New.
+//
+// Namespaces partition the store: every namespace has its own swarms,
+// counters, callbacks and garbage collection, using the settings configured
+// for it in Config.Namespaces.
+// Calling WithNamespace on a namespace resolves the name relative to the
+// default namespace.
+//
+// Namespaces are stopped together with the default namespace. The admin
+// servers only serve the default namespace.
+func (s *PeerStore) WithNamespace(name string) *PeerStore {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	root := s.root
+	if name == "" {
+		return root
+	}
+
+	root.nsMu.Lock()
+	defer root.nsMu.Unlock()
+
+	// Check again, the default namespace might have been stopped in the
+	// meantime.
+	select {
+	case <-root.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if ns, ok := root.namespaces[name]; ok {
+		return ns
+	}
+
+	ns := newPeerStore(root.cfg.namespace(name))
+	ns.name = name
+	ns.root = root
+	err := ns.loadDownloadCounters()
+	if err != nil {
+		log.Error("optmem: unable to load download counters", log.Fields{"namespace": name, "error": err})
+	}
+	ns.start()
+	if root.namespaces == nil {
+		root.namespaces = make(map[string]*PeerStore)
+	}
+	root.namespaces[name] = ns
+
+	return ns
+}
+
+// Namespaces returns the names of all namespaces created so far, sorted.
+// The default namespace is not included.
+func (s *PeerStore) Namespaces() []string {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	root := s.root
+	root.nsMu.Lock()
+	defer root.nsMu.Unlock()
+
+	names := make([]string, 0, len(root.namespaces))
+	for name := range root.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// stopNamespaces stops all namespaces of the default namespace, or removes a
+// namespace from its default namespace if it is stopped on its own.
+// It must be called after s was closed.
+func (s *PeerStore) stopNamespaces() {
+	root := s.root
+	root.nsMu.Lock()
+	if root != s {
+		if root.namespaces[s.name] == s {
+			delete(root.namespaces, s.name)
+		}
+		root.nsMu.Unlock()
+		return
+	}
+	namespaces := root.namespaces
+	root.namespaces = nil
+	root.nsMu.Unlock()
+
+	for _, ns := range namespaces {
+		<-ns.Stop()
+	}
+}
@@ -0,0 +1,38 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaces(t *testing.T) {
+	cfg := testConfig
+	cfg.Namespaces = map[string]NamespaceConfig{"b": {PeerLifetime: time.Minute}}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	a := ps.WithNamespace("a")
+	b := ps.WithNamespace("b")
+	require.True(t, a == ps.WithNamespace("a"))
+	require.True(t, a == b.WithNamespace("a"))
+	require.True(t, ps == a.WithNamespace(""))
+	require.Equal(t, []string{"a", "b"}, ps.Namespaces())
+	require.Equal(t, testConfig.PeerLifetime, a.cfg.PeerLifetime)
+	require.Equal(t, time.Minute, b.cfg.PeerLifetime)
+
+	require.Nil(t, a.PutSeeder(ih, p1))
+	require.Nil(t, b.PutLeecher(ih, p1))
+	require.Nil(t, b.PutLeecher(ih, p2))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	require.Equal(t, uint32(1), a.ScrapeSwarm(ih, p1.IP.AddressFamily).Complete)
+	require.Equal(t, uint32(2), b.ScrapeSwarm(ih, p1.IP.AddressFamily).Incomplete)
+
+	// Stopping a namespace on its own removes it.
+	require.Nil(t, <-a.Stop())
+	require.Equal(t, []string{"b"}, ps.Namespaces())
+
+	require.Nil(t, <-ps.Stop())
+	require.Panics(t, func() { b.NumSwarms() })
+}
@@ -0,0 +1,90 @@
+package optmem
+
+import (
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// swarmFilterHashes is the number of counters of a swarmFilter every
+// infohash maps to.
+const swarmFilterHashes = 3
+
+// swarmFilter is a counting Bloom filter of the infohashes of the swarms of
+// a shard, see NegativeCacheSize.
+//
+// It is changed only while the shard is write-locked, but read without
+// locks, so that announces and scrapes for infohashes that are not stored
+// are rejected without contending for the shard.
+// Infohashes are never missed, but an infohash that is not stored may be
+// reported as stored.
+type swarmFilter struct {
+	seed     uint64
+	counters []uint32 // accessed atomically
+}
+
+// newSwarmFilter creates a swarmFilter of at least size counters, rounded up
+// to a power of two.
+func newSwarmFilter(size uint) *swarmFilter {
+	n := 1
+	for uint(n) < size {
+		n <<= 1
+	}
+	return &swarmFilter{
+		seed:     randomSeed(),
+		counters: make([]uint32, n),
+	}
+}
+
+// indices returns the indices of the counters of an infohash.
+// They are derived from a single hash using double hashing.
+func (f *swarmFilter) indices(ih infohash) (idx [swarmFilterHashes]uint64) {
+	h := seededHash(f.seed, ih[:])
+	h1, h2 := h>>32, h|1
+	mask := uint64(len(f.counters) - 1)
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & mask
+	}
+	return
+}
+
+// add adds an infohash to the filter.
+// The shard must be write-locked by the caller.
+func (f *swarmFilter) add(ih infohash) {
+	for _, i := range f.indices(ih) {
+		atomic.AddUint32(&f.counters[i], 1)
+	}
+}
+
+// remove removes an infohash that was added before from the filter.
+// The shard must be write-locked by the caller.
+func (f *swarmFilter) remove(ih infohash) {
+	for _, i := range f.indices(ih) {
+		atomic.AddUint32(&f.counters[i], ^uint32(0))
+	}
+}
+
+// mayContain returns false if the infohash was definitely not added to the
+// filter.
+// It takes no locks.
+func (f *swarmFilter) mayContain(ih infohash) bool {
+	for _, i := range f.indices(ih) {
+		if atomic.LoadUint32(&f.counters[i]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// swarmMayExist returns false if the negative cache of the shard rules out
+// that the swarm of an infohash is stored, without locking the shard.
+// Rejected requests are counted for the given address family.
+// Swarms spilled to a ColdStorage are not in the filter, so it is ignored
+// while a ColdStorage is set.
+func (s *PeerStore) swarmMayExist(shard *shard, ih infohash, af bittorrent.AddressFamily) bool {
+	if shard.known == nil || shard.known.mayContain(ih) || s.coldStorage() != nil {
+		return true
+	}
+	promNegativeCacheHits.inc(af)
+	return false
+}
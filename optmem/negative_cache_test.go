@@ -0,0 +1,57 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarmFilter(t *testing.T) {
+	f := newSwarmFilter(1000)
+	require.Len(t, f.counters, 1024)
+
+	ih2 := infohash(bittorrent.InfoHashFromString("11111111111111111111"))
+	require.False(t, f.mayContain(infohash(ih)))
+	f.add(infohash(ih))
+	f.add(ih2)
+	require.True(t, f.mayContain(infohash(ih)))
+	require.True(t, f.mayContain(ih2))
+
+	f.remove(infohash(ih))
+	require.False(t, f.mayContain(infohash(ih)))
+	require.True(t, f.mayContain(ih2))
+	f.remove(ih2)
+	for _, c := range f.counters {
+		require.Equal(t, uint32(0), c)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	cfg := testConfig
+	cfg.NegativeCacheSize = 1024
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	_, err = ps.AnnouncePeers(ih, false, 10, p1)
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+	_, _, err = ps.AnnouncePeersDualStack(ih, false, 10, p1)
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	shard := ps.shards.shards[ps.shards.shardIndex(infohash(ih))]
+	require.True(t, shard.known.mayContain(infohash(ih)))
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+	peers, err := ps.AnnouncePeers(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.True(t, ps.CheckConsistency().OK())
+
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	require.False(t, shard.known.mayContain(infohash(ih)))
+	_, err = ps.AnnouncePeers(ih, false, 10, p2)
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+}
@@ -0,0 +1,35 @@
+package optmemtest
+
+import (
+	"time"
+
+	"github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem"
+)
+
+// DefaultChaos delays one in a hundred shard locks by up to a millisecond
+// and forces garbage collection runs and rebalances every few milliseconds.
+// Peers do not expire early, so the stores behave like regular stores,
+// only slower.
+var DefaultChaos = optmem.Chaos{
+	Seed:              1,
+	LockDelay:         time.Millisecond,
+	LockDelayRatio:    0.01,
+	GCInterval:        5 * time.Millisecond,
+	RebalanceInterval: time.Millisecond,
+}
+
+// NewChaotic creates a PeerStore from cfg that injects the faults configured
+// by chaos, to flush out races between requests, garbage collection and
+// rebalancing.
+// Run concurrent workloads, for example the storage benchmarks of chihaya,
+// against it, ideally with the race detector and the optmem_debug build tag,
+// and check the store with CheckConsistency afterwards.
+//
+// Unlike the stores created by New, it uses the system clock, because the
+// faults are timed by it, and it collects garbage as configured.
+// Prometheus reporting is disabled.
+func NewChaotic(cfg optmem.Config, chaos optmem.Chaos) (*optmem.PeerStore, error) {
+	cfg.Chaos = &chaos
+	cfg.DisablePrometheus = true
+	return optmem.New(cfg)
+}
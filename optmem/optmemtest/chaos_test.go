@@ -0,0 +1,66 @@
+package optmemtest
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaoticConformance(t *testing.T) {
+	// The conformance tests use peers with unroutable IPs.
+	cfg := testConfig
+	cfg.AllowedUnroutableNetworks = []string{"0.0.0.0/0", "::/0"}
+	ps, err := NewChaotic(cfg, DefaultChaos)
+	require.Nil(t, err)
+
+	tmp := storage.PeerEqualityFunc
+	storage.PeerEqualityFunc = func(p1, p2 bittorrent.Peer) bool { return p1.EqualEndpoint(p2) }
+	defer func() { storage.PeerEqualityFunc = tmp }()
+	storage.TestPeerStore(t, ps)
+}
+
+func TestChaoticWorkload(t *testing.T) {
+	chaos := DefaultChaos
+	chaos.ExpireEarly = true
+	ps, err := NewChaotic(testConfig, chaos)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	infoHashes := make([]bittorrent.InfoHash, 8)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				ih := infoHashes[r.Intn(len(infoHashes))]
+				p := peer(r.Intn(2000))
+				switch r.Intn(4) {
+				case 0:
+					_ = ps.PutSeeder(ih, p)
+				case 1:
+					_ = ps.PutLeecher(ih, p)
+				case 2:
+					_ = ps.DeleteLeecher(ih, p)
+				default:
+					_, _ = ps.AnnouncePeers(ih, false, 50, p)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	report := ps.CheckConsistency()
+	require.True(t, report.OK(), "%v", report.Problems)
+}
@@ -0,0 +1,164 @@
+// Package optmemtest provides deterministic optmem PeerStores for tests of
+// code using the driver, for example chihaya middleware.
+//
+// Stores created by this package use a fixed shard seed and a manually
+// advanced clock, and never collect garbage on their own.
+// Given the same operations, they return the same peers from announces and
+// the same scrape results.
+package optmemtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem"
+)
+
+// DefaultStart is the time the clock of a Store starts at.
+var DefaultStart = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// DefaultShardSeed is the shard seed used if the config does not set one.
+const DefaultShardSeed = 0x6f70746d656d
+
+// disabledGCInterval is the garbage collection interval of a Store, long
+// enough for garbage collection to never run during a test.
+const disabledGCInterval = 100 * 365 * 24 * time.Hour
+
+// Clock is an optmem.Clock that only moves when it is advanced.
+// Timers fire once the clock is advanced to or past their deadline.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a pending timer of a Clock.
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+var _ optmem.Clock = &Clock{}
+
+// NewClock returns a Clock set to start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now implements optmem.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements optmem.Clock.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{deadline: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d and fires the timers that expired.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.fire()
+	c.mu.Unlock()
+}
+
+// Set sets the clock to t and fires the timers that expired.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.fire()
+	c.mu.Unlock()
+}
+
+// Waiters returns the number of pending timers.
+// Tests can use it to wait until a background goroutine sleeps before
+// advancing the clock.
+func (c *Clock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// fire sends the current time to the timers that expired and removes them.
+// c.mu must be held.
+func (c *Clock) fire() {
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+}
+
+// Store is a deterministic optmem PeerStore.
+type Store struct {
+	*optmem.PeerStore
+
+	// Clock is the clock of the store, starting at DefaultStart.
+	Clock *Clock
+
+	cfg optmem.Config
+}
+
+// New creates a deterministic Store from cfg.
+//
+// The clock, garbage collection interval and Prometheus reporting of cfg are
+// overridden.
+// The shard seed of cfg is used if it is set, DefaultShardSeed otherwise.
+func New(cfg optmem.Config) (*Store, error) {
+	clock := NewClock(DefaultStart)
+	cfg.Clock = clock
+	cfg.GarbageCollectionInterval = disabledGCInterval
+	cfg.DisablePrometheus = true
+	if cfg.ShardSeed == 0 {
+		cfg.ShardSeed = DefaultShardSeed
+	}
+	cfg = cfg.Validate()
+
+	ps, err := optmem.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{PeerStore: ps, Clock: clock, cfg: cfg}, nil
+}
+
+// Config returns the validated config the store was created with.
+func (s *Store) Config() optmem.Config {
+	return s.cfg
+}
+
+// CollectGarbage removes all peers that did not announce within the peer
+// lifetime, as of the current time of the clock.
+func (s *Store) CollectGarbage() (optmem.GCStats, error) {
+	return s.PeerStore.CollectGarbage(s.Clock.Now().Add(-s.cfg.PeerLifetime))
+}
+
+// Expire advances the clock past the peer lifetime and collects garbage, so
+// that all peers that do not announce again are removed.
+func (s *Store) Expire() (optmem.GCStats, error) {
+	s.Clock.Advance(s.cfg.PeerLifetime + time.Second)
+	return s.CollectGarbage()
+}
+
+// Rebalance rebalances the buckets of the swarms of the given infohashes.
+func (s *Store) Rebalance(infoHashes ...bittorrent.InfoHash) {
+	for _, infoHash := range infoHashes {
+		s.RebalanceSwarm(infoHash)
+	}
+}
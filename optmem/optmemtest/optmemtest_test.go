@@ -0,0 +1,120 @@
+package optmemtest
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testConfig = optmem.Config{ShardCountBits: 4, PeerLifetime: 10 * time.Minute}
+	ih         = bittorrent.InfoHashFromString("00000000000000000000")
+)
+
+func peer(i int) bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString(fmt.Sprintf("%020d", i)),
+		IP:   bittorrent.IP{IP: net.IPv4(1, 2, byte(i>>8), byte(i)), AddressFamily: bittorrent.IPv4},
+		Port: uint16(i),
+	}
+}
+
+func populate(t *testing.T) *Store {
+	s, err := New(testConfig)
+	require.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, s.PutLeecher(ih, peer(i)))
+	}
+	return s
+}
+
+func TestDeterministicAnnounces(t *testing.T) {
+	s1 := populate(t)
+	s2 := populate(t)
+
+	peers1, err := s1.AnnouncePeers(ih, false, 50, peer(5000))
+	require.Nil(t, err)
+	peers2, err := s2.AnnouncePeers(ih, false, 50, peer(5000))
+	require.Nil(t, err)
+	require.Len(t, peers1, 50)
+	require.Equal(t, peers1, peers2)
+
+	require.Nil(t, <-s1.Stop())
+	require.Nil(t, <-s2.Stop())
+}
+
+func TestExpire(t *testing.T) {
+	s := populate(t)
+
+	s.Clock.Advance(testConfig.PeerLifetime / 2)
+	require.Nil(t, s.PutSeeder(ih, peer(0)))
+
+	stats, err := s.CollectGarbage()
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.PeersRemoved)
+
+	stats, err = s.Expire()
+	require.Nil(t, err)
+	require.Equal(t, 1000, stats.PeersRemoved)
+	require.Equal(t, uint64(0), s.NumSwarms())
+
+	require.Nil(t, <-s.Stop())
+}
+
+func TestRebalance(t *testing.T) {
+	s := populate(t)
+	for i := 0; i < 1000; i++ {
+		require.Nil(t, s.DeleteLeecher(ih, peer(i)))
+	}
+	require.Nil(t, s.PutLeecher(ih, peer(0)))
+	s.Rebalance(ih)
+	require.True(t, s.CheckConsistency().OK())
+	require.Nil(t, <-s.Stop())
+}
+
+func TestClockAfter(t *testing.T) {
+	c := NewClock(DefaultStart)
+	ch := c.After(time.Minute)
+	require.Equal(t, 1, c.Waiters())
+
+	c.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	c.Advance(time.Second)
+	require.Equal(t, DefaultStart.Add(time.Minute), <-ch)
+	require.Equal(t, 0, c.Waiters())
+
+	require.Equal(t, DefaultStart.Add(time.Minute), <-c.After(0))
+}
+
+func TestClockDrivesGarbageCollection(t *testing.T) {
+	clock := NewClock(DefaultStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.GarbageCollectionInterval = time.Minute
+	cfg.DisablePrometheus = true
+	ps, err := optmem.New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecher(ih, peer(1)))
+
+	// Step through the peer lifetime one GC interval at a time, waiting for
+	// the GC goroutine to sleep on the clock before every step.
+	for i := 0; i < int(cfg.PeerLifetime/cfg.GarbageCollectionInterval); i++ {
+		require.Eventually(t, func() bool { return clock.Waiters() > 0 }, time.Second, time.Millisecond)
+		require.Equal(t, uint64(1), ps.NumSwarms())
+		clock.Advance(cfg.GarbageCollectionInterval)
+	}
+
+	require.Eventually(t, func() bool { return ps.NumSwarms() == 0 }, time.Second, time.Millisecond)
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/chihaya/chihaya/middleware/pkg/random"
@@ -17,8 +18,17 @@ const peerCompareSize = ipLen + portLen
 type peerList struct {
 	numSeeders   int
 	numPeers     int
+	numDead      int // tombstones in peerBuckets, see removePeer
+	numWebRTC    int // WebRTC peers, see Transport
 	numDownloads uint64
-	peerBuckets  []bucket // sorted by endpoint
+	peerBuckets  []bucket               // sorted by endpoint
+	stats        map[endpoint]PeerStats // extended peer records, nil until stats are put
+	scores       map[endpoint]uint8     // scores of regularly announcing peers, see updateScore
+	keys         map[uint64]endpoint    // endpoints by hashed announce key, nil unless a peer put a key, see PutSeederKey
+	keyOf        map[endpoint]uint64    // hashed identity keys by endpoint, the inverse of keys for announce keys, see identityKey
+	seed         uint64                 // seed of the bucket indices, see bucketIndex
+	hot          *hotSet                // nil unless the list is large, see HotSetThreshold
+	shared       bool                   // whether peerBuckets are shared with a clone, see own
 }
 
 type bucket []peer
@@ -38,19 +48,24 @@ func (b bucket) Swap(i, j int) {
 	b[i], b[j] = b[j], b[i]
 }
 
-func newPeerList() *peerList {
+func newPeerList(seed uint64) *peerList {
 	return &peerList{
 		peerBuckets: make([]bucket, 1),
+		seed:        seed,
 	}
 }
 
 // TODO sort buckets by leecher/seeder?
 
 // Returns whether at least one peer was deleted.
-func (pl *peerList) collectGarbage(cutoffTime, maxDiff uint16) (gc bool) {
+// If evicted is not nil, the deleted peers are appended to it.
+func (pl *peerList) collectGarbage(cutoffTime, maxDiff uint16, evicted *[]peer) (gc bool) {
 	for j := 0; j < len(pl.peerBuckets); j++ {
 		for i := 0; i < len(pl.peerBuckets[j]); i++ {
 			peer := pl.peerBuckets[j][i]
+			if peer.isDead() {
+				continue
+			}
 			var remove bool
 			if peer.peerTime() == cutoffTime {
 				remove = true
@@ -72,13 +87,43 @@ func (pl *peerList) collectGarbage(cutoffTime, maxDiff uint16) (gc bool) {
 				if !found {
 					panic(fmt.Sprintf("peer not found during GC, peer: %s %d", net.IP(peer.ip()), peer.port()))
 				}
-				i--
+				if evicted != nil {
+					*evicted = append(*evicted, peer)
+				}
 			}
 		}
 	}
+	pl.compact()
 	return
 }
 
+// oldestPeerTime returns the peer time of the peer that announced longest
+// before now, or oldest if it is older.
+func (pl *peerList) oldestPeerTime(now, oldest uint16) uint16 {
+	for _, b := range pl.peerBuckets {
+		for _, peer := range b {
+			if !peer.isDead() && now-peer.peerTime() > now-oldest {
+				oldest = peer.peerTime()
+			}
+		}
+	}
+	return oldest
+}
+
+// countOlderThan returns the number of peers that last announced at least
+// minAge seconds before now.
+func (pl *peerList) countOlderThan(now, minAge uint16) int {
+	count := 0
+	for _, b := range pl.peerBuckets {
+		for _, peer := range b {
+			if !peer.isDead() && now-peer.peerTime() >= minAge {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 // computeTargetBuckets computes the number of buckets to be used for a number
 // of peers.
 // It returns targetBuckets and defensiveTargetBuckets, to be used when reducing
@@ -114,27 +159,45 @@ func computeTargetBuckets(numPeers int) (int, int) {
 // On the other hand, if less buckets could sustain the <=512 target, there is
 // a buffer zone of pl.numPeers/10 peers, to avoid sizing the bucket list up and
 // down constantly.
+// Tombstones are removed if rebalancing is performed, or if they make up more
+// than a quarter of the entries.
 // Returns whether rebalancing was performed.
 func (pl *peerList) rebalanceBuckets() bool {
 	targetBuckets, defensiveTargetBuckets := computeTargetBuckets(pl.numPeers)
 
 	if len(pl.peerBuckets) == targetBuckets {
+		pl.compactIfSparse()
 		return false
 	} else if len(pl.peerBuckets) > targetBuckets {
 		if targetBuckets != defensiveTargetBuckets {
 			// Buffer zone: don't immediately reduce the number of buckets to reduce churn
+			pl.compactIfSparse()
 			return false
 		}
 	}
 
+	pl.redistribute(targetBuckets)
+	return true
+}
+
+// redistribute moves all peers to targetBuckets new buckets, dropping
+// tombstones.
+func (pl *peerList) redistribute(targetBuckets int) {
 	before := time.Now()
+	pl.own()
 	oldBuckets := pl.peerBuckets
 	pl.peerBuckets = make([]bucket, targetBuckets)
+	for i := range pl.peerBuckets {
+		pl.peerBuckets[i] = getBucket()
+	}
 
 	// Add all peers to their buckets, without explicitly sorting them.
 	// This should avoid a lot of memmoves.
 	for _, bucket := range oldBuckets {
 		for _, peer := range bucket {
+			if peer.isDead() {
+				continue
+			}
 			bucketRef := &pl.peerBuckets[pl.bucketIndex(&peer)]
 			*bucketRef = append(*bucketRef, peer)
 		}
@@ -143,12 +206,67 @@ func (pl *peerList) rebalanceBuckets() bool {
 	for _, bucket := range pl.peerBuckets {
 		sort.Sort(bucket)
 	}
+	pl.numDead = 0
+	for _, bucket := range oldBuckets {
+		putBucket(bucket)
+	}
 
 	log.Debug("optmem: bucket rebalance finished", log.Fields{"buckets": targetBuckets, "numPeers": pl.numPeers, "timeTaken": time.Since(before)})
 	if targetBuckets >= 256 {
 		log.Info("optmem: had to do a huge bucket rebalance", log.Fields{"buckets": targetBuckets, "numPeers": pl.numPeers, "timeTaken": time.Since(before)})
 	}
-	return true
+}
+
+// bucketCapacity is the capacity of newly allocated buckets, the number of
+// peers rebalanceBuckets aims for.
+const bucketCapacity = 512
+
+// bucketPool holds buckets left over by rebalanceBuckets, for reuse.
+var bucketPool sync.Pool
+
+// getBucket returns an empty bucket, from the pool if possible.
+func getBucket() bucket {
+	if b, ok := bucketPool.Get().(*bucket); ok {
+		promBucketPoolHits.Inc()
+		return (*b)[:0]
+	}
+	promBucketPoolMisses.Inc()
+	return make(bucket, 0, bucketCapacity)
+}
+
+// putBucket returns a bucket that is no longer used to the pool.
+func putBucket(b bucket) {
+	if cap(b) == 0 {
+		return
+	}
+	b = b[:0]
+	bucketPool.Put(&b)
+}
+
+// compact removes all tombstones.
+func (pl *peerList) compact() {
+	if pl.numDead == 0 {
+		return
+	}
+	pl.own()
+	for j, b := range pl.peerBuckets {
+		kept := b[:0]
+		for _, p := range b {
+			if !p.isDead() {
+				kept = append(kept, p)
+			}
+		}
+		pl.peerBuckets[j] = kept
+	}
+	pl.numDead = 0
+}
+
+// compactIfSparse removes all tombstones if they make up more than a quarter
+// of the entries.
+func (pl *peerList) compactIfSparse() {
+	if pl.numDead*4 > pl.numPeers+pl.numDead {
+		pl.compact()
+	}
 }
 
 func binarySearchFunc(p *peer, b bucket) func(int) bool {
@@ -158,10 +276,11 @@ func binarySearchFunc(p *peer, b bucket) func(int) bool {
 }
 
 func (pl *peerList) removePeer(p *peer) (found bool, wasSeeder bool) {
+	pl.own()
 	bucketRef := &pl.peerBuckets[pl.bucketIndex(p)]
 	bucket := *bucketRef
 	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
-	if match >= len(bucket) || bucket[match].peerFlag() != p.peerFlag() || !bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize]) {
+	if match >= len(bucket) || bucket[match].isDead() || bucket[match].peerFlag()&peerFlagRole != p.peerFlag()&peerFlagRole || !bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize]) {
 		return false, false
 	}
 	found = true
@@ -171,13 +290,20 @@ func (pl *peerList) removePeer(p *peer) (found bool, wasSeeder bool) {
 		wasSeeder = true
 		pl.numSeeders--
 	}
-	bucket = append(bucket[:match], bucket[match+1:]...)
-	*bucketRef = bucket
+	if bucket[match].isWebRTC() {
+		pl.numWebRTC--
+	}
+	// Leave a tombstone instead of moving the rest of the bucket, it is
+	// removed lazily, see compact.
+	bucket[match].setPeerFlag(peerFlagDead)
+	pl.numDead++
+	pl.deleteStats(p)
 
 	return
 }
 
 func (pl *peerList) putPeer(p *peer) (deltaPeers uint64, deltaSeeders int64) {
+	pl.own()
 	bucketRef := &pl.peerBuckets[pl.bucketIndex(p)]
 	bucket := *bucketRef
 	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
@@ -193,6 +319,25 @@ func (pl *peerList) putPeer(p *peer) (deltaPeers uint64, deltaSeeders int64) {
 			pl.numSeeders++
 			deltaSeeders = 1
 		}
+		if p.isWebRTC() {
+			pl.numWebRTC++
+		}
+		return
+	}
+
+	if bucket[match].isDead() {
+		// revive tombstone
+		bucket[match] = *p
+		pl.numDead--
+		pl.numPeers++
+		deltaPeers = 1
+		if p.isSeeder() {
+			pl.numSeeders++
+			deltaSeeders = 1
+		}
+		if p.isWebRTC() {
+			pl.numWebRTC++
+		}
 		return
 	}
 
@@ -206,71 +351,76 @@ func (pl *peerList) putPeer(p *peer) (deltaPeers uint64, deltaSeeders int64) {
 		pl.numSeeders--
 		deltaSeeders = -1
 	}
+	if bucket[match].isWebRTC() != p.isWebRTC() {
+		if p.isWebRTC() {
+			pl.numWebRTC++
+		} else {
+			pl.numWebRTC--
+		}
+	}
 	bucket[match] = *p
 
 	return
 }
 
-func (pl *peerList) getAllPeers() []peer {
-	buckets := pl.peerBuckets
-	seeders := make([]peer, 0, pl.numSeeders)
-	leechers := make([]peer, 0, pl.numPeers) // will be reused to store all peers, hence the size
-
-	for _, b := range buckets {
-		for _, peer := range b {
-			if peer.isSeeder() {
-				seeders = append(seeders, peer) // will never realloc
-			} else {
-				leechers = append(leechers, peer) // will never realloc
-			}
-		}
+// growPeers returns dst with capacity for at least n more peers.
+func growPeers(dst []peer, n int) []peer {
+	if dst != nil && cap(dst)-len(dst) >= n {
+		return dst
 	}
+	grown := make([]peer, len(dst), len(dst)+n)
+	copy(grown, dst)
+	return grown
+}
 
-	// leechers are first, then seeders
-	if len(seeders) > 0 {
-		leechers = append(leechers, seeders...) // will never realloc
-	}
+// The get functions below append the peers to dst and return the extended
+// slice.
 
-	return leechers
+func (pl *peerList) getAllPeers(dst []peer) []peer {
+	dst = growPeers(dst, pl.numPeers)
+
+	// leechers are first, then seeders
+	dst = pl.getAllLeechers(dst)
+	return pl.getAllSeeders(dst)
 }
 
-func (pl *peerList) getAllSeeders() []peer {
+func (pl *peerList) getAllSeeders(dst []peer) []peer {
 	buckets := pl.peerBuckets
-	seeders := make([]peer, 0, pl.numSeeders)
+	dst = growPeers(dst, pl.numSeeders)
 
 	for _, b := range buckets {
 		for _, peer := range b {
 			if peer.isSeeder() {
-				seeders = append(seeders, peer)
+				dst = append(dst, peer) // will never realloc
 			}
 		}
 	}
 
-	return seeders
+	return dst
 }
 
-func (pl *peerList) getAllLeechers() []peer {
+func (pl *peerList) getAllLeechers(dst []peer) []peer {
 	buckets := pl.peerBuckets
-	leechers := make([]peer, 0, pl.numPeers-pl.numSeeders)
+	dst = growPeers(dst, pl.numPeers-pl.numSeeders)
 
 	for _, b := range buckets {
 		for _, peer := range b {
 			if peer.isLeecher() {
-				leechers = append(leechers, peer)
+				dst = append(dst, peer) // will never realloc
 			}
 		}
 	}
 
-	return leechers
+	return dst
 }
 
-func (pl *peerList) getRandomSeeders(numWant int, s0, s1 uint64) []peer {
+func (pl *peerList) getRandomSeeders(dst []peer, numWant int, s0, s1 uint64) []peer {
 	buckets := pl.peerBuckets
-	toReturn := make([]peer, numWant)
+	dst = growPeers(dst, numWant)
 	chosen := 0
 
 	if numWant == 0 {
-		return toReturn
+		return dst
 	}
 
 	bucketOffset := 0
@@ -285,22 +435,22 @@ func (pl *peerList) getRandomSeeders(numWant int, s0, s1 uint64) []peer {
 			}
 			peer := b[bucketOffset%len(b)]
 			if peer.isSeeder() {
-				toReturn[chosen] = peer
+				dst = append(dst, peer)
 				chosen++
 			}
 		}
 	}
 
-	return toReturn
+	return dst
 }
 
-func (pl *peerList) getRandomLeechers(numWant int, s0, s1 uint64) []peer {
+func (pl *peerList) getRandomLeechers(dst []peer, numWant int, s0, s1 uint64) []peer {
 	buckets := pl.peerBuckets
-	toReturn := make([]peer, numWant)
+	dst = growPeers(dst, numWant)
 	chosen := 0
 
 	if numWant == 0 {
-		return toReturn
+		return dst
 	}
 
 	bucketOffset := 0
@@ -315,59 +465,98 @@ func (pl *peerList) getRandomLeechers(numWant int, s0, s1 uint64) []peer {
 			}
 			peer := b[bucketOffset%len(b)]
 			if peer.isLeecher() {
-				toReturn[chosen] = peer
+				dst = append(dst, peer)
 				chosen++
 			}
 		}
 	}
 
-	return toReturn
+	return dst
+}
+
+// getAnnouncePeers appends up to numWant peers for an announce to dst.
+// seederShare is the share of seeders returned to leechers, see
+// splitNumWant.
+func (pl *peerList) getAnnouncePeers(dst []peer, numWant int, seeder bool, announcingPeer *peer, seederShare float64, s0, s1 uint64) []peer {
+	if announcingPeer.requiresCrypto() {
+		return pl.getEncryptedAnnouncePeers(dst, numWant, seeder, seederShare, s0, s1)
+	}
+	return pl.getRandomAnnouncePeers(dst, numWant, seeder, seederShare, s0, s1)
 }
 
-func (pl *peerList) getAnnouncePeers(numWant int, seeder bool, announcingPeer *peer, s0, s1 uint64) (peers []peer) {
+// getRandomAnnouncePeers appends up to numWant random peers for an announce
+// to dst, regardless of their support for encryption.
+// This is the policy of the Random Selector.
+func (pl *peerList) getRandomAnnouncePeers(dst []peer, numWant int, seeder bool, seederShare float64, s0, s1 uint64) []peer {
 	if seeder {
 		// seeder announces: only leechers
 		if numWant > pl.numPeers-pl.numSeeders {
 			numWant = pl.numPeers - pl.numSeeders
 		}
 		if numWant == pl.numPeers-pl.numSeeders {
-			return pl.getAllLeechers()
+			return pl.getAllLeechers(dst)
 		}
-		return pl.getRandomLeechers(numWant, s0, s1)
+		return pl.getRandomLeechers(dst, numWant, s0, s1)
 	}
 
-	// leecher announces: seeders as many as possible, then leechers
+	// leecher announces: seeders and leechers as split by splitNumWant
 
 	if numWant > pl.numPeers {
 		// we can only return as many peers as we have
 		numWant = pl.numPeers
 	}
 
-	// we have enough seeders to only return seeders
-	if numWant <= pl.numSeeders {
-		return pl.getRandomSeeders(numWant, s0, s1)
-	}
 	// we have exactly as many peers as they want
 	if numWant == pl.numPeers {
-		peers = pl.getAllPeers()
-		return
+		return pl.getAllPeers(dst)
 	}
 
-	// we don't have enough seeders to only return seeders
-	peers = make([]peer, 0, numWant)
-	peers = append(peers, pl.getAllSeeders()...)
-	leechers := pl.getRandomLeechers(numWant-len(peers), s0, s1)
-	peers = append(peers, leechers...)
-	return
-}
+	numLeechers := pl.numPeers - pl.numSeeders
+	wantSeeders, wantLeechers := splitNumWant(numWant, pl.numSeeders, numLeechers, seederShare)
 
-func (pl *peerList) bucketIndex(peer *peer) int {
-	var hash uint = 5381
-	var i uint = peerCompareSize
+	// we have enough seeders to only return seeders
+	if wantLeechers == 0 {
+		return pl.getRandomSeeders(dst, wantSeeders, s0, s1)
+	}
 
-	for j := 0; i > 0; i, j = i-1, j+1 {
-		hash += (hash << 5) + uint(peer[j])
+	dst = growPeers(dst, numWant)
+	if wantSeeders == pl.numSeeders {
+		dst = pl.getAllSeeders(dst)
+	} else {
+		dst = pl.getRandomSeeders(dst, wantSeeders, s0, s1)
+	}
+	if wantLeechers == numLeechers {
+		return pl.getAllLeechers(dst)
 	}
+	return pl.getRandomLeechers(dst, wantLeechers, s0, s1)
+}
 
-	return int(hash % uint(len(pl.peerBuckets)))
+// splitNumWant splits the number of peers returned to a leecher announce into
+// seeders and leechers.
+// numWant must not be larger than numSeeders+numLeechers.
+//
+// A seederShare of zero returns as many seeders as possible. Otherwise, the
+// given share of seeders is returned, rounded up, unless there are not enough
+// seeders or leechers available.
+func splitNumWant(numWant, numSeeders, numLeechers int, seederShare float64) (wantSeeders, wantLeechers int) {
+	wantSeeders = numWant
+	if seederShare > 0 {
+		wantSeeders = int(math.Ceil(float64(numWant) * seederShare))
+	}
+	if wantSeeders > numSeeders {
+		wantSeeders = numSeeders
+	}
+	wantLeechers = numWant - wantSeeders
+	if wantLeechers > numLeechers {
+		wantLeechers = numLeechers
+		wantSeeders = numWant - wantLeechers
+	}
+	return
+}
+
+// bucketIndex returns the index of the bucket a peer belongs in.
+// The endpoint of the peer is hashed with the seed of the peerList, so peers
+// can not be crafted to all end up in the same bucket without knowing it.
+func (pl *peerList) bucketIndex(peer *peer) int {
+	return int(seededHash(pl.seed, peer[:peerCompareSize]) % uint64(len(pl.peerBuckets)))
 }
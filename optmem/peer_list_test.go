@@ -3,6 +3,7 @@ package optmem
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"net"
 	"sort"
 	"testing"
@@ -27,7 +28,7 @@ func TestComputeTargetBuckets(t *testing.T) {
 }
 
 func TestPutPeer(t *testing.T) {
-	pl := newPeerList()
+	pl := newPeerList(0)
 	for i := 0; i < 10; i++ {
 		p := new(peer)
 		p.setIP(net.IP{245, 132, 24, byte(i)}.To16())
@@ -45,7 +46,7 @@ func TestPutPeer(t *testing.T) {
 }
 
 func TestRemovePeer(t *testing.T) {
-	pl := newPeerList()
+	pl := newPeerList(0)
 	for i := 0; i < 10; i++ {
 		p := new(peer)
 		p.setIP(net.IP{245, 132, 24, byte(i)}.To16())
@@ -61,15 +62,59 @@ func TestRemovePeer(t *testing.T) {
 		p.setPort(3124 + uint16(i))
 		found, _ := pl.removePeer(p)
 		require.True(t, found)
+		found, _ = pl.removePeer(p)
+		require.False(t, found)
 	}
 
+	// Removed peers are tombstoned until the list is compacted.
+	require.Equal(t, 0, pl.numPeers)
+	require.Equal(t, 10, pl.numDead)
+	require.Equal(t, 0, len(pl.getAllPeers(nil)))
+	pl.rebalanceBuckets()
+	require.Equal(t, 0, pl.numDead)
 	require.Equal(t, 0, len(pl.peerBuckets[0]))
 }
 
+func TestReviveTombstone(t *testing.T) {
+	pl := newPeerList(0)
+	p := new(peer)
+	p.setIP(net.IP{245, 132, 24, 1}.To16())
+	p.setPort(3124)
+	p.setPeerFlag(peerFlagLeecher)
+	pl.putPeer(p)
+	found, _ := pl.removePeer(p)
+	require.True(t, found)
+
+	p.setPeerFlag(peerFlagSeeder)
+	deltaPeers, deltaSeeders := pl.putPeer(p)
+	require.Equal(t, uint64(1), deltaPeers)
+	require.Equal(t, int64(1), deltaSeeders)
+	require.Equal(t, 0, pl.numDead)
+	require.Equal(t, 1, len(pl.peerBuckets[0]))
+	require.True(t, pl.hasPeer(p))
+}
+
+func TestCountOlderThan(t *testing.T) {
+	pl := newPeerList(0)
+	for i := 0; i < 10; i++ {
+		p := new(peer)
+		p.setIP(net.IP{245, 132, 24, byte(i)}.To16())
+		p.setPort(3124 + uint16(i))
+		p.setPeerTime(math.MaxUint16 - 5 + uint16(i)) // wraps around
+		pl.putPeer(p)
+	}
+
+	now := uint16(10)
+	require.Equal(t, 10, pl.countOlderThan(now, 0))
+	require.Equal(t, 10, pl.countOlderThan(now, 7))
+	require.Equal(t, 5, pl.countOlderThan(now, 12))
+	require.Equal(t, 0, pl.countOlderThan(now, 17))
+}
+
 func BenchmarkRebalanceBuckets(b *testing.B) {
 	for k := 2; k < 10; k *= 2 {
 		b.Run(fmt.Sprintf("%d-peers-to-%d-buckets", 512*k, k), func(b *testing.B) {
-			pl := newPeerList()
+			pl := newPeerList(0)
 			numPeers := 0
 			for j := 0; j < k*2; j++ {
 				for i := 0; i < 256; i++ {
@@ -97,9 +142,35 @@ func BenchmarkRebalanceBuckets(b *testing.B) {
 
 }
 
+// BenchmarkRebalanceBucketsLarge rebalances single lists of up to a million
+// peers into their target number of buckets.
+func BenchmarkRebalanceBucketsLarge(b *testing.B) {
+	for _, numPeers := range []int{1 << 16, 1 << 18, 1 << 20} {
+		b.Run(fmt.Sprintf("%d-peers", numPeers), func(b *testing.B) {
+			pl := newPeerList(0)
+			oldBucket := make(bucket, 0, numPeers)
+			for i := 0; i < numPeers; i++ {
+				p := peer{}
+				p.setIP(net.IP{245, byte(i >> 16), byte(i >> 8), byte(i)}.To16())
+				p.setPort(3142)
+				oldBucket = append(oldBucket, p)
+			}
+			pl.numPeers = numPeers
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pl.peerBuckets = []bucket{oldBucket}
+				rebalanced := pl.rebalanceBuckets()
+				require.True(b, rebalanced)
+			}
+		})
+	}
+}
+
 func TestRebalanceBuckets(t *testing.T) {
-	pl := newPeerList()
-	pl2 := newPeerList()
+	pl := newPeerList(0)
+	pl2 := newPeerList(0)
 	numPeers := 0
 	for j := 0; j < 10; j++ {
 		for i := 0; i < 256; i++ {
@@ -143,3 +214,57 @@ func (pl *peerList) findPeer(p *peer) bool {
 	}
 	return true
 }
+
+var splitNumWantData = []struct {
+	numWant, numSeeders, numLeechers int
+	seederShare                      float64
+	expectedSeeders                  int
+	expectedLeechers                 int
+}{
+	{10, 100, 100, 0, 10, 0},
+	{10, 5, 100, 0, 5, 5},
+	{10, 100, 100, 0.6, 6, 4},
+	{10, 100, 2, 0.6, 8, 2},
+	{10, 3, 100, 0.6, 3, 7},
+	{5, 100, 100, 0.5, 3, 2},
+}
+
+func TestSplitNumWant(t *testing.T) {
+	for _, c := range splitNumWantData {
+		seeders, leechers := splitNumWant(c.numWant, c.numSeeders, c.numLeechers, c.seederShare)
+		require.Equal(t, c.expectedSeeders, seeders, "%+v", c)
+		require.Equal(t, c.expectedLeechers, leechers, "%+v", c)
+	}
+}
+
+func TestGetAnnouncePeersSeederShare(t *testing.T) {
+	pl := newPeerList(0)
+	for i := 0; i < 100; i++ {
+		p := new(peer)
+		p.setIP(net.IP{245, 132, 24, byte(i)}.To16())
+		p.setPort(3124)
+		if i%10 == 0 {
+			p.setPeerFlag(peerFlagLeecher)
+		} else {
+			p.setPeerFlag(peerFlagSeeder)
+		}
+		pl.putPeer(p)
+	}
+
+	peers := pl.getAnnouncePeers(nil, 10, false, new(peer), 0.6, 1, 2)
+	require.Len(t, peers, 10)
+	var seeders int
+	for _, p := range peers {
+		if p.isSeeder() {
+			seeders++
+		}
+	}
+	require.Equal(t, 6, seeders)
+}
+
+func TestBucketPool(t *testing.T) {
+	putBucket(make(bucket, 3, 600))
+	b := getBucket()
+	require.Equal(t, 0, len(b))
+	require.True(t, cap(b) >= bucketCapacity)
+}
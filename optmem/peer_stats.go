@@ -0,0 +1,132 @@
+package optmem
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// PeerStats are the transfer statistics a peer reported in an announce.
+type PeerStats struct {
+	Uploaded   uint64
+	Downloaded uint64
+	Left       uint64
+}
+
+// endpoint is the IP and port of a peer, used to key extended peer records.
+type endpoint [peerCompareSize]byte
+
+// hasPeer returns whether the peerList contains a peer with the same endpoint
+// as p, regardless of whether it is a seeder or a leecher.
+func (pl *peerList) hasPeer(p *peer) bool {
+	bucket := pl.peerBuckets[pl.bucketIndex(p)]
+	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
+	return match < len(bucket) && !bucket[match].isDead() && bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize])
+}
+
+// lookupPeer returns the stored peer with the endpoint ep, if any.
+func (pl *peerList) lookupPeer(ep endpoint) (peer, bool) {
+	var p peer
+	copy(p[:], ep[:])
+	bucket := pl.peerBuckets[pl.bucketIndex(&p)]
+	match := sort.Search(len(bucket), binarySearchFunc(&p, bucket))
+	if match < len(bucket) && !bucket[match].isDead() && bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize]) {
+		return bucket[match], true
+	}
+	return p, false
+}
+
+// deleteStats removes the extended record, the score and the announce key of
+// a peer, if any.
+func (pl *peerList) deleteStats(p *peer) {
+	if pl.stats == nil && pl.scores == nil && pl.keyOf == nil {
+		return
+	}
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	delete(pl.stats, e)
+	delete(pl.scores, e)
+	pl.deleteKey(e)
+}
+
+// PutPeerStats stores the transfer statistics of a peer alongside it.
+// The statistics are removed together with the peer, they are not included in
+// exports.
+//
+// Peers without statistics do not use any additional memory, so it is fine to
+// only store statistics for some peers.
+//
+// Returns storage.ErrResourceDoesNotExist if the peer is not stored in the
+// swarm of the given infohash.
+func (s *PeerStore) PutPeerStats(infoHash bittorrent.InfoHash, p bittorrent.Peer, stats PeerStats) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+	if p.IP.AddressFamily != bittorrent.IPv4 && p.IP.AddressFamily != bittorrent.IPv6 {
+		return ErrInvalidIP
+	}
+
+	ih := infohash(infoHash)
+	peer := makePeer(p, 0, 0)
+	shard := s.shards.lockShardByHash(ih)
+	defer s.shards.unlockShardByHash(ih, 0)
+
+	pl := shard.swarms[ih].list(p.IP.AddressFamily)
+	if pl == nil || !pl.hasPeer(peer) {
+		return storage.ErrResourceDoesNotExist
+	}
+
+	if pl.stats == nil {
+		pl.stats = make(map[endpoint]PeerStats)
+	}
+	var e endpoint
+	copy(e[:], peer[:peerCompareSize])
+	pl.stats[e] = stats
+
+	return nil
+}
+
+// GetPeerStats returns the transfer statistics stored for a peer.
+//
+// Returns storage.ErrResourceDoesNotExist if the peer is not stored in the
+// swarm of the given infohash or no statistics were stored for it.
+func (s *PeerStore) GetPeerStats(infoHash bittorrent.InfoHash, p bittorrent.Peer) (PeerStats, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	if p.IP.AddressFamily != bittorrent.IPv4 && p.IP.AddressFamily != bittorrent.IPv6 {
+		return PeerStats{}, ErrInvalidIP
+	}
+
+	ih := infohash(infoHash)
+	peer := makePeer(p, 0, 0)
+	shard := s.shards.rLockShardByHash(ih)
+	defer s.shards.rUnlockShardByHash(ih)
+
+	pl := shard.swarms[ih].list(p.IP.AddressFamily)
+	if pl == nil {
+		return PeerStats{}, storage.ErrResourceDoesNotExist
+	}
+
+	var e endpoint
+	copy(e[:], peer[:peerCompareSize])
+	stats, ok := pl.stats[e]
+	if !ok {
+		return PeerStats{}, storage.ErrResourceDoesNotExist
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,47 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerStats(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	stats := PeerStats{Uploaded: 1024, Downloaded: 512, Left: 256}
+	require.Equal(t, storage.ErrResourceDoesNotExist, ps.PutPeerStats(ih, p1, stats))
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	_, err = ps.GetPeerStats(ih, p1)
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+	require.Nil(t, ps.PutPeerStats(ih, p1, stats))
+	got, err := ps.GetPeerStats(ih, p1)
+	require.Nil(t, err)
+	require.Equal(t, stats, got)
+
+	// Graduating keeps the record.
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	got, err = ps.GetPeerStats(ih, p1)
+	require.Nil(t, err)
+	require.Equal(t, stats, got)
+
+	// Deleting the peer removes it.
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	_, err = ps.GetPeerStats(ih, p1)
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+	// So does purging the IP.
+	require.Nil(t, ps.PutPeerStats(ih, p2, stats))
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Equal(t, 1, purgeIP(t, ps, p2.IP.IP))
+	_, err = ps.GetPeerStats(ih, p2)
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
@@ -1,18 +1,24 @@
 package optmem
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
+	"math"
 	"net"
+	"net/http"
 	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
-	"github.com/chihaya/chihaya/pkg/timecache"
 	"github.com/chihaya/chihaya/storage"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
 // ErrInvalidIP is returned if a peer with an invalid IP was specified.
@@ -20,61 +26,365 @@ var ErrInvalidIP = errors.New("invalid IP")
 
 var _ storage.PeerStore = &PeerStore{}
 
+// Errors returned instead of storage.ErrResourceDoesNotExist if
+// DistinctNotFoundErrors is enabled.
+var (
+	// ErrSwarmNotFound is returned if the swarm of an infohash does not
+	// exist.
+	ErrSwarmNotFound = bittorrent.ClientError("swarm does not exist")
+
+	// ErrNoPeersForAddressFamily is returned if a swarm exists, but has no
+	// peers of the requested address family.
+	ErrNoPeersForAddressFamily = bittorrent.ClientError("swarm has no peers of the address family")
+
+	// ErrPeerNotFound is returned by deletes if the swarm has peers of the
+	// address family, but not the peer to delete.
+	ErrPeerNotFound = bittorrent.ClientError("peer does not exist")
+)
+
+// notFound returns err if distinct not-found errors are enabled and
+// storage.ErrResourceDoesNotExist otherwise.
+func (s *PeerStore) notFound(err error) error {
+	if s.cfg.DistinctNotFoundErrors {
+		return err
+	}
+	return storage.ErrResourceDoesNotExist
+}
+
 // New creates a new PeerStore from the config.
 func New(provided Config) (*PeerStore, error) {
 	cfg := provided.Validate()
-
-	ps := &PeerStore{
-		shards: newShardContainer(cfg.ShardCountBits),
-		closed: make(chan struct{}),
-		cfg:    cfg,
+	if (cfg.AdminAddr != "" || cfg.AdminGRPCAddr != "") && !cfg.adminAuthRequired() && !cfg.AdminInsecure {
+		return nil, ErrAdminCredentials
 	}
 
-	// Start a goroutine for garbage collection.
-	ps.wg.Add(1)
-	go func() {
-		defer ps.wg.Done()
-		for {
-			select {
-			case <-ps.closed:
-				return
-			case <-time.After(cfg.GarbageCollectionInterval):
-				cutoffTime := time.Now().Add(cfg.PeerLifetime * -1)
-				log.Debug("optmem: collecting garbage", log.Fields{"cutoffTime": cutoffTime})
-				ps.collectGarbage(cutoffTime)
-				log.Debug("optmem: finished collecting garbage")
-			}
+	ps := newPeerStore(cfg)
+	ps.erasureKey = cfg.erasureKey()
+
+	var err error
+	defer func() {
+		if err != nil {
+			ps.closeResources()
 		}
 	}()
 
-	// Start a goroutine for reporting statistics to Prometheus.
-	ps.wg.Add(1)
-	go func() {
-		defer ps.wg.Done()
-		t := time.NewTicker(cfg.PrometheusReportingInterval)
-		for {
-			select {
-			case <-ps.closed:
-				t.Stop()
-				return
-			case <-t.C:
-				before := time.Now()
-				log.Debug("optmem: populating prometheus...")
-				ps.populateProm()
-				log.Debug("storage: populateProm() finished", log.Fields{"timeTaken": time.Since(before)})
-			}
+	ps.snapshotCipher, err = cfg.snapshotCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	ps.persistence, err = cfg.persistenceDriver()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create persistence driver")
+	}
+
+	err = ps.loadSnapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load snapshot")
+	}
+
+	err = ps.loadDownloadCounters()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load download counters")
+	}
+
+	if cfg.AdminAuditLogPath != "" {
+		ps.auditLog, err = openAuditLog(cfg.AdminAuditLogPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open audit log")
 		}
-	}()
+	}
+
+	ps.reporters, err = cfg.reporters()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create metrics reporters")
+	}
+
+	if cfg.ColdStoragePath != "" {
+		ps.boltCold, err = OpenBoltColdStorage(cfg.ColdStoragePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open cold storage")
+		}
+		ps.boltCold.now = ps.now
+		ps.SetColdStorage(ps.boltCold)
+	}
+
+	if (cfg.AdminAddr != "" || cfg.AdminGRPCAddr != "") && !cfg.adminAuthRequired() {
+		log.Warn("optmem: admin servers run without authentication", log.Fields{"adminAddr": cfg.AdminAddr, "adminGRPCAddr": cfg.AdminGRPCAddr})
+	}
+
+	if cfg.AdminAddr != "" {
+		err = ps.startAdminServer()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to start admin server")
+		}
+	}
+
+	if cfg.AdminGRPCAddr != "" {
+		err = ps.startAdminGRPCServer()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to start admin gRPC server")
+		}
+	}
+
+	ps.start()
 
 	return ps, nil
 }
 
+// closeResources releases what New acquired before it failed.
+func (s *PeerStore) closeResources() {
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	if s.adminGRPC != nil {
+		s.adminGRPC.Stop()
+	}
+	if s.boltCold != nil {
+		s.boltCold.Close()
+	}
+	if s.persistence != nil {
+		s.persistence.Close()
+	}
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+	for _, r := range s.reporters {
+		if sr, ok := r.(*statsDReporter); ok {
+			sr.Close()
+		}
+	}
+}
+
+// newPeerStore creates a PeerStore from a validated config, without starting
+// any servers or goroutines.
+func newPeerStore(cfg Config) *PeerStore {
+	allowedNetworks, _ := parseCIDRs(cfg.AllowedUnroutableNetworks)
+	if cfg.ShardSeed == 0 {
+		cfg.ShardSeed = cfg.SelectionSeed
+	}
+	if cfg.ShardSeed == 0 {
+		cfg.ShardSeed = randomSeed()
+	}
+
+	ps := &PeerStore{
+		shards:          newShardContainer(cfg.ShardCountBits, cfg.LockFreeScrapes, cfg.ShardSeed),
+		allowedNetworks: allowedNetworks,
+		requests:        newRateMeter(cfg.clock()),
+		putCounts:       &putCounters{},
+		closed:          make(chan struct{}),
+		cfg:             cfg,
+		rand:            cfg.selectionRand(),
+		selector:        cfg.peerSelector(),
+		evictor:         cfg.evictor(),
+		breaker:         newCircuitBreaker(cfg),
+	}
+	ps.shards.contention = newRateMeter(cfg.clock())
+	ps.shards.chaos = newChaosInjector(cfg.Chaos)
+	ps.shards.hooks = &ps.hooks
+	ps.lastStaleSweep = ps.nowUnix()
+	if cfg.AnnounceRateLimit > 0 {
+		for _, shard := range ps.shards.shards {
+			shard.limits = &sync.Map{}
+		}
+	}
+	if cfg.AnnounceCacheThreshold > 0 {
+		for _, shard := range ps.shards.shards {
+			shard.selections = &sync.Map{}
+		}
+	}
+	if cfg.NegativeCacheSize > 0 {
+		for _, shard := range ps.shards.shards {
+			shard.known = newSwarmFilter(cfg.NegativeCacheSize)
+		}
+	}
+	if cfg.TimingWheel {
+		for _, shard := range ps.shards.shards {
+			shard.wheel = newTimingWheel(cfg)
+		}
+	}
+	if cfg.AnonymizeIPs {
+		ps.anon = newAnonymizer(cfg.AnonymizationKeyRotation)
+	}
+	ps.privacy = newScrapePrivacy(cfg)
+	if cfg.DownloadCountersPath != "" {
+		for _, shard := range ps.shards.shards {
+			shard.downloads = make(map[infohash][2]uint64)
+		}
+	}
+	ps.identity = cfg.identityMode()
+	if ps.identity != identityEndpoint {
+		ps.keySeed = randomSeed() | 1
+		for _, shard := range ps.shards.shards {
+			shard.identity = ps.identity
+			shard.linked = cfg.LinkDualStackPeers
+		}
+	}
+	if cfg.PeerScoring {
+		gap := uint16(math.MaxUint16)
+		if secs := cfg.PeerScoreMinInterval / time.Second; secs < math.MaxUint16 {
+			gap = uint16(secs)
+		}
+		if gap == 0 {
+			gap = 1
+		}
+		for _, shard := range ps.shards.shards {
+			shard.scoreGap = gap
+		}
+	}
+	if cfg.HistoryInterval > 0 {
+		ps.history = newHistory(cfg.historySize())
+	}
+	if cfg.ScrapeCacheTTL > 0 {
+		ps.scrapeCache = newScrapeCache(cfg)
+	}
+	ps.root = ps
+
+	return ps
+}
+
+// start starts the goroutines of a PeerStore.
+func (s *PeerStore) start() {
+	if s.cfg.BatchQueueSize > 0 {
+		s.startBatchWorkers()
+	}
+
+	// Start a goroutine for garbage collection.
+	atomic.StoreInt64(&s.gcHeartbeat, s.now().UnixNano())
+	s.wg.Add(1)
+	go s.supervise("gc", s.runGC)
+
+	if s.cfg.GCDeadline > 0 {
+		s.wg.Add(1)
+		go s.supervise("gc_watchdog", s.runGCWatchdog)
+	}
+
+	if s.shards.chaos != nil {
+		s.wg.Add(1)
+		go s.supervise("chaos", s.runChaos)
+	}
+
+	if s.cfg.ShedLoadAbove > 0 {
+		s.wg.Add(1)
+		go s.supervise("load_shedding", s.runLoadShedding)
+	}
+
+	if s.cfg.HotSetThreshold > 0 {
+		s.wg.Add(1)
+		go s.supervise("hot_sets", s.runHotSetRefresh)
+	}
+
+	if s.cfg.DownloadCountersPath != "" {
+		s.wg.Add(1)
+		go s.supervise("download_counters", s.runDownloadCounters)
+	}
+
+	if s.history != nil {
+		s.wg.Add(1)
+		go s.supervise("history", s.runHistory)
+	}
+
+	if s.cfg.Federation.enabled() {
+		s.wg.Add(1)
+		go s.supervise("federation", s.runFederation)
+	}
+
+	if len(s.reporters) > 0 {
+		for _, r := range s.reporters {
+			metricsReporters.add(r)
+		}
+		s.wg.Add(1)
+		go s.supervise("metrics", s.runMetrics)
+	}
+
+	if !s.cfg.DisablePrometheus {
+		promStores.add(s)
+	}
+}
+
 // PeerStore is an instance of an optmem PeerStore.
 type PeerStore struct {
-	shards *shardContainer
-	closed chan struct{}
-	cfg    Config
-	wg     sync.WaitGroup
+	shards          *shardContainer
+	batches         []*batchQueue // one per batch worker, nil if batching is disabled
+	requests        *rateMeter    // counts puts, deletes, announces and scrapes
+	putCounts       *putCounters
+	allowedNetworks []*net.IPNet // unroutable networks peers are stored from
+	admin           *http.Server // nil if the admin server is disabled
+	adminGRPC       *grpc.Server // nil if the admin gRPC server is disabled
+	auditLog        *auditLog    // nil if the audit log is disabled
+	hooks           lifecycleHooks
+	cold            atomic.Value               // coldStorageHolder, see SetColdStorage
+	boltCold        *BoltColdStorage           // nil unless ColdStoragePath is set
+	spilling        map[infohash]*pendingSpill // swarms being spilled, see beginSpill
+	spillMu         sync.Mutex                 // protects spilling
+	filter          atomic.Value               // peerFilterHolder, see SetPeerFilter
+	aliases         atomic.Value               // map[infohash]infohash, replaced on change, see AliasSwarm
+	aliasMu         sync.Mutex                 // serializes changes of aliases
+	bans            atomic.Value               // map[endpoint]int64 of expiry unix nanoseconds, replaced on change, only used in the default namespace, see BanPeer
+	banMu           sync.Mutex                 // serializes changes of bans
+	readOnly        int32                      // 1 if the store is read-only, see SetReadOnly
+	gcHeartbeat     int64                      // unix nanoseconds of the last GC activity, see Health
+	lastGCDuration  int64                      // nanoseconds of the last GC run, see LoadReport
+	lastStaleSweep  int64                      // unix seconds of the last run of sweepStale, only accessed by runGC
+	shedding        int32                      // 1 if announces are rejected with ErrOverloaded, see ShedLoadAbove
+	backupRunning   int32                      // 1 while a backup is written, see Backup
+	name            string                     // name of the namespace, empty for the default namespace
+	root            *PeerStore                 // store of the default namespace, s itself if name is empty
+	nsMu            sync.Mutex
+	namespaces      map[string]*PeerStore // only used in the default namespace
+	closed          chan struct{}
+	cfg             Config
+	wg              sync.WaitGroup
+	gcMu            sync.Mutex
+	gcPasses        map[*gcPass]struct{} // running GC passes, see runGCWatchdog
+	lastPanic       atomic.Value         // BackgroundError, see LastBackgroundError
+	rand            Rand                 // nil to derive selection entropy from requests
+	persistence     PersistenceDriver    // nil if persistence is disabled
+	snapshotCipher  *snapshotCipher      // nil unless snapshots are encrypted
+	selector        Selector             // nil for Random
+	evictor         Evictor
+	anon            *anonymizer        // nil unless AnonymizeIPs is set
+	privacy         *scrapePrivacy     // nil if scrapes are exact
+	history         *history           // nil unless HistoryInterval is set
+	scrapeCache     *scrapeCache       // nil unless ScrapeCacheTTL is set
+	reporters       []MetricsReporter  // only set in the default namespace
+	erasureKey      ed25519.PrivateKey // signs ErasureReports, only set in the default namespace
+	identity        identityMode
+	keySeed         uint64          // hashes identity keys, zero if peers are identified by their endpoint only
+	breaker         *circuitBreaker // nil unless ExpensiveOpSLO is set
+}
+
+// runGC collects garbage at the configured interval until the store is
+// closed.
+func (s *PeerStore) runGC() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(s.cfg.GarbageCollectionInterval):
+			atomic.StoreInt64(&s.gcHeartbeat, s.now().UnixNano())
+			if s.root == s {
+				s.expireBans()
+			}
+			if s.isReadOnly() {
+				log.Debug("optmem: skipping garbage collection, store is read-only", log.Fields{"namespace": s.name})
+				continue
+			}
+			if s.cfg.LazyExpiration {
+				// Peers are expired by puts and reads, see sweepLocked.
+				s.sweepStale()
+				continue
+			}
+			if s.cfg.TimingWheel {
+				s.collectWheels()
+				continue
+			}
+			cutoffTime := s.now().Add(s.cfg.PeerLifetime * -1)
+			log.Debug("optmem: collecting garbage", log.Fields{"namespace": s.name, "cutoffTime": cutoffTime})
+			s.collectGarbage(cutoffTime)
+			log.Debug("optmem: finished collecting garbage", log.Fields{"namespace": s.name})
+		}
+	}
 }
 
 // recordGCDuration records the duration of a GC sweep.
@@ -82,95 +392,247 @@ func recordGCDuration(duration time.Duration) {
 	storage.PromGCDurationMilliseconds.Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
 }
 
-// populateProm aggregates metrics over all shards and then posts them to
-// prometheus.
-func (s *PeerStore) populateProm() {
-	storage.PromInfohashesCount.Set(float64(s.NumSwarms()))
-	seeders, leechers := s.NumTotalPeers()
-	storage.PromSeedersCount.Set(float64(seeders))
-	storage.PromLeechersCount.Set(float64(leechers))
-}
-
 // LogFields implements log.LogFielder for a PeerStore.
 func (s *PeerStore) LogFields() log.Fields {
 	return s.cfg.LogFields()
 }
 
-func (s *PeerStore) collectGarbage(cutoff time.Time) {
+// GCStats describes the work done by a garbage collection run.
+type GCStats struct {
+	// PeersRemoved is the number of expired peers that were removed.
+	PeersRemoved int
+
+	// SwarmsRemoved is the number of swarms that were removed because they
+	// had no peers left.
+	SwarmsRemoved int
+
+	// SwarmsSpilled is the number of idle swarms that were moved to the
+	// ColdStorage.
+	SwarmsSpilled int
+
+	// ShardsTouched is the number of shards in which at least one peer or
+	// swarm was removed.
+	ShardsTouched int
+
+	// SwarmsCompacted is the number of swarms without leechers whose
+	// seeders were compacted, see SeederCompactionAfter.
+	SwarmsCompacted int
+
+	// Rebalances is the number of peer lists whose buckets were rebalanced
+	// after peers were removed.
+	Rebalances int
+
+	// Duration is the duration of the run.
+	Duration time.Duration
+
+	// Aborted is true if the run exceeded the configured GCDeadline and was
+	// aborted before all shards were collected.
+	Aborted bool
+}
+
+func (s *PeerStore) collectGarbage(cutoff time.Time) GCStats {
+	var stats GCStats
+	span := s.startSpan("optmem.CollectGarbage")
+	defer span.End()
+	var totalLockWait time.Duration
 	start := time.Now()
 	internalCutoff := uint16(cutoff.Unix())
-	maxDiff := uint16(time.Now().Unix() - cutoff.Unix())
+	maxDiff := uint16(s.nowUnix() - cutoff.Unix())
 	seeders, leechers := s.NumTotalPeers()
 	log.Debug("optmem: running GC", log.Fields{"internalCutoff": internalCutoff, "maxDiff": maxDiff, "numInfohashes": s.NumSwarms(), "numPeers": seeders + leechers})
+	hooks := &s.hooks // s is shadowed below
+	store := s
+	now := uint16(s.nowUnix())
+	minLifetime := uint16(s.cfg.MinSwarmLifetime / time.Second)
+	spillAfter := uint16(s.cfg.SpillAfter / time.Second)
+	compactAfter := uint16(s.cfg.SeederCompactionAfter / time.Second)
+	compactSample := int(s.cfg.SeederCompactionSample)
+	cold := s.coldStorage()
+	if spillAfter == 0 {
+		cold = nil
+	}
+	pass := s.beginGCPass()
+	defer s.endGCPass(pass)
+
+	// Release the shard lock if collecting a shard panics, so that the
+	// restarted GC goroutine and everyone else can still use the shard.
+	// The swarms may have been collected partially, so the counts of the
+	// shard are recomputed first.
+	held := -1
+	defer func() {
+		if r := recover(); r != nil {
+			if held >= 0 {
+				shard := s.shards.shards[held]
+				shard.recount()
+				s.shards.unlockShard(held, len(shard.swarms)-int(atomic.LoadUint64(&shard.numSwarms)))
+			}
+			panic(r)
+		}
+	}()
 
 	for i := 0; i < len(s.shards.shards); i++ {
+		if pass.aborted() {
+			log.Warn("optmem: aborting garbage collection", log.Fields{"namespace": s.name, "shardsDone": i})
+			stats.Aborted = true
+			break
+		}
+		pass.enterShard(i, s.now())
 		deltaTorrents := 0
 		// We must recount the number of seeders/leechers during GC, that's probably easier than having
 		// (*peerList).collectGarbage() return the number.
-		var numPeers, numSeeders uint64
+		var counts peerCounts
 		log.Debug("garbage-collecting shard", log.Fields{"index": i})
+		lockStart := time.Now()
 		shard := s.shards.lockShard(i)
+		held = i
+		pass.shardLocked()
+		totalLockWait += time.Since(lockStart)
 		log.Debug("got GC lock", log.Fields{"index": i, "infohashesInShard": len(shard.swarms)})
 
+		var expired4, expired6 int
+		var evicted []EvictedPeer
+		var spills []spill
+		var removed *[]peer
+		if hooks.hasEvictionCallbacks() {
+			removed = new([]peer)
+		}
 		for ih, s := range shard.swarms {
+			final := s
+			// Young swarms are kept like pinned swarms.
+			keep := s.retained() || s.young(now, minLifetime)
+			if cold != nil && !keep && s.idle(now, spillAfter) {
+				// The swarm is written after the shard is unlocked.
+				spills = append(spills, store.beginSpill(shard, ih, s))
+				shard.deleteSwarm(ih)
+				deltaTorrents--
+				continue
+			}
+			var gc4, gc6 bool
 			if s.peers4 != nil {
-				gc := s.peers4.collectGarbage(internalCutoff, maxDiff)
-				if s.peers4.numPeers == 0 {
+				before := s.peers4.numPeers
+				gc4 = s.peers4.collectGarbage(internalCutoff, maxDiff, removed)
+				evicted = takeEvictedPeers(evicted, ih, bittorrent.IPv4, removed)
+				expired4 += before - s.peers4.numPeers
+				if s.peers4.numPeers == 0 && !keep {
 					s.peers4 = nil
-					shard.swarms[ih] = s
 				} else {
-					if gc {
+					if gc4 {
 						s.peers4.rebalanceBuckets()
+						stats.Rebalances++
 					}
-					numPeers += uint64(s.peers4.numPeers)
-					numSeeders += uint64(s.peers4.numSeeders)
+					counts.peers4 += uint64(s.peers4.numPeers)
+					counts.seeders4 += uint64(s.peers4.numSeeders)
 				}
 			}
 
 			if s.peers6 != nil {
-				gc := s.peers6.collectGarbage(internalCutoff, maxDiff)
-				if s.peers6.numPeers == 0 {
+				before := s.peers6.numPeers
+				gc6 = s.peers6.collectGarbage(internalCutoff, maxDiff, removed)
+				evicted = takeEvictedPeers(evicted, ih, bittorrent.IPv6, removed)
+				expired6 += before - s.peers6.numPeers
+				if s.peers6.numPeers == 0 && !keep {
 					s.peers6 = nil
-					shard.swarms[ih] = s
 				} else {
-					if gc {
+					if gc6 {
 						s.peers6.rebalanceBuckets()
+						stats.Rebalances++
 					}
-					numPeers += uint64(s.peers6.numPeers)
-					numSeeders += uint64(s.peers6.numSeeders)
+					counts.peers6 += uint64(s.peers6.numPeers)
+					counts.seeders6 += uint64(s.peers6.numSeeders)
 				}
 			}
 
-			if s.peers4 == nil && s.peers6 == nil {
-				delete(shard.swarms, ih)
+			changed := gc4 || gc6
+			if s.compacted != nil {
+				changed = s.compacted.estimate(s) || changed
+				counts.addHidden(s)
+			}
+
+			if !keep && s.peers4 == nil && s.peers6 == nil {
+				hooks.swarmRemoved(shard, ih, final)
+				shard.deleteSwarm(ih)
 				deltaTorrents--
+				stats.SwarmsRemoved++
+				continue
+			}
+
+			var seededChanged bool
+			if compactAfter > 0 && s.compacted == nil {
+				var due bool
+				seededChanged, due = s.trackSeeded(now, compactAfter)
+				if due && compactSeeders(shard, ih, &s, compactSample) {
+					stats.SwarmsCompacted++
+					changed = true
+				}
+			}
+			if changed {
+				s.version = shard.nextVersion()
+			}
+			if changed || seededChanged {
+				shard.setSwarm(ih, s)
 			}
 		}
 
-		shard.numPeers = numPeers
-		shard.numSeeders = numSeeders
+		shard.counts = counts
 
 		s.shards.unlockShard(i, deltaTorrents)
+		held = -1
+		if len(spills) > 0 {
+			stats.SwarmsSpilled += s.finishSpills(cold, spills)
+		}
+		if len(evicted) > 0 {
+			s.anonymizeEvictedPeers(evicted)
+			hooks.peersEvicted(evicted)
+		}
+		promGCExpired4.Add(float64(expired4))
+		promGCExpired6.Add(float64(expired6))
+		metricsReporters.count("gc.expired_peers.ipv4", int64(expired4))
+		metricsReporters.count("gc.expired_peers.ipv6", int64(expired6))
+		atomic.StoreInt64(&s.gcHeartbeat, s.now().UnixNano())
+		stats.PeersRemoved += expired4 + expired6
+		if expired4+expired6 > 0 || deltaTorrents < 0 {
+			stats.ShardsTouched++
+		}
 		log.Debug("done garbage-collecting shard", log.Fields{"index": i})
 		runtime.Gosched()
 	}
 
-	recordGCDuration(time.Since(start))
+	if e, ok := cold.(coldStorageExpirer); ok && !stats.Aborted {
+		n, err := e.Expire(cutoff)
+		if err != nil {
+			log.Error("optmem: unable to expire spilled swarms", log.Fields{"error": err})
+		} else if n > 0 {
+			log.Debug("optmem: expired spilled swarms", log.Fields{"swarms": n})
+		}
+	}
+
+	stats.Duration = time.Since(start)
+	atomic.StoreInt64(&s.lastGCDuration, int64(stats.Duration))
+	recordGCDuration(stats.Duration)
+	recordGCStats(stats)
+	span.SetAttributes(attrLockWait.Int64(int64(totalLockWait)), attrSwarms.Int64(int64(s.NumSwarms())))
 	seeders, leechers = s.NumTotalPeers()
-	log.Debug("optmem: GC done", log.Fields{"numInfohashes": s.NumSwarms(), "numPeers": seeders + leechers})
+	log.Debug("optmem: GC done", log.Fields{"numInfohashes": s.NumSwarms(), "numPeers": seeders + leechers, "stats": stats})
+
+	return stats
 }
 
 // CollectGarbage can be used to manually collect peers older than the given
 // cutoff.
-func (s *PeerStore) CollectGarbage(cutoff time.Time) error {
+// It returns statistics about the work done, or ErrReadOnly if the store is
+// read-only.
+func (s *PeerStore) CollectGarbage(cutoff time.Time) (GCStats, error) {
 	select {
 	case <-s.closed:
 		panic("attempted to interact with closed store")
 	default:
 	}
 
-	s.collectGarbage(cutoff)
-	return nil
+	if s.isReadOnly() {
+		return GCStats{}, ErrReadOnly
+	}
+
+	return s.collectGarbage(cutoff), nil
 }
 
 // PutSeeder implements the PutSeeder method of a storage.PeerStore.
@@ -181,12 +643,7 @@ func (s *PeerStore) PutSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer) e
 	default:
 	}
 
-	peer := makePeer(p, peerFlagSeeder, uint16(timecache.NowUnix()))
-	ih := infohash(infoHash)
-
-	s.putPeer(ih, peer, p.IP.AddressFamily)
-
-	return nil
+	return s.put("optmem.PutSeeder", infoHash, p, peerFlagSeeder, false)
 }
 
 // DeleteSeeder implements the DeleteSeeder method of a storage.PeerStore.
@@ -196,11 +653,28 @@ func (s *PeerStore) DeleteSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer
 		panic("attempted to interact with closed store")
 	default:
 	}
+	defer promDeleteLatency.since(p.IP.AddressFamily, time.Now())
+	infoHash = s.resolveAlias(infoHash)
+	s.requests.inc()
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
 
 	peer := makePeer(p, peerFlagSeeder, uint16(0))
 	ih := infohash(infoHash)
 
+	s.faultIn(ih)
+	if s.batches != nil {
+		// Apply queued puts first, they might concern this peer.
+		s.flushShard(s.shards.shardIndex(ih))
+	}
+
 	_, err := s.deletePeer(ih, peer, p.IP.AddressFamily)
+	if err == nil {
+		promDeletes.inc(p.IP.AddressFamily)
+		s.logOp(Op{Kind: OpDelete, InfoHash: infoHash, Peer: p, Seeder: true})
+	}
 
 	return err
 }
@@ -213,12 +687,7 @@ func (s *PeerStore) PutLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer)
 	default:
 	}
 
-	peer := makePeer(p, peerFlagLeecher, uint16(timecache.NowUnix()))
-	ih := infohash(infoHash)
-
-	s.putPeer(ih, peer, p.IP.AddressFamily)
-
-	return nil
+	return s.put("optmem.PutLeecher", infoHash, p, peerFlagLeecher, false)
 }
 
 // DeleteLeecher implements the DeleteLeecher method of a storage.PeerStore.
@@ -228,66 +697,221 @@ func (s *PeerStore) DeleteLeecher(infoHash bittorrent.InfoHash, p bittorrent.Pee
 		panic("attempted to interact with closed store")
 	default:
 	}
+	defer promDeleteLatency.since(p.IP.AddressFamily, time.Now())
+	infoHash = s.resolveAlias(infoHash)
+	s.requests.inc()
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
 
 	peer := makePeer(p, peerFlagLeecher, uint16(0))
 	ih := infohash(infoHash)
 
+	s.faultIn(ih)
+	if s.batches != nil {
+		// Apply queued puts first, they might concern this peer.
+		s.flushShard(s.shards.shardIndex(ih))
+	}
+
 	_, err := s.deletePeer(ih, peer, p.IP.AddressFamily)
+	if err == nil {
+		promDeletes.inc(p.IP.AddressFamily)
+		s.logOp(Op{Kind: OpDelete, InfoHash: infoHash, Peer: p, Seeder: false})
+	}
 
 	return err
 }
 
 // GraduateLeecher implements the GraduateLeecher method of a storage.PeerStore.
+// It counts a completed download for the swarm.
 func (s *PeerStore) GraduateLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error {
-	// we can just overwrite any leecher we already have, so
-	return s.PutSeeder(infoHash, p)
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	// we can just overwrite any leecher we already have
+	return s.graduate(infoHash, p, peerFlagSeeder, s.identityKey(p, ""))
+}
+
+// graduate stores a peer with the given flags, which include
+// peerFlagSeeder, counting a completed download.
+// The graduation callbacks are called once the put is applied, if it turned
+// a stored leecher into a seeder, see putApplied.
+// All variants of GraduateLeecher go through it, see OnLeecherGraduated.
+func (s *PeerStore) graduate(infoHash bittorrent.InfoHash, p bittorrent.Peer, flag peerFlag, key uint64) error {
+	return s.putKeyed("optmem.GraduateLeecher", s.resolveAlias(infoHash), p, flag, true, key)
+}
+
+// put stores a peer with the given flags under the span name, counting a
+// completed download if completed is set.
+func (s *PeerStore) put(name string, infoHash bittorrent.InfoHash, p bittorrent.Peer, flag peerFlag, completed bool) error {
+	return s.putKeyed(name, infoHash, p, flag, completed, s.identityKey(p, ""))
 }
 
-func (s *PeerStore) putPeer(ih infohash, peer *peer, af bittorrent.AddressFamily) (swarmCreated bool) {
+// putKeyed works like put, but identifies the peer by the hashed identity key
+// as well as its endpoint, unless key is zero, see identityKey.
+func (s *PeerStore) putKeyed(name string, infoHash bittorrent.InfoHash, p bittorrent.Peer, flag peerFlag, completed bool, key uint64) error {
+	latency := promPutLatency
+	if completed {
+		latency = promGraduateLatency
+	}
+	defer latency.since(p.IP.AddressFamily, time.Now())
+	infoHash = s.resolveAlias(infoHash)
+	s.requests.inc()
+	span := s.startSpan(name)
+	defer span.End()
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	if !s.routable(p.IP) {
+		return ErrUnroutableIP
+	}
+
+	if s.banned(p) {
+		return ErrPeerBanned
+	}
+
+	if completed {
+		promGraduations.inc(p.IP.AddressFamily)
+	}
+
+	now := s.nowUnix()
+	peer := makePeer(p, flag, uint16(now))
+	ih := infohash(infoHash)
+	s.faultIn(ih)
+
+	op := opOfPut(infoHash, p, flag, completed, time.Unix(now, 0))
+	if s.batches != nil {
+		span.SetAttributes(attrBatched.Bool(true))
+		s.enqueuePut(ih, peer, p.IP.AddressFamily, completed, key, op)
+	} else {
+		graduated, err := s.putPeer(ih, peer, p.IP.AddressFamily, completed, key, span)
+		if err != nil {
+			return err
+		}
+		s.putApplied(op, graduated)
+	}
+
+	return nil
+}
+
+// putApplied logs a put that was applied and calls the graduation callbacks
+// if it turned a stored leecher into a seeder.
+// The shard must not be locked.
+func (s *PeerStore) putApplied(op Op, graduated bool) {
+	s.logOp(op)
+	if graduated {
+		s.hooks.leecherGraduated(op.InfoHash, s.anonymizePeer(op.Peer))
+	}
+}
+
+// putPeer stores a peer, evicting another one if a cap is hit.
+// Returns whether a stored leecher was turned into a seeder.
+func (s *PeerStore) putPeer(ih infohash, peer *peer, af bittorrent.AddressFamily, completed bool, key uint64, span trace.Span) (bool, error) {
+	start := waitStart(span)
 	shard := s.shards.lockShardByHash(ih)
+	lockWait(span, s.shards.shardIndex(ih), start)
+	err := s.admitPeer(shard, ih, peer, af)
+	if err != nil {
+		s.shards.unlockShardByHash(ih, 0)
+		return false, err
+	}
+	swarmCreated, inserted, graduated := putKeyedPeerLocked(shard, ih, peer, af, completed, key)
+	swarmSize(span, shard, ih, af)
+	removed, evicted := s.sweepLocked(shard, ih, nil)
+
+	if swarmCreated {
+		s.hooks.swarmCreated(shard, ih)
+		s.shards.unlockShardByHash(ih, 1-removed)
+	} else {
+		s.shards.unlockShardByHash(ih, -removed)
+	}
+	s.finishSweep(evicted)
+	s.putCounts.record(af, inserted)
+	return graduated, nil
+}
 
+// putPeerLocked inserts or updates a peer in a shard.
+// If completed is set, a download is counted for the swarm.
+// Returns whether the swarm was created and whether the peer was inserted,
+// as opposed to an existing peer being updated.
+// The shard must be write-locked by the caller.
+func putPeerLocked(shard *shard, ih infohash, peer *peer, af bittorrent.AddressFamily, completed bool) (swarmCreated, inserted bool) {
 	pl, ok := shard.swarms[ih]
 	if !ok {
 		swarmCreated = true
 		if af == bittorrent.IPv4 {
-			pl = swarm{peers4: newPeerList()}
+			pl = swarm{peers4: newPeerList(shard.seed)}
 		} else {
-			pl = swarm{peers6: newPeerList()}
+			pl = swarm{peers6: newPeerList(shard.seed)}
+		}
+		pl.created = peer.peerTime()
+		pl.swept, pl.oldest = pl.created, pl.created
+	} else if int16(peer.peerTime()-pl.oldest) < 0 {
+		// Imported peers may be older than the others.
+		pl.oldest = peer.peerTime()
+	}
+	if pl.compacted != nil {
+		if !peer.isSeeder() || completed {
+			expandSeeders(shard, &pl)
+		} else if l := pl.list(af); l == nil || !l.hasPeer(peer) {
+			// Seeders that are not in the sample are counted as hidden
+			// seeders, or not at all if they are new.
+			return false, false
 		}
-		shard.swarms[ih] = pl
 	}
 
 	if af == bittorrent.IPv4 {
 		if pl.peers4 == nil {
-			pl.peers4 = newPeerList()
-			shard.swarms[ih] = pl
+			pl.peers4 = newPeerList(shard.seed)
 		}
 
+		if shard.scoreGap > 0 {
+			pl.peers4.updateScore(peer, shard.scoreGap)
+		}
 		deltaPeers, deltaSeeders := pl.peers4.putPeer(peer)
 		if deltaPeers != 0 {
+			inserted = true
 			pl.peers4.rebalanceBuckets()
-			shard.numPeers += deltaPeers
+			shard.counts.peers4 += deltaPeers
 		}
-		shard.numSeeders = uint64(int64(shard.numSeeders) + deltaSeeders)
+		if completed {
+			pl.peers4.numDownloads++
+			shard.countDownload(ih, af, 1)
+		}
+		shard.counts.seeders4 = uint64(int64(shard.counts.seeders4) + deltaSeeders)
 	} else {
 		if pl.peers6 == nil {
-			pl.peers6 = newPeerList()
-			shard.swarms[ih] = pl
+			pl.peers6 = newPeerList(shard.seed)
 		}
 
+		if shard.scoreGap > 0 {
+			pl.peers6.updateScore(peer, shard.scoreGap)
+		}
 		deltaPeers, deltaSeeders := pl.peers6.putPeer(peer)
 		if deltaPeers != 0 {
+			inserted = true
 			pl.peers6.rebalanceBuckets()
-			shard.numPeers += deltaPeers
+			shard.counts.peers6 += deltaPeers
 		}
-		shard.numSeeders = uint64(int64(shard.numSeeders) + deltaSeeders)
+		if completed {
+			pl.peers6.numDownloads++
+			shard.countDownload(ih, af, 1)
+		}
+		shard.counts.seeders6 = uint64(int64(shard.counts.seeders6) + deltaSeeders)
 	}
 
-	if swarmCreated {
-		s.shards.unlockShardByHash(ih, 1)
-	} else {
-		s.shards.unlockShardByHash(ih, 0)
+	if shard.wheel != nil {
+		shard.wheel.addPeer(ih, af, peer)
 	}
+	pl.version = shard.nextVersion()
+	shard.setSwarm(ih, pl)
+
 	return
 }
 
@@ -303,56 +927,70 @@ func (s *PeerStore) deletePeer(ih infohash, peer *peer, af bittorrent.AddressFam
 
 	pl, ok := shard.swarms[ih]
 	if !ok {
-		return false, storage.ErrResourceDoesNotExist
+		return false, s.notFound(ErrSwarmNotFound)
+	}
+	// The peer lists are modified in place, but may be dropped from pl.
+	final := pl
+	var linkKey uint64
+	if shard.linked {
+		linkKey = pl.list(af).identityOf(peer)
 	}
 
 	if af == bittorrent.IPv4 {
 		if pl.peers4 == nil {
-			return false, storage.ErrResourceDoesNotExist
+			return false, s.notFound(ErrNoPeersForAddressFamily)
 		}
 
 		found, seeder := pl.peers4.removePeer(peer)
 		if !found {
-			return false, storage.ErrResourceDoesNotExist
+			return false, s.notFound(ErrPeerNotFound)
 		}
-		shard.numPeers--
+		shard.counts.peers4--
 		if seeder {
-			shard.numSeeders--
+			shard.counts.seeders4--
 		}
 
-		if pl.peers4.numPeers == 0 {
+		if pl.peers4.numPeers == 0 && !pl.retained() {
+			dropHiddenSeeders(shard, pl, bittorrent.IPv4)
 			pl.peers4 = nil
-			shard.swarms[ih] = pl
 		} else {
 			pl.peers4.rebalanceBuckets()
 		}
 	} else {
 		if pl.peers6 == nil {
-			return false, storage.ErrResourceDoesNotExist
+			return false, s.notFound(ErrNoPeersForAddressFamily)
 		}
 
 		found, seeder := pl.peers6.removePeer(peer)
 		if !found {
-			return false, storage.ErrResourceDoesNotExist
+			return false, s.notFound(ErrPeerNotFound)
 		}
-		shard.numPeers--
+		shard.counts.peers6--
 		if seeder {
-			shard.numSeeders--
+			shard.counts.seeders6--
 		}
 
-		if pl.peers6.numPeers == 0 {
+		if pl.peers6.numPeers == 0 && !pl.retained() {
+			dropHiddenSeeders(shard, pl, bittorrent.IPv6)
 			pl.peers6 = nil
-			shard.swarms[ih] = pl
 		} else {
 			pl.peers6.rebalanceBuckets()
 		}
 	}
+	if linkKey != 0 {
+		removeLinked(shard, &pl, af, linkKey)
+	}
 
-	if (pl.peers4 == nil && pl.peers6 == nil) || (pl.peers6 == nil && pl.peers4.numPeers == 0) || (pl.peers4 == nil && pl.peers6.numPeers == 0) {
-		delete(shard.swarms, ih)
+	if !pl.retained() && pl.peers4 == nil && pl.peers6 == nil {
+		s.hooks.swarmRemoved(shard, ih, final)
+		shard.deleteSwarm(ih)
 		deleted = true
+		return
 	}
 
+	pl.version = shard.nextVersion()
+	shard.setSwarm(ih, pl)
+
 	return
 }
 
@@ -370,82 +1008,291 @@ func (s *PeerStore) AnnouncePeers(infoHash bittorrent.InfoHash, seeder bool, num
 	default:
 	}
 
+	return s.announce(nil, infoHash, seeder, numWant, announcingPeer, 0)
+}
+
+// AppendAnnouncePeers works like AnnouncePeers, but appends the peers to dst
+// and returns the extended slice.
+//
+// The IPs of the entries between len(dst) and cap(dst) are reused to hold the
+// IPs of the returned peers, so announces reusing the same buffer, truncated
+// to zero length, do not allocate.
+// Callers must therefore not retain the peers of a buffer they pass again.
+func (s *PeerStore) AppendAnnouncePeers(dst []bittorrent.Peer, infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.announce(dst, infoHash, seeder, numWant, announcingPeer, 0)
+}
+
+// announce appends peers for an announcing peer with the given flags to dst.
+func (s *PeerStore) announce(dst []bittorrent.Peer, infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer, flag peerFlag) ([]bittorrent.Peer, error) {
+	buf, err := s.announceRecords(infoHash, seeder, numWant, announcingPeer, flag)
+	if err != nil {
+		return dst, err
+	}
+
+	dst = appendBittorrentPeers(dst, *buf, announcingPeer.IP.AddressFamily)
+	putPeerBuffer(buf)
+
+	return dst, nil
+}
+
+// announceRecords selects peers for an announcing peer with the given flags.
+// The peers are returned in a pooled buffer, which must be returned with
+// putPeerBuffer.
+func (s *PeerStore) announceRecords(infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer, flag peerFlag) (*[]peer, error) {
+	infoHash = s.resolveAlias(infoHash)
+	s.requests.inc()
+
 	if announcingPeer.IP.AddressFamily != bittorrent.IPv4 && announcingPeer.IP.AddressFamily != bittorrent.IPv6 {
 		return nil, ErrInvalidIP
 	}
+	promAnnounces.inc(announcingPeer.IP.AddressFamily)
+	defer promAnnounceLatency.since(announcingPeer.IP.AddressFamily, time.Now())
+	if s.overloaded(announcingPeer.IP.AddressFamily) {
+		return nil, ErrOverloaded
+	}
+	span := s.startSpan("optmem.AnnouncePeers")
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attrNumWant.Int(numWant))
+	}
 
 	ih := infohash(infoHash)
-	s0, s1 := deriveEntropyFromRequest(infoHash, announcingPeer)
+	s0, s1 := s.selectionEntropy(infoHash, announcingPeer)
+	s.faultIn(ih)
 
 	p := &peer{}
 	p.setPort(announcingPeer.Port)
 	p.setIP(announcingPeer.IP.To16())
-	return s.announceSingleStack(ih, seeder, numWant, p, announcingPeer.IP.AddressFamily, s0, s1)
+	p.setPeerFlag(flag)
+	buf, err := s.announceSingleStack(ih, seeder, s.cfg.clampNumWant(numWant), p, announcingPeer.IP.AddressFamily, s0, s1, span)
+	if err != nil {
+		recordNumWant(numWant, 0)
+		return nil, err
+	}
+	recordNumWant(numWant, len(*buf))
+
+	return buf, nil
 }
 
-func (s *PeerStore) announceSingleStack(ih infohash, seeder bool, numWant int, p *peer, af bittorrent.AddressFamily, s0, s1 uint64) (peers []bittorrent.Peer, err error) {
+// clampNumWant applies the configured default and maximum to the numWant of
+// an announce.
+// Negative values are treated as zero.
+func (cfg Config) clampNumWant(numWant int) int {
+	if numWant < 0 {
+		numWant = 0
+	}
+	if numWant == 0 && cfg.DefaultNumWant > 0 {
+		numWant = int(cfg.DefaultNumWant)
+	}
+	if cfg.MaxNumWant > 0 && numWant > int(cfg.MaxNumWant) {
+		numWant = int(cfg.MaxNumWant)
+	}
+	return numWant
+}
+
+// maxPooledPeers is the capacity up to which the intermediate peer buffers of
+// announces are pooled.
+const maxPooledPeers = 4096
+
+// peerBufferPool holds intermediate peer buffers of announces.
+var peerBufferPool = sync.Pool{New: func() interface{} { return new([]peer) }}
+
+func (s *PeerStore) announceSingleStack(ih infohash, seeder bool, numWant int, p *peer, af bittorrent.AddressFamily, s0, s1 uint64, span trace.Span) (*[]peer, error) {
+	if !s.swarmMayExist(s.shards.shards[s.shards.shardIndex(ih)], ih, af) {
+		return nil, s.notFound(ErrSwarmNotFound)
+	}
+
+	start := waitStart(span)
 	shard := s.shards.rLockShardByHash(ih)
+	lockWait(span, s.shards.shardIndex(ih), start)
+	swarmSize(span, shard, ih, af)
 
 	pl, ok := shard.swarms[ih]
 	if !ok {
 		s.shards.rUnlockShardByHash(ih)
-		return nil, storage.ErrResourceDoesNotExist
+		return nil, s.notFound(ErrSwarmNotFound)
+	}
+	if !s.allowAnnounce(shard, ih, af) {
+		s.shards.rUnlockShardByHash(ih)
+		return nil, ErrThrottled
+	}
+	l := pl.list(af)
+	if l == nil && s.cfg.DistinctNotFoundErrors {
+		s.shards.rUnlockShardByHash(ih)
+		return nil, ErrNoPeersForAddressFamily
 	}
 
-	var ps []peer
-	if af == bittorrent.IPv4 {
-		ps = pl.peers4.getAnnouncePeers(numWant, seeder, p, s0, s1)
-	} else {
-		ps = pl.peers6.getAnnouncePeers(numWant, seeder, p, s0, s1)
+	buf := peerBufferPool.Get().(*[]peer)
+	*buf = (*buf)[:0]
+	if l != nil {
+		*buf = s.selectPeers(shard, ih, l, *buf, numWant, seeder, p, af, s0, s1)
 	}
+	due := s.sweepDue(pl)
 	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
 
-	peers = make([]bittorrent.Peer, len(ps))
-	for i, p := range ps {
+	return buf, nil
+}
+
+// putPeerBuffer returns an intermediate peer buffer to the pool, unless it
+// grew too large.
+func putPeerBuffer(buf *[]peer) {
+	if cap(*buf) <= maxPooledPeers {
+		*buf = (*buf)[:0]
+		peerBufferPool.Put(buf)
+	}
+}
+
+// appendBittorrentPeers converts peers of an address family and appends them
+// to dst.
+// The IPs of the entries in the spare capacity of dst are reused.
+func appendBittorrentPeers(dst []bittorrent.Peer, ps []peer, af bittorrent.AddressFamily) []bittorrent.Peer {
+	if dst == nil || cap(dst)-len(dst) < len(ps) {
+		grown := make([]bittorrent.Peer, len(dst), len(dst)+len(ps))
+		copy(grown, dst)
+		dst = grown
+	}
+
+	for i := range ps {
+		ip := dst[:len(dst)+1][len(dst)].IP.IP[:0]
 		if af == bittorrent.IPv4 {
-			peers[i] = bittorrent.Peer{IP: bittorrent.IP{IP: net.IP(p.ip4()), AddressFamily: bittorrent.IPv4}, Port: p.port()}
-			continue
+			ip = append(ip, ps[i][12:ipLen]...)
+		} else {
+			ip = append(ip, ps[i][:ipLen]...)
 		}
-		peers[i] = bittorrent.Peer{IP: bittorrent.IP{IP: net.IP(p.ip()), AddressFamily: bittorrent.IPv6}, Port: p.port()}
+		dst = append(dst, bittorrent.Peer{IP: bittorrent.IP{IP: ip, AddressFamily: af}, Port: ps[i].port()})
 	}
 
-	return
+	return dst
 }
 
 // ScrapeSwarm implements the ScrapeSwarm method of a storage.PeerStore.
+// Results are cached for ScrapeCacheTTL, if set.
 func (s *PeerStore) ScrapeSwarm(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) (scrape bittorrent.Scrape) {
 	select {
 	case <-s.closed:
 		panic("attempted to interact with closed store")
 	default:
 	}
+	s.requests.inc()
 
-	scrape.InfoHash = infoHash
-	ih := infohash(infoHash)
-	shard := s.shards.rLockShardByHash(ih)
+	promScrapes.inc(af)
+	defer promScrapeLatency.since(af, time.Now())
 
-	pl, ok := shard.swarms[ih]
-	if !ok {
-		s.shards.rUnlockShardByHash(ih)
-		return
+	scrape.InfoHash = infoHash
+	ih := infohash(s.resolveAlias(infoHash))
+	s.faultIn(ih)
+	var now int64
+	if s.scrapeCache != nil {
+		now = s.now().UnixNano()
 	}
-
-	if af == bittorrent.IPv6 {
-		if pl.peers6 != nil {
-			scrape.Complete = uint32(pl.peers6.numSeeders)
-			scrape.Incomplete = uint32(pl.peers6.numPeers - pl.peers6.numSeeders)
+	if s.scrapeCache == nil || !s.scrapeCache.get(ih, af, now, &scrape) {
+		shard := s.shards.shards[s.shards.shardIndex(ih)]
+		if shard.downloads != nil || s.swarmMayExist(shard, ih, af) {
+			if !s.cfg.LockFreeScrapes || !scrapeLockFree(shard, ih, af, &scrape) {
+				s.shards.rLockShardByHash(ih)
+				sw := shard.swarms[ih]
+				scrapeLocked(shard, ih, af, s.peerCutoff(sw), &scrape)
+				due := s.sweepDue(sw)
+				s.shards.rUnlockShardByHash(ih)
+				s.sweepAfterRead(ih, due)
+			}
 		}
-	} else {
-		if pl.peers4 != nil {
-			scrape.Complete = uint32(pl.peers4.numSeeders)
-			scrape.Incomplete = uint32(pl.peers4.numPeers - pl.peers4.numSeeders)
+		if s.scrapeCache != nil {
+			s.scrapeCache.put(ih, af, now, scrape)
 		}
 	}
+	s.privacy.perturbScrape(ih, af, &scrape)
 
-	s.shards.rUnlockShardByHash(ih)
 	return
 }
 
+// scrapeLocked fills in the seeder and leecher counts of a scrape, without
+// the peers selected by cutoff.
+// Counts that do not fit into 32 bits are saturated, see Scrape64.
+// The shard must be read-locked by the caller.
+func scrapeLocked(shard *shard, ih infohash, af bittorrent.AddressFamily, cutoff peerCutoff, scrape *bittorrent.Scrape) {
+	counts := scrapeLocked64(shard, ih, af, cutoff)
+	scrape.Snatches = saturate32(counts.Snatches)
+	scrape.Complete = saturate32(counts.Complete)
+	scrape.Incomplete = saturate32(counts.Incomplete)
+}
+
+// ScrapeSwarms returns the scrape data for multiple infohashes.
+// The scrapes are returned in the order of the infohashes given.
+// Infohashes are grouped by shard, every shard is only locked once.
+func (s *PeerStore) ScrapeSwarms(infoHashes []bittorrent.InfoHash, af bittorrent.AddressFamily) []bittorrent.Scrape {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	s.requests.inc()
+
+	scrapes := make([]bittorrent.Scrape, len(infoHashes))
+	shardIndices := make([]int, len(infoHashes))
+	order := make([]int, len(infoHashes))
+	resolved := make([]infohash, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		scrapes[i].InfoHash = infoHash
+		resolved[i] = infohash(s.resolveAlias(infoHash))
+		shardIndices[i] = s.shards.shardIndex(resolved[i])
+		order[i] = i
+		s.faultIn(resolved[i])
+		promScrapes.inc(af)
+	}
+	sort.Slice(order, func(i, j int) bool { return shardIndices[order[i]] < shardIndices[order[j]] })
+
+	for start := 0; start < len(order); {
+		index := shardIndices[order[start]]
+		shard := s.shards.rLockShard(index)
+		end := start
+		for ; end < len(order) && shardIndices[order[end]] == index; end++ {
+			i := order[end]
+			scrapeLocked(shard, resolved[i], af, s.peerCutoff(shard.swarms[resolved[i]]), &scrapes[i])
+		}
+		s.shards.rUnlockShard(index)
+		start = end
+	}
+	for i := range scrapes {
+		s.privacy.perturbScrape(resolved[i], af, &scrapes[i])
+	}
+
+	return scrapes
+}
+
+// SwarmStats holds the scrape data of a swarm, per address family and
+// combined.
+type SwarmStats struct {
+	IPv4     bittorrent.Scrape
+	IPv6     bittorrent.Scrape
+	Combined bittorrent.Scrape
+	Tags     []string // see SetSwarmTags
+}
+
+// ScrapeSwarmBoth returns the scrape data of both address families for the
+// given infohash.
+// Unlike calling ScrapeSwarm for each family, the numbers are obtained
+// atomically.
+// Counts that do not fit into 32 bits, including the combined counts, are
+// saturated, see ScrapeSwarmBoth64.
+func (s *PeerStore) ScrapeSwarmBoth(infoHash bittorrent.InfoHash) SwarmStats {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	s.requests.inc()
+
+	return s.scrapeBoth64(infoHash).swarmStats()
+}
+
 // NumSeeders returns the number of seeders for the given infohash.
 func (s *PeerStore) NumSeeders(infoHash bittorrent.InfoHash) int {
 	select {
@@ -453,6 +1300,7 @@ func (s *PeerStore) NumSeeders(infoHash bittorrent.InfoHash) int {
 		panic("attempted to interact with closed store")
 	default:
 	}
+	infoHash = s.resolveAlias(infoHash)
 
 	ih := infohash(infoHash)
 	shard := s.shards.rLockShardByHash(ih)
@@ -463,16 +1311,12 @@ func (s *PeerStore) NumSeeders(infoHash bittorrent.InfoHash) int {
 		return 0
 	}
 
-	totalSeeders := 0
-	if pl.peers4 != nil {
-		totalSeeders += pl.peers4.numSeeders
-	}
-	if pl.peers6 != nil {
-		totalSeeders += pl.peers6.numSeeders
-	}
+	totalSeeders, _, _ := pl.counts(s.peerCutoff(pl))
+	due := s.sweepDue(pl)
 
 	s.shards.rUnlockShardByHash(ih)
-	return totalSeeders
+	s.sweepAfterRead(ih, due)
+	return int(totalSeeders)
 }
 
 // NumLeechers returns the number of leechers for the given infohash.
@@ -482,6 +1326,7 @@ func (s *PeerStore) NumLeechers(infoHash bittorrent.InfoHash) int {
 		panic("attempted to interact with closed store")
 	default:
 	}
+	infoHash = s.resolveAlias(infoHash)
 
 	ih := infohash(infoHash)
 	shard := s.shards.rLockShardByHash(ih)
@@ -492,25 +1337,51 @@ func (s *PeerStore) NumLeechers(infoHash bittorrent.InfoHash) int {
 		return 0
 	}
 
-	totalLeechers := 0
-	if pl.peers4 != nil {
-		totalLeechers += (pl.peers4.numPeers - pl.peers4.numSeeders)
+	_, totalLeechers, _ := pl.counts(s.peerCutoff(pl))
+	due := s.sweepDue(pl)
+
+	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
+	return int(totalLeechers)
+}
+
+// SwarmDigest returns a version for the swarm of the given infohash.
+// The version changes every time the swarm is modified, which allows caches to
+// check whether data they derived from the swarm is still fresh.
+// Versions are not comparable across infohashes.
+// Zero is returned if the swarm does not exist.
+// Runs in constant time.
+func (s *PeerStore) SwarmDigest(infoHash bittorrent.InfoHash) uint64 {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
 	}
-	if pl.peers6 != nil {
-		totalLeechers += (pl.peers6.numPeers - pl.peers6.numSeeders)
+	infoHash = s.resolveAlias(infoHash)
+
+	ih := infohash(infoHash)
+	shard := s.shards.rLockShardByHash(ih)
+
+	pl, ok := shard.swarms[ih]
+	if !ok {
+		s.shards.rUnlockShardByHash(ih)
+		return 0
 	}
 
+	version := pl.version
 	s.shards.rUnlockShardByHash(ih)
-	return totalLeechers
+	return version
 }
 
 // GetSeeders returns all seeders for the given infohash.
+// If AnonymizeIPs is enabled, their IPs are replaced by pseudonyms.
 func (s *PeerStore) GetSeeders(infoHash bittorrent.InfoHash) (peers4, peers6 []bittorrent.Peer, err error) {
 	select {
 	case <-s.closed:
 		panic("attempted to interact with closed store")
 	default:
 	}
+	infoHash = s.resolveAlias(infoHash)
 
 	ih := infohash(infoHash)
 	shard := s.shards.rLockShardByHash(ih)
@@ -518,17 +1389,28 @@ func (s *PeerStore) GetSeeders(infoHash bittorrent.InfoHash) (peers4, peers6 []b
 	pl, ok := shard.swarms[ih]
 	if !ok {
 		s.shards.rUnlockShardByHash(ih)
-		return nil, nil, storage.ErrResourceDoesNotExist
+		return nil, nil, s.notFound(ErrSwarmNotFound)
+	}
+	if s.expensiveSwarm(pl.numPeers()) {
+		start, ok := s.breaker.admit(opGetSeeders)
+		if !ok {
+			s.shards.rUnlockShardByHash(ih)
+			return nil, nil, ErrCircuitOpen
+		}
+		defer s.breaker.done(start)
 	}
 
 	var ps4, ps6 []peer
+	cutoff := s.peerCutoff(pl)
 	if pl.peers4 != nil {
-		ps4 = pl.peers4.getAllSeeders()
+		ps4 = cutoff.filter(pl.peers4.getAllSeeders(nil), 0)
 	}
 	if pl.peers6 != nil {
-		ps6 = pl.peers6.getAllSeeders()
+		ps6 = cutoff.filter(pl.peers6.getAllSeeders(nil), 0)
 	}
+	due := s.sweepDue(pl)
 	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
 
 	for _, p := range ps4 {
 		peers4 = append(peers4, bittorrent.Peer{IP: bittorrent.IP{IP: net.IP(p.ip4()), AddressFamily: bittorrent.IPv4}, Port: p.port()})
@@ -538,16 +1420,21 @@ func (s *PeerStore) GetSeeders(infoHash bittorrent.InfoHash) (peers4, peers6 []b
 		peers6 = append(peers6, bittorrent.Peer{IP: bittorrent.IP{IP: net.IP(p.ip()), AddressFamily: bittorrent.IPv6}, Port: p.port()})
 	}
 
+	s.anonymizePeers(peers4)
+	s.anonymizePeers(peers6)
+
 	return
 }
 
 // GetLeechers returns all leechers for the given infohash.
+// If AnonymizeIPs is enabled, their IPs are replaced by pseudonyms.
 func (s *PeerStore) GetLeechers(infoHash bittorrent.InfoHash) (peers4, peers6 []bittorrent.Peer, err error) {
 	select {
 	case <-s.closed:
 		panic("attempted to interact with closed store")
 	default:
 	}
+	infoHash = s.resolveAlias(infoHash)
 
 	ih := infohash(infoHash)
 	shard := s.shards.rLockShardByHash(ih)
@@ -555,17 +1442,28 @@ func (s *PeerStore) GetLeechers(infoHash bittorrent.InfoHash) (peers4, peers6 []
 	pl, ok := shard.swarms[ih]
 	if !ok {
 		s.shards.rUnlockShardByHash(ih)
-		return nil, nil, storage.ErrResourceDoesNotExist
+		return nil, nil, s.notFound(ErrSwarmNotFound)
+	}
+	if s.expensiveSwarm(pl.numPeers()) {
+		start, ok := s.breaker.admit(opGetLeechers)
+		if !ok {
+			s.shards.rUnlockShardByHash(ih)
+			return nil, nil, ErrCircuitOpen
+		}
+		defer s.breaker.done(start)
 	}
 
 	var ps4, ps6 []peer
+	cutoff := s.peerCutoff(pl)
 	if pl.peers4 != nil {
-		ps4 = pl.peers4.getAllLeechers()
+		ps4 = cutoff.filter(pl.peers4.getAllLeechers(nil), 0)
 	}
 	if pl.peers6 != nil {
-		ps6 = pl.peers6.getAllLeechers()
+		ps6 = cutoff.filter(pl.peers6.getAllLeechers(nil), 0)
 	}
+	due := s.sweepDue(pl)
 	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
 
 	for _, p := range ps4 {
 		peers4 = append(peers4, bittorrent.Peer{IP: bittorrent.IP{IP: net.IP(p.ip4()), AddressFamily: bittorrent.IPv4}, Port: p.port()})
@@ -575,22 +1473,76 @@ func (s *PeerStore) GetLeechers(infoHash bittorrent.InfoHash) (peers4, peers6 []
 		peers6 = append(peers6, bittorrent.Peer{IP: bittorrent.IP{IP: net.IP(p.ip()), AddressFamily: bittorrent.IPv6}, Port: p.port()})
 	}
 
+	s.anonymizePeers(peers4)
+	s.anonymizePeers(peers6)
+
 	return
 }
 
 // Stop implements the Stop method of a storage.PeerStore.
+// If a snapshot path is configured, the swarms are written to it before the
+// result is delivered.
 func (s *PeerStore) Stop() stop.Result {
 	select {
 	case <-s.closed:
 		return stop.AlreadyStopped
 	default:
 	}
-	toReturn := make(chan []error)
+	toReturn := make(chan []error, 1)
 	go func() {
+		promStores.remove(s)
 		close(s.closed)
+		if s.admin != nil {
+			s.admin.Close()
+		}
+		if s.adminGRPC != nil {
+			s.adminGRPC.Stop()
+		}
+		s.stopNamespaces()
 		s.wg.Wait()
+		s.breaker.close()
 
-		s.shards = newShardContainer(s.cfg.ShardCountBits)
+		var errs []error
+		err := s.writeSnapshot()
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "unable to write snapshot"))
+		}
+		err = s.writeDownloadCounters()
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "unable to write download counters"))
+		}
+		if s.boltCold != nil {
+			err = s.boltCold.Close()
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, "unable to close cold storage"))
+			}
+		}
+		if s.persistence != nil {
+			err = s.persistence.Close()
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, "unable to close persistence driver"))
+			}
+		}
+		if s.auditLog != nil {
+			err = s.auditLog.Close()
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, "unable to close audit log"))
+			}
+		}
+		for _, r := range s.reporters {
+			metricsReporters.remove(r)
+			if sr, ok := r.(*statsDReporter); ok {
+				err = sr.Close()
+				if err != nil {
+					errs = append(errs, errors.Wrap(err, "unable to close StatsD reporter"))
+				}
+			}
+		}
+		if len(errs) > 0 {
+			toReturn <- errs
+		}
+
+		s.shards = newShardContainer(s.cfg.ShardCountBits, s.cfg.LockFreeScrapes, s.cfg.ShardSeed)
 		close(toReturn)
 	}()
 	return toReturn
@@ -610,7 +1562,8 @@ func (s *PeerStore) NumSwarms() uint64 {
 }
 
 // NumTotalPeers returns the total number of peers tracked by the PeerStore.
-// Runs in linear time in regards to the number of swarms tracked. The numbers
+// Runs in constant time, or in linear time in regards to the number of
+// swarms if LazyExpiration is set, see unexpiredPeerCounts. The numbers
 // returned are approximate.
 func (s *PeerStore) NumTotalPeers() (seeders, leechers uint64) {
 	select {
@@ -619,12 +1572,20 @@ func (s *PeerStore) NumTotalPeers() (seeders, leechers uint64) {
 	default:
 	}
 
-	for i := 0; i < len(s.shards.shards); i++ {
-		shard := s.shards.rLockShard(i)
-		seeders += shard.numSeeders
-		leechers += shard.numPeers - shard.numSeeders
-		s.shards.rUnlockShard(i)
+	return s.unexpiredPeerCounts().total()
+}
+
+// NumPeers returns the number of peers of an address family tracked by the
+// PeerStore.
+// Runs in constant time, or in linear time in regards to the number of
+// swarms if LazyExpiration is set, see unexpiredPeerCounts. The numbers
+// returned are approximate.
+func (s *PeerStore) NumPeers(af bittorrent.AddressFamily) (seeders, leechers uint64) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
 	}
 
-	return seeders, leechers
+	return s.unexpiredPeerCounts().family(af)
 }
@@ -1,12 +1,14 @@
 package optmem
 
 import (
+	"math/rand"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	s "github.com/chihaya/chihaya/storage"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,6 +26,10 @@ var (
 		IP:   bittorrent.IP{IP: net.ParseIP("2.3.4.5"), AddressFamily: bittorrent.IPv4},
 		Port: 2345,
 	}
+	p3 = bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: bittorrent.IPv6},
+		Port: 3456,
+	}
 )
 
 func TestPutNumGetSeeder(t *testing.T) {
@@ -216,8 +222,190 @@ func TestDeleteLastLeecher(t *testing.T) {
 	require.Nil(t, errs)
 }
 
-func createNew() s.PeerStore {
+func TestSwarmDigest(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	require.NotNil(t, ps)
+
+	require.Equal(t, uint64(0), ps.SwarmDigest(ih))
+
+	err = ps.PutLeecher(ih, p1)
+	require.Nil(t, err)
+	d1 := ps.SwarmDigest(ih)
+	require.NotEqual(t, uint64(0), d1)
+	require.Equal(t, d1, ps.SwarmDigest(ih))
+
+	err = ps.PutSeeder(ih, p2)
+	require.Nil(t, err)
+	d2 := ps.SwarmDigest(ih)
+	require.NotEqual(t, d1, d2)
+
+	err = ps.DeleteSeeder(ih, p2)
+	require.Nil(t, err)
+	d3 := ps.SwarmDigest(ih)
+	require.NotEqual(t, d2, d3)
+
+	// Removing and recreating the swarm must not reuse an old version.
+	err = ps.DeleteLeecher(ih, p1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), ps.SwarmDigest(ih))
+	err = ps.PutLeecher(ih, p1)
+	require.Nil(t, err)
+	require.NotEqual(t, d1, ps.SwarmDigest(ih))
+	require.NotEqual(t, d3, ps.SwarmDigest(ih))
+
+	e := ps.Stop()
+	errs := <-e
+	require.Nil(t, errs)
+}
+
+func TestScrapeSwarmBoth(t *testing.T) {
 	ps, err := New(testConfig)
+	require.Nil(t, err)
+	require.NotNil(t, ps)
+
+	stats := ps.ScrapeSwarmBoth(ih)
+	require.Equal(t, ih, stats.Combined.InfoHash)
+	require.Equal(t, uint32(0), stats.Combined.Complete)
+	require.Equal(t, uint32(0), stats.Combined.Incomplete)
+
+	err = ps.PutSeeder(ih, p1)
+	require.Nil(t, err)
+	err = ps.PutLeecher(ih, p2)
+	require.Nil(t, err)
+	err = ps.PutSeeder(ih, p3)
+	require.Nil(t, err)
+
+	stats = ps.ScrapeSwarmBoth(ih)
+	require.Equal(t, uint32(1), stats.IPv4.Complete)
+	require.Equal(t, uint32(1), stats.IPv4.Incomplete)
+	require.Equal(t, uint32(1), stats.IPv6.Complete)
+	require.Equal(t, uint32(0), stats.IPv6.Incomplete)
+	require.Equal(t, uint32(2), stats.Combined.Complete)
+	require.Equal(t, uint32(1), stats.Combined.Incomplete)
+	require.Equal(t, ps.ScrapeSwarm(ih, bittorrent.IPv4), stats.IPv4)
+	require.Equal(t, ps.ScrapeSwarm(ih, bittorrent.IPv6), stats.IPv6)
+
+	e := ps.Stop()
+	errs := <-e
+	require.Nil(t, errs)
+}
+
+func TestBatchedPuts(t *testing.T) {
+	cfg := testConfig
+	cfg.BatchQueueSize = 16
+	cfg.BatchFlushInterval = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, ps)
+
+	err = ps.PutSeeder(ih, p1)
+	require.Nil(t, err)
+	err = ps.PutLeecher(ih, p2)
+	require.Nil(t, err)
+
+	ps.Flush()
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	require.Equal(t, uint64(1), ps.NumSwarms())
+
+	// Deletes must see queued puts.
+	err = ps.PutLeecher(ih, p3)
+	require.Nil(t, err)
+	err = ps.DeleteLeecher(ih, p3)
+	require.Nil(t, err)
+
+	e := ps.Stop()
+	errs := <-e
+	require.Nil(t, errs)
+}
+
+func TestBatchWorkers(t *testing.T) {
+	cfg := testConfig
+	cfg.BatchQueueSize = 16
+	cfg.BatchFlushInterval = time.Hour
+	cfg.BatchWorkers = 3
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+	require.Len(t, ps.batches, 3)
+	require.Equal(t, 16*342, cap(ps.batches[0].ops))
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	ps.Flush()
+	require.True(t, ps.FreezeSwarm(ih))
+
+	// Queued puts rejected by the frozen swarm are counted.
+	var m dto.Metric
+	require.Nil(t, promBatchRejects.ipv4.Write(&m))
+	before := m.GetCounter().GetValue()
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	ps.Flush()
+	require.Equal(t, 0, ps.NumLeechers(ih))
+	require.Nil(t, promBatchRejects.ipv4.Write(&m))
+	require.Equal(t, before+1, m.GetCounter().GetValue())
+}
+
+func TestScrapeSwarms(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	require.NotNil(t, ps)
+
+	infoHashes := []bittorrent.InfoHash{
+		bittorrent.InfoHashFromString("11111111111111111111"),
+		ih,
+		bittorrent.InfoHashFromString("22222222222222222222"),
+		bittorrent.InfoHashFromString("11111111111111111112"),
+	}
+	for i, infoHash := range infoHashes {
+		for j := 0; j <= i; j++ {
+			err = ps.PutSeeder(infoHash, bittorrent.Peer{
+				IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(j)).To4(), AddressFamily: bittorrent.IPv4},
+				Port: 1234,
+			})
+			require.Nil(t, err)
+		}
+	}
+	infoHashes = append(infoHashes, bittorrent.InfoHashFromString("33333333333333333333"))
+
+	scrapes := ps.ScrapeSwarms(infoHashes, bittorrent.IPv4)
+	require.Equal(t, len(infoHashes), len(scrapes))
+	for i, infoHash := range infoHashes {
+		require.Equal(t, ps.ScrapeSwarm(infoHash, bittorrent.IPv4), scrapes[i])
+	}
+	require.Equal(t, uint32(3), scrapes[2].Complete)
+	require.Equal(t, uint32(0), scrapes[4].Complete)
+
+	e := ps.Stop()
+	errs := <-e
+	require.Nil(t, errs)
+}
+
+func TestPutCounts(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	require.NotNil(t, ps)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+
+	ipv4, ipv6 := ps.PutCounts()
+	require.Equal(t, PutCounts{Inserted: 2, Updated: 2}, ipv4)
+	require.Equal(t, PutCounts{Inserted: 1, Updated: 0}, ipv6)
+
+	e := ps.Stop()
+	errs := <-e
+	require.Nil(t, errs)
+}
+
+func createNew() s.PeerStore {
+	// The benchmarks use random IPs, which are not necessarily routable.
+	cfg := testConfig
+	cfg.AllowedUnroutableNetworks = []string{"0.0.0.0/0", "::/0"}
+	ps, err := New(cfg)
 	if err != nil {
 		panic(err)
 	}
@@ -258,3 +446,230 @@ func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, cre
 func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
 func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
 func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
+
+func TestNumTotalPeers(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	r := rand.New(rand.NewSource(0))
+	var infoHashes []bittorrent.InfoHash
+	for i := 0; i < 100; i++ {
+		infoHash := randomInfoHash(r)
+		infoHashes = append(infoHashes, infoHash)
+		for j := 0; j < 10; j++ {
+			p := benchPeer(i*10 + j)
+			if j%3 == 0 {
+				require.Nil(t, ps.PutSeeder(infoHash, p))
+			} else {
+				require.Nil(t, ps.PutLeecher(infoHash, p))
+			}
+		}
+	}
+	ps.DeleteSwarm(infoHashes[0])
+	ps.RemoveSwarms(func(infoHash bittorrent.InfoHash) bool { return infoHash == infoHashes[1] })
+	ps.collectGarbage(time.Now().Add(-time.Minute))
+
+	var seeders, leechers uint64
+	for i := range ps.shards.shards {
+		shard := ps.shards.rLockShard(i)
+		shardSeeders, shardLeechers := shard.counts.total()
+		seeders += shardSeeders
+		leechers += shardLeechers
+		ps.shards.rUnlockShard(i)
+	}
+	require.Equal(t, uint64(98*4), seeders)
+	require.Equal(t, uint64(98*6), leechers)
+
+	gotSeeders, gotLeechers := ps.NumTotalPeers()
+	require.Equal(t, seeders, gotSeeders)
+	require.Equal(t, leechers, gotLeechers)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+func TestNumPeers(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+
+	seeders, leechers := ps.NumPeers(bittorrent.IPv4)
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(1), leechers)
+	seeders, leechers = ps.NumPeers(bittorrent.IPv6)
+	require.Equal(t, uint64(0), seeders)
+	require.Equal(t, uint64(1), leechers)
+
+	require.Nil(t, ps.GraduateLeecher(ih, p3))
+	require.Nil(t, ps.DeleteLeecher(ih, p2))
+	seeders, leechers = ps.NumPeers(bittorrent.IPv4)
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(0), leechers)
+	seeders, leechers = ps.NumPeers(bittorrent.IPv6)
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(0), leechers)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+func TestClampNumWant(t *testing.T) {
+	cfg := Config{MaxNumWant: 50, DefaultNumWant: 30}
+	require.Equal(t, 30, cfg.clampNumWant(0))
+	require.Equal(t, 30, cfg.clampNumWant(-1))
+	require.Equal(t, 10, cfg.clampNumWant(10))
+	require.Equal(t, 50, cfg.clampNumWant(10000))
+	require.Equal(t, 10000, Config{}.clampNumWant(10000))
+	require.Equal(t, 0, Config{}.clampNumWant(0))
+	require.Equal(t, 0, Config{}.clampNumWant(-1))
+
+	cfg = testConfig
+	cfg.MaxNumWant = 1
+	cfg.DefaultNumWant = 10
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint(1), ps.cfg.DefaultNumWant)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	peers, err := ps.AnnouncePeers(ih, false, 10000, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+func TestNegativeNumWant(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	require.Equal(t, uint(0), ps.cfg.DefaultNumWant)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	peers, err := ps.AnnouncePeers(ih, false, -5, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+	peers4, peers6, err := ps.AnnouncePeersDualStack(ih, false, -5, p1)
+	require.Nil(t, err)
+	require.Len(t, peers4, 0)
+	require.Len(t, peers6, 0)
+	peers, err = ps.AnnounceAndPut(ih, false, -5, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestMinSwarmLifetime(t *testing.T) {
+	cfg := testConfig
+	cfg.MinSwarmLifetime = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+
+	// The swarm is young, it is kept without peers.
+	ps.collectGarbage(time.Now())
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders+leechers)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Snatches)
+
+	// Age the swarm.
+	shard := ps.shards.lockShardByHash(infohash(ih))
+	sw := shard.swarms[infohash(ih)]
+	sw.created -= uint16(2 * time.Hour / time.Second)
+	shard.swarms[infohash(ih)] = sw
+	ps.shards.unlockShardByHash(infohash(ih), 0)
+
+	ps.collectGarbage(time.Now())
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+func TestDistinctNotFoundErrors(t *testing.T) {
+	cfg := testConfig
+	cfg.DistinctNotFoundErrors = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Equal(t, ErrSwarmNotFound, ps.DeleteSeeder(ih, p1))
+	_, err = ps.AnnouncePeers(ih, false, 10, p1)
+	require.Equal(t, ErrSwarmNotFound, err)
+	_, _, err = ps.GetSeeders(ih)
+	require.Equal(t, ErrSwarmNotFound, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Equal(t, ErrNoPeersForAddressFamily, ps.DeleteSeeder(ih, p3))
+	_, err = ps.AnnouncePeers(ih, false, 10, p3)
+	require.Equal(t, ErrNoPeersForAddressFamily, err)
+	require.Equal(t, ErrPeerNotFound, ps.DeleteLeecher(ih, p2))
+
+	peers, err := ps.AnnouncePeers(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+func TestCollectGarbageStats(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+
+	stats, err := ps.CollectGarbage(time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 2, stats.PeersRemoved)
+	require.Equal(t, 1, stats.SwarmsRemoved)
+	require.Equal(t, 0, stats.SwarmsSpilled)
+	require.Equal(t, 1, stats.ShardsTouched)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	// Nothing is left to collect.
+	stats, err = ps.CollectGarbage(time.Now())
+	require.Nil(t, err)
+	require.Equal(t, GCStats{Duration: stats.Duration}, stats)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+func TestAppendAnnouncePeers(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+
+	// The IPs in dst are reused, so don't pass the shared test peers.
+	first := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("2001:db8::2"), AddressFamily: bittorrent.IPv6}, Port: 1}
+	dst := []bittorrent.Peer{first}
+	dst, err = ps.AppendAnnouncePeers(dst, ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Len(t, dst, 3)
+	require.Equal(t, first, dst[0])
+
+	announced, err := ps.AnnouncePeers(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Equal(t, announced, dst[1:])
+
+	allocs := testing.AllocsPerRun(100, func() {
+		dst, err = ps.AppendAnnouncePeers(dst[:0], ih, false, 10, p2)
+	})
+	require.Nil(t, err)
+	require.Len(t, dst, 2)
+	require.Equal(t, float64(0), allocs)
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
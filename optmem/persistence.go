@@ -0,0 +1,221 @@
+package optmem
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// ErrPersistenceDriverDoesNotExist is returned if a persistence driver that
+// was not registered is configured.
+var ErrPersistenceDriverDoesNotExist = errors.New("persistence driver with that name does not exist")
+
+// OpKind is the kind of an Op.
+type OpKind byte
+
+// The kinds of Ops.
+const (
+	// OpPut stores a peer, like PutSeeder, PutLeecher or GraduateLeecher.
+	OpPut OpKind = iota + 1
+
+	// OpDelete deletes a peer, like DeleteSeeder or DeleteLeecher.
+	OpDelete
+)
+
+// Op is a change made to a PeerStore, as logged to a PersistenceDriver.
+type Op struct {
+	Kind     OpKind
+	InfoHash bittorrent.InfoHash
+	Peer     bittorrent.Peer
+
+	// Seeder is true if the peer was put or deleted as a seeder.
+	Seeder bool
+
+	// Completed is true if the put counted a completed download.
+	Completed bool
+
+	// Crypto is the encryption support the peer was put with.
+	Crypto CryptoLevel
+
+	// Time is the time of the put, from which the peer expires.
+	Time time.Time
+}
+
+// PersistenceDriver stores snapshots of the swarms of a PeerStore and,
+// optionally, the changes made after the last snapshot, so that the swarms
+// survive restarts.
+//
+// Snapshots are written when the store is stopped and after erasures, see
+// ErasePeer, and loaded when it is created.
+// Implementations must be safe for concurrent use of Save and AppendOp.
+type PersistenceDriver interface {
+	// Save stores a snapshot, which it obtains by calling export with a
+	// writer.
+	// Once Save returns nil, the Ops appended before it was called are no
+	// longer needed.
+	Save(export func(w io.Writer) error) error
+
+	// Load calls restore with the latest snapshot, if there is one, and
+	// then replay with every Op appended after it, in order.
+	// Errors returned by restore or replay must be returned.
+	Load(restore func(r io.Reader) error, replay func(op Op) error) error
+
+	// AppendOp logs a change made after the last snapshot.
+	// It is only called if logging changes is enabled, see
+	// PersistenceConfig.
+	AppendOp(op Op) error
+
+	// Close releases the resources of the driver.
+	// It is called after the final Save when the store is stopped.
+	Close() error
+}
+
+// PersistenceDriverFactory creates PersistenceDrivers from their config.
+type PersistenceDriverFactory interface {
+	// NewPersistenceDriver creates a driver from the config section of
+	// its PersistenceConfig, as parsed from YAML.
+	NewPersistenceDriver(cfg interface{}) (PersistenceDriver, error)
+}
+
+var (
+	persistenceDriversM sync.RWMutex
+	persistenceDrivers  = make(map[string]PersistenceDriverFactory)
+)
+
+// RegisterPersistenceDriver makes a persistence driver available by the
+// provided name, to be selected in PersistenceConfig.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// factory is nil, this function panics.
+func RegisterPersistenceDriver(name string, f PersistenceDriverFactory) {
+	if name == "" {
+		panic("optmem: could not register a PersistenceDriverFactory with an empty name")
+	}
+	if f == nil {
+		panic("optmem: could not register a nil PersistenceDriverFactory")
+	}
+
+	persistenceDriversM.Lock()
+	defer persistenceDriversM.Unlock()
+
+	if _, dup := persistenceDrivers[name]; dup {
+		panic("optmem: RegisterPersistenceDriver called twice for " + name)
+	}
+
+	persistenceDrivers[name] = f
+}
+
+// NewPersistenceDriver creates a persistence driver registered by the given
+// name.
+//
+// If a driver does not exist, returns ErrPersistenceDriverDoesNotExist.
+func NewPersistenceDriver(name string, cfg interface{}) (PersistenceDriver, error) {
+	persistenceDriversM.RLock()
+	f, ok := persistenceDrivers[name]
+	persistenceDriversM.RUnlock()
+	if !ok {
+		return nil, ErrPersistenceDriverDoesNotExist
+	}
+
+	return f.NewPersistenceDriver(cfg)
+}
+
+// PersistenceConfig selects the persistence driver of a PeerStore.
+type PersistenceConfig struct {
+	// Name is the name of a registered persistence driver, for example
+	// "file".
+	// Empty disables persistence, unless SnapshotPath is set.
+	Name string `yaml:"name"`
+
+	// Config is passed to the driver.
+	Config interface{} `yaml:"config"`
+
+	// LogOps makes the store pass every put and delete to the driver, so
+	// that changes made after the last snapshot survive crashes.
+	// Without it, only the snapshot written when the store is stopped is
+	// persisted.
+	// With write batching, puts are logged once they are applied.
+	LogOps bool `yaml:"log_ops"`
+}
+
+// persistenceDriver creates the configured persistence driver, nil if
+// persistence is disabled.
+// SnapshotPath is a shorthand for the file driver without logging.
+func (cfg Config) persistenceDriver() (PersistenceDriver, error) {
+	if cfg.Persistence.Name != "" {
+		return NewPersistenceDriver(cfg.Persistence.Name, cfg.Persistence.Config)
+	}
+	if cfg.SnapshotPath != "" {
+		return newFileDriver(cfg.SnapshotPath), nil
+	}
+	return nil, nil
+}
+
+// logsOps returns whether changes are logged, see PersistenceConfig.LogOps.
+func (s *PeerStore) logsOps() bool {
+	return s.persistence != nil && s.cfg.Persistence.LogOps
+}
+
+// logOp passes a change to the persistence driver, if logging is enabled.
+// Failures are logged, the change itself is not undone.
+func (s *PeerStore) logOp(op Op) {
+	if !s.logsOps() {
+		return
+	}
+
+	err := s.persistence.AppendOp(op)
+	if err != nil {
+		log.Error("optmem: unable to log change", log.Fields{"namespace": s.name, "kind": op.Kind, "error": err})
+	}
+}
+
+// opOfPut returns the Op of a put.
+func opOfPut(infoHash bittorrent.InfoHash, p bittorrent.Peer, flag peerFlag, completed bool, t time.Time) Op {
+	return Op{
+		Kind:      OpPut,
+		InfoHash:  infoHash,
+		Peer:      p,
+		Seeder:    flag&peerFlagSeeder != 0,
+		Completed: completed,
+		Crypto:    cryptoLevelOf(flag),
+		Time:      t,
+	}
+}
+
+// replayOp applies a logged change.
+// Deletes of peers that do not exist are ignored.
+func (s *PeerStore) replayOp(op Op) error {
+	af := op.Peer.IP.AddressFamily
+	if af != bittorrent.IPv4 && af != bittorrent.IPv6 {
+		return ErrInvalidIP
+	}
+
+	flag := peerFlagLeecher
+	if op.Seeder {
+		flag = peerFlagSeeder
+	}
+	ih := infohash(op.InfoHash)
+
+	switch op.Kind {
+	case OpPut:
+		p := makePeer(op.Peer, flag|op.Crypto.peerFlag(), uint16(op.Time.Unix()))
+		shard := s.shards.lockShardByHash(ih)
+		swarmCreated, _ := putPeerLocked(shard, ih, p, af, op.Completed)
+		if swarmCreated {
+			s.hooks.swarmCreated(shard, ih)
+			s.shards.unlockShardByHash(ih, 1)
+		} else {
+			s.shards.unlockShardByHash(ih, 0)
+		}
+	case OpDelete:
+		s.deletePeer(ih, makePeer(op.Peer, flag, 0), af)
+	default:
+		return errors.Errorf("unknown op kind %d", op.Kind)
+	}
+
+	return nil
+}
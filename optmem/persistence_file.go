@@ -0,0 +1,250 @@
+package optmem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	RegisterPersistenceDriver("file", fileDriverFactory{})
+}
+
+// FileDriverConfig is the config of the file persistence driver.
+type FileDriverConfig struct {
+	// Path is the path of the snapshot file.
+	// Ops are logged to the same path with a ".log" suffix.
+	Path string `yaml:"path"`
+}
+
+type fileDriverFactory struct{}
+
+func (fileDriverFactory) NewPersistenceDriver(icfg interface{}) (PersistenceDriver, error) {
+	// Marshal the config back into bytes.
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the bytes into the proper config type.
+	var cfg FileDriverConfig
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Path == "" {
+		return nil, errors.New("file persistence driver requires a path")
+	}
+
+	return newFileDriver(cfg.Path), nil
+}
+
+// fileDriver is a PersistenceDriver storing the snapshot in a file and the
+// Ops in a second file next to it.
+type fileDriver struct {
+	path string
+	mu   sync.Mutex
+	log  *os.File // opened on the first AppendOp
+}
+
+func newFileDriver(path string) *fileDriver {
+	return &fileDriver{path: path}
+}
+
+func (d *fileDriver) logPath() string {
+	return d.path + ".log"
+}
+
+// Save writes the snapshot to a temporary file first, which then replaces
+// the previous snapshot, so a failed write does not destroy it.
+// The op log is truncated afterwards.
+func (d *fileDriver) Save(export func(w io.Writer) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tmp := d.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	err = export(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, d.path)
+	if err != nil {
+		return err
+	}
+
+	if d.log != nil {
+		err = d.log.Truncate(0)
+	} else {
+		err = os.Remove(d.logPath())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return errors.Wrap(err, "unable to truncate op log")
+}
+
+// Load reads the snapshot and then the op log.
+// Missing files are not an error, they are created when needed.
+// A partial record at the end of the op log, left by a crash, is ignored.
+func (d *fileDriver) Load(restore func(r io.Reader) error, replay func(op Op) error) error {
+	f, err := os.Open(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = restore(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err = os.Open(d.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var buf [opRecordSize]byte
+	for {
+		_, err = io.ReadFull(br, buf[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		op, err := decodeOp(buf[:])
+		if err != nil {
+			return errors.Wrap(err, "unable to decode op")
+		}
+		err = replay(op)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// AppendOp appends a record to the op log.
+func (d *fileDriver) AppendOp(op Op) error {
+	var buf [opRecordSize]byte
+	encodeOp(buf[:], op)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.log == nil {
+		f, err := os.OpenFile(d.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		d.log = f
+	}
+
+	_, err := d.log.Write(buf[:])
+	return err
+}
+
+// Close closes the op log.
+func (d *fileDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.log == nil {
+		return nil
+	}
+	err := d.log.Close()
+	d.log = nil
+	return err
+}
+
+// An op record is laid out as follows:
+//
+//	kind (1) | flags (1) | crypto (1) | address family (1) | infohash (20) |
+//	IP (16) | port (2) | peer ID (20) | unix time (8)
+//
+// IPv4 addresses are stored in their 16 byte form.
+const opRecordSize = 70
+
+const (
+	opFlagSeeder    = 1 << 0
+	opFlagCompleted = 1 << 1
+)
+
+func encodeOp(buf []byte, op Op) {
+	buf[0] = byte(op.Kind)
+	buf[1] = 0
+	if op.Seeder {
+		buf[1] |= opFlagSeeder
+	}
+	if op.Completed {
+		buf[1] |= opFlagCompleted
+	}
+	buf[2] = byte(op.Crypto)
+	buf[3] = byte(op.Peer.IP.AddressFamily)
+	copy(buf[4:24], op.InfoHash[:])
+	copy(buf[24:40], op.Peer.IP.IP.To16())
+	binary.BigEndian.PutUint16(buf[40:42], op.Peer.Port)
+	copy(buf[42:62], op.Peer.ID[:])
+	binary.BigEndian.PutUint64(buf[62:70], uint64(op.Time.Unix()))
+}
+
+func decodeOp(buf []byte) (Op, error) {
+	op := Op{
+		Kind:      OpKind(buf[0]),
+		Seeder:    buf[1]&opFlagSeeder != 0,
+		Completed: buf[1]&opFlagCompleted != 0,
+		Crypto:    CryptoLevel(buf[2]),
+		Time:      time.Unix(int64(binary.BigEndian.Uint64(buf[62:70])), 0),
+	}
+	if op.Kind != OpPut && op.Kind != OpDelete {
+		return Op{}, errors.Errorf("unknown op kind %d", op.Kind)
+	}
+
+	af := bittorrent.AddressFamily(buf[3])
+	ip := net.IP(append([]byte(nil), buf[24:40]...))
+	switch af {
+	case bittorrent.IPv4:
+		ip = ip.To4()
+	case bittorrent.IPv6:
+	default:
+		return Op{}, ErrInvalidIP
+	}
+
+	copy(op.InfoHash[:], buf[4:24])
+	copy(op.Peer.ID[:], buf[42:62])
+	op.Peer.IP = bittorrent.IP{IP: ip, AddressFamily: af}
+	op.Peer.Port = binary.BigEndian.Uint16(buf[40:42])
+
+	return op, nil
+}
@@ -0,0 +1,219 @@
+package optmem
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// memDriver is a PersistenceDriver keeping everything in memory.
+type memDriver struct {
+	mu       sync.Mutex
+	snapshot []byte
+	ops      []Op
+	closed   int
+}
+
+func (d *memDriver) NewPersistenceDriver(interface{}) (PersistenceDriver, error) {
+	return d, nil
+}
+
+func (d *memDriver) Save(export func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	err := export(&buf)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.snapshot = buf.Bytes()
+	d.ops = nil
+	return nil
+}
+
+func (d *memDriver) Load(restore func(r io.Reader) error, replay func(op Op) error) error {
+	d.mu.Lock()
+	snapshot, ops := d.snapshot, append([]Op(nil), d.ops...)
+	d.mu.Unlock()
+
+	if snapshot != nil {
+		err := restore(bytes.NewReader(snapshot))
+		if err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		err := replay(op)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *memDriver) AppendOp(op Op) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ops = append(d.ops, op)
+	return nil
+}
+
+func (d *memDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed++
+	return nil
+}
+
+var testMemDriver = &memDriver{}
+
+func init() {
+	RegisterPersistenceDriver("test-memory", testMemDriver)
+}
+
+func TestPersistenceRegistry(t *testing.T) {
+	require.Panics(t, func() { RegisterPersistenceDriver("file", fileDriverFactory{}) })
+	require.Panics(t, func() { RegisterPersistenceDriver("", fileDriverFactory{}) })
+	require.Panics(t, func() { RegisterPersistenceDriver("nil", nil) })
+
+	_, err := NewPersistenceDriver("does-not-exist", nil)
+	require.Equal(t, ErrPersistenceDriverDoesNotExist, err)
+
+	cfg := testConfig
+	cfg.Persistence.Name = "does-not-exist"
+	_, err = New(cfg)
+	require.NotNil(t, err)
+
+	_, err = NewPersistenceDriver("file", map[string]interface{}{})
+	require.NotNil(t, err)
+}
+
+func TestPersistenceReplay(t *testing.T) {
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	cfg := testConfig
+	cfg.Persistence = PersistenceConfig{Name: "test-memory", LogOps: true}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecherCrypto(ih, p1, CryptoRequired))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.DeleteLeecher(ih, p2))
+	_, err = ps.AnnounceAndPut(ih2, false, 10, p3)
+	require.Nil(t, err)
+	require.NotNil(t, ps.DeleteSeeder(ih, p2))
+
+	testMemDriver.mu.Lock()
+	require.Len(t, testMemDriver.ops, 5)
+	require.Equal(t, OpPut, testMemDriver.ops[1].Kind)
+	require.True(t, testMemDriver.ops[1].Seeder)
+	require.True(t, testMemDriver.ops[1].Completed)
+	require.Equal(t, CryptoRequired, testMemDriver.ops[1].Crypto)
+	require.Equal(t, OpDelete, testMemDriver.ops[3].Kind)
+	testMemDriver.mu.Unlock()
+
+	// A second store replays the ops, as after a crash.
+	replayed, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), replayed.NumSwarms())
+	require.Equal(t, 1, replayed.NumSeeders(ih))
+	require.Equal(t, 0, replayed.NumLeechers(ih))
+	require.Equal(t, 1, replayed.NumLeechers(ih2))
+	scrape := replayed.ScrapeSwarm(ih, p1.IP.AddressFamily)
+	require.Equal(t, uint32(1), scrape.Snatches)
+	require.Nil(t, <-replayed.Stop())
+
+	// Stopping saves a snapshot, after which the ops are dropped.
+	require.Nil(t, <-ps.Stop())
+	testMemDriver.mu.Lock()
+	require.Len(t, testMemDriver.ops, 0)
+	require.Equal(t, 2, testMemDriver.closed)
+	testMemDriver.snapshot = nil
+	testMemDriver.closed = 0
+	testMemDriver.mu.Unlock()
+}
+
+func TestPersistenceBatched(t *testing.T) {
+	cfg := testConfig
+	cfg.Persistence = PersistenceConfig{Name: "test-memory", LogOps: true}
+	cfg.BatchQueueSize = 16
+	cfg.BatchFlushInterval = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	// Queued puts are logged once they are applied.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	_, err = ps.AnnounceAndPut(ih, false, 10, p2)
+	require.Nil(t, err)
+	testMemDriver.mu.Lock()
+	require.Len(t, testMemDriver.ops, 0)
+	testMemDriver.mu.Unlock()
+	ps.Flush()
+	testMemDriver.mu.Lock()
+	require.Len(t, testMemDriver.ops, 2)
+	testMemDriver.mu.Unlock()
+
+	// Queued puts that are dropped are not.
+	require.True(t, ps.FreezeSwarm(ih))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+	ps.Flush()
+	testMemDriver.mu.Lock()
+	require.Len(t, testMemDriver.ops, 2)
+	testMemDriver.mu.Unlock()
+
+	require.Nil(t, <-ps.Stop())
+	testMemDriver.mu.Lock()
+	testMemDriver.snapshot = nil
+	testMemDriver.closed = 0
+	testMemDriver.mu.Unlock()
+}
+
+func TestFileDriverOpLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot")
+	cfg := testConfig
+	cfg.Persistence = PersistenceConfig{
+		Name:   "file",
+		Config: map[interface{}]interface{}{"path": path},
+		LogOps: true,
+	}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+
+	// A partial record left by a crash is ignored.
+	f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{byte(OpPut), 0, 0})
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	replayed, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 1, replayed.NumSeeders(ih))
+	require.Equal(t, 1, replayed.NumLeechers(ih))
+
+	require.Nil(t, <-ps.Stop())
+	info, err := os.Stat(path + ".log")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), info.Size())
+	require.Nil(t, <-replayed.Stop())
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Nil(t, <-ps.Stop())
+}
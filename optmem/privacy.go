@@ -0,0 +1,126 @@
+package optmem
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// scrapePrivacy perturbs scrape counts, see ScrapeEpsilon and
+// ScrapeRoundBelow.
+type scrapePrivacy struct {
+	epsilon    float64
+	roundBelow uint64
+	seed       uint64 // secret, so that the noise can not be predicted
+}
+
+// newScrapePrivacy returns the scrapePrivacy configured by cfg, or nil if
+// scrape counts are returned exactly.
+func newScrapePrivacy(cfg Config) *scrapePrivacy {
+	if cfg.ScrapeEpsilon <= 0 && cfg.ScrapeRoundBelow == 0 {
+		return nil
+	}
+	return &scrapePrivacy{
+		epsilon:    cfg.ScrapeEpsilon,
+		roundBelow: uint64(cfg.ScrapeRoundBelow),
+		seed:       randomSeed(),
+	}
+}
+
+// The fields of a scrape, to draw independent noise for each.
+const (
+	fieldComplete byte = iota
+	fieldIncomplete
+	fieldSnatches
+)
+
+// perturb returns a count with Laplace noise of scale 1/epsilon added,
+// rounded to zero or roundBelow if it is smaller than roundBelow.
+//
+// The noise is derived from the swarm, the field and the count itself, so
+// repeated scrapes of an unchanged swarm return the same numbers and can not
+// be averaged to remove the noise.
+// afByte is 4 or 6 for the counts of an address family and 0 for combined
+// counts.
+// It is a no-op on a nil scrapePrivacy.
+func (p *scrapePrivacy) perturb(ih infohash, afByte, field byte, count uint64) uint64 {
+	if p == nil {
+		return count
+	}
+
+	v := float64(count)
+	if p.epsilon > 0 {
+		var buf [len(infohash{}) + 10]byte
+		copy(buf[:], ih[:])
+		n := len(ih)
+		buf[n] = afByte
+		buf[n+1] = field
+		binary.BigEndian.PutUint64(buf[n+2:], count)
+		// A uniform number in (0,1).
+		u := (float64(seededHash(p.seed, buf[:])>>11) + 0.5) / (1 << 53)
+		v += laplace(u, 1/p.epsilon)
+	}
+
+	if v < 0 {
+		v = 0
+	}
+	n := uint64(math.Round(v))
+	if n < p.roundBelow {
+		if 2*n < p.roundBelow {
+			n = 0
+		} else {
+			n = p.roundBelow
+		}
+	}
+	return n
+}
+
+// laplace returns the value of the inverse CDF of the Laplace distribution
+// with mean 0 and the given scale at u, which must be in (0,1).
+func laplace(u, scale float64) float64 {
+	u -= 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+// perturbScrape perturbs the counts of a scrape of an address family.
+// Perturbed counts that do not fit into 32 bits are saturated.
+func (p *scrapePrivacy) perturbScrape(ih infohash, af bittorrent.AddressFamily, scrape *bittorrent.Scrape) {
+	if p == nil {
+		return
+	}
+	afByte := byte(4)
+	if af == bittorrent.IPv6 {
+		afByte = 6
+	}
+	scrape.Complete = saturate32(p.perturb(ih, afByte, fieldComplete, uint64(scrape.Complete)))
+	scrape.Incomplete = saturate32(p.perturb(ih, afByte, fieldIncomplete, uint64(scrape.Incomplete)))
+	scrape.Snatches = saturate32(p.perturb(ih, afByte, fieldSnatches, uint64(scrape.Snatches)))
+}
+
+// perturbScrape64 works like perturbScrape for 64-bit scrapes.
+func (p *scrapePrivacy) perturbScrape64(ih infohash, af bittorrent.AddressFamily, scrape *Scrape64) {
+	if p == nil {
+		return
+	}
+	afByte := byte(4)
+	if af == bittorrent.IPv6 {
+		afByte = 6
+	}
+	scrape.Complete = p.perturb(ih, afByte, fieldComplete, scrape.Complete)
+	scrape.Incomplete = p.perturb(ih, afByte, fieldIncomplete, scrape.Incomplete)
+	scrape.Snatches = p.perturb(ih, afByte, fieldSnatches, scrape.Snatches)
+}
+
+// perturbEntry perturbs the combined counts of a full scrape entry.
+func (p *scrapePrivacy) perturbEntry(e *scrapeEntry) {
+	if p == nil {
+		return
+	}
+	e.complete = p.perturb(e.ih, 0, fieldComplete, e.complete)
+	e.incomplete = p.perturb(e.ih, 0, fieldIncomplete, e.incomplete)
+	e.downloaded = p.perturb(e.ih, 0, fieldSnatches, e.downloaded)
+}
@@ -0,0 +1,63 @@
+package optmem
+
+import (
+	"math"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeRoundBelow(t *testing.T) {
+	cfg := testConfig
+	cfg.ScrapeRoundBelow = 5
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(3)))
+	for i := 0; i < 7; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(100+i)))
+	}
+
+	scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(5), scrape.Complete)
+	require.Equal(t, uint32(8), scrape.Incomplete)
+	require.Equal(t, uint32(0), scrape.Snatches)
+
+	stats := ps.ScrapeSwarmBoth(ih)
+	require.Equal(t, scrape.Complete, stats.IPv4.Complete)
+	require.Equal(t, uint32(0), stats.IPv6.Complete)
+	require.Equal(t, uint32(5), stats.Combined.Complete)
+}
+
+func TestScrapeEpsilon(t *testing.T) {
+	p := &scrapePrivacy{epsilon: 0.5, seed: 42}
+
+	var sumErr, sumAbsErr float64
+	changed := 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		var h infohash
+		h[0], h[1] = byte(i), byte(i>>8)
+		noisy := p.perturb(h, 4, fieldComplete, 1000)
+		// The same count of the same swarm gets the same noise.
+		require.Equal(t, noisy, p.perturb(h, 4, fieldComplete, 1000))
+		if noisy != 1000 {
+			changed++
+		}
+		sumErr += float64(noisy) - 1000
+		sumAbsErr += math.Abs(float64(noisy) - 1000)
+	}
+
+	// The mean absolute deviation of Laplace noise is its scale.
+	require.InDelta(t, 0, sumErr/n, 0.2)
+	require.InDelta(t, 2, sumAbsErr/n, 0.2)
+	require.True(t, changed > n/2)
+
+	var nilPrivacy *scrapePrivacy
+	require.Equal(t, uint64(7), nilPrivacy.perturb(infohash{}, 4, fieldComplete, 7))
+}
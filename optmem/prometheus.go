@@ -0,0 +1,382 @@
+package optmem
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	// Register the metrics.
+	prometheus.MustRegister(
+		promNumWantRequested,
+		promNumWantGranted,
+		promLatency,
+		promPuts,
+		promOperations,
+		promGCExpired,
+		promGCSwarms,
+		promGCRebalances,
+		promGCShardsTouched,
+		promGCStuck,
+		promBreakerShed,
+		promBreakerOpen,
+		promBackgroundPanics,
+		promBucketPool,
+		promStores,
+	)
+}
+
+var (
+	// promNumWantRequested is a histogram of the numWant values requested
+	// by announces.
+	promNumWantRequested = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chihaya_storage_optmem_numwant_requested",
+		Help:    "The number of peers requested by announces",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+	})
+
+	// promNumWantGranted is a histogram of the number of peers actually
+	// returned by announces.
+	promNumWantGranted = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chihaya_storage_optmem_numwant_granted",
+		Help:    "The number of peers returned to announces",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+	})
+
+	// promLatency is a histogram of the duration of operations, labelled by
+	// operation and address family.
+	promLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chihaya_storage_optmem_operation_duration_milliseconds",
+		Help:    "The duration of puts, deletes, graduations, announces and single scrapes, by operation and address family",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"operation", "address_family"})
+
+	promPutLatency      = newFamilyHistograms(promLatency, "put")
+	promDeleteLatency   = newFamilyHistograms(promLatency, "delete")
+	promGraduateLatency = newFamilyHistograms(promLatency, "graduate")
+	promAnnounceLatency = newFamilyHistograms(promLatency, "announce")
+	promScrapeLatency   = newFamilyHistograms(promLatency, "scrape")
+
+	// promPuts is a counter of puts, labelled by address family and
+	// whether the put inserted a new peer or updated an existing one.
+	promPuts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_puts_total",
+		Help: "The number of puts, by address family and result",
+	}, []string{"address_family", "result"})
+
+	promPutsInserted4 = promPuts.WithLabelValues("IPv4", "inserted")
+	promPutsUpdated4  = promPuts.WithLabelValues("IPv4", "updated")
+	promPutsInserted6 = promPuts.WithLabelValues("IPv6", "inserted")
+	promPutsUpdated6  = promPuts.WithLabelValues("IPv6", "updated")
+
+	// promOperations is a counter of operations other than puts, labelled
+	// by operation and address family.
+	promOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_operations_total",
+		Help: "The number of deletes, graduations, announces, scrapes, evictions, throttled announces, puts rejected by frozen swarms or bans, queued puts rejected when applied, announces shed under load, peers merged from upstream trackers, scrape and announce cache hits and misses and requests rejected by the negative cache, by operation and address family",
+	}, []string{"operation", "address_family"})
+
+	promDeletes         = newFamilyCounters(promOperations, "delete")
+	promGraduations     = newFamilyCounters(promOperations, "graduate")
+	promAnnounces       = newFamilyCounters(promOperations, "announce")
+	promScrapes         = newFamilyCounters(promOperations, "scrape")
+	promEvictions       = newFamilyCounters(promOperations, "evict")
+	promThrottled       = newFamilyCounters(promOperations, "throttle")
+	promFrozenRejects   = newFamilyCounters(promOperations, "reject_frozen")
+	promBanRejects      = newFamilyCounters(promOperations, "reject_banned")
+	promOverloadRejects = newFamilyCounters(promOperations, "reject_overloaded")
+	promFederated       = newFamilyCounters(promOperations, "federate")
+	promBatchRejects    = newFamilyCounters(promOperations, "batch_rejected")
+
+	promScrapeCacheHits   = newFamilyCounters(promOperations, "scrape_cache_hit")
+	promScrapeCacheMisses = newFamilyCounters(promOperations, "scrape_cache_miss")
+
+	promAnnounceCacheHits   = newFamilyCounters(promOperations, "announce_cache_hit")
+	promAnnounceCacheMisses = newFamilyCounters(promOperations, "announce_cache_miss")
+
+	promNegativeCacheHits = newFamilyCounters(promOperations, "negative_cache_hit")
+
+	// promGCExpired is a counter of peers removed by garbage collection,
+	// labelled by address family.
+	promGCExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_gc_expired_peers_total",
+		Help: "The number of peers removed by garbage collection, by address family",
+	}, []string{"address_family"})
+
+	promGCExpired4 = promGCExpired.WithLabelValues("IPv4")
+	promGCExpired6 = promGCExpired.WithLabelValues("IPv6")
+
+	// promGCSwarms is a counter of swarms removed from memory by garbage
+	// collection, labelled by whether they were removed or spilled.
+	promGCSwarms = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_gc_swarms_total",
+		Help: "The number of swarms removed from memory by garbage collection, by result",
+	}, []string{"result"})
+
+	promGCSwarmsRemoved = promGCSwarms.WithLabelValues("removed")
+	promGCSwarmsSpilled = promGCSwarms.WithLabelValues("spilled")
+
+	// promGCRebalances is a counter of peer lists rebalanced by garbage
+	// collection.
+	promGCRebalances = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_gc_rebalances_total",
+		Help: "The number of peer lists rebalanced by garbage collection",
+	})
+
+	// promGCShardsTouched is the number of shards modified by the last
+	// garbage collection run.
+	promGCShardsTouched = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_storage_optmem_gc_shards_touched",
+		Help: "The number of shards modified by the last garbage collection",
+	})
+
+	// promGCStuck is the number of garbage collection passes currently
+	// running longer than the configured deadline.
+	promGCStuck = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_storage_optmem_gc_stuck",
+		Help: "The number of garbage collection passes running longer than the deadline",
+	})
+
+	// promBreakerShed is a counter of expensive operations rejected by the
+	// circuit breaker, labelled by operation.
+	promBreakerShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_breaker_shed_total",
+		Help: "The number of expensive operations rejected by the circuit breaker, by operation",
+	}, []string{"operation"})
+
+	// promBreakerOpen is the number of stores whose circuit breaker
+	// currently rejects expensive operations.
+	promBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_storage_optmem_breaker_open",
+		Help: "The number of stores whose circuit breaker rejects expensive operations",
+	})
+
+	// promBackgroundPanics is a counter of panics recovered in background
+	// goroutines, labelled by goroutine.
+	promBackgroundPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_background_panics_total",
+		Help: "The number of panics recovered in background goroutines, by goroutine",
+	}, []string{"goroutine"})
+
+	// promBucketPool is a counter of buckets taken for rebalancing, labelled
+	// by whether they were reused from the pool or newly allocated.
+	promBucketPool = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_optmem_bucket_pool_gets_total",
+		Help: "The number of buckets taken for rebalancing, by whether they were reused",
+	}, []string{"result"})
+
+	promBucketPoolHits   = promBucketPool.WithLabelValues("hit")
+	promBucketPoolMisses = promBucketPool.WithLabelValues("miss")
+)
+
+// familyCounters holds the children of a counter for both address
+// families, and their names for MetricsReporters.
+type familyCounters struct {
+	ipv4, ipv6   prometheus.Counter
+	name4, name6 string
+}
+
+// newFamilyCounters returns the children of an operation counter.
+func newFamilyCounters(vec *prometheus.CounterVec, operation string) familyCounters {
+	return familyCounters{
+		ipv4:  vec.WithLabelValues(operation, "IPv4"),
+		ipv6:  vec.WithLabelValues(operation, "IPv6"),
+		name4: familyName("operations."+operation, bittorrent.IPv4),
+		name6: familyName("operations."+operation, bittorrent.IPv6),
+	}
+}
+
+// inc counts an operation for an address family.
+func (c familyCounters) inc(af bittorrent.AddressFamily) {
+	if af == bittorrent.IPv4 {
+		c.ipv4.Inc()
+		metricsReporters.count(c.name4, 1)
+	} else {
+		c.ipv6.Inc()
+		metricsReporters.count(c.name6, 1)
+	}
+}
+
+// familyHistograms holds the children of a latency histogram for both
+// address families.
+type familyHistograms struct {
+	ipv4, ipv6 prometheus.Observer
+}
+
+// newFamilyHistograms returns the children of an operation histogram.
+func newFamilyHistograms(vec *prometheus.HistogramVec, operation string) familyHistograms {
+	return familyHistograms{
+		ipv4: vec.WithLabelValues(operation, "IPv4"),
+		ipv6: vec.WithLabelValues(operation, "IPv6"),
+	}
+}
+
+// since records the time elapsed since start for an operation of an address
+// family.
+func (h familyHistograms) since(af bittorrent.AddressFamily, start time.Time) {
+	ms := float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
+	if af == bittorrent.IPv4 {
+		h.ipv4.Observe(ms)
+	} else {
+		h.ipv6.Observe(ms)
+	}
+}
+
+// recordNumWant records the number of peers requested and returned by an
+// announce.
+// MetricsReporters receive the sums, which divided by the number of
+// announces give the averages.
+func recordNumWant(requested, granted int) {
+	promNumWantRequested.Observe(float64(requested))
+	promNumWantGranted.Observe(float64(granted))
+	metricsReporters.count("numwant.requested", int64(requested))
+	metricsReporters.count("numwant.granted", int64(granted))
+}
+
+// recordGCStats records the results of a garbage collection run.
+// Removed peers are counted per shard while the run is in progress.
+func recordGCStats(stats GCStats) {
+	promGCSwarmsRemoved.Add(float64(stats.SwarmsRemoved))
+	promGCSwarmsSpilled.Add(float64(stats.SwarmsSpilled))
+	promGCRebalances.Add(float64(stats.Rebalances))
+	promGCShardsTouched.Set(float64(stats.ShardsTouched))
+	metricsReporters.count("gc.swarms.removed", int64(stats.SwarmsRemoved))
+	metricsReporters.count("gc.swarms.spilled", int64(stats.SwarmsSpilled))
+	metricsReporters.count("gc.rebalances", int64(stats.Rebalances))
+	metricsReporters.count("gc.runs", 1)
+}
+
+// Descriptions of the metrics computed when the collector is scraped.
+var (
+	promSwarmsDesc = prometheus.NewDesc(
+		"chihaya_storage_optmem_swarms",
+		"The number of swarms tracked",
+		nil, nil)
+	promSeedersDesc = prometheus.NewDesc(
+		"chihaya_storage_optmem_seeders",
+		"The number of seeders tracked, by address family",
+		[]string{"address_family"}, nil)
+	promLeechersDesc = prometheus.NewDesc(
+		"chihaya_storage_optmem_leechers",
+		"The number of leechers tracked, by address family",
+		[]string{"address_family"}, nil)
+	promBatchQueueDepthDesc = prometheus.NewDesc(
+		"chihaya_storage_optmem_batch_queue_depth",
+		"The number of queued puts waiting to be applied",
+		nil, nil)
+	promShardSwarmsVarianceDesc = prometheus.NewDesc(
+		"chihaya_storage_optmem_shard_swarms_variance",
+		"The variance of the number of swarms per shard",
+		nil, nil)
+)
+
+// promStores is the collector reporting the counts of all running PeerStores
+// with Prometheus reporting enabled.
+var promStores = &storeCollector{stores: make(map[*PeerStore]struct{})}
+
+// storeCollector is a prometheus.Collector that computes the counts of the
+// PeerStores whenever metrics are scraped, instead of periodically.
+type storeCollector struct {
+	mu     sync.Mutex
+	stores map[*PeerStore]struct{}
+}
+
+var _ prometheus.Collector = &storeCollector{}
+
+// add starts reporting the counts of a PeerStore.
+func (c *storeCollector) add(s *PeerStore) {
+	c.mu.Lock()
+	c.stores[s] = struct{}{}
+	c.mu.Unlock()
+}
+
+// remove stops reporting the counts of a PeerStore.
+// It must be called before the PeerStore is closed.
+func (c *storeCollector) remove(s *PeerStore) {
+	c.mu.Lock()
+	delete(c.stores, s)
+	c.mu.Unlock()
+}
+
+// Describe implements prometheus.Collector.
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promSwarmsDesc
+	ch <- promSeedersDesc
+	ch <- promLeechersDesc
+	ch <- promBatchQueueDepthDesc
+	ch <- promShardSwarmsVarianceDesc
+}
+
+// Collect implements prometheus.Collector.
+// The counts are summed over all PeerStores.
+//
+// The generic storage gauges of chihaya are registered by chihaya itself, so
+// they are updated as a side effect and may lag one scrape behind.
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.stores) == 0 {
+		return
+	}
+
+	var swarms, queued uint64
+	var counts peerCounts
+	var occupancy occupancyStats
+	for s := range c.stores {
+		swarms += s.NumSwarms()
+		occupancy.addShards(s.shards)
+		storeCounts := s.shards.getPeerCounts()
+		counts.peers4 += storeCounts.peers4
+		counts.seeders4 += storeCounts.seeders4
+		counts.peers6 += storeCounts.peers6
+		counts.seeders6 += storeCounts.seeders6
+		queued += uint64(s.batchQueueDepth())
+	}
+
+	seeders, leechers := counts.total()
+	storage.PromInfohashesCount.Set(float64(swarms))
+	storage.PromSeedersCount.Set(float64(seeders))
+	storage.PromLeechersCount.Set(float64(leechers))
+
+	seeders4, leechers4 := counts.family(bittorrent.IPv4)
+	seeders6, leechers6 := counts.family(bittorrent.IPv6)
+	ch <- prometheus.MustNewConstMetric(promSwarmsDesc, prometheus.GaugeValue, float64(swarms))
+	ch <- prometheus.MustNewConstMetric(promSeedersDesc, prometheus.GaugeValue, float64(seeders4), "IPv4")
+	ch <- prometheus.MustNewConstMetric(promSeedersDesc, prometheus.GaugeValue, float64(seeders6), "IPv6")
+	ch <- prometheus.MustNewConstMetric(promLeechersDesc, prometheus.GaugeValue, float64(leechers4), "IPv4")
+	ch <- prometheus.MustNewConstMetric(promLeechersDesc, prometheus.GaugeValue, float64(leechers6), "IPv6")
+	ch <- prometheus.MustNewConstMetric(promBatchQueueDepthDesc, prometheus.GaugeValue, float64(queued))
+	ch <- prometheus.MustNewConstMetric(promShardSwarmsVarianceDesc, prometheus.GaugeValue, occupancy.variance())
+}
+
+// occupancyStats accumulates the number of swarms per shard.
+type occupancyStats struct {
+	n          int
+	sum, sumSq float64
+}
+
+// addShards adds the number of swarms of every shard of a shardContainer.
+// The numbers are read without locking the shards.
+func (o *occupancyStats) addShards(sc *shardContainer) {
+	for _, shard := range sc.shards {
+		swarms := float64(atomic.LoadUint64(&shard.numSwarms))
+		o.n++
+		o.sum += swarms
+		o.sumSq += swarms * swarms
+	}
+}
+
+// variance returns the population variance of the number of swarms per
+// shard.
+func (o *occupancyStats) variance() float64 {
+	if o.n == 0 {
+		return 0
+	}
+	mean := o.sum / float64(o.n)
+	return o.sumSq/float64(o.n) - mean*mean
+}
@@ -0,0 +1,168 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreCollector(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	require.Contains(t, promStores.stores, ps)
+
+	ch := make(chan prometheus.Metric, 7)
+	promStores.Collect(ch)
+	require.Len(t, ch, 7)
+
+	e := <-ps.Stop()
+	require.Nil(t, e)
+	require.NotContains(t, promStores.stores, ps)
+
+	cfg := testConfig
+	cfg.DisablePrometheus = true
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.NotContains(t, promStores.stores, ps)
+
+	e = <-ps.Stop()
+	require.Nil(t, e)
+}
+
+func TestOccupancyVariance(t *testing.T) {
+	sc := newShardContainer(2, false, 1)
+	var o occupancyStats
+	o.addShards(sc)
+	require.Equal(t, float64(0), o.variance())
+
+	for i, n := range []uint64{1, 3, 1, 3} {
+		sc.shards[i].numSwarms = n
+	}
+	o = occupancyStats{}
+	o.addShards(sc)
+	require.Equal(t, float64(1), o.variance())
+}
+
+// histogramCounts returns the number of observations of a histogram and the
+// cumulative counts of its buckets, by upper bound.
+func histogramCounts(t *testing.T, h prometheus.Histogram) (uint64, map[float64]uint64) {
+	var m dto.Metric
+	require.Nil(t, h.Write(&m))
+	buckets := make(map[float64]uint64)
+	for _, b := range m.GetHistogram().GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return m.GetHistogram().GetSampleCount(), buckets
+}
+
+func TestNumWantHistograms(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+
+	requested, requestedBuckets := histogramCounts(t, promNumWantRequested)
+	granted, grantedBuckets := histogramCounts(t, promNumWantGranted)
+
+	peers, err := ps.AnnouncePeers(ih, false, 2, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	peers, err = ps.AnnouncePeers(ih, false, 50, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 3)
+	_, err = ps.AnnouncePeers(bittorrent.InfoHashFromString("11111111111111111111"), false, 8, p1)
+	require.NotNil(t, err)
+
+	// Requested: 2, 50 and 8, granted: 2, 3 and 0.
+	count, buckets := histogramCounts(t, promNumWantRequested)
+	require.Equal(t, requested+3, count)
+	require.Equal(t, requestedBuckets[1], buckets[1])
+	require.Equal(t, requestedBuckets[2]+1, buckets[2])
+	require.Equal(t, requestedBuckets[8]+2, buckets[8])
+	require.Equal(t, requestedBuckets[32]+2, buckets[32])
+	require.Equal(t, requestedBuckets[64]+3, buckets[64])
+
+	count, buckets = histogramCounts(t, promNumWantGranted)
+	require.Equal(t, granted+3, count)
+	require.Equal(t, grantedBuckets[1]+1, buckets[1])
+	require.Equal(t, grantedBuckets[2]+2, buckets[2])
+	require.Equal(t, grantedBuckets[4]+3, buckets[4])
+	require.Equal(t, grantedBuckets[1024]+3, buckets[1024])
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	observations := func(h familyHistograms, af bittorrent.AddressFamily) uint64 {
+		o := h.ipv4
+		if af == bittorrent.IPv6 {
+			o = h.ipv6
+		}
+		count, _ := histogramCounts(t, o.(prometheus.Histogram))
+		return count
+	}
+	histograms := []familyHistograms{promPutLatency, promDeleteLatency, promGraduateLatency, promAnnounceLatency, promScrapeLatency}
+	before := make(map[bittorrent.AddressFamily][]uint64)
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		for _, h := range histograms {
+			before[af] = append(before[af], observations(h, af))
+		}
+	}
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.DeleteLeecher(ih, p2))
+	_, err = ps.AnnouncePeers(ih, false, 10, p3)
+	require.Nil(t, err)
+	ps.ScrapeSwarm(ih, bittorrent.IPv6)
+	ps.ScrapeSwarm(ih, bittorrent.IPv6)
+
+	// Puts, deletes and graduations are observed for the family of the
+	// peer, announces for the family of the announcer and scrapes for the
+	// requested family.
+	want := map[bittorrent.AddressFamily][]uint64{
+		bittorrent.IPv4: {2, 1, 1, 0, 0},
+		bittorrent.IPv6: {0, 0, 0, 1, 2},
+	}
+	for af, counts := range want {
+		for i, h := range histograms {
+			require.Equal(t, before[af][i]+counts[i], observations(h, af), "%v %d", af, i)
+		}
+	}
+}
+
+func TestDeleteCounter(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	deletes := func() float64 {
+		var m dto.Metric
+		require.Nil(t, promDeletes.ipv4.Write(&m))
+		return m.GetCounter().GetValue()
+	}
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	before := deletes()
+
+	// Deletes are counted whether or not they remove the swarm.
+	require.Nil(t, ps.DeleteLeecher(ih, p1))
+	require.Equal(t, before+1, deletes())
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	require.Nil(t, ps.DeleteSeeder(ih, p2))
+	require.Equal(t, before+2, deletes())
+
+	// Deletes of unknown peers are not.
+	require.NotNil(t, ps.DeleteSeeder(ih, p2))
+	require.Equal(t, before+2, deletes())
+}
@@ -0,0 +1,65 @@
+package optmem
+
+import (
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// PutCounts holds the number of puts that inserted a new peer and the number
+// of puts that updated an existing peer.
+// A high ratio of updates to inserts indicates that most put traffic is
+// caused by peers re-announcing, rather than swarms growing.
+type PutCounts struct {
+	Inserted uint64
+	Updated  uint64
+}
+
+// putCounters counts puts per address family.
+// All fields are accessed atomically.
+type putCounters struct {
+	inserted4, updated4 uint64
+	inserted6, updated6 uint64
+}
+
+// record counts a put and reports it to prometheus and the MetricsReporters.
+func (c *putCounters) record(af bittorrent.AddressFamily, inserted bool) {
+	if af == bittorrent.IPv4 {
+		if inserted {
+			atomic.AddUint64(&c.inserted4, 1)
+			promPutsInserted4.Inc()
+			metricsReporters.count("puts.inserted.ipv4", 1)
+		} else {
+			atomic.AddUint64(&c.updated4, 1)
+			promPutsUpdated4.Inc()
+			metricsReporters.count("puts.updated.ipv4", 1)
+		}
+		return
+	}
+
+	if inserted {
+		atomic.AddUint64(&c.inserted6, 1)
+		promPutsInserted6.Inc()
+		metricsReporters.count("puts.inserted.ipv6", 1)
+	} else {
+		atomic.AddUint64(&c.updated6, 1)
+		promPutsUpdated6.Inc()
+		metricsReporters.count("puts.updated.ipv6", 1)
+	}
+}
+
+// PutCounts returns the number of puts that inserted or updated peers since
+// the PeerStore was created, per address family.
+func (s *PeerStore) PutCounts() (ipv4, ipv6 PutCounts) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	ipv4.Inserted = atomic.LoadUint64(&s.putCounts.inserted4)
+	ipv4.Updated = atomic.LoadUint64(&s.putCounts.updated4)
+	ipv6.Inserted = atomic.LoadUint64(&s.putCounts.inserted6)
+	ipv6.Updated = atomic.LoadUint64(&s.putCounts.updated6)
+	return
+}
@@ -0,0 +1,69 @@
+package optmem
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// ErrThrottled is returned by announces to a swarm that is announced to more
+// often than AnnounceRateLimit allows.
+var ErrThrottled = bittorrent.ClientError("swarm is announced too often, try again later")
+
+// announceBucket is the token bucket limiting the announces of a swarm.
+type announceBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // of the last refill
+}
+
+// take refills the bucket at rate tokens per second up to burst and takes a
+// token, if there is one.
+func (b *announceBucket) take(now time.Time, rate, burst float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// announceBurst returns the configured AnnounceBurst, or the number of
+// announces allowed per second if none is configured.
+func (cfg Config) announceBurst() float64 {
+	if cfg.AnnounceBurst > 0 {
+		return float64(cfg.AnnounceBurst)
+	}
+	return math.Max(1, math.Ceil(cfg.AnnounceRateLimit))
+}
+
+// allowAnnounce takes a token from the bucket of the swarm and returns
+// whether the announce may proceed.
+// The swarm must exist and its shard must be locked by the caller, at least
+// for reading, so that the bucket is not leaked by a concurrent removal of
+// the swarm.
+func (s *PeerStore) allowAnnounce(shard *shard, ih infohash, af bittorrent.AddressFamily) bool {
+	if shard.limits == nil {
+		return true
+	}
+
+	now := s.now()
+	burst := s.cfg.announceBurst()
+	v, ok := shard.limits.Load(ih)
+	if !ok {
+		v, _ = shard.limits.LoadOrStore(ih, &announceBucket{tokens: burst, last: now})
+	}
+	if v.(*announceBucket).take(now, s.cfg.AnnounceRateLimit, burst) {
+		return true
+	}
+	promThrottled.inc(af)
+	return false
+}
@@ -0,0 +1,52 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceRateLimit(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.AnnounceRateLimit = 0.5
+	cfg.AnnounceBurst = 2
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih2, p1))
+
+	for i := 0; i < 2; i++ {
+		_, err = ps.AnnouncePeers(ih, false, 10, p2)
+		require.Nil(t, err)
+	}
+	_, err = ps.AnnouncePeers(ih, false, 10, p2)
+	require.Equal(t, ErrThrottled, err)
+	_, err = ps.AnnounceAndPut(ih, false, 10, p2)
+	require.Equal(t, ErrThrottled, err)
+	require.Equal(t, 0, ps.NumLeechers(ih))
+
+	// Other swarms are not affected.
+	_, err = ps.AnnouncePeers(ih2, false, 10, p2)
+	require.Nil(t, err)
+
+	// One token is refilled every two seconds.
+	clock.set(gcBenchStart.Add(2 * time.Second))
+	_, err = ps.AnnounceAndPut(ih, false, 10, p2)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	_, err = ps.AnnouncePeers(ih, false, 10, p2)
+	require.Equal(t, ErrThrottled, err)
+
+	// The bucket is dropped with the swarm.
+	require.True(t, ps.DeleteSwarm(ih))
+	_, ok := ps.shards.shards[ps.shards.shardIndex(infohash(ih))].limits.Load(infohash(ih))
+	require.False(t, ok)
+}
@@ -0,0 +1,54 @@
+package optmem
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReadOnly is returned by methods that modify the PeerStore while it is
+// read-only.
+var ErrReadOnly = errors.New("store is read-only")
+
+// SetReadOnly enables or disables read-only mode.
+//
+// While the store is read-only, puts, deletes, graduations, imports,
+// pinning, purges and changes to tags and peer statistics return ErrReadOnly
+// and garbage collection is paused.
+// Announces and scrapes keep working from the existing data.
+// This is useful during cutovers to another instance or while taking
+// consistent backups.
+//
+// Puts that were queued for batching before read-only mode was enabled are
+// still applied, Flush can be used to wait for them.
+// DeleteSwarm and freezing swarms are not affected.
+// Read-only mode only applies to the namespace it is set on.
+func (s *PeerStore) SetReadOnly(readOnly bool) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&s.readOnly, v)
+}
+
+// ReadOnly returns whether the store is read-only.
+func (s *PeerStore) ReadOnly() bool {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.isReadOnly()
+}
+
+// isReadOnly returns whether the store is read-only.
+func (s *PeerStore) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
@@ -0,0 +1,60 @@
+package optmem
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	var export bytes.Buffer
+	_, err = ps.ExportSwarms(&export, nil)
+	require.Nil(t, err)
+
+	ps.SetReadOnly(true)
+	require.True(t, ps.ReadOnly())
+
+	require.Equal(t, ErrReadOnly, ps.PutSeeder(ih, p3))
+	require.Equal(t, ErrReadOnly, ps.PutLeecher(ih, p3))
+	require.Equal(t, ErrReadOnly, ps.GraduateLeecher(ih, p2))
+	require.Equal(t, ErrReadOnly, ps.DeleteSeeder(ih, p1))
+	require.Equal(t, ErrReadOnly, ps.DeleteLeecher(ih, p2))
+	require.Equal(t, ErrReadOnly, ps.SetSwarmTags(ih, []string{"a"}))
+	require.Equal(t, ErrReadOnly, ps.PutPeerStats(ih, p1, PeerStats{}))
+	require.Equal(t, ErrReadOnly, ps.PinSwarm(ih))
+	require.Equal(t, ErrReadOnly, ps.UnpinSwarm(ih))
+	_, err = ps.PurgeIP(p1.IP.IP)
+	require.Equal(t, ErrReadOnly, err)
+	_, err = ps.ImportSwarms(&export)
+	require.Equal(t, ErrReadOnly, err)
+	_, err = ps.CollectGarbage(time.Now())
+	require.Equal(t, ErrReadOnly, err)
+
+	// Reads keep working.
+	announcer := bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.ParseIP("3.4.5.6"), AddressFamily: bittorrent.IPv4},
+		Port: 4567,
+	}
+	peers, err := ps.AnnouncePeers(ih, false, 10, announcer)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	ps.SetReadOnly(false)
+	require.False(t, ps.ReadOnly())
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	require.Equal(t, 0, ps.NumSeeders(ih))
+
+	require.Nil(t, <-ps.Stop())
+}
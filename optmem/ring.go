@@ -0,0 +1,150 @@
+package optmem
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Ring is a consistent hashing ring that assigns infohashes to tracker nodes.
+//
+// It can be used to shard swarms over multiple instances of the PeerStore.
+// When the node membership changes, Moves computes the parts of the infohash
+// key space that change owners, which can then be moved using ExportSwarms,
+// ImportSwarms and RemoveSwarms.
+type Ring struct {
+	points []ringPoint // sorted by position
+}
+
+type ringPoint struct {
+	position uint64
+	node     string
+}
+
+// NewRing creates a Ring for the given nodes.
+// Every node is placed on the ring virtualNodes times, more virtual nodes
+// distribute the key space more evenly.
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+
+	r := &Ring{points: make([]ringPoint, 0, len(nodes)*virtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			h := sha1.Sum([]byte(node + "#" + strconv.Itoa(i)))
+			r.points = append(r.points, ringPoint{position: binary.BigEndian.Uint64(h[:8]), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].position == r.points[j].position {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].position < r.points[j].position
+	})
+
+	return r
+}
+
+// keyPosition returns the position of an infohash on a Ring.
+func keyPosition(infoHash bittorrent.InfoHash) uint64 {
+	return binary.BigEndian.Uint64(infoHash[:8])
+}
+
+// ownerAt returns the node owning the given position.
+// A position is owned by the first node at or after it, wrapping around.
+func (r *Ring) ownerAt(position uint64) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].position >= position })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Owner returns the node responsible for the given infohash.
+// It returns an empty string if the Ring has no nodes.
+func (r *Ring) Owner(infoHash bittorrent.InfoHash) string {
+	return r.ownerAt(keyPosition(infoHash))
+}
+
+// KeyRange is a part of the infohash key space that changes owners.
+// The range is inclusive on both ends and refers to the big-endian value of
+// the first eight bytes of an infohash.
+type KeyRange struct {
+	First uint64
+	Last  uint64
+	From  string
+	To    string
+}
+
+// Contains returns whether the infohash lies within the KeyRange.
+func (k KeyRange) Contains(infoHash bittorrent.InfoHash) bool {
+	pos := keyPosition(infoHash)
+	return pos >= k.First && pos <= k.Last
+}
+
+// Moves returns the key ranges whose owner differs between r and to, sorted
+// by position.
+// Adjacent ranges moving between the same nodes are merged.
+func (r *Ring) Moves(to *Ring) []KeyRange {
+	// The owner can only change at the position of a point of either ring.
+	// Every range therefore ends at such a position, or at the end of the
+	// key space.
+	ends := make([]uint64, 0, len(r.points)+len(to.points)+1)
+	for _, p := range r.points {
+		ends = append(ends, p.position)
+	}
+	for _, p := range to.points {
+		ends = append(ends, p.position)
+	}
+	ends = append(ends, math.MaxUint64)
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+
+	var moves []KeyRange
+	first := uint64(0)
+	for i, last := range ends {
+		if i > 0 && last == ends[i-1] {
+			continue
+		}
+
+		from, dest := r.ownerAt(last), to.ownerAt(last)
+		if from != dest {
+			if n := len(moves); n > 0 && moves[n-1].Last+1 == first && moves[n-1].From == from && moves[n-1].To == dest {
+				moves[n-1].Last = last
+			} else {
+				moves = append(moves, KeyRange{First: first, Last: last, From: from, To: dest})
+			}
+		}
+
+		if last == math.MaxUint64 {
+			break
+		}
+		first = last + 1
+	}
+
+	return moves
+}
+
+// MovingTo returns a filter for ExportSwarms and RemoveSwarms that matches
+// the infohashes of moves that go from the node from to the node to.
+func MovingTo(moves []KeyRange, from, to string) func(bittorrent.InfoHash) bool {
+	var relevant []KeyRange
+	for _, m := range moves {
+		if m.From == from && m.To == to {
+			relevant = append(relevant, m)
+		}
+	}
+
+	return func(infoHash bittorrent.InfoHash) bool {
+		pos := keyPosition(infoHash)
+		i := sort.Search(len(relevant), func(i int) bool { return relevant[i].Last >= pos })
+		return i < len(relevant) && relevant[i].First <= pos
+	}
+}
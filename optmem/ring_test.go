@@ -0,0 +1,47 @@
+package optmem
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func randomInfoHash(r *rand.Rand) (ih bittorrent.InfoHash) {
+	r.Read(ih[:])
+	return
+}
+
+func TestRingMoves(t *testing.T) {
+	from := NewRing([]string{"a", "b", "c"}, 16)
+	to := NewRing([]string{"a", "b", "c", "d"}, 16)
+
+	moves := from.Moves(to)
+	require.NotEmpty(t, moves)
+	for i, m := range moves {
+		require.True(t, m.First <= m.Last)
+		require.NotEqual(t, m.From, m.To)
+		require.Equal(t, "d", m.To, "only the new node should receive swarms")
+		if i > 0 {
+			require.True(t, moves[i-1].Last < m.First)
+		}
+	}
+
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		infoHash := randomInfoHash(r)
+		moved := MovingTo(moves, from.Owner(infoHash), "d")(infoHash)
+		require.Equal(t, from.Owner(infoHash) != to.Owner(infoHash), moved)
+	}
+}
+
+func TestRingMovesCoverKeySpace(t *testing.T) {
+	from := NewRing([]string{"a"}, 4)
+	to := NewRing([]string{"b"}, 4)
+
+	moves := from.Moves(to)
+	require.Equal(t, []KeyRange{{First: 0, Last: math.MaxUint64, From: "a", To: "b"}}, moves)
+	require.Empty(t, from.Moves(from))
+}
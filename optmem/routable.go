@@ -0,0 +1,89 @@
+package optmem
+
+import (
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/pkg/errors"
+)
+
+// ErrUnroutableIP is returned if a peer with an IP that is not globally
+// routable is put, unless the IP is within one of the configured allowed
+// networks.
+var ErrUnroutableIP = errors.New("unroutable IP")
+
+// unroutableNetworks4 and unroutableNetworks6 are the networks whose
+// addresses can not be reached from the public internet.
+// Distributing peers from these networks only wastes the connection attempts
+// of clients.
+var (
+	unroutableNetworks4 = mustParseCIDRs(
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved, broadcast
+	)
+	unroutableNetworks6 = mustParseCIDRs(
+		"::/128",    // unspecified
+		"::1/128",   // loopback
+		"fc00::/7",  // unique local
+		"fe80::/10", // link-local
+		"ff00::/8",  // multicast
+	)
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// parseCIDRs parses the given networks, skipping invalid ones.
+// Returns the parsed networks and the invalid ones.
+func parseCIDRs(cidrs []string) (nets []*net.IPNet, invalid []string) {
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			invalid = append(invalid, cidr)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// routable returns whether the IP may be stored.
+// An IP may be stored if it is globally routable or contained in one of the
+// allowed networks.
+func (s *PeerStore) routable(ip bittorrent.IP) bool {
+	for _, n := range s.allowedNetworks {
+		if n.Contains(ip.IP) {
+			return true
+		}
+	}
+
+	unroutable := unroutableNetworks4
+	if ip.AddressFamily == bittorrent.IPv6 {
+		if ip.To4() != nil {
+			// IPv4-mapped addresses are not valid IPv6 peers.
+			return false
+		}
+		unroutable = unroutableNetworks6
+	}
+	for _, n := range unroutable {
+		if n.Contains(ip.IP) {
+			return false
+		}
+	}
+	return true
+}
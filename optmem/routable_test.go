@@ -0,0 +1,54 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnroutableIPs(t *testing.T) {
+	cfg := testConfig
+	cfg.AllowedUnroutableNetworks = []string{"192.168.1.0/24", "not a network"}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	var table = []struct {
+		ip       string
+		af       bittorrent.AddressFamily
+		routable bool
+	}{
+		{"1.2.3.4", bittorrent.IPv4, true},
+		{"10.1.2.3", bittorrent.IPv4, false},
+		{"127.0.0.1", bittorrent.IPv4, false},
+		{"169.254.1.1", bittorrent.IPv4, false},
+		{"224.0.0.1", bittorrent.IPv4, false},
+		{"255.255.255.255", bittorrent.IPv4, false},
+		{"192.168.2.1", bittorrent.IPv4, false},
+		{"192.168.1.1", bittorrent.IPv4, true}, // allowed
+		{"2001:db8::1", bittorrent.IPv6, true},
+		{"::1", bittorrent.IPv6, false},
+		{"fe80::1", bittorrent.IPv6, false},
+		{"fd00::1", bittorrent.IPv6, false},
+		{"ff02::1", bittorrent.IPv6, false},
+		{"::ffff:1.2.3.4", bittorrent.IPv6, false},
+	}
+
+	for _, tt := range table {
+		ip := net.ParseIP(tt.ip)
+		if tt.af == bittorrent.IPv4 {
+			ip = ip.To4()
+		}
+		p := bittorrent.Peer{IP: bittorrent.IP{IP: ip, AddressFamily: tt.af}, Port: 1234}
+
+		err := ps.PutLeecher(ih, p)
+		if tt.routable {
+			require.Nil(t, err, tt.ip)
+		} else {
+			require.Equal(t, ErrUnroutableIP, err, tt.ip)
+		}
+	}
+
+	require.Nil(t, <-ps.Stop())
+}
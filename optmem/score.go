@@ -0,0 +1,78 @@
+package optmem
+
+import (
+	"bytes"
+	"sort"
+)
+
+// defaultStableScore is the score from which StableFirst prefers peers if
+// MinScore is not set.
+const defaultStableScore = 2
+
+// maxScore is the maximum score of a peer.
+const maxScore = 255
+
+// updateScore updates the score of a peer that is about to be put, see
+// Config.PeerScoring.
+// Peers that announce at least minGap seconds after their previous announce
+// gain a point, peers announcing more often lose half of their points.
+// Peers that are not stored yet, because they are new or left in the
+// meantime, start without points.
+// Peers without points do not use any memory for their score.
+func (pl *peerList) updateScore(p *peer, minGap uint16) {
+	bucket := pl.peerBuckets[pl.bucketIndex(p)]
+	match := sort.Search(len(bucket), binarySearchFunc(p, bucket))
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	if match >= len(bucket) || bucket[match].isDead() || !bytes.Equal(p[:peerCompareSize], bucket[match][:peerCompareSize]) {
+		delete(pl.scores, e)
+		return
+	}
+
+	score := pl.scores[e]
+	if p.peerTime()-bucket[match].peerTime() < minGap {
+		score /= 2
+	} else if score < maxScore {
+		score++
+	}
+
+	if score == 0 {
+		delete(pl.scores, e)
+		return
+	}
+	if pl.scores == nil {
+		pl.scores = make(map[endpoint]uint8)
+	}
+	pl.scores[e] = score
+}
+
+// score returns the score of a peer.
+func (pl *peerList) score(p *peer) uint8 {
+	if pl.scores == nil {
+		return 0
+	}
+	var e endpoint
+	copy(e[:], p[:peerCompareSize])
+	return pl.scores[e]
+}
+
+// StableFirst is a Selector preferring peers that announce regularly, as
+// tracked with Config.PeerScoring, over peers that just joined or flap.
+// The remaining peers are chosen randomly.
+// It runs in linear time in regards to the number of peers in the swarm.
+type StableFirst struct {
+	// MinScore is the score from which peers are preferred.
+	// Zero selects 2.
+	MinScore uint8
+}
+
+// Select implements Selector.
+func (sf StableFirst) Select(v *SelectionView, req SelectionRequest) {
+	minScore := sf.MinScore
+	if minScore == 0 {
+		minScore = defaultStableScore
+	}
+	selectPreferred(v, req, func(c Candidate) bool {
+		return c.Score() >= minScore
+	})
+}
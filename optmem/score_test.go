@@ -0,0 +1,122 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scoreRecorder is a Selector recording the scores of all candidates.
+type scoreRecorder map[string]uint8
+
+func (r scoreRecorder) Select(v *SelectionView, req SelectionRequest) {
+	v.Each(func(c Candidate) bool {
+		r[c.IP().String()] = c.Score()
+		return true
+	})
+}
+
+func TestPeerScoring(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.PeerScoring = true
+	cfg.PeerScoreMinInterval = 10 * time.Second
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	scores := func() scoreRecorder {
+		r := make(scoreRecorder)
+		ps.selector = r
+		_, err := ps.AnnouncePeers(ih, false, 10, p1)
+		require.Nil(t, err)
+		return r
+	}
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+	require.Equal(t, uint8(0), scores()[benchPeer(0).IP.String()])
+
+	// Regular announces gain points.
+	for i := 0; i < 3; i++ {
+		clock.set(clock.Now().Add(20 * time.Second))
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(0)))
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(1)))
+	}
+	require.Equal(t, uint8(3), scores()[benchPeer(0).IP.String()])
+
+	// Announcing too often halves the score.
+	clock.set(clock.Now().Add(time.Second))
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(0)))
+	s := scores()
+	require.Equal(t, uint8(1), s[benchPeer(0).IP.String()])
+	require.Equal(t, uint8(3), s[benchPeer(1).IP.String()])
+	require.Equal(t, uint8(0), s[benchPeer(2).IP.String()])
+
+	// Rejoining peers start over.
+	require.Nil(t, ps.DeleteLeecher(ih, benchPeer(1)))
+	clock.set(clock.Now().Add(20 * time.Second))
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(1)))
+	require.Equal(t, uint8(0), scores()[benchPeer(1).IP.String()])
+}
+
+func TestPeerScoringDisabled(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(0)))
+		clock.set(clock.Now().Add(time.Hour))
+	}
+	r := make(scoreRecorder)
+	ps.selector = r
+	_, err = ps.AnnouncePeers(ih, false, 10, p1)
+	require.Nil(t, err)
+	require.Equal(t, uint8(0), r[benchPeer(0).IP.String()])
+}
+
+func TestSelectorStableFirst(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.PeerScoring = true
+	cfg.PeerScoreMinInterval = 10 * time.Second
+	cfg.PeerSelector = "stable_first"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 100; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+	// Only benchPeer(7) and benchPeer(42) announce regularly, benchPeer(8)
+	// flaps.
+	for i := 0; i < 2; i++ {
+		clock.set(clock.Now().Add(20 * time.Second))
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(7)))
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(42)))
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(8)))
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(8)))
+	}
+
+	for i := 0; i < 20; i++ {
+		peers, err := ps.AnnouncePeers(ih, false, 2, p1)
+		require.Nil(t, err)
+		ips := make(map[string]bool)
+		for _, p := range peers {
+			ips[p.IP.String()] = true
+		}
+		require.True(t, ips[benchPeer(7).IP.String()])
+		require.True(t, ips[benchPeer(42).IP.String()])
+	}
+}
@@ -0,0 +1,179 @@
+package optmem
+
+import (
+	"math"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Scrape64 is the scrape data of a swarm with 64-bit counts.
+// Unlike bittorrent.Scrape, whose 32-bit counts the store saturates at
+// math.MaxUint32, it does not overflow for very large swarms or for counts
+// aggregated over many swarms or namespaces.
+type Scrape64 struct {
+	InfoHash   bittorrent.InfoHash
+	Snatches   uint64
+	Complete   uint64
+	Incomplete uint64
+}
+
+// Add returns the sum of the counts of s and o, with the infohash of s.
+func (s Scrape64) Add(o Scrape64) Scrape64 {
+	s.Snatches += o.Snatches
+	s.Complete += o.Complete
+	s.Incomplete += o.Incomplete
+	return s
+}
+
+// Scrape converts s to a bittorrent.Scrape, saturating counts that do not fit
+// into 32 bits at math.MaxUint32.
+func (s Scrape64) Scrape() bittorrent.Scrape {
+	return bittorrent.Scrape{
+		InfoHash:   s.InfoHash,
+		Snatches:   saturate32(s.Snatches),
+		Complete:   saturate32(s.Complete),
+		Incomplete: saturate32(s.Incomplete),
+	}
+}
+
+// SwarmStats64 is the 64-bit variant of SwarmStats.
+type SwarmStats64 struct {
+	IPv4     Scrape64
+	IPv6     Scrape64
+	Combined Scrape64
+	Tags     []string // see SetSwarmTags
+}
+
+// swarmStats converts s to a SwarmStats, saturating counts that do not fit
+// into 32 bits.
+func (s SwarmStats64) swarmStats() SwarmStats {
+	return SwarmStats{
+		IPv4:     s.IPv4.Scrape(),
+		IPv6:     s.IPv6.Scrape(),
+		Combined: s.Combined.Scrape(),
+		Tags:     s.Tags,
+	}
+}
+
+// saturate32 returns n, or math.MaxUint32 if n does not fit into 32 bits.
+func saturate32(n uint64) uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// scrapeLocked64 returns the seeder, leecher and download counts of a swarm,
+// without the peers selected by cutoff.
+// The shard must be read-locked by the caller.
+func scrapeLocked64(shard *shard, ih infohash, af bittorrent.AddressFamily, cutoff peerCutoff) (scrape Scrape64) {
+	pl := shard.swarms[ih].list(af)
+	scrape.Snatches = shard.snatches(ih, pl, af)
+	if pl != nil {
+		expired, expiredSeeders := cutoff.count(pl)
+		scrape.Complete = uint64(pl.numSeeders - expiredSeeders + shard.swarms[ih].hiddenSeeders(af))
+		scrape.Incomplete = uint64(pl.numPeers - pl.numSeeders - (expired - expiredSeeders))
+	}
+	return
+}
+
+// ScrapeSwarm64 works like ScrapeSwarm, but returns 64-bit counts.
+// It always locks the shard, lock-free scrapes only hold 32-bit counts.
+func (s *PeerStore) ScrapeSwarm64(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) Scrape64 {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	s.requests.inc()
+
+	promScrapes.inc(af)
+	defer promScrapeLatency.since(af, time.Now())
+
+	ih := infohash(s.resolveAlias(infoHash))
+	s.faultIn(ih)
+	shard := s.shards.rLockShardByHash(ih)
+	sw := shard.swarms[ih]
+	scrape := scrapeLocked64(shard, ih, af, s.peerCutoff(sw))
+	due := s.sweepDue(sw)
+	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
+	scrape.InfoHash = infoHash
+	s.privacy.perturbScrape64(ih, af, &scrape)
+
+	return scrape
+}
+
+// ScrapeSwarmBoth64 works like ScrapeSwarmBoth, but returns 64-bit counts.
+func (s *PeerStore) ScrapeSwarmBoth64(infoHash bittorrent.InfoHash) SwarmStats64 {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	s.requests.inc()
+
+	return s.scrapeBoth64(infoHash)
+}
+
+// scrapeBoth64 implements ScrapeSwarmBoth64 for a single namespace.
+func (s *PeerStore) scrapeBoth64(infoHash bittorrent.InfoHash) (stats SwarmStats64) {
+	promScrapes.inc(bittorrent.IPv4)
+	promScrapes.inc(bittorrent.IPv6)
+
+	ih := infohash(s.resolveAlias(infoHash))
+	s.faultIn(ih)
+	shard := s.shards.rLockShardByHash(ih)
+	sw := shard.swarms[ih]
+	cutoff := s.peerCutoff(sw)
+	stats.IPv4 = scrapeLocked64(shard, ih, bittorrent.IPv4, cutoff)
+	stats.IPv6 = scrapeLocked64(shard, ih, bittorrent.IPv6, cutoff)
+	stats.Tags = append([]string(nil), shard.tags[ih]...)
+	due := s.sweepDue(sw)
+	s.shards.rUnlockShardByHash(ih)
+	s.sweepAfterRead(ih, due)
+	s.privacy.perturbScrape64(ih, bittorrent.IPv4, &stats.IPv4)
+	s.privacy.perturbScrape64(ih, bittorrent.IPv6, &stats.IPv6)
+
+	stats.IPv4.InfoHash = infoHash
+	stats.IPv6.InfoHash = infoHash
+	stats.Combined = stats.IPv4.Add(stats.IPv6)
+	return
+}
+
+// ScrapeAllNamespaces returns the scrape data of the swarm of the given
+// infohash summed over the default namespace and all other namespaces, for
+// example to report the total size of a swarm that is split by namespace.
+// Tags are those of the default namespace.
+// Every namespace is scraped separately, so the sum is not atomic.
+func (s *PeerStore) ScrapeAllNamespaces(infoHash bittorrent.InfoHash) SwarmStats64 {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	s.requests.inc()
+
+	root := s.root
+	root.nsMu.Lock()
+	stores := make([]*PeerStore, 0, len(root.namespaces))
+	for _, ns := range root.namespaces {
+		stores = append(stores, ns)
+	}
+	root.nsMu.Unlock()
+
+	stats := root.scrapeBoth64(infoHash)
+	for _, ns := range stores {
+		select {
+		case <-ns.closed:
+			continue
+		default:
+		}
+		nsStats := ns.scrapeBoth64(infoHash)
+		stats.IPv4 = stats.IPv4.Add(nsStats.IPv4)
+		stats.IPv6 = stats.IPv6.Add(nsStats.IPv6)
+		stats.Combined = stats.Combined.Add(nsStats.Combined)
+	}
+	return stats
+}
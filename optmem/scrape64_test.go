@@ -0,0 +1,64 @@
+package optmem
+
+import (
+	"math"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrape64Saturates(t *testing.T) {
+	s := Scrape64{InfoHash: ih, Snatches: 1, Complete: math.MaxUint32, Incomplete: math.MaxUint32 + 1}
+	sum := s.Add(s)
+	require.Equal(t, ih, sum.InfoHash)
+	require.Equal(t, uint64(2*math.MaxUint32), sum.Complete)
+	require.Equal(t, uint64(2), sum.Snatches)
+
+	scrape := sum.Scrape()
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(2), scrape.Snatches)
+	require.Equal(t, uint32(math.MaxUint32), scrape.Complete)
+	require.Equal(t, uint32(math.MaxUint32), scrape.Incomplete)
+
+	stats := SwarmStats64{IPv4: s, IPv6: s, Combined: sum}.swarmStats()
+	require.Equal(t, uint32(math.MaxUint32), stats.Combined.Complete)
+	require.Equal(t, uint32(math.MaxUint32), stats.IPv4.Complete)
+}
+
+func TestScrapeSwarm64(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+
+	scrape := ps.ScrapeSwarm64(ih, bittorrent.IPv4)
+	require.Equal(t, Scrape64{InfoHash: ih, Complete: 1, Incomplete: 1}, scrape)
+
+	stats := ps.ScrapeSwarmBoth64(ih)
+	require.Equal(t, uint64(2), stats.Combined.Complete)
+	require.Equal(t, uint64(1), stats.Combined.Incomplete)
+	require.Equal(t, ps.ScrapeSwarmBoth(ih).Combined, stats.Combined.Scrape())
+}
+
+func TestScrapeAllNamespaces(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	ns := ps.WithNamespace("other")
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ns.PutSeeder(ih, p1))
+	require.Nil(t, ns.PutLeecher(ih, p3))
+
+	stats := ns.ScrapeAllNamespaces(ih)
+	require.Equal(t, ih, stats.Combined.InfoHash)
+	require.Equal(t, uint64(2), stats.IPv4.Complete)
+	require.Equal(t, uint64(1), stats.IPv6.Incomplete)
+	require.Equal(t, uint64(2), stats.Combined.Complete)
+	require.Equal(t, uint64(1), stats.Combined.Incomplete)
+}
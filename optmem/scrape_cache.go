@@ -0,0 +1,101 @@
+package optmem
+
+import (
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// defaultScrapeCacheSize is the number of entries of the scrape cache if
+// ScrapeCacheSize is zero.
+const defaultScrapeCacheSize = 1 << 16
+
+// scrapeCache caches the results of ScrapeSwarm for ScrapeCacheTTL.
+//
+// It is a direct-mapped cache of immutable entries: every infohash and
+// address family maps to a single slot, which holds the last scrape of any
+// of the infohashes mapping to it.
+// Lookups and updates take no locks.
+type scrapeCache struct {
+	hits, misses uint64 // accessed atomically, first for alignment
+	ttl          int64  // nanoseconds
+	seed         uint64
+	slots        []atomic.Value // *scrapeCacheEntry
+}
+
+// scrapeCacheEntry is a cached scrape, which is never changed after it is
+// stored.
+type scrapeCacheEntry struct {
+	ih      infohash
+	af      bittorrent.AddressFamily
+	expires int64 // unix nanoseconds
+	scrape  bittorrent.Scrape
+}
+
+// newScrapeCache creates a scrape cache of at least ScrapeCacheSize entries,
+// rounded up to a power of two.
+func newScrapeCache(cfg Config) *scrapeCache {
+	size := cfg.ScrapeCacheSize
+	if size == 0 {
+		size = defaultScrapeCacheSize
+	}
+	n := 1
+	for uint(n) < size {
+		n <<= 1
+	}
+	return &scrapeCache{
+		ttl:   int64(cfg.ScrapeCacheTTL),
+		seed:  randomSeed(),
+		slots: make([]atomic.Value, n),
+	}
+}
+
+// slot returns the slot of an infohash and address family.
+func (c *scrapeCache) slot(ih infohash, af bittorrent.AddressFamily) *atomic.Value {
+	h := seededHash(c.seed^uint64(af), ih[:])
+	return &c.slots[h&uint64(len(c.slots)-1)]
+}
+
+// get fills in the counts of scrape from the cache.
+// Returns false if the cache holds no scrape of the infohash and address
+// family that is younger than the TTL.
+func (c *scrapeCache) get(ih infohash, af bittorrent.AddressFamily, now int64, scrape *bittorrent.Scrape) bool {
+	e, _ := c.slot(ih, af).Load().(*scrapeCacheEntry)
+	if e == nil || e.ih != ih || e.af != af || e.expires <= now {
+		atomic.AddUint64(&c.misses, 1)
+		promScrapeCacheMisses.inc(af)
+		return false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	promScrapeCacheHits.inc(af)
+	scrape.Snatches = e.scrape.Snatches
+	scrape.Complete = e.scrape.Complete
+	scrape.Incomplete = e.scrape.Incomplete
+	return true
+}
+
+// put caches the counts of a scrape.
+func (c *scrapeCache) put(ih infohash, af bittorrent.AddressFamily, now int64, scrape bittorrent.Scrape) {
+	c.slot(ih, af).Store(&scrapeCacheEntry{
+		ih:      ih,
+		af:      af,
+		expires: now + c.ttl,
+		scrape:  scrape,
+	})
+}
+
+// ScrapeCacheStats returns the number of scrapes answered from the scrape
+// cache and the number of scrapes that missed it, see ScrapeCacheTTL.
+// Both are zero if the cache is disabled.
+func (s *PeerStore) ScrapeCacheStats() (hits, misses uint64) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if s.scrapeCache == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&s.scrapeCache.hits), atomic.LoadUint64(&s.scrapeCache.misses)
+}
@@ -0,0 +1,44 @@
+package optmem
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeCache(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.ScrapeCacheTTL = time.Second
+	cfg.ScrapeCacheSize = 3
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Len(t, ps.scrapeCache.slots, 4)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(1), scrape.Complete)
+
+	// Scrapes are stale until the TTL expires.
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	scrape = ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	hits, misses := ps.ScrapeCacheStats()
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(1), misses)
+
+	atomic.AddInt64(&clock.unix, 1)
+	scrape = ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+	hits, misses = ps.ScrapeCacheStats()
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(2), misses)
+
+	require.Nil(t, <-ps.Stop())
+}
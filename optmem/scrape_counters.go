@@ -0,0 +1,71 @@
+package optmem
+
+import (
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// scrapeCounters holds the scrape data of a swarm for lock-free scrapes.
+// All fields are accessed atomically.
+//
+// The seeder and leecher counts of an address family are packed into a
+// single word, so they are always read consistently.
+// The number of downloads may be off by one in regards to them.
+type scrapeCounters struct {
+	peers4, snatches4 uint64
+	peers6, snatches6 uint64
+}
+
+func packCounts(sw swarm, af bittorrent.AddressFamily) uint64 {
+	pl := sw.list(af)
+	if pl == nil {
+		return 0
+	}
+	return uint64(saturate32(uint64(pl.numSeeders+sw.hiddenSeeders(af))))<<32 | uint64(saturate32(uint64(pl.numPeers-pl.numSeeders)))
+}
+
+// publishCounters updates the scrape counters of a swarm.
+// The shard must be write-locked by the caller.
+func (s *shard) publishCounters(ih infohash, sw swarm) {
+	v, ok := s.counters.Load(ih)
+	if !ok {
+		s.counters.Store(ih, &scrapeCounters{
+			peers4:    packCounts(sw, bittorrent.IPv4),
+			snatches4: s.snatches(ih, sw.peers4, bittorrent.IPv4),
+			peers6:    packCounts(sw, bittorrent.IPv6),
+			snatches6: s.snatches(ih, sw.peers6, bittorrent.IPv6),
+		})
+		return
+	}
+
+	c := v.(*scrapeCounters)
+	atomic.StoreUint64(&c.peers4, packCounts(sw, bittorrent.IPv4))
+	atomic.StoreUint64(&c.snatches4, s.snatches(ih, sw.peers4, bittorrent.IPv4))
+	atomic.StoreUint64(&c.peers6, packCounts(sw, bittorrent.IPv6))
+	atomic.StoreUint64(&c.snatches6, s.snatches(ih, sw.peers6, bittorrent.IPv6))
+}
+
+// scrapeLockFree fills in the seeder and leecher counts of a scrape without
+// locking the shard.
+// Returns false if the swarm has no counters but may have durable download
+// counters, which must be read under the lock.
+func scrapeLockFree(shard *shard, ih infohash, af bittorrent.AddressFamily, scrape *bittorrent.Scrape) bool {
+	v, ok := shard.counters.Load(ih)
+	if !ok {
+		return shard.downloads == nil
+	}
+	c := v.(*scrapeCounters)
+
+	var counts uint64
+	if af == bittorrent.IPv6 {
+		counts = atomic.LoadUint64(&c.peers6)
+		scrape.Snatches = saturate32(atomic.LoadUint64(&c.snatches6))
+	} else {
+		counts = atomic.LoadUint64(&c.peers4)
+		scrape.Snatches = saturate32(atomic.LoadUint64(&c.snatches4))
+	}
+	scrape.Complete = uint32(counts >> 32)
+	scrape.Incomplete = uint32(counts)
+	return true
+}
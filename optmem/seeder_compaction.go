@@ -0,0 +1,156 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+)
+
+// compactedSeeders holds the seeders of a compacted swarm that are counted,
+// but not stored, see Config.SeederCompactionAfter.
+// It is shared by all copies of the swarm.
+type compactedSeeders struct {
+	hidden  [2]int // seeders not in the sample, as estimated by the last GC
+	total   [2]int // seeders not in the sample at compaction
+	sampled [2]int // seeders in the sample at compaction
+}
+
+// hiddenSeeders returns the number of seeders of an address family that are
+// counted, but not stored, because the swarm is compacted.
+func (sw swarm) hiddenSeeders(af bittorrent.AddressFamily) int {
+	if sw.compacted == nil {
+		return 0
+	}
+	return sw.compacted.hidden[afIndex(af)]
+}
+
+// hasLeechers returns whether the swarm has leechers of any address family.
+func (sw swarm) hasLeechers() bool {
+	return (sw.peers4 != nil && sw.peers4.numPeers > sw.peers4.numSeeders) ||
+		(sw.peers6 != nil && sw.peers6.numPeers > sw.peers6.numSeeders)
+}
+
+// estimate updates the number of hidden seeders, assuming that they leave
+// at the same rate as the seeders in the sample.
+// Returns whether the number changed.
+func (c *compactedSeeders) estimate(sw swarm) (changed bool) {
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		i := afIndex(af)
+		hidden := 0
+		if pl := sw.list(af); pl != nil && c.sampled[i] > 0 {
+			hidden = int(uint64(c.total[i]) * uint64(pl.numSeeders) / uint64(c.sampled[i]))
+		}
+		if hidden != c.hidden[i] {
+			c.hidden[i] = hidden
+			changed = true
+		}
+	}
+	return changed
+}
+
+// trackSeeded records since when GC saw the swarm without leechers.
+// Returns whether that changed and whether the swarm has been without
+// leechers for at least after seconds.
+func (sw *swarm) trackSeeded(now, after uint16) (changed, due bool) {
+	if sw.hasLeechers() {
+		changed = sw.seeded
+		sw.seeded = false
+		return changed, false
+	}
+	if !sw.seeded {
+		sw.seeded = true
+		sw.seededSince = now
+		return true, false
+	}
+	return false, now-sw.seededSince >= after
+}
+
+// compactSeeders replaces every peer list of a swarm without leechers that
+// holds more than sample seeders by a random sample of them.
+// The seeders that are dropped are still counted as hidden seeders, so the
+// counts of the swarm and the shard do not change.
+// PeerStats, scores and identity keys of the dropped seeders are lost.
+// Returns false if no peer list was large enough.
+func compactSeeders(shard *shard, ih infohash, sw *swarm, sample int) bool {
+	var c compactedSeeders
+	var compacted bool
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		pl := sw.list(af)
+		if pl == nil || pl.numSeeders <= sample {
+			continue
+		}
+		kept := pl.sampleSeeders(sample, seededHash(shard.seed, ih[:]), uint64(sw.seededSince))
+		small := newPeerList(shard.seed)
+		for i := range kept {
+			small.putPeer(&kept[i])
+		}
+		small.rebalanceBuckets()
+		small.numDownloads = pl.numDownloads
+
+		i := afIndex(af)
+		c.sampled[i] = small.numSeeders
+		c.total[i] = pl.numSeeders - small.numSeeders
+		c.hidden[i] = c.total[i]
+		if af == bittorrent.IPv4 {
+			sw.peers4 = small
+		} else {
+			sw.peers6 = small
+		}
+		compacted = true
+	}
+	if !compacted {
+		return false
+	}
+	sw.compacted = &c
+	return true
+}
+
+// sampleSeeders returns a uniformly random sample of n distinct seeders.
+// It runs in linear time in regards to the number of peers.
+func (pl *peerList) sampleSeeders(n int, s0, s1 uint64) []peer {
+	kept := make([]peer, 0, n)
+	seen := 0
+	for _, b := range pl.peerBuckets {
+		for i := range b {
+			if !b[i].isSeeder() {
+				continue
+			}
+			seen++
+			if len(kept) < n {
+				kept = append(kept, b[i])
+				continue
+			}
+			var j int
+			j, s0, s1 = random.Intn(s0, s1, seen)
+			if j < n {
+				kept[j] = b[i]
+			}
+		}
+	}
+	return kept
+}
+
+// expandSeeders turns a compacted swarm back into a regular one.
+// The hidden seeders are no longer counted, they are stored again once they
+// announce.
+// The shard must be write-locked by the caller.
+func expandSeeders(shard *shard, sw *swarm) {
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		h := sw.hiddenSeeders(af)
+		shard.counts.sub(af, h, h)
+	}
+	sw.compacted = nil
+	sw.seeded = false
+}
+
+// dropHiddenSeeders stops counting the hidden seeders of an address family,
+// for example because the sample of the address family is gone.
+// The shard must be write-locked by the caller.
+func dropHiddenSeeders(shard *shard, sw swarm, af bittorrent.AddressFamily) {
+	if sw.compacted == nil {
+		return
+	}
+	h := sw.hiddenSeeders(af)
+	shard.counts.sub(af, h, h)
+	i := afIndex(af)
+	sw.compacted.hidden[i], sw.compacted.total[i], sw.compacted.sampled[i] = 0, 0, 0
+}
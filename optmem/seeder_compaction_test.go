@@ -0,0 +1,129 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// compactedStore returns a store with a swarm of 100 seeders compacted to 10.
+func compactedStore(t *testing.T) (*PeerStore, *benchClock) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.SeederCompactionAfter = 10 * time.Minute
+	cfg.SeederCompactionSample = 10
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	stats, err := ps.CollectGarbage(clock.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.SwarmsCompacted)
+
+	clock.set(clock.Now().Add(10 * time.Minute))
+	stats, err = ps.CollectGarbage(clock.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, stats.SwarmsCompacted)
+	return ps, clock
+}
+
+// sampledSeeders returns the seeders stored for the swarm.
+func sampledSeeders(ps *PeerStore) []bittorrent.Peer {
+	shard := ps.shards.rLockShardByHash(infohash(ih))
+	defer ps.shards.rUnlockShardByHash(infohash(ih))
+	return appendBittorrentPeers(nil, shard.swarms[infohash(ih)].peers4.getAllSeeders(nil), bittorrent.IPv4)
+}
+
+func TestSeederCompaction(t *testing.T) {
+	ps, _ := compactedStore(t)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	sample := sampledSeeders(ps)
+	require.Len(t, sample, 10)
+	require.Equal(t, 100, ps.NumSeeders(ih))
+	require.Equal(t, uint32(100), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(100), seeders)
+	require.Equal(t, uint64(0), leechers)
+	require.True(t, ps.CheckConsistency().OK())
+
+	// Seeders that are not in the sample still receive peers, but are not
+	// stored.
+	peers, err := ps.AnnounceAndPut(ih, true, 5, benchPeer(1000))
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+	peers, err = ps.AnnouncePeers(ih, false, 5, benchPeer(1000))
+	require.Nil(t, err)
+	require.Len(t, peers, 5)
+	require.Equal(t, 100, ps.NumSeeders(ih))
+	require.Len(t, sampledSeeders(ps), 10)
+
+	// Hidden seeders leave at the rate of the sampled ones.
+	for _, p := range sample[:5] {
+		require.Nil(t, ps.DeleteSeeder(ih, p))
+	}
+	_, err = ps.CollectGarbage(time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Equal(t, 50, ps.NumSeeders(ih))
+	require.True(t, ps.CheckConsistency().OK())
+
+	// The swarm is removed with the last sampled seeder.
+	for _, p := range sample[5:] {
+		require.Nil(t, ps.DeleteSeeder(ih, p))
+	}
+	require.Equal(t, 0, ps.NumSeeders(ih))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	seeders, _ = ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders)
+	require.True(t, ps.CheckConsistency().OK())
+}
+
+func TestSeederCompactionExpand(t *testing.T) {
+	ps, _ := compactedStore(t)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(1000)))
+	require.Equal(t, 10, ps.NumSeeders(ih))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	require.True(t, ps.CheckConsistency().OK())
+
+	// Seeders are stored again.
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(1001)))
+	require.Equal(t, 11, ps.NumSeeders(ih))
+}
+
+func TestSeederCompactionSmallSwarm(t *testing.T) {
+	clock := &benchClock{}
+	clock.set(gcBenchStart)
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.SeederCompactionAfter = time.Minute
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(10)))
+	for i := 0; i < 3; i++ {
+		stats, err := ps.CollectGarbage(clock.Now().Add(-time.Hour))
+		require.Nil(t, err)
+		require.Equal(t, 0, stats.SwarmsCompacted)
+		clock.set(clock.Now().Add(time.Minute))
+	}
+	require.Nil(t, ps.DeleteLeecher(ih, benchPeer(10)))
+	for i := 0; i < 3; i++ {
+		stats, err := ps.CollectGarbage(clock.Now().Add(-time.Hour))
+		require.Nil(t, err)
+		require.Equal(t, 0, stats.SwarmsCompacted)
+		clock.set(clock.Now().Add(time.Minute))
+	}
+	require.Equal(t, 10, ps.NumSeeders(ih))
+}
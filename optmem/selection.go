@@ -0,0 +1,59 @@
+package optmem
+
+import (
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Rand provides the randomness used to select the peers returned to
+// announces.
+// Implementations must be safe for concurrent use.
+type Rand interface {
+	Uint64() uint64
+}
+
+// SeededRand is a Rand returning a fixed sequence of numbers for a seed.
+// Concurrent callers share the sequence, so only the numbers returned to
+// sequential calls are reproducible.
+type SeededRand struct {
+	state uint64
+}
+
+var _ Rand = &SeededRand{}
+
+// NewSeededRand returns a SeededRand for seed.
+func NewSeededRand(seed uint64) *SeededRand {
+	return &SeededRand{state: seed}
+}
+
+// Uint64 implements Rand, using splitmix64.
+func (r *SeededRand) Uint64() uint64 {
+	z := atomic.AddUint64(&r.state, 0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// selectionRand returns the Rand peers are selected with, or nil to derive
+// the randomness from the requests.
+func (cfg Config) selectionRand() Rand {
+	if cfg.Rand != nil {
+		return cfg.Rand
+	}
+	if cfg.SelectionSeed != 0 {
+		return NewSeededRand(cfg.SelectionSeed)
+	}
+	return nil
+}
+
+// selectionEntropy returns the seeds to select peers for an announce with.
+// Without a Rand, they are derived from the infohash and the peer ID, so
+// repeated announces of a peer return the same peers as long as the swarm
+// does not change.
+func (s *PeerStore) selectionEntropy(infoHash bittorrent.InfoHash, p bittorrent.Peer) (uint64, uint64) {
+	if s.rand == nil {
+		return deriveEntropyFromRequest(infoHash, p)
+	}
+	return s.rand.Uint64(), s.rand.Uint64()
+}
@@ -0,0 +1,69 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectionSeed(t *testing.T) {
+	announce := func(seed uint64) [][]bittorrent.Peer {
+		cfg := testConfig
+		cfg.SelectionSeed = seed
+		ps, err := New(cfg)
+		require.Nil(t, err)
+		defer func() { require.Nil(t, <-ps.Stop()) }()
+
+		for i := 0; i < 200; i++ {
+			require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+		}
+
+		var responses [][]bittorrent.Peer
+		for i := 0; i < 10; i++ {
+			peers, err := ps.AnnouncePeers(ih, true, 20, p1)
+			require.Nil(t, err)
+			require.Len(t, peers, 20)
+			responses = append(responses, peers)
+		}
+		return responses
+	}
+
+	responses := announce(1)
+	require.Equal(t, responses, announce(1))
+	require.NotEqual(t, responses, announce(2))
+	// Repeated announces get different peers.
+	require.NotEqual(t, responses[0], responses[1])
+}
+
+// constantRand is a Rand always returning the same number.
+type constantRand uint64
+
+func (r constantRand) Uint64() uint64 { return uint64(r) }
+
+func TestSelectionRand(t *testing.T) {
+	cfg := testConfig
+	cfg.Rand = constantRand(42)
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	for i := 0; i < 200; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+	}
+
+	// Different announcing peers get the same peers, as the selection does
+	// not depend on the request.
+	other := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("12345678901234567890"),
+		IP:   bittorrent.IP{IP: net.ParseIP("3.4.5.6").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 3456,
+	}
+	peers1, err := ps.AnnouncePeers(ih, true, 20, p1)
+	require.Nil(t, err)
+	peers2, err := ps.AnnouncePeers(ih, true, 20, other)
+	require.Nil(t, err)
+	require.Equal(t, peers1, peers2)
+
+	require.Nil(t, <-ps.Stop())
+}
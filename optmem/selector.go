@@ -0,0 +1,361 @@
+package optmem
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// A Selector decides which peers of a swarm are returned to an announce.
+//
+// Selectors run while the shard of the swarm is locked, so they should be
+// fast and must not call the PeerStore.
+// Peers rejected by the PeerFilter are hidden from Selectors.
+// Announces of peers that require encryption bypass the Selector and are
+// always answered with random peers that support encryption.
+type Selector interface {
+	// Select adds up to req.NumWant peers of the view to it.
+	// Additional peers are ignored.
+	Select(v *SelectionView, req SelectionRequest)
+}
+
+// SelectionRequest describes the announce a Selector selects peers for.
+type SelectionRequest struct {
+	// Announcer is the announcing peer.
+	Announcer Candidate
+
+	// Seeder is true if the announcing peer is a seeder.
+	// Seeders must only be returned leechers.
+	Seeder bool
+
+	// NumWant is the number of peers to select, already limited by the
+	// configuration.
+	NumWant int
+
+	// SeederShare is the configured AnnounceSeederShare.
+	SeederShare float64
+}
+
+// Candidate is a peer of a swarm, as seen by Selectors, Evictors and
+// PeerFilters.
+type Candidate struct {
+	p     peer
+	af    bittorrent.AddressFamily
+	score uint8
+}
+
+// IP returns a copy of the IP of the peer.
+func (c Candidate) IP() net.IP {
+	if c.af == bittorrent.IPv4 {
+		return net.IP(c.p.ip4())
+	}
+	return net.IP(c.p.ip())
+}
+
+// Port returns the port of the peer.
+func (c Candidate) Port() uint16 {
+	return c.p.port()
+}
+
+// Seeder returns whether the peer is a seeder.
+func (c Candidate) Seeder() bool {
+	return c.p.isSeeder()
+}
+
+// External returns whether the peer was learned from an upstream tracker,
+// see FederationConfig.
+func (c Candidate) External() bool {
+	return c.p.isExternal()
+}
+
+// Score returns the number of regular announces the peer made in a row,
+// up to 255, if Config.PeerScoring is set.
+// Announces made too soon after the previous one halve the score, and peers
+// that leave and rejoin start over at zero.
+// It is only set for the candidates of SelectionView.Each.
+func (c Candidate) Score() uint8 {
+	return c.score
+}
+
+// SelectionView gives a Selector access to the peers of one address family of
+// a swarm and collects the selected peers.
+// It is only valid during the call to Select.
+type SelectionView struct {
+	pl     *peerList
+	af     bittorrent.AddressFamily
+	dst    []peer
+	s0, s1 uint64
+	keep   func(p *peer) bool // nil to see all peers, see peerKeeper
+}
+
+// NumPeers returns the number of peers in the swarm, including peers
+// rejected by the PeerFilter.
+func (v *SelectionView) NumPeers() int {
+	return v.pl.numPeers
+}
+
+// NumSeeders returns the number of seeders in the swarm, including seeders
+// rejected by the PeerFilter.
+func (v *SelectionView) NumSeeders() int {
+	return v.pl.numSeeders
+}
+
+// Each calls f for every peer in the swarm, in no particular order, until f
+// returns false.
+// It runs in linear time in regards to the number of peers in the swarm.
+func (v *SelectionView) Each(f func(c Candidate) bool) {
+	for _, b := range v.pl.peerBuckets {
+		for _, p := range b {
+			if p.isDead() || (v.keep != nil && !v.keep(&p)) {
+				continue
+			}
+			if !f(Candidate{p: p, af: v.af, score: v.pl.score(&p)}) {
+				return
+			}
+		}
+	}
+}
+
+// Add selects a peer.
+func (v *SelectionView) Add(c Candidate) {
+	v.dst = append(v.dst, c.p)
+}
+
+// AddRandom selects numWant random peers the way the Random Selector does,
+// splitting them into seeders and leechers by seederShare.
+// If seeder is set, only leechers are selected.
+// Random peers are sampled with replacement, so a peer might be selected
+// more than once.
+func (v *SelectionView) AddRandom(numWant int, seeder bool, seederShare float64) {
+	if v.keep != nil {
+		v.dst = v.pl.getFilteredAnnouncePeers(v.dst, numWant, seeder, seederShare, v.s0, v.s1, v.keep)
+		return
+	}
+	v.dst = v.pl.getRandomAnnouncePeers(v.dst, numWant, seeder, seederShare, v.s0, v.s1)
+}
+
+// Entropy returns the random seeds of the announce, see Config.Rand.
+func (v *SelectionView) Entropy() (uint64, uint64) {
+	return v.s0, v.s1
+}
+
+// Random is the default Selector, returning random peers.
+// Leechers receive seeders and leechers as split by AnnounceSeederShare.
+type Random struct{}
+
+// Select implements Selector.
+func (Random) Select(v *SelectionView, req SelectionRequest) {
+	v.AddRandom(req.NumWant, req.Seeder, req.SeederShare)
+}
+
+// SeederFirst is a Selector returning as many seeders as possible to
+// leechers, ignoring AnnounceSeederShare.
+type SeederFirst struct{}
+
+// Select implements Selector.
+func (SeederFirst) Select(v *SelectionView, req SelectionRequest) {
+	v.AddRandom(req.NumWant, req.Seeder, 0)
+}
+
+// SubnetAffinity is a Selector preferring peers in the same /24 (IPv4) or /48
+// (IPv6) network as the announcing peer, for example to keep traffic within
+// an ISP or campus.
+// The remaining peers are chosen randomly.
+// It runs in linear time in regards to the number of peers in the swarm.
+type SubnetAffinity struct{}
+
+var (
+	subnetMask4 = net.CIDRMask(24, 32)
+	subnetMask6 = net.CIDRMask(48, 128)
+)
+
+// Select implements Selector.
+func (SubnetAffinity) Select(v *SelectionView, req SelectionRequest) {
+	mask := subnetMask6
+	if v.af == bittorrent.IPv4 {
+		mask = subnetMask4
+	}
+	selectByAffinity(v, req, func(ip net.IP) string {
+		return string(ip.Mask(mask))
+	})
+}
+
+// GeoAware is a Selector preferring peers in the same region as the
+// announcing peer.
+// The remaining peers are chosen randomly.
+// It runs in linear time in regards to the number of peers in the swarm.
+//
+// GeoAware needs a geolocation database, so it is not registered by default.
+// Register it under a name of your choice with RegisterSelector.
+type GeoAware struct {
+	// Locate returns the region of an IP, or an empty string if it is not
+	// known.
+	// Peers without a known region have no affinity to any peer.
+	// It must be safe for concurrent use.
+	Locate func(ip net.IP) string
+}
+
+// Select implements Selector.
+func (g GeoAware) Select(v *SelectionView, req SelectionRequest) {
+	selectByAffinity(v, req, g.Locate)
+}
+
+// selectByAffinity selects peers in the same region as the announcing peer,
+// as returned by region, and fills up with random peers.
+func selectByAffinity(v *SelectionView, req SelectionRequest, region func(ip net.IP) string) {
+	want := region(req.Announcer.IP())
+	if want == "" {
+		selectPreferred(v, req, nil)
+		return
+	}
+	selectPreferred(v, req, func(c Candidate) bool {
+		return region(c.IP()) == want
+	})
+}
+
+// selectPreferred selects the peers prefer returns true for and fills up
+// with random peers.
+// A nil prefer selects only random peers.
+func selectPreferred(v *SelectionView, req SelectionRequest, prefer func(c Candidate) bool) {
+	start := len(v.dst)
+	if prefer != nil {
+		v.Each(func(c Candidate) bool {
+			if len(v.dst)-start == req.NumWant {
+				return false
+			}
+			if req.Seeder && c.Seeder() {
+				return true
+			}
+			if bytes.Equal(c.p[:peerCompareSize], req.Announcer.p[:peerCompareSize]) {
+				return true
+			}
+			if prefer(c) {
+				v.Add(c)
+			}
+			return true
+		})
+	}
+
+	preferred := len(v.dst)
+	missing := req.NumWant - (preferred - start)
+	if missing == 0 {
+		return
+	}
+
+	// Fill up with random peers that were not already selected.
+	v.AddRandom(req.NumWant, req.Seeder, req.SeederShare)
+	selected := v.dst[start:preferred]
+	n := preferred
+	for _, p := range v.dst[preferred:] {
+		if n-preferred == missing {
+			break
+		}
+		if !containsPeer(selected, &p) {
+			v.dst[n] = p
+			n++
+		}
+	}
+	v.dst = v.dst[:n]
+}
+
+// containsPeer returns whether ps contains a peer with the endpoint of p.
+func containsPeer(ps []peer, p *peer) bool {
+	for i := range ps {
+		if bytes.Equal(ps[i][:peerCompareSize], p[:peerCompareSize]) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	selectorsM sync.RWMutex
+	selectors  = map[string]Selector{
+		"random":          Random{},
+		"seeder_first":    SeederFirst{},
+		"subnet_affinity": SubnetAffinity{},
+		"stable_first":    StableFirst{},
+	}
+)
+
+// RegisterSelector makes a Selector available by the provided name, to be
+// selected with Config.PeerSelector.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// Selector is nil, this function panics.
+func RegisterSelector(name string, s Selector) {
+	if name == "" {
+		panic("optmem: could not register a Selector with an empty name")
+	}
+	if s == nil {
+		panic("optmem: could not register a nil Selector")
+	}
+
+	selectorsM.Lock()
+	defer selectorsM.Unlock()
+
+	if _, dup := selectors[name]; dup {
+		panic("optmem: RegisterSelector called twice for " + name)
+	}
+
+	selectors[name] = s
+}
+
+// lookupSelector returns the Selector registered by the given name.
+func lookupSelector(name string) (Selector, bool) {
+	selectorsM.RLock()
+	defer selectorsM.RUnlock()
+	s, ok := selectors[name]
+	return s, ok
+}
+
+// peerSelector returns the configured Selector, or nil for Random, which is
+// implemented without a SelectionView.
+func (cfg Config) peerSelector() Selector {
+	s, ok := lookupSelector(cfg.PeerSelector)
+	if !ok {
+		return nil
+	}
+	if _, random := s.(Random); random {
+		return nil
+	}
+	return s
+}
+
+// selectPeers appends peers of l, the list of the given address family of
+// the swarm of ih, for an announce to dst, using the configured Selector.
+// Peers that outlived PeerLifetime are skipped during selection if
+// LazyExpiration is set, so they do not take the place of other peers. The
+// sampled fast paths are only used while no peer of the swarm can have
+// expired, sweeps drop the samples of swarms they remove peers from.
+// The shard of the swarm must be locked by the caller.
+func (s *PeerStore) selectPeers(shard *shard, ih infohash, l *peerList, dst []peer, numWant int, seeder bool, p *peer, af bittorrent.AddressFamily, s0, s1 uint64) []peer {
+	keep := s.peerCutoff(shard.swarms[ih]).keep(s.peerKeeper(l, p, af))
+	if s.selector == nil || p.requiresCrypto() {
+		if keep == nil {
+			if shard.selections != nil && l.numPeers >= int(s.cfg.AnnounceCacheThreshold) && !p.requiresCrypto() {
+				return s.cachedAnnouncePeers(shard, ih, l, af, dst, numWant, seeder, s0, s1)
+			}
+			if l.hot != nil && !p.requiresCrypto() {
+				return l.hot.announcePeers(dst, numWant, seeder, s.cfg.AnnounceSeederShare, s0, s1)
+			}
+			return l.getAnnouncePeers(dst, numWant, seeder, p, s.cfg.AnnounceSeederShare, s0, s1)
+		}
+		return l.getFilteredAnnouncePeers(dst, numWant, seeder, s.cfg.AnnounceSeederShare, s0, s1, keep)
+	}
+
+	start := len(dst)
+	v := SelectionView{pl: l, af: af, dst: dst, s0: s0, s1: s1, keep: keep}
+	s.selector.Select(&v, SelectionRequest{
+		Announcer:   Candidate{p: *p, af: af},
+		Seeder:      seeder,
+		NumWant:     numWant,
+		SeederShare: s.cfg.AnnounceSeederShare,
+	})
+	if len(v.dst)-start > numWant {
+		v.dst = v.dst[:start+numWant]
+	}
+	return v.dst
+}
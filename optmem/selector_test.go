@@ -0,0 +1,93 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectorSubnetAffinity(t *testing.T) {
+	cfg := testConfig
+	cfg.PeerSelector = "subnet_affinity"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	// One leecher in each of 100 /24 networks and a seeder, which must not
+	// be returned to seeders, in the network of the announcing peer.
+	for i := 0; i < 100; i++ {
+		require.Nil(t, ps.PutLeecher(ih, benchPeer(i<<8)))
+	}
+	require.Nil(t, ps.PutSeeder(ih, benchPeer(1)))
+
+	for i := 0; i < 20; i++ {
+		peers, err := ps.AnnouncePeers(ih, true, 5, benchPeer(2))
+		require.Nil(t, err)
+		require.True(t, len(peers) > 1 && len(peers) <= 5)
+		require.Equal(t, benchPeer(0).IP.IP, peers[0].IP.IP)
+
+		seen := make(map[string]bool)
+		for _, p := range peers {
+			require.False(t, seen[p.IP.String()])
+			seen[p.IP.String()] = true
+		}
+	}
+}
+
+func TestSelectorSeederFirst(t *testing.T) {
+	cfg := testConfig
+	cfg.PeerSelector = "seeder_first"
+	cfg.AnnounceSeederShare = 0.5
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+		} else {
+			require.Nil(t, ps.PutLeecher(ih, benchPeer(i)))
+		}
+	}
+
+	peers, err := ps.AnnouncePeers(ih, false, 10, p1)
+	require.Nil(t, err)
+	require.Len(t, peers, 10)
+	for _, p := range peers {
+		require.Equal(t, byte(0), p.IP.IP[3]%2)
+	}
+}
+
+func TestSelectorGeoAware(t *testing.T) {
+	RegisterSelector("test-geo", GeoAware{Locate: func(ip net.IP) string {
+		if ip[0] == 1 {
+			return "eu"
+		}
+		return ""
+	}})
+	require.Panics(t, func() { RegisterSelector("test-geo", Random{}) })
+	require.Panics(t, func() { RegisterSelector("random", Random{}) })
+
+	cfg := testConfig
+	cfg.PeerSelector = "test-geo"
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	far := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(2, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	require.Nil(t, ps.PutLeecher(ih, far))
+	require.Nil(t, ps.PutLeecher(ih, benchPeer(1)))
+
+	peers, err := ps.AnnouncePeers(ih, true, 1, benchPeer(2))
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, benchPeer(1).IP.IP, peers[0].IP.IP)
+}
+
+func TestSelectorUnknown(t *testing.T) {
+	cfg := testConfig
+	cfg.PeerSelector = "does-not-exist"
+	require.Equal(t, "random", cfg.Validate().PeerSelector)
+}
@@ -1,7 +1,6 @@
 package optmem
 
 import (
-	"encoding/binary"
 	"sync"
 	"sync/atomic"
 )
@@ -9,13 +8,18 @@ import (
 type shardContainer struct {
 	shards          []*shard
 	numTorrents     *uint64
+	totals          *peerCounts // sum of the published counts of all shards
 	shardCountShift uint
 	shardLocks      []*sync.RWMutex // mutexes for the shards
+	seed            uint64          // see shardIndex
+	chaos           *chaosInjector  // nil unless chaos mode is enabled
+	contention      *rateMeter      // counts lock acquisitions that had to wait, see LoadReport
+	hooks           *lifecycleHooks // receives the swarm events queued while a shard was locked
 }
 
-func newShardContainer(shardCountBits uint) *shardContainer {
+func newShardContainer(shardCountBits uint, lockFreeScrapes bool, seed uint64) *shardContainer {
 	shardCount := 1 << shardCountBits      // this is the amount of shards of the infohash keyspace we have
-	shardCountShift := 32 - shardCountBits // we need this to quickly find the shard for an infohash
+	shardCountShift := 64 - shardCountBits // we need this to quickly find the shard for an infohash
 	numTorrents := uint64(0)
 
 	toReturn := shardContainer{
@@ -23,24 +27,40 @@ func newShardContainer(shardCountBits uint) *shardContainer {
 		shardCountShift: shardCountShift,
 		shardLocks:      make([]*sync.RWMutex, shardCount),
 		numTorrents:     &numTorrents,
+		totals:          &peerCounts{},
+		seed:            seed,
 	}
 	for i := 0; i < shardCount; i++ {
 		toReturn.shards[i] = &shard{
 			swarms: make(map[infohash]swarm),
+			seed:   bucketSeed(seed),
+		}
+		if lockFreeScrapes {
+			toReturn.shards[i].counters = &sync.Map{}
 		}
 		toReturn.shardLocks[i] = &sync.RWMutex{}
 	}
 	return &toReturn
 }
 
+// shardIndex returns the index of the shard responsible for an infohash.
+// The whole infohash is hashed with the seed, so infohashes can not be
+// crafted to all end up in the same shard without knowing it.
+func (s *shardContainer) shardIndex(hash infohash) int {
+	return int(seededHash(s.seed, hash[:]) >> s.shardCountShift)
+}
+
 func (s *shardContainer) rLockShard(shard int) *shard {
-	s.shardLocks[shard].RLock()
+	if l := s.shardLocks[shard]; !l.TryRLock() {
+		s.contention.inc()
+		l.RLock()
+	}
+	s.chaos.lockAcquired()
 	return s.shards[shard]
 }
 
 func (s *shardContainer) rLockShardByHash(hash infohash) *shard {
-	u := int(binary.BigEndian.Uint32(hash[:8]) >> s.shardCountShift)
-	return s.rLockShard(u)
+	return s.rLockShard(s.shardIndex(hash))
 }
 
 func (s *shardContainer) rUnlockShard(shard int) {
@@ -48,29 +68,81 @@ func (s *shardContainer) rUnlockShard(shard int) {
 }
 
 func (s *shardContainer) rUnlockShardByHash(hash infohash) {
-	u := int(binary.BigEndian.Uint32(hash[:8]) >> s.shardCountShift)
-	s.rUnlockShard(u)
+	s.rUnlockShard(s.shardIndex(hash))
 }
 
 func (s *shardContainer) lockShard(shard int) *shard {
-	s.shardLocks[shard].Lock()
-	return s.shards[shard]
+	if l := s.shardLocks[shard]; !l.TryLock() {
+		s.contention.inc()
+		l.Lock()
+	}
+	return s.locked(shard)
+}
+
+// tryLockShard write-locks a shard, unless that requires waiting.
+func (s *shardContainer) tryLockShard(shard int) (*shard, bool) {
+	if !s.shardLocks[shard].TryLock() {
+		return nil, false
+	}
+	return s.locked(shard), true
+}
+
+// locked returns a shard that was just write-locked, preserving it for a
+// running backup first.
+func (s *shardContainer) locked(shard int) *shard {
+	s.chaos.lockAcquired()
+	sh := s.shards[shard]
+	if sh.backup != nil {
+		sh.backup.preserve(sh)
+		sh.backup = nil
+	}
+	return sh
 }
 
 func (s *shardContainer) lockShardByHash(hash infohash) *shard {
-	u := int(binary.BigEndian.Uint32(hash[:8]) >> s.shardCountShift)
-	s.shardLocks[u].Lock()
-	return s.shards[u]
+	return s.lockShard(s.shardIndex(hash))
 }
 
+// unlockShard unlocks a write-locked shard, publishes the changes to the
+// shard's peer and seeder counts to the store-wide totals and passes the swarm
+// events queued meanwhile to the lifecycle callbacks.
 func (s *shardContainer) unlockShard(shard, numTorrentsDelta int) {
+	sh := s.shards[shard]
+	// Deltas may be negative, unsigned overflow takes care of that.
+	delta := peerCounts{
+		peers4:   sh.counts.peers4 - sh.published.peers4,
+		seeders4: sh.counts.seeders4 - sh.published.seeders4,
+		peers6:   sh.counts.peers6 - sh.published.peers6,
+		seeders6: sh.counts.seeders6 - sh.published.seeders6,
+	}
+	sh.published.store(sh.counts)
+	atomic.AddUint64(&sh.numSwarms, uint64(numTorrentsDelta))
+	if debugChecks {
+		checkShardInvariants(sh, shard)
+	}
 	s.shardLocks[shard].Unlock()
+
 	atomic.AddUint64(s.numTorrents, uint64(numTorrentsDelta))
+	if delta != (peerCounts{}) {
+		atomic.AddUint64(&s.totals.peers4, delta.peers4)
+		atomic.AddUint64(&s.totals.seeders4, delta.seeders4)
+		atomic.AddUint64(&s.totals.peers6, delta.peers6)
+		atomic.AddUint64(&s.totals.seeders6, delta.seeders6)
+	}
+	// Callbacks see the totals including the changes that caused the events.
+	if s.hooks != nil && atomic.LoadInt32(&sh.events.pending) > 0 {
+		s.hooks.deliver(&sh.events)
+	}
 }
 
 func (s *shardContainer) unlockShardByHash(hash infohash, numTorrentsDelta int) {
-	u := int(binary.BigEndian.Uint32(hash[:8]) >> s.shardCountShift)
-	s.unlockShard(u, numTorrentsDelta)
+	s.unlockShard(s.shardIndex(hash), numTorrentsDelta)
+}
+
+// getPeerCounts returns the counts of all shards.
+// The counts are not read atomically, so they might be slightly off.
+func (s *shardContainer) getPeerCounts() peerCounts {
+	return s.totals.load()
 }
 
 func (s *shardContainer) getTorrentCount() uint64 {
@@ -0,0 +1,34 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardIndex(t *testing.T) {
+	sc := newShardContainer(4, false, randomSeed())
+
+	// Infohashes sharing a long prefix are still spread over the shards.
+	seen := make(map[int]bool)
+	var ih infohash
+	for i := 0; i < 256; i++ {
+		ih[19] = byte(i)
+		index := sc.shardIndex(ih)
+		require.True(t, index >= 0 && index < len(sc.shards))
+		require.Equal(t, index, sc.shardIndex(ih))
+		seen[index] = true
+	}
+	require.True(t, len(seen) > len(sc.shards)/2)
+
+	// The assignment depends on the seed only.
+	same := newShardContainer(4, false, sc.seed)
+	other := newShardContainer(4, false, sc.seed+1)
+	differ := false
+	for i := 0; i < 256; i++ {
+		ih[19] = byte(i)
+		require.Equal(t, sc.shardIndex(ih), same.shardIndex(ih))
+		differ = differ || sc.shardIndex(ih) != other.shardIndex(ih)
+	}
+	require.True(t, differ)
+}
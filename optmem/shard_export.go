@@ -0,0 +1,164 @@
+package optmem
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidShard is returned by ExportShard and ImportShard for shard
+// indices out of range, see NumShards.
+var ErrInvalidShard = errors.New("invalid shard index")
+
+// NumShards returns the number of shards of the PeerStore, see
+// ShardCountBits.
+func (s *PeerStore) NumShards() int {
+	return len(s.shards.shards)
+}
+
+// ShardOf returns the index of the shard holding the swarm of the given
+// infohash.
+// Instances only assign infohashes to the same shards if they use the same
+// ShardCountBits and ShardSeed.
+func (s *PeerStore) ShardOf(infoHash bittorrent.InfoHash) int {
+	return s.shards.shardIndex(infohash(s.resolveAlias(infoHash)))
+}
+
+// ExportShard writes the swarms of the i-th shard to w, in the format of
+// ExportSwarms.
+// It is compressed as configured by ExportCompression.
+//
+// The export is a consistent snapshot of the shard, the shard is only locked
+// while it is cloned, see cloneShard.
+// The export can be imported using ImportSwarms, or ImportShard to replace
+// a shard.
+//
+// Returns the number of swarms exported, or ErrInvalidShard if there is no
+// such shard.
+func (s *PeerStore) ExportShard(w io.Writer, i int) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if i < 0 || i >= len(s.shards.shards) {
+		return 0, ErrInvalidShard
+	}
+	if s.anon != nil {
+		return 0, ErrAnonymized
+	}
+
+	cw, flush, err := s.cfg.compressWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	clone := s.shards.cloneShard(i)
+	exported, err := s.writeSections(cw, 1, func(_ int, buf []byte) ([]byte, int, uint64) {
+		var e swarmExporter
+		return e.appendShard(buf, clone, nil)
+	})
+	ferr := flush()
+	if err == nil {
+		err = ferr
+	}
+	return exported, err
+}
+
+// ImportShard replaces the swarms of the i-th shard with the swarms read
+// from r that belong to it, see ShardOf.
+// Swarms of other shards are skipped, so a shard can be rebuilt from an
+// export of the whole store as well, for example if CheckConsistency reports
+// problems for it.
+// Durable download counters of the shard are kept, pins are not, as they
+// are not part of exports.
+//
+// The export is read completely before the shard is changed, and exports
+// written by ExportShard, ExportSwarms or Backup are verified, so a
+// truncated or corrupt export does not change the shard.
+// The shard is locked while the swarms are replaced.
+//
+// Returns the number of swarms imported, ErrInvalidShard if there is no such
+// shard, or ErrReadOnly if the store is read-only.
+func (s *PeerStore) ImportShard(r io.Reader, i int) (int, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	if i < 0 || i >= len(s.shards.shards) {
+		return 0, ErrInvalidShard
+	}
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	swarms, err := readExport(r)
+	if err != nil {
+		return 0, err
+	}
+
+	shard := s.shards.lockShard(i)
+	removed := len(shard.swarms)
+	for ih, sw := range shard.swarms {
+		shard.counts.subSwarm(sw)
+		s.hooks.swarmRemoved(shard, ih, sw)
+		shard.deleteSwarm(ih)
+	}
+
+	imported, created := 0, 0
+	for _, sw := range swarms {
+		if s.shards.shardIndex(sw.ih) != i || len(sw.peers) == 0 {
+			continue
+		}
+		if s.importSwarmLocked(shard, sw.ih, sw.peers[:sw.n4], sw.peers[sw.n4:], sw.tags) {
+			created++
+		}
+		imported++
+	}
+	s.shards.unlockShard(i, created-removed)
+
+	return imported, nil
+}
+
+// readExport reads all swarms of an export.
+// Exports of version 3 or later are verified, see readVerified.
+func readExport(r io.Reader) ([]importedSwarm, error) {
+	br, release, err := decompressReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	header, err := readExportHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	version := header[len(exportMagic)]
+	if version >= 3 {
+		return readVerified(br, header)
+	}
+
+	var swarms []importedSwarm
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidExport
+		}
+		if marker == exportMarkerEnd {
+			return swarms, nil
+		}
+		if marker != exportMarkerSwarm {
+			return nil, ErrInvalidExport
+		}
+
+		var sw importedSwarm
+		sw.ih, sw.n4, sw.peers, sw.tags, err = readSwarmRecord(br, version, nil)
+		if err != nil {
+			return nil, ErrInvalidExport
+		}
+		swarms = append(swarms, sw)
+	}
+}
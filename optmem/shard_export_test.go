@@ -0,0 +1,66 @@
+package optmem
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportShard(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	// Find an infohash of the same shard as ih, and one of another shard.
+	i := ps.ShardOf(ih)
+	var same, other bittorrent.InfoHash
+	for n := 0; same == (bittorrent.InfoHash{}) || other == (bittorrent.InfoHash{}); n++ {
+		candidate := bittorrent.InfoHashFromString(fmt.Sprintf("%020d", n+1))
+		if ps.ShardOf(candidate) == i {
+			same = candidate
+		} else {
+			other = candidate
+		}
+	}
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.PutSeeder(other, p1))
+
+	var buf bytes.Buffer
+	n, err := ps.ExportShard(&buf, i)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	// The shard changes after the export.
+	require.True(t, ps.DeleteSwarm(ih))
+	require.Nil(t, ps.PutSeeder(same, p2))
+	require.Nil(t, ps.PutLeecher(other, p2))
+
+	n, err = ps.ImportShard(&buf, i)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Equal(t, 1, ps.NumLeechers(ih))
+	require.Equal(t, 0, ps.NumSeeders(same))
+	require.Equal(t, 1, ps.NumLeechers(other))
+	require.Equal(t, uint64(2), ps.NumSwarms())
+	require.True(t, ps.CheckConsistency().OK())
+
+	// A corrupt export does not change the shard.
+	buf.Reset()
+	_, err = ps.ExportShard(&buf, i)
+	require.Nil(t, err)
+	_, err = ps.ImportShard(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), i)
+	require.Equal(t, ErrInvalidExport, err)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+
+	_, err = ps.ExportShard(&buf, ps.NumShards())
+	require.Equal(t, ErrInvalidShard, err)
+	_, err = ps.ImportShard(&buf, -1)
+	require.Equal(t, ErrInvalidShard, err)
+
+	require.Nil(t, <-ps.Stop())
+}
@@ -0,0 +1,117 @@
+package optmem
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// loadSnapshot imports the swarms from the persistence driver and replays
+// the changes logged after the snapshot.
+//
+// Encrypted snapshots are decrypted with the configured key, see
+// Config.SnapshotEncryptionKey.
+// If a snapshot of version 3 or later, or an encrypted one, is truncated or
+// corrupt, the store starts empty instead: such snapshots are verified
+// before anything is imported, and the logged changes are skipped, as they
+// only make sense on top of the snapshot.
+// The snapshot is replaced by the next one written.
+// Files that are not snapshots at all are still an error, as they would be
+// overwritten, and so are snapshots encrypted with a different key.
+func (s *PeerStore) loadSnapshot() error {
+	if s.persistence == nil {
+		return nil
+	}
+
+	var swarms, ops int
+	var corrupt bool
+	err := s.persistence.Load(func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		encrypted := isEncrypted(br)
+		if encrypted {
+			dr, err := s.snapshotCipher.decryptReader(br)
+			if err == ErrInvalidExport {
+				corrupt = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			br = bufio.NewReader(dr)
+		} else if s.snapshotCipher != nil {
+			log.Warn("optmem: snapshot is not encrypted, it is encrypted when it is written next")
+		}
+
+		br, release, err := decompressReader(br)
+		if err == ErrInvalidExport && encrypted {
+			corrupt = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer release()
+		header, _ := br.Peek(len(exportMagic) + 1)
+		verified := encrypted || len(header) == len(exportMagic)+1 && string(header[:len(exportMagic)]) == exportMagic && header[len(exportMagic)] >= 3
+		n, err := s.ImportSwarms(br)
+		swarms = n
+		if err == ErrInvalidExport && verified {
+			corrupt = true
+			return nil
+		}
+		return err
+	}, func(op Op) error {
+		if corrupt {
+			return nil
+		}
+		ops++
+		return s.replayOp(op)
+	})
+	if err != nil {
+		return err
+	}
+	if corrupt {
+		log.Error("optmem: snapshot is truncated or corrupt, starting empty", log.Fields{"swarms": swarms})
+		return nil
+	}
+	log.Info("optmem: loaded snapshot", log.Fields{"swarms": swarms, "ops": ops})
+
+	return nil
+}
+
+// writeSnapshot exports all swarms to the persistence driver, encrypted if
+// a key is configured.
+//
+// It is called while stopping, after all goroutines of the store have exited.
+func (s *PeerStore) writeSnapshot() error {
+	if s.persistence == nil {
+		return nil
+	}
+
+	var swarms int
+	err := s.persistence.Save(func(w io.Writer) error {
+		if s.snapshotCipher == nil {
+			n, err := s.exportSwarms(w, nil, ExportSampling{})
+			swarms = n
+			return err
+		}
+
+		ew, err := s.snapshotCipher.encryptWriter(w)
+		if err != nil {
+			return err
+		}
+		n, err := s.exportSwarms(ew, nil, ExportSampling{})
+		swarms = n
+		if err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("optmem: wrote snapshot", log.Fields{"swarms": swarms})
+
+	return nil
+}
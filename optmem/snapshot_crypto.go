@@ -0,0 +1,244 @@
+package optmem
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSnapshotKey is returned if a snapshot can not be loaded because it was
+// encrypted with a different key, or no key is configured.
+var ErrSnapshotKey = errors.New("snapshot is encrypted with a different key")
+
+// An encrypted snapshot consists of a header followed by chunks.
+//
+// The header is the magic string followed by a version byte, the first 8
+// bytes of the SHA-256 of the key and a random 8 byte nonce prefix.
+// Every chunk is a flag byte, which is 1 for the last chunk and 0 otherwise,
+// followed by the length of the sealed chunk as a big-endian uint32 and the
+// chunk sealed with AES-GCM.
+// The nonce of a chunk is the nonce prefix followed by the index of the
+// chunk as a big-endian uint32, the additional data is the header and the
+// flag byte, so reordered, truncated or extended snapshots are detected.
+// The key fingerprint tells a wrong key apart from a corrupt snapshot.
+const (
+	encryptedMagic   = "OPTE"
+	encryptedVersion = 1
+
+	encryptedHeaderLen = len(encryptedMagic) + 1 + 8 + 8
+	encryptedChunkLen  = 64 << 10 // plaintext bytes per chunk
+)
+
+// snapshotCipher encrypts and decrypts snapshots, see
+// Config.SnapshotEncryptionKey.
+type snapshotCipher struct {
+	aead        cipher.AEAD
+	fingerprint [8]byte
+}
+
+// snapshotCipher returns the cipher of the configured snapshot encryption
+// key, or nil if snapshots are not encrypted.
+// A key of the form env:NAME is read from the environment variable NAME.
+func (cfg Config) snapshotCipher() (*snapshotCipher, error) {
+	key := cfg.SnapshotEncryptionKey
+	if strings.HasPrefix(key, "env:") {
+		name := strings.TrimPrefix(key, "env:")
+		var ok bool
+		key, ok = os.LookupEnv(name)
+		if !ok || key == "" {
+			return nil, errors.Errorf("environment variable %s of the snapshot encryption key is not set", name)
+		}
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode snapshot encryption key")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot encryption key")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &snapshotCipher{aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(c.fingerprint[:], sum[:])
+	return c, nil
+}
+
+// encryptWriter encrypts everything written to it in chunks.
+type encryptWriter struct {
+	c      *snapshotCipher
+	w      io.Writer
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	buf    []byte // plaintext of the current chunk
+	out    []byte
+}
+
+// encryptWriter writes the header of an encrypted snapshot to w and returns
+// a writer encrypting to w.
+// It must be closed after the last write, to write the last chunk.
+func (c *snapshotCipher) encryptWriter(w io.Writer) (*encryptWriter, error) {
+	header := append([]byte(encryptedMagic), encryptedVersion)
+	header = append(header, c.fingerprint[:]...)
+	prefix := make([]byte, 8)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to generate nonce")
+	}
+	header = append(header, prefix...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, prefix)
+	return &encryptWriter{c: c, w: w, header: header, nonce: nonce, buf: make([]byte, 0, encryptedChunkLen)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		if len(e.buf) == cap(e.buf) && len(p) > 0 {
+			err := e.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, which may be empty.
+// It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts and writes the current chunk.
+func (e *encryptWriter) seal(last bool) error {
+	flag := byte(0)
+	if last {
+		flag = 1
+	}
+	binary.BigEndian.PutUint32(e.nonce[8:], e.chunk)
+	e.chunk++
+
+	e.out = append(e.out[:0], flag, 0, 0, 0, 0)
+	e.out = e.c.aead.Seal(e.out, e.nonce, e.buf, append(e.header, flag))
+	binary.BigEndian.PutUint32(e.out[1:5], uint32(len(e.out)-5))
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// decryptReader decrypts an encrypted snapshot.
+// Corrupt or truncated snapshots make it return ErrInvalidExport.
+type decryptReader struct {
+	c      *snapshotCipher
+	r      *bufio.Reader
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	last   bool
+	in     []byte
+	buf    []byte // unread plaintext of the current chunk
+}
+
+// isEncrypted returns whether br holds an encrypted snapshot.
+func isEncrypted(br *bufio.Reader) bool {
+	magic, _ := br.Peek(len(encryptedMagic))
+	return string(magic) == encryptedMagic
+}
+
+// decryptReader reads the header of an encrypted snapshot from br and
+// returns a reader of the decrypted snapshot.
+// Returns ErrSnapshotKey if the snapshot was encrypted with a different key.
+func (c *snapshotCipher) decryptReader(br *bufio.Reader) (*decryptReader, error) {
+	header := make([]byte, encryptedHeaderLen)
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic || header[len(encryptedMagic)] != encryptedVersion {
+		return nil, ErrInvalidExport
+	}
+	if c == nil || !bytes.Equal(header[len(encryptedMagic)+1:len(encryptedMagic)+9], c.fingerprint[:]) {
+		return nil, ErrSnapshotKey
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, header[len(encryptedMagic)+9:])
+	return &decryptReader{c: c, r: br, header: header, nonce: nonce}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		err := d.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	var chunkHeader [5]byte
+	_, err := io.ReadFull(d.r, chunkHeader[:])
+	if err != nil {
+		return ErrInvalidExport
+	}
+	flag := chunkHeader[0]
+	n := binary.BigEndian.Uint32(chunkHeader[1:])
+	if flag > 1 || n > encryptedChunkLen+uint32(d.c.aead.Overhead()) {
+		return ErrInvalidExport
+	}
+	if cap(d.in) < int(n) {
+		d.in = make([]byte, n)
+	}
+	d.in = d.in[:n]
+	_, err = io.ReadFull(d.r, d.in)
+	if err != nil {
+		return ErrInvalidExport
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[8:], d.chunk)
+	d.chunk++
+	d.buf, err = d.c.aead.Open(d.in[:0], d.nonce, d.in, append(d.header, flag))
+	if err != nil {
+		return ErrInvalidExport
+	}
+	if flag == 1 {
+		d.last = true
+		if _, err = d.r.Peek(1); err != io.EOF {
+			return ErrInvalidExport
+		}
+	}
+	return nil
+}
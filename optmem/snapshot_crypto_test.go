@@ -0,0 +1,151 @@
+package optmem
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSnapshotKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	otherSnapshotKey = "0f0e0d0c0b0a09080706050403020100"
+)
+
+func TestSnapshotEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	cfg.SnapshotEncryptionKey = testSnapshotKey
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		require.Nil(t, ps.PutSeeder(ih, benchPeer(i)))
+	}
+	require.Nil(t, <-ps.Stop())
+
+	snapshot, err := ioutil.ReadFile(cfg.SnapshotPath)
+	require.Nil(t, err)
+	require.True(t, bytes.HasPrefix(snapshot, []byte(encryptedMagic)))
+	require.False(t, bytes.Contains(snapshot, []byte(exportMagic)))
+	require.False(t, bytes.Contains(snapshot, ih[:]))
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 5000, ps.NumSeeders(ih))
+	require.Nil(t, <-ps.Stop())
+
+	// A different key fails the start.
+	other := cfg
+	other.SnapshotEncryptionKey = otherSnapshotKey
+	_, err = New(other)
+	require.Equal(t, ErrSnapshotKey, errors.Cause(err))
+
+	// So does no key.
+	other.SnapshotEncryptionKey = ""
+	_, err = New(other)
+	require.NotNil(t, err)
+
+	// A truncated snapshot is detected and the store starts empty.
+	snapshot, err = ioutil.ReadFile(cfg.SnapshotPath)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(cfg.SnapshotPath, snapshot[:len(snapshot)-100], 0600))
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestSnapshotEncryptionKeyFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// An unencrypted snapshot is loaded and encrypted when it is written.
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, <-ps.Stop())
+
+	cfg.SnapshotEncryptionKey = "env:OPTMEM_TEST_SNAPSHOT_KEY"
+	_, err = New(cfg)
+	require.NotNil(t, err)
+
+	require.Nil(t, os.Setenv("OPTMEM_TEST_SNAPSHOT_KEY", otherSnapshotKey))
+	defer os.Unsetenv("OPTMEM_TEST_SNAPSHOT_KEY")
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Nil(t, <-ps.Stop())
+
+	snapshot, err := ioutil.ReadFile(cfg.SnapshotPath)
+	require.Nil(t, err)
+	require.True(t, bytes.HasPrefix(snapshot, []byte(encryptedMagic)))
+
+	cfg.SnapshotEncryptionKey = otherSnapshotKey
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestSnapshotEncryptionInvalidKey(t *testing.T) {
+	for _, key := range []string{"zz", "0001020304"} {
+		cfg := testConfig
+		cfg.SnapshotEncryptionKey = key
+		_, err := New(cfg)
+		require.NotNil(t, err, key)
+	}
+}
+
+func TestEncryptedChunks(t *testing.T) {
+	cfg := testConfig
+	cfg.SnapshotEncryptionKey = testSnapshotKey
+	c, err := cfg.snapshotCipher()
+	require.Nil(t, err)
+
+	plain := bytes.Repeat([]byte("0123456789abcdef"), encryptedChunkLen/8)
+	var buf bytes.Buffer
+	ew, err := c.encryptWriter(&buf)
+	require.Nil(t, err)
+	_, err = ew.Write(plain)
+	require.Nil(t, err)
+	require.Nil(t, ew.Close())
+
+	decrypt := func(b []byte) ([]byte, error) {
+		dr, err := c.decryptReader(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(dr)
+	}
+	got, err := decrypt(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, plain, got)
+
+	// Swapping the two chunks of equal length is detected.
+	sealed := encryptedChunkLen + c.aead.Overhead() + 5
+	encrypted := buf.Bytes()
+	require.Equal(t, encryptedHeaderLen+2*sealed, len(encrypted))
+	swapped := append([]byte(nil), encrypted[:encryptedHeaderLen]...)
+	swapped = append(swapped, encrypted[encryptedHeaderLen+sealed:]...)
+	swapped = append(swapped, encrypted[encryptedHeaderLen:encryptedHeaderLen+sealed]...)
+	_, err = decrypt(swapped)
+	require.Equal(t, ErrInvalidExport, err)
+
+	// So is dropping the last chunk, and appending data.
+	_, err = decrypt(encrypted[:encryptedHeaderLen+sealed])
+	require.Equal(t, ErrInvalidExport, err)
+	_, err = decrypt(append(append([]byte(nil), encrypted...), 0))
+	require.Equal(t, ErrInvalidExport, err)
+}
@@ -0,0 +1,97 @@
+package optmem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.SetSwarmTags(ih, []string{"persistent"}))
+	require.Nil(t, <-ps.Stop())
+
+	_, err = os.Stat(cfg.SnapshotPath + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	require.Equal(t, 2, ps.NumSeeders(ih)+ps.NumLeechers(ih))
+	require.Equal(t, []string{"persistent"}, ps.SwarmTags(ih))
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestSnapshotBatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	cfg.BatchQueueSize = 16
+	cfg.BatchFlushInterval = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	// Queued puts are applied before the snapshot is written.
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, <-ps.Stop())
+
+	cfg.BatchQueueSize = 0
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, 1, ps.NumSeeders(ih))
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	require.Nil(t, ioutil.WriteFile(cfg.SnapshotPath, []byte("garbage"), 0600))
+
+	_, err = New(cfg)
+	require.NotNil(t, err)
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optmem")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig
+	cfg.SnapshotPath = filepath.Join(dir, "snapshot")
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, <-ps.Stop())
+
+	snapshot, err := ioutil.ReadFile(cfg.SnapshotPath)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(cfg.SnapshotPath, snapshot[:len(snapshot)-1], 0600))
+
+	// A truncated snapshot is detected and the store starts empty.
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	require.Nil(t, <-ps.Stop())
+}
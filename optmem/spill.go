@@ -0,0 +1,282 @@
+package optmem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ColdStorage is an embedded key-value store that idle swarms are spilled to,
+// for example a wrapper around Badger or Bolt, see BoltColdStorage.
+//
+// Implementations must be safe for concurrent use.
+// They are called without holding shard locks, but garbage collection waits
+// for puts and requests for spilled swarms wait for gets, so they should be
+// fast.
+// Swarms are only removed from the ColdStorage when they are accessed again,
+// implementations should therefore expire entries that were not read for
+// longer than the peer lifetime.
+// If the ColdStorage has a method
+//
+//	Expire(cutoff time.Time) (int, error)
+//
+// garbage collection calls it with the cutoff of the peer lifetime to remove
+// the entries put before it, whose peers have all expired.
+type ColdStorage interface {
+	// Get returns the value stored for an infohash, or nil if there is none.
+	Get(infoHash bittorrent.InfoHash) ([]byte, error)
+
+	// Put stores the value for an infohash.
+	// The value must be copied if it is retained.
+	Put(infoHash bittorrent.InfoHash, value []byte) error
+
+	// Delete removes the value stored for an infohash.
+	Delete(infoHash bittorrent.InfoHash) error
+}
+
+// coldStorageExpirer is a ColdStorage that removes old entries itself when
+// asked to, see ColdStorage.
+type coldStorageExpirer interface {
+	Expire(cutoff time.Time) (int, error)
+}
+
+// coldStorageHolder wraps a ColdStorage to store it in an atomic.Value.
+type coldStorageHolder struct {
+	ColdStorage
+}
+
+// SetColdStorage sets the ColdStorage that swarms without announces for the
+// configured SpillAfter duration are moved to during garbage collection.
+// Spilled swarms are moved back into memory when they are accessed.
+//
+// Swarms in the ColdStorage are not included in counts like NumSwarms,
+// NumTotalPeers or full scrapes.
+// A nil ColdStorage disables spilling, swarms that were already spilled stay
+// in the old ColdStorage.
+func (s *PeerStore) SetColdStorage(cs ColdStorage) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	s.cold.Store(coldStorageHolder{cs})
+}
+
+// coldStorage returns the ColdStorage, or nil if none is set.
+func (s *PeerStore) coldStorage() ColdStorage {
+	h, _ := s.cold.Load().(coldStorageHolder)
+	return h.ColdStorage
+}
+
+// idle returns whether the swarm has peers and none of them announced within
+// the last minAge seconds before now.
+func (sw swarm) idle(now, minAge uint16) bool {
+	n := 0
+	for _, pl := range [2]*peerList{sw.peers4, sw.peers6} {
+		if pl == nil {
+			continue
+		}
+		if pl.countOlderThan(now, minAge) != pl.numPeers {
+			return false
+		}
+		n += pl.numPeers
+	}
+	return n > 0
+}
+
+// coldVersion is the version of the format swarms are spilled in.
+// It consists of the version byte, the download counters of the IPv4 and IPv6
+// peers as big-endian uint64s and a swarm record of the export format.
+const coldVersion = 1
+
+// pendingSpill is a swarm that was removed from its shard, but is not written
+// to the ColdStorage yet.
+type pendingSpill struct {
+	mu    sync.Mutex
+	value []byte // nil once written or faulted in
+}
+
+// spill is a swarm spilled by garbage collection.
+type spill struct {
+	ih      infohash
+	pending *pendingSpill
+}
+
+// encodeSpilledSwarm encodes a swarm in the cold storage format.
+// The shard must be locked by the caller.
+func encodeSpilledSwarm(shard *shard, ih infohash, sw swarm) []byte {
+	var downloads [16]byte
+	if sw.peers4 != nil {
+		binary.BigEndian.PutUint64(downloads[:8], sw.peers4.numDownloads)
+	}
+	if sw.peers6 != nil {
+		binary.BigEndian.PutUint64(downloads[8:], sw.peers6.numDownloads)
+	}
+
+	buf := append([]byte{coldVersion}, downloads[:]...)
+	e := swarmExporter{}
+	return e.appendSwarmRecord(buf, ih, sw, shard.tags[ih])
+}
+
+// beginSpill encodes a swarm to be spilled and registers it as pending, so
+// that it can be faulted in before it is written.
+// The shard must be write-locked by the caller, which removes the swarm and
+// passes the spill to finishSpills once the shard is unlocked.
+func (s *PeerStore) beginSpill(shard *shard, ih infohash, sw swarm) spill {
+	p := &pendingSpill{value: encodeSpilledSwarm(shard, ih, sw)}
+	s.spillMu.Lock()
+	if s.spilling == nil {
+		s.spilling = make(map[infohash]*pendingSpill)
+	}
+	s.spilling[ih] = p
+	s.spillMu.Unlock()
+	return spill{ih: ih, pending: p}
+}
+
+// finishSpills writes spilled swarms to the ColdStorage.
+// Swarms that can not be written are moved back into memory.
+// Returns the number of swarms written.
+// The shard must not be locked.
+func (s *PeerStore) finishSpills(cs ColdStorage, spills []spill) int {
+	written := 0
+	for _, sp := range spills {
+		var failed []byte
+		sp.pending.mu.Lock()
+		if sp.pending.value != nil {
+			err := cs.Put(bittorrent.InfoHash(sp.ih), sp.pending.value)
+			if err != nil {
+				log.Error("optmem: unable to spill swarm", log.Fields{"infoHash": bittorrent.InfoHash(sp.ih), "error": err})
+				failed = sp.pending.value
+			} else {
+				written++
+			}
+			sp.pending.value = nil
+		}
+		sp.pending.mu.Unlock()
+
+		s.spillMu.Lock()
+		if s.spilling[sp.ih] == sp.pending {
+			delete(s.spilling, sp.ih)
+		}
+		s.spillMu.Unlock()
+
+		if failed != nil && !s.restoreSwarm(failed) {
+			log.Error("optmem: dropping invalid spilled swarm", log.Fields{"infoHash": bittorrent.InfoHash(sp.ih)})
+		}
+	}
+	return written
+}
+
+// takePendingSpill returns the encoded swarm of an infohash that is being
+// spilled, or nil if it is not pending.
+// Waits for a write to the ColdStorage in progress, after which the swarm has
+// to be read from it.
+func (s *PeerStore) takePendingSpill(ih infohash) []byte {
+	s.spillMu.Lock()
+	p := s.spilling[ih]
+	s.spillMu.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	value := p.value
+	p.value = nil
+	p.mu.Unlock()
+	return value
+}
+
+// faultIn moves the swarm of an infohash back from the ColdStorage, if it was
+// spilled.
+func (s *PeerStore) faultIn(ih infohash) {
+	cs := s.coldStorage()
+	if cs == nil {
+		return
+	}
+
+	shard := s.shards.rLockShardByHash(ih)
+	_, ok := shard.swarms[ih]
+	s.shards.rUnlockShardByHash(ih)
+	if ok {
+		return
+	}
+
+	if value := s.takePendingSpill(ih); value != nil {
+		if !s.restoreSwarm(value) {
+			log.Error("optmem: dropping invalid spilled swarm", log.Fields{"infoHash": bittorrent.InfoHash(ih)})
+		}
+		return
+	}
+
+	value, err := cs.Get(bittorrent.InfoHash(ih))
+	if err != nil {
+		log.Error("optmem: unable to read spilled swarm", log.Fields{"infoHash": bittorrent.InfoHash(ih), "error": err})
+		return
+	}
+	if value == nil {
+		return
+	}
+
+	if !s.restoreSwarm(value) {
+		log.Error("optmem: dropping invalid spilled swarm", log.Fields{"infoHash": bittorrent.InfoHash(ih)})
+	}
+	err = cs.Delete(bittorrent.InfoHash(ih))
+	if err != nil {
+		log.Error("optmem: unable to delete spilled swarm", log.Fields{"infoHash": bittorrent.InfoHash(ih), "error": err})
+	}
+}
+
+// restoreSwarm adds a spilled swarm to its shard.
+// Peers that were added while the swarm was spilled are kept.
+// Returns false if the value is invalid.
+func (s *PeerStore) restoreSwarm(value []byte) bool {
+	if len(value) < 18 || value[0] != coldVersion || value[17] != exportMarkerSwarm {
+		return false
+	}
+	downloads4 := binary.BigEndian.Uint64(value[1:9])
+	downloads6 := binary.BigEndian.Uint64(value[9:17])
+
+	br := bufio.NewReader(bytes.NewReader(value[18:]))
+	ih, n4, peers, tags, err := readSwarmRecord(br, exportVersion, nil)
+	if err != nil || len(peers) == 0 {
+		return false
+	}
+
+	shard := s.shards.lockShardByHash(ih)
+	_, existed := shard.swarms[ih]
+	for i := range peers {
+		af := bittorrent.IPv6
+		if i < n4 {
+			af = bittorrent.IPv4
+		}
+		// Don't overwrite peers that announced while the swarm was spilled.
+		if pl := shard.swarms[ih].list(af); pl != nil && pl.hasPeer(&peers[i]) {
+			continue
+		}
+		putPeerLocked(shard, ih, &peers[i], af, false)
+	}
+	sw := shard.swarms[ih]
+	if sw.peers4 != nil {
+		sw.peers4.numDownloads += downloads4
+	}
+	if sw.peers6 != nil {
+		sw.peers6.numDownloads += downloads6
+	}
+	shard.setSwarm(ih, sw)
+	if len(tags) > 0 && len(shard.tags[ih]) == 0 {
+		shard.setTags(ih, tags)
+	}
+
+	if existed {
+		s.shards.unlockShardByHash(ih, 0)
+	} else {
+		s.shards.unlockShardByHash(ih, 1)
+	}
+	return true
+}
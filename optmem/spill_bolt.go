@@ -0,0 +1,123 @@
+package optmem
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltSwarmBucket is the Bolt bucket spilled swarms are stored in.
+var boltSwarmBucket = []byte("swarms")
+
+// BoltColdStorage is a ColdStorage backed by a Bolt database file, see
+// ColdStoragePath.
+//
+// Every value is prefixed with the unix time it was put at, so that Expire
+// can remove swarms that stayed spilled for longer than the peer lifetime.
+type BoltColdStorage struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+var _ ColdStorage = &BoltColdStorage{}
+
+// OpenBoltColdStorage opens the Bolt database at path, creating it if it does
+// not exist.
+// Swarms spilled before the database was last closed are kept, so they can be
+// faulted in after a restart.
+// The database is locked until Close is called.
+func OpenBoltColdStorage(path string) (*BoltColdStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSwarmBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltColdStorage{db: db, now: time.Now}, nil
+}
+
+// Get implements the Get method of a ColdStorage.
+func (b *BoltColdStorage) Get(infoHash bittorrent.InfoHash) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltSwarmBucket).Get(infoHash[:])
+		if len(v) > 8 {
+			// Values are only valid during the transaction.
+			value = append([]byte(nil), v[8:]...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Put implements the Put method of a ColdStorage.
+func (b *BoltColdStorage) Put(infoHash bittorrent.InfoHash, value []byte) error {
+	v := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(v, uint64(b.now().Unix()))
+	v = append(v, value...)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSwarmBucket).Put(infoHash[:], v)
+	})
+}
+
+// Delete implements the Delete method of a ColdStorage.
+func (b *BoltColdStorage) Delete(infoHash bittorrent.InfoHash) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSwarmBucket).Delete(infoHash[:])
+	})
+}
+
+// Expire removes the swarms put before cutoff.
+// It runs in linear time in regards to the number of spilled swarms.
+// Returns the number of swarms removed.
+func (b *BoltColdStorage) Expire(cutoff time.Time) (int, error) {
+	removed := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltSwarmBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(v) <= 8 || int64(binary.BigEndian.Uint64(v)) < cutoff.Unix() {
+				// Keys are only valid during the transaction.
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
+
+// Len returns the number of spilled swarms.
+func (b *BoltColdStorage) Len() (int, error) {
+	n := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltSwarmBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Close closes the database.
+func (b *BoltColdStorage) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,197 @@
+package optmem
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+type mapColdStorage struct {
+	sync.Mutex
+	m map[bittorrent.InfoHash][]byte
+}
+
+func (cs *mapColdStorage) Get(infoHash bittorrent.InfoHash) ([]byte, error) {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.m[infoHash], nil
+}
+
+func (cs *mapColdStorage) Put(infoHash bittorrent.InfoHash, value []byte) error {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.m[infoHash] = append([]byte(nil), value...)
+	return nil
+}
+
+func (cs *mapColdStorage) Delete(infoHash bittorrent.InfoHash) error {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(cs.m, infoHash)
+	return nil
+}
+
+// agePeers moves the announce times of all peers of a swarm back by d.
+func agePeers(ps *PeerStore, infoHash bittorrent.InfoHash, d time.Duration) {
+	ih := infohash(infoHash)
+	shard := ps.shards.lockShardByHash(ih)
+	sw := shard.swarms[ih]
+	for _, pl := range []*peerList{sw.peers4, sw.peers6} {
+		if pl == nil {
+			continue
+		}
+		for _, b := range pl.peerBuckets {
+			for i := range b {
+				b[i].setPeerTime(b[i].peerTime() - uint16(d/time.Second))
+			}
+		}
+	}
+	ps.shards.unlockShardByHash(ih, 0)
+}
+
+func TestSpillSwarms(t *testing.T) {
+	cfg := testConfig
+	cfg.SpillAfter = time.Minute
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	cs := &mapColdStorage{m: make(map[bittorrent.InfoHash][]byte)}
+	ps.SetColdStorage(cs)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	require.Nil(t, ps.SetSwarmTags(ih, []string{"cold"}))
+
+	// Active swarms are not spilled.
+	ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	require.Len(t, cs.m, 0)
+
+	agePeers(ps, ih, 2*time.Minute)
+	ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders+leechers)
+	require.Len(t, cs.m, 1)
+
+	// Accessing the swarm moves it back into memory.
+	stats := ps.ScrapeSwarmBoth(ih)
+	require.Equal(t, uint32(1), stats.IPv4.Complete)
+	require.Equal(t, uint32(1), stats.IPv4.Snatches)
+	require.Equal(t, uint32(1), stats.IPv6.Incomplete)
+	require.Equal(t, []string{"cold"}, stats.Tags)
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	seeders, leechers = ps.NumTotalPeers()
+	require.Equal(t, uint64(1), seeders)
+	require.Equal(t, uint64(1), leechers)
+	require.Len(t, cs.m, 0)
+
+	// Spilled swarms are moved back before peers are stored.
+	ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	require.Len(t, cs.m, 1)
+	require.Nil(t, ps.PutSeeder(ih, p3))
+	require.Equal(t, 2, ps.NumSeeders(ih))
+	require.Equal(t, 0, ps.NumLeechers(ih))
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}
+
+// callbackColdStorage is a mapColdStorage that calls a function before puts.
+type callbackColdStorage struct {
+	mapColdStorage
+	beforePut func() error
+}
+
+func (cs *callbackColdStorage) Put(infoHash bittorrent.InfoHash, value []byte) error {
+	err := cs.beforePut()
+	if err != nil {
+		return err
+	}
+	return cs.mapColdStorage.Put(infoHash, value)
+}
+
+func TestSpillOutsideShardLock(t *testing.T) {
+	cfg := testConfig
+	cfg.SpillAfter = time.Minute
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	var putErr error
+	cs := &callbackColdStorage{mapColdStorage: mapColdStorage{m: make(map[bittorrent.InfoHash][]byte)}}
+	cs.beforePut = func() error {
+		// The shard is unlocked and the swarm is gone from it.
+		shard := ps.shards.lockShardByHash(infohash(ih))
+		_, ok := shard.swarms[infohash(ih)]
+		ps.shards.unlockShardByHash(infohash(ih), 0)
+		require.False(t, ok)
+		return putErr
+	}
+	ps.SetColdStorage(cs)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	agePeers(ps, ih, 2*time.Minute)
+	stats := ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	require.Equal(t, 1, stats.SwarmsSpilled)
+	require.Len(t, cs.m, 1)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+	require.Len(t, cs.m, 0)
+
+	// Swarms that can not be written are moved back into memory.
+	putErr = errors.New("disk full")
+	agePeers(ps, ih, 2*time.Minute)
+	stats = ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	require.Equal(t, 0, stats.SwarmsSpilled)
+	require.Len(t, cs.m, 0)
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	require.Equal(t, 1, ps.NumLeechers(ih))
+
+	require.Nil(t, <-ps.Stop())
+}
+
+func TestBoltColdStorage(t *testing.T) {
+	cfg := testConfig
+	cfg.SpillAfter = time.Minute
+	cfg.ColdStoragePath = filepath.Join(t.TempDir(), "cold.db")
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.GraduateLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	agePeers(ps, ih, 2*time.Minute)
+	ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	n, err := ps.boltCold.Len()
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	require.Nil(t, <-ps.Stop())
+
+	// Spilled swarms survive restarts.
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	stats := ps.ScrapeSwarmBoth(ih)
+	require.Equal(t, uint32(1), stats.IPv4.Complete)
+	require.Equal(t, uint32(1), stats.IPv4.Snatches)
+	require.Equal(t, uint32(1), stats.IPv6.Incomplete)
+	n, err = ps.boltCold.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	// Swarms spilled for longer than the peer lifetime are expired.
+	agePeers(ps, ih, 2*time.Minute)
+	ps.collectGarbage(time.Now().Add(-cfg.PeerLifetime))
+	n, err = ps.boltCold.Len()
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	ps.collectGarbage(time.Now().Add(time.Second))
+	n, err = ps.boltCold.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	require.Nil(t, <-ps.Stop())
+}
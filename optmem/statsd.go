@@ -0,0 +1,114 @@
+package optmem
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// maxStatsDPacketSize is the maximum size of the UDP packets sent to StatsD,
+// small enough to not be fragmented on common networks.
+const maxStatsDPacketSize = 1432
+
+// StatsDConfig configures reporting metrics to a StatsD server.
+type StatsDConfig struct {
+	// Addr is the UDP address of the StatsD server.
+	// An empty address disables StatsD.
+	Addr string `yaml:"addr"`
+
+	// Prefix is prepended to the names of all metrics, followed by a dot.
+	Prefix string `yaml:"prefix"`
+}
+
+// statsDReporter is a MetricsReporter sending metrics to StatsD.
+// Counters are aggregated in memory and sent along with the gauges whenever
+// the reporter is flushed, so counting is cheap.
+type statsDReporter struct {
+	conn   net.Conn
+	prefix string
+
+	counters sync.Map // name -> *int64
+	mu       sync.Mutex
+	gauges   map[string]float64
+}
+
+var _ MetricsReporter = &statsDReporter{}
+
+func newStatsDReporter(cfg StatsDConfig) (*statsDReporter, error) {
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &statsDReporter{conn: conn, gauges: make(map[string]float64)}
+	if cfg.Prefix != "" {
+		r.prefix = cfg.Prefix + "."
+	}
+	return r, nil
+}
+
+// Count implements MetricsReporter.
+func (r *statsDReporter) Count(name string, delta int64) {
+	v, ok := r.counters.Load(name)
+	if !ok {
+		v, _ = r.counters.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), delta)
+}
+
+// Gauge implements MetricsReporter.
+func (r *statsDReporter) Gauge(name string, value float64) {
+	r.mu.Lock()
+	r.gauges[name] = value
+	r.mu.Unlock()
+}
+
+// flush sends the counts since the last flush and the gauges set since then.
+func (r *statsDReporter) flush() {
+	var buf, packet bytes.Buffer
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		_, err := r.conn.Write(packet.Bytes())
+		if err != nil {
+			log.Debug("optmem: failed to send metrics to StatsD", log.Fields{"error": err})
+		}
+		packet.Reset()
+	}
+	add := func() {
+		if packet.Len()+buf.Len() > maxStatsDPacketSize {
+			send()
+		}
+		packet.Write(buf.Bytes())
+		buf.Reset()
+	}
+
+	r.counters.Range(func(k, v interface{}) bool {
+		delta := atomic.SwapInt64(v.(*int64), 0)
+		if delta != 0 {
+			buf.WriteString(r.prefix + k.(string) + ":" + strconv.FormatInt(delta, 10) + "|c\n")
+			add()
+		}
+		return true
+	})
+
+	r.mu.Lock()
+	for name, value := range r.gauges {
+		buf.WriteString(r.prefix + name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|g\n")
+		add()
+	}
+	r.gauges = make(map[string]float64, len(r.gauges))
+	r.mu.Unlock()
+
+	send()
+}
+
+// Close flushes the reporter and closes its connection.
+func (r *statsDReporter) Close() error {
+	r.flush()
+	return r.conn.Close()
+}
@@ -0,0 +1,109 @@
+package optmem
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsDReporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	cfg := testConfig
+	cfg.StatsD = StatsDConfig{Addr: conn.LocalAddr().String(), Prefix: "tracker"}
+	cfg.MetricsInterval = time.Hour
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	ps.WithNamespace("private")
+	ps.reportGauges()
+
+	lines := readStatsD(t, conn)
+	require.Contains(t, lines, "tracker.puts.inserted.ipv4:1|c")
+	require.Contains(t, lines, "tracker.puts.updated.ipv4:1|c")
+	require.Contains(t, lines, "tracker.operations.scrape.ipv4:1|c")
+	require.Contains(t, lines, "tracker.swarms:1|g")
+	require.Contains(t, lines, "tracker.seeders.ipv4:1|g")
+	require.Contains(t, lines, "tracker.namespaces.private.swarms:0|g")
+
+	// Counters are reset by flushes.
+	ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Nil(t, <-ps.Stop())
+	lines = readStatsD(t, conn)
+	require.Equal(t, []string{"tracker.operations.scrape.ipv4:1|c"}, lines)
+}
+
+// readStatsD reads the lines of the StatsD packets sent to conn until none
+// arrive for a while.
+func readStatsD(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, maxStatsDPacketSize)
+	for {
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		require.True(t, n <= maxStatsDPacketSize)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+type recordingReporter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	gauges map[string]float64
+}
+
+func (r *recordingReporter) Count(name string, delta int64) {
+	r.mu.Lock()
+	r.counts[name] += delta
+	r.mu.Unlock()
+}
+
+func (r *recordingReporter) Gauge(name string, value float64) {
+	r.mu.Lock()
+	r.gauges[name] = value
+	r.mu.Unlock()
+}
+
+func TestMetricsReporter(t *testing.T) {
+	r := &recordingReporter{counts: make(map[string]int64), gauges: make(map[string]float64)}
+	cfg := testConfig
+	cfg.MetricsReporter = r
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutLeecher(ih, p3))
+	_, err = ps.AnnouncePeers(ih, false, 10, p3)
+	require.Nil(t, err)
+	ps.reportGauges()
+	require.Nil(t, <-ps.Stop())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	require.Equal(t, int64(1), r.counts["puts.inserted.ipv6"])
+	require.Equal(t, int64(1), r.counts["operations.announce.ipv6"])
+	require.Equal(t, int64(10), r.counts["numwant.requested"])
+	require.Equal(t, float64(1), r.gauges["leechers.ipv6"])
+
+	// Stopped stores no longer receive counters.
+	ps2, err := New(testConfig)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps2.Stop()) }()
+	require.Nil(t, ps2.PutLeecher(ih, p3))
+	require.Equal(t, int64(1), r.counts["puts.inserted.ipv6"])
+}
@@ -0,0 +1,100 @@
+package optmem
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// BackgroundError describes a panic recovered in a background goroutine of
+// the PeerStore.
+type BackgroundError struct {
+	// Goroutine is the name of the goroutine that panicked, for example
+	// "gc".
+	Goroutine string
+
+	// Panic is the formatted value the goroutine panicked with.
+	Panic string
+
+	// Time is the time the panic was recovered.
+	Time time.Time
+}
+
+// Backoff between restarts of a background goroutine that panicked.
+// The backoff doubles with every panic and is reset once the goroutine ran
+// for longer than maxRestartBackoff.
+const (
+	minRestartBackoff = 100 * time.Millisecond
+	maxRestartBackoff = time.Minute
+)
+
+// supervise runs f, a background goroutine with the given name, until it
+// returns, which it must do once the store is closed.
+// If f panics, the panic is logged and recorded and f is restarted with
+// exponential backoff.
+// It must be started with s.wg incremented.
+func (s *PeerStore) supervise(name string, f func()) {
+	defer s.wg.Done()
+	backoff := minRestartBackoff
+	for {
+		started := s.now()
+		if !s.runRecovered(name, f) {
+			return
+		}
+		if s.now().Sub(started) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+
+		select {
+		case <-s.closed:
+			return
+		case <-s.after(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// runRecovered runs f and returns whether it panicked.
+func (s *PeerStore) runRecovered(name string, f func()) (panicked bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		panicked = true
+
+		e := BackgroundError{Goroutine: name, Panic: fmt.Sprint(r), Time: s.now()}
+		s.lastPanic.Store(e)
+		promBackgroundPanics.WithLabelValues(name).Inc()
+		metricsReporters.count("background_panics."+name, 1)
+		log.Error("optmem: recovered panic in background goroutine", log.Fields{
+			"namespace": s.name,
+			"goroutine": name,
+			"panic":     e.Panic,
+			"stack":     string(debug.Stack()),
+		})
+	}()
+
+	f()
+	return false
+}
+
+// LastBackgroundError returns the last panic recovered in a background
+// goroutine, if any.
+// The garbage collection goroutine and the garbage collection watchdog are
+// restarted after a panic.
+func (s *PeerStore) LastBackgroundError() (BackgroundError, bool) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	e, ok := s.lastPanic.Load().(BackgroundError)
+	return e, ok
+}
@@ -0,0 +1,57 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervise(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	_, ok := ps.LastBackgroundError()
+	require.False(t, ok)
+
+	runs := 0
+	running := make(chan struct{})
+	ps.wg.Add(1)
+	go ps.supervise("test", func() {
+		runs++
+		if runs < 3 {
+			panic("boom")
+		}
+		close(running)
+		<-ps.closed
+	})
+
+	select {
+	case <-running:
+	case <-time.After(5 * time.Second):
+		t.Fatal("goroutine was not restarted")
+	}
+	e, ok := ps.LastBackgroundError()
+	require.True(t, ok)
+	require.Equal(t, "test", e.Goroutine)
+	require.Equal(t, "boom", e.Panic)
+
+	require.Nil(t, <-ps.Stop())
+	require.Equal(t, 3, runs)
+}
+
+func TestCollectGarbagePanicUnlocks(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ps.OnSwarmRemoved(func(bittorrent.InfoHash, SwarmStats) { panic("boom") })
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Panics(t, func() { ps.collectGarbage(time.Now()) })
+
+	// The shard is consistent and usable again.
+	require.True(t, ps.CheckConsistency().OK())
+	require.Nil(t, ps.PutSeeder(ih, p2))
+
+	require.Nil(t, <-ps.Stop())
+}
@@ -0,0 +1,164 @@
+package optmem
+
+import (
+	"sort"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/pkg/errors"
+)
+
+// Limits for swarm tags.
+const (
+	maxTagsPerSwarm = 16
+	maxTagLength    = 64
+)
+
+// ErrInvalidTags is returned if too many tags, or tags that are empty or too
+// long, are set for a swarm.
+var ErrInvalidTags = errors.New("invalid tags")
+
+// validTags checks the given tags against the limits.
+func validTags(tags []string) bool {
+	if len(tags) > maxTagsPerSwarm {
+		return false
+	}
+	for _, tag := range tags {
+		if len(tag) == 0 || len(tag) > maxTagLength {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeTags returns a sorted copy of the tags without duplicates, or nil
+// if there are none.
+func normalizeTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	normalized := append([]string(nil), tags...)
+	sort.Strings(normalized)
+	j := 0
+	for i := range normalized {
+		if i > 0 && normalized[i] == normalized[j-1] {
+			continue
+		}
+		normalized[j] = normalized[i]
+		j++
+	}
+	return normalized[:j]
+}
+
+// setTags sets the tags of a swarm, removing them if tags is empty.
+// The tags must be normalized.
+// The shard must be write-locked by the caller.
+func (s *shard) setTags(ih infohash, tags []string) {
+	if len(tags) == 0 {
+		delete(s.tags, ih)
+		return
+	}
+	if s.tags == nil {
+		s.tags = make(map[infohash][]string)
+	}
+	s.tags[ih] = tags
+}
+
+// hasTag returns whether the normalized tags contain the given tag.
+func hasTag(tags []string, tag string) bool {
+	i := sort.SearchStrings(tags, tag)
+	return i < len(tags) && tags[i] == tag
+}
+
+// SetSwarmTags replaces the tags of the swarm of the given infohash.
+// Tags are small strings that can be used to attach metadata to swarms, for
+// example "freeleech".
+// An empty list of tags removes all tags.
+//
+// Tags are removed together with their swarm, pin swarms to keep them across
+// periods without peers.
+//
+// Returns storage.ErrResourceDoesNotExist if the swarm does not exist and
+// ErrInvalidTags if more than 16 tags are given or a tag is empty or longer
+// than 64 bytes.
+func (s *PeerStore) SetSwarmTags(infoHash bittorrent.InfoHash, tags []string) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+	if !validTags(tags) {
+		return ErrInvalidTags
+	}
+	tags = normalizeTags(tags)
+
+	ih := infohash(infoHash)
+	shard := s.shards.lockShardByHash(ih)
+	defer s.shards.unlockShardByHash(ih, 0)
+
+	if _, ok := shard.swarms[ih]; !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	shard.setTags(ih, tags)
+
+	return nil
+}
+
+// SwarmTags returns the tags of the swarm of the given infohash, sorted.
+func (s *PeerStore) SwarmTags(infoHash bittorrent.InfoHash) []string {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	ih := infohash(infoHash)
+	shard := s.shards.rLockShardByHash(ih)
+	defer s.shards.rUnlockShardByHash(ih)
+
+	return append([]string(nil), shard.tags[ih]...)
+}
+
+// SwarmsWithTag returns the infohashes of all swarms with the given tag.
+// Runs in linear time in regards to the number of tagged swarms.
+func (s *PeerStore) SwarmsWithTag(tag string) []bittorrent.InfoHash {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	var infoHashes []bittorrent.InfoHash
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.rLockShard(i)
+		for ih, tags := range shard.tags {
+			if hasTag(tags, tag) {
+				infoHashes = append(infoHashes, bittorrent.InfoHash(ih))
+			}
+		}
+		s.shards.rUnlockShard(i)
+	}
+
+	return infoHashes
+}
+
+// TagFilter returns a filter for ExportSwarms and RemoveSwarms that matches
+// the swarms that have the given tag at the time TagFilter is called.
+func (s *PeerStore) TagFilter(tag string) func(bittorrent.InfoHash) bool {
+	tagged := make(map[bittorrent.InfoHash]struct{})
+	for _, infoHash := range s.SwarmsWithTag(tag) {
+		tagged[infoHash] = struct{}{}
+	}
+
+	return func(infoHash bittorrent.InfoHash) bool {
+		_, ok := tagged[infoHash]
+		return ok
+	}
+}
@@ -0,0 +1,54 @@
+package optmem
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarmTags(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Equal(t, storage.ErrResourceDoesNotExist, ps.SetSwarmTags(ih, []string{"freeleech"}))
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih2, p1))
+	require.Nil(t, ps.SetSwarmTags(ih, []string{"internal", "freeleech", "internal"}))
+	require.Nil(t, ps.SetSwarmTags(ih2, []string{"internal"}))
+	require.Equal(t, []string{"freeleech", "internal"}, ps.SwarmTags(ih))
+	require.Equal(t, []string{"freeleech", "internal"}, ps.ScrapeSwarmBoth(ih).Tags)
+	require.Equal(t, []bittorrent.InfoHash{ih}, ps.SwarmsWithTag("freeleech"))
+	require.Len(t, ps.SwarmsWithTag("internal"), 2)
+
+	require.Equal(t, ErrInvalidTags, ps.SetSwarmTags(ih, []string{""}))
+	require.Equal(t, ErrInvalidTags, ps.SetSwarmTags(ih, []string{strings.Repeat("a", maxTagLength+1)}))
+
+	// Tags are exported and can be used to filter exports.
+	var buf bytes.Buffer
+	n, err := ps.ExportSwarms(&buf, ps.TagFilter("freeleech"))
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	dst, err := New(testConfig)
+	require.Nil(t, err)
+	_, err = dst.ImportSwarms(&buf)
+	require.Nil(t, err)
+	require.Equal(t, []string{"freeleech", "internal"}, dst.SwarmTags(ih))
+	require.Equal(t, uint64(1), dst.NumSwarms())
+
+	// Tags are removed with their swarm.
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Len(t, ps.SwarmTags(ih), 0)
+
+	require.Nil(t, ps.SetSwarmTags(ih2, nil))
+	require.Len(t, ps.SwarmsWithTag("internal"), 0)
+
+	require.Nil(t, <-ps.Stop())
+	require.Nil(t, <-dst.Stop())
+}
@@ -0,0 +1,223 @@
+package optmem
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// timingWheel indexes the peers of a shard by the garbage collection tick at
+// which they expire, see TimingWheel.
+//
+// A peer expires PeerLifetime after its last put, so every put adds the peer
+// to the slot of the first tick at least PeerLifetime ahead. All expiries lie
+// within one PeerLifetime, so a single wheel of slots covering it suffices,
+// no hierarchy of coarser wheels is needed.
+// Swarms left without peers are indexed as well, so that they are removed
+// once they are neither retained nor young.
+// The wheel is protected by the lock of its shard.
+type timingWheel struct {
+	slots    []wheelSlot
+	current  int // index of the slot collected by the next tick
+	ahead    int // number of ticks between a put and its slot
+	interval time.Duration
+}
+
+// wheelSlot holds the entries of a timingWheel due at one tick.
+// Entries are deduplicated, a peer put several times between two ticks is
+// indexed once.
+type wheelSlot struct {
+	peers  map[wheelPeer]struct{}
+	swarms map[infohash]struct{}
+}
+
+// wheelPeer identifies a peer of a swarm indexed by a timingWheel.
+type wheelPeer struct {
+	ih infohash
+	af bittorrent.AddressFamily
+	ep endpoint
+}
+
+func newWheelSlot() wheelSlot {
+	return wheelSlot{
+		peers:  make(map[wheelPeer]struct{}),
+		swarms: make(map[infohash]struct{}),
+	}
+}
+
+// newTimingWheel creates a timingWheel for the configured
+// GarbageCollectionInterval and PeerLifetime.
+func newTimingWheel(cfg Config) *timingWheel {
+	ahead := int((cfg.PeerLifetime + cfg.GarbageCollectionInterval - 1) / cfg.GarbageCollectionInterval)
+	w := &timingWheel{
+		slots:    make([]wheelSlot, ahead+1),
+		ahead:    ahead,
+		interval: cfg.GarbageCollectionInterval,
+	}
+	for i := range w.slots {
+		w.slots[i] = newWheelSlot()
+	}
+	return w
+}
+
+// slot returns the slot collected after the given number of ticks, which is
+// clamped to [1, ahead+1].
+func (w *timingWheel) slot(ticks int) wheelSlot {
+	switch {
+	case ticks < 1:
+		ticks = 1
+	case ticks > w.ahead+1:
+		ticks = w.ahead + 1
+	}
+	return w.slots[(w.current+ticks-1)%len(w.slots)]
+}
+
+// ticks returns the number of ticks until at least the given number of
+// seconds passed, counted from a tick.
+func (w *timingWheel) ticks(seconds uint16) int {
+	return int((time.Duration(seconds)*time.Second + w.interval - 1) / w.interval)
+}
+
+// addPeer schedules a peer that was put to be collected once it may have
+// expired.
+// A put between two ticks happens before the next one, and every tick
+// happens at least GarbageCollectionInterval after the previous one, so the
+// peer is collected at least PeerLifetime after the put.
+// The shard must be write-locked by the caller.
+func (w *timingWheel) addPeer(ih infohash, af bittorrent.AddressFamily, p *peer) {
+	e := wheelPeer{ih: ih, af: af}
+	copy(e.ep[:], p[:peerCompareSize])
+	w.slot(w.ahead + 1).peers[e] = struct{}{}
+}
+
+// addSwarm schedules a swarm without peers to be collected one PeerLifetime
+// later, like addPeer.
+// The shard must be write-locked by the caller.
+func (w *timingWheel) addSwarm(ih infohash) {
+	w.slot(w.ahead + 1).swarms[ih] = struct{}{}
+}
+
+// advance returns the entries scheduled for the current tick and moves on to
+// the next one.
+// The shard must be write-locked by the caller.
+func (w *timingWheel) advance() wheelSlot {
+	due := w.slots[w.current]
+	w.slots[w.current] = newWheelSlot()
+	w.current = (w.current + 1) % len(w.slots)
+	return due
+}
+
+// collectWheels collects the peers and swarms due in the timing wheel of
+// every shard, instead of walking all swarms like collectGarbage.
+// Peers that were put again since they were indexed are indexed anew for the
+// tick at which they expire.
+func (s *PeerStore) collectWheels() GCStats {
+	var stats GCStats
+	start := time.Now()
+	lifetime := s.cfg.lifetime()
+	minLifetime := uint16(s.cfg.MinSwarmLifetime / time.Second)
+	var buf *[]peer
+	if s.hooks.hasEvictionCallbacks() {
+		buf = new([]peer)
+	}
+
+	for i := 0; i < len(s.shards.shards); i++ {
+		shard := s.shards.lockShard(i)
+		now := uint16(s.nowUnix())
+		due := shard.wheel.advance()
+		var expired4, expired6, removed int
+		var evicted []EvictedPeer
+		changed := make(map[infohash]struct{})
+
+		for e := range due.peers {
+			l := shard.swarms[e.ih].list(e.af)
+			if l == nil {
+				continue
+			}
+			p, ok := l.lookupPeer(e.ep)
+			if !ok {
+				continue
+			}
+			if age := now - p.peerTime(); age < lifetime {
+				// The peer was put again after it was indexed.
+				shard.wheel.slot(shard.wheel.ticks(lifetime - age)).peers[e] = struct{}{}
+				continue
+			}
+
+			_, seeder := l.removePeer(&p)
+			seeders := 0
+			if seeder {
+				seeders = 1
+			}
+			shard.counts.sub(e.af, 1, seeders)
+			if e.af == bittorrent.IPv4 {
+				expired4++
+			} else {
+				expired6++
+			}
+			if buf != nil {
+				*buf = append(*buf, p)
+				evicted = takeEvictedPeers(evicted, e.ih, e.af, buf)
+			}
+			changed[e.ih] = struct{}{}
+			due.swarms[e.ih] = struct{}{}
+		}
+		if expired4+expired6 > 0 {
+			promGCExpired4.Add(float64(expired4))
+			promGCExpired6.Add(float64(expired6))
+			metricsReporters.count("gc.expired_peers.ipv4", int64(expired4))
+			metricsReporters.count("gc.expired_peers.ipv6", int64(expired6))
+		}
+
+		for ih := range due.swarms {
+			sw, ok := shard.swarms[ih]
+			if !ok {
+				continue
+			}
+			_, dirty := changed[ih]
+			final := sw
+			keep := sw.retained() || sw.young(now, minLifetime)
+			for _, l := range [2]**peerList{&sw.peers4, &sw.peers6} {
+				switch {
+				case *l == nil:
+				case (*l).numPeers == 0 && !keep:
+					*l = nil
+				case dirty:
+					(*l).rebalanceBuckets()
+				}
+			}
+
+			if !keep && sw.peers4 == nil && sw.peers6 == nil {
+				s.hooks.swarmRemoved(shard, ih, final)
+				shard.deleteSwarm(ih)
+				removed++
+				continue
+			}
+			if dirty {
+				sw.version = shard.nextVersion()
+				shard.setSwarm(ih, sw)
+			} else if sw.numPeers() == 0 && !sw.retained() {
+				// Young swarms are checked again until they age.
+				shard.wheel.addSwarm(ih)
+			}
+		}
+		s.shards.unlockShard(i, -removed)
+		s.finishSweep(evicted)
+
+		stats.PeersRemoved += expired4 + expired6
+		stats.SwarmsRemoved += removed
+		if expired4+expired6 > 0 || removed > 0 {
+			stats.ShardsTouched++
+		}
+	}
+
+	stats.Duration = time.Since(start)
+	atomic.StoreInt64(&s.lastGCDuration, int64(stats.Duration))
+	recordGCDuration(stats.Duration)
+	recordGCStats(stats)
+	log.Debug("optmem: timing wheel GC done", log.Fields{"namespace": s.name, "stats": stats})
+
+	return stats
+}
@@ -0,0 +1,77 @@
+package optmem
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingWheel(t *testing.T) {
+	clock := &diffClock{unix: 1000}
+	cfg := testConfig
+	cfg.Clock = clock
+	cfg.TimingWheel = true
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, <-ps.Stop()) }()
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutLeecher(ih2, p2))
+	require.Equal(t, GCStats{}, withoutDuration(ps.collectWheels()))
+
+	// Swarms changed again are collected one lifetime after the change.
+	atomic.AddInt64(&clock.unix, 300)
+	require.Nil(t, ps.PutLeecher(ih2, p2))
+
+	atomic.AddInt64(&clock.unix, 300)
+	stats := ps.collectWheels()
+	require.Equal(t, 1, stats.PeersRemoved)
+	require.Equal(t, 1, stats.SwarmsRemoved)
+	require.Equal(t, uint64(1), ps.NumSwarms())
+	require.True(t, ps.CheckConsistency().OK())
+
+	atomic.AddInt64(&clock.unix, 600)
+	stats = ps.collectWheels()
+	require.Equal(t, 1, stats.PeersRemoved)
+	require.Equal(t, 1, stats.SwarmsRemoved)
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	// Peers of a swarm expire on their own, the others are left alone.
+	require.Nil(t, ps.PutLeecher(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih, p3))
+	ps.collectWheels()
+	atomic.AddInt64(&clock.unix, 300)
+	require.Nil(t, ps.PutLeecher(ih, p2))
+	atomic.AddInt64(&clock.unix, 300)
+	stats = ps.collectWheels()
+	require.Equal(t, 2, stats.PeersRemoved)
+	require.Equal(t, 0, stats.SwarmsRemoved)
+	seeders, leechers := ps.NumTotalPeers()
+	require.Equal(t, uint64(0), seeders)
+	require.Equal(t, uint64(1), leechers)
+	require.True(t, ps.CheckConsistency().OK())
+}
+
+func TestTimingWheelValidate(t *testing.T) {
+	cfg := testConfig
+	cfg.TimingWheel = true
+	cfg.SpillAfter = time.Minute
+	cfg.SeederCompactionAfter = time.Minute
+	valid := cfg.Validate()
+	require.True(t, valid.TimingWheel)
+	require.Equal(t, time.Duration(0), valid.SpillAfter)
+	require.Equal(t, time.Duration(0), valid.SeederCompactionAfter)
+
+	cfg.LazyExpiration = true
+	require.False(t, cfg.Validate().TimingWheel)
+}
+
+// withoutDuration returns stats with the duration cleared.
+func withoutDuration(stats GCStats) GCStats {
+	stats.Duration = 0
+	return stats
+}
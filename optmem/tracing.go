@@ -0,0 +1,73 @@
+package optmem
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used by the PeerStore.
+const tracerName = "github.com/mrd0ll4r/chihaya-optmem-peerstore/optmem"
+
+// Attribute keys of the spans recorded by the PeerStore.
+const (
+	attrShard     = attribute.Key("optmem.shard")
+	attrSwarmSize = attribute.Key("optmem.swarm_size")
+	attrLockWait  = attribute.Key("optmem.lock_wait_ns")
+	attrBatched   = attribute.Key("optmem.batched")
+	attrNumWant   = attribute.Key("optmem.num_want")
+	attrSwarms    = attribute.Key("optmem.swarms")
+)
+
+// noopSpan is returned by startSpan for operations that are not sampled.
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// startSpan starts a span for a store operation, using the globally
+// registered TracerProvider.
+// Only the configured ratio of operations is traced, a non-recording span is
+// returned for all others.
+//
+// The storage.PeerStore interface does not carry contexts, so the spans are
+// root spans.
+func (s *PeerStore) startSpan(name string) trace.Span {
+	if s.cfg.TraceSampleRatio <= 0 || rand.Float64() >= s.cfg.TraceSampleRatio {
+		return noopSpan
+	}
+
+	_, span := otel.Tracer(tracerName).Start(context.Background(), name)
+	return span
+}
+
+// lockWait records the time spent waiting for a shard lock on a span.
+func lockWait(span trace.Span, shard int, start time.Time) {
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(attrShard.Int(shard), attrLockWait.Int64(int64(time.Since(start))))
+}
+
+// waitStart returns the current time if the span is recording, to be passed
+// to lockWait.
+func waitStart(span trace.Span) time.Time {
+	if !span.IsRecording() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// swarmSize records the number of peers of the given address family of a
+// swarm on a span.
+// The shard must be locked by the caller.
+func swarmSize(span trace.Span, shard *shard, ih infohash, af bittorrent.AddressFamily) {
+	if !span.IsRecording() {
+		return
+	}
+	if pl := shard.swarms[ih].list(af); pl != nil {
+		span.SetAttributes(attrSwarmSize.Int(pl.numPeers))
+	}
+}
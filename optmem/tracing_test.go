@@ -0,0 +1,41 @@
+package optmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	cfg := testConfig
+	cfg.TraceSampleRatio = 1
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	_, err = ps.AnnouncePeers(ih, false, 50, p2)
+	require.Nil(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	require.Equal(t, "optmem.PutSeeder", spans[0].Name())
+	require.Equal(t, "optmem.AnnouncePeers", spans[1].Name())
+
+	attrs := make(map[string]bool)
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = true
+	}
+	require.True(t, attrs[string(attrShard)])
+	require.True(t, attrs[string(attrLockWait)])
+	require.True(t, attrs[string(attrSwarmSize)])
+
+	require.Nil(t, <-ps.Stop())
+}
@@ -3,6 +3,8 @@ package optmem
 import (
 	"encoding/binary"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/chihaya/chihaya/bittorrent"
 )
@@ -69,6 +71,10 @@ func (p *peer) isLeecher() bool {
 	return p.peerFlag()&peerFlagLeecher != 0
 }
 
+func (p *peer) isDead() bool {
+	return p.peerFlag()&peerFlagDead != 0
+}
+
 func makePeer(p bittorrent.Peer, flag peerFlag, peerTime uint16) *peer {
 	toReturn := &peer{}
 	toReturn.setIP(p.IP.To16())
@@ -83,15 +89,225 @@ type peerFlag byte
 const (
 	peerFlagSeeder peerFlag = 1 << iota
 	peerFlagLeecher
+	peerFlagCryptoSupported
+	peerFlagCryptoRequired
+	peerFlagDead // tombstone of a removed peer, no other flags are set
+	peerFlagWebRTC
+	peerFlagExternal // learned from an upstream tracker, see FederationConfig
 )
 
+// peerFlagRole masks the flags that distinguish seeders from leechers.
+const peerFlagRole = peerFlagSeeder | peerFlagLeecher
+
 type swarm struct {
-	peers4 *peerList
-	peers6 *peerList
+	peers4    *peerList
+	peers6    *peerList
+	version   uint64 // shard-wide version of the last mutation, see SwarmDigest
+	pinned    bool   // pinned swarms are kept even if they have no peers
+	webSeeded bool   // swarms with web seeds are kept like pinned swarms, see SetWebSeeds
+	frozen    bool   // frozen swarms reject new peers, see FreezeSwarm
+	created   uint16 // uint16(unix seconds) of the creation of the swarm
+	swept     uint16 // uint16(unix seconds) of the last sweep, see LazyExpiration
+	oldest    uint16 // uint16(unix seconds) no later than the last announce of any peer, see peerCutoff
+
+	// seeded is set once GC sees the swarm without leechers, at
+	// seededSince, see SeederCompactionAfter.
+	seeded      bool
+	seededSince uint16
+	compacted   *compactedSeeders // nil unless the swarm is compacted
+}
+
+// retained returns whether the swarm is kept even if it has no peers,
+// because it is pinned or has web seeds.
+func (sw swarm) retained() bool {
+	return sw.pinned || sw.webSeeded
+}
+
+// young returns whether the swarm was created less than minLifetime seconds
+// before now.
+func (sw swarm) young(now, minLifetime uint16) bool {
+	return now-sw.created < minLifetime
 }
 
 type shard struct {
 	swarms     map[infohash]swarm
-	numPeers   uint64
-	numSeeders uint64
+	counts     peerCounts
+	published  peerCounts             // counts last added to the totals of the shardContainer, stored atomically
+	numSwarms  uint64                 // number of swarms as of the last unlock, accessed atomically
+	seed       uint64                 // seed of the bucket indices of the peerLists of the shard
+	version    uint64                 // last version handed out to a swarm of this shard
+	counters   *sync.Map              // infohash -> *scrapeCounters, nil unless lock-free scrapes are enabled
+	limits     *sync.Map              // infohash -> *announceBucket, nil unless AnnounceRateLimit is set
+	selections *sync.Map              // selectionKey -> *cachedSelection, nil unless AnnounceCacheThreshold is set
+	known      *swarmFilter           // infohashes of the swarms of the shard, nil unless NegativeCacheSize is set
+	wheel      *timingWheel           // nil unless TimingWheel is set
+	tags       map[infohash][]string  // only contains tagged swarms, nil until a swarm is tagged
+	webSeeds   map[infohash][]string  // only contains swarms with web seeds, nil until web seeds are set
+	downloads  map[infohash][2]uint64 // durable download counters by address family, nil unless DownloadCountersPath is set
+	scoreGap   uint16                 // minimum seconds between regular announces, zero unless PeerScoring is set
+	identity   identityMode           // how peers are identified, see putKeyedPeerLocked
+	linked     bool                   // whether the endpoints of dual-stack peers are linked, see touchLinked
+	backup     *shardBackup           // nil unless a running backup has to preserve the shard before it is changed, see Backup
+	events     swarmEvents            // swarm creations and removals not yet passed to the lifecycle callbacks
+}
+
+// peerCounts holds the number of peers and seeders per address family.
+type peerCounts struct {
+	peers4, seeders4 uint64
+	peers6, seeders6 uint64
+}
+
+// sub subtracts removed peers and seeders from the counts of an address
+// family.
+func (c *peerCounts) sub(af bittorrent.AddressFamily, peers, seeders int) {
+	if af == bittorrent.IPv4 {
+		c.peers4 -= uint64(peers)
+		c.seeders4 -= uint64(seeders)
+	} else {
+		c.peers6 -= uint64(peers)
+		c.seeders6 -= uint64(seeders)
+	}
+}
+
+// subSwarm subtracts all peers of a swarm from the counts.
+func (c *peerCounts) subSwarm(sw swarm) {
+	if sw.peers4 != nil {
+		h := sw.hiddenSeeders(bittorrent.IPv4)
+		c.sub(bittorrent.IPv4, sw.peers4.numPeers+h, sw.peers4.numSeeders+h)
+	}
+	if sw.peers6 != nil {
+		h := sw.hiddenSeeders(bittorrent.IPv6)
+		c.sub(bittorrent.IPv6, sw.peers6.numPeers+h, sw.peers6.numSeeders+h)
+	}
+}
+
+// addHidden adds the hidden seeders of a compacted swarm to the counts.
+func (c *peerCounts) addHidden(sw swarm) {
+	h4, h6 := uint64(sw.hiddenSeeders(bittorrent.IPv4)), uint64(sw.hiddenSeeders(bittorrent.IPv6))
+	c.peers4 += h4
+	c.seeders4 += h4
+	c.peers6 += h6
+	c.seeders6 += h6
+}
+
+// addSwarm adds all peers of a swarm to the counts.
+func (c *peerCounts) addSwarm(sw swarm) {
+	if sw.peers4 != nil {
+		h := uint64(sw.hiddenSeeders(bittorrent.IPv4))
+		c.peers4 += uint64(sw.peers4.numPeers) + h
+		c.seeders4 += uint64(sw.peers4.numSeeders) + h
+	}
+	if sw.peers6 != nil {
+		h := uint64(sw.hiddenSeeders(bittorrent.IPv6))
+		c.peers6 += uint64(sw.peers6.numPeers) + h
+		c.seeders6 += uint64(sw.peers6.numSeeders) + h
+	}
+}
+
+// family returns the number of seeders and leechers of an address family.
+func (c peerCounts) family(af bittorrent.AddressFamily) (seeders, leechers uint64) {
+	if af == bittorrent.IPv4 {
+		return c.seeders4, c.peers4 - c.seeders4
+	}
+	return c.seeders6, c.peers6 - c.seeders6
+}
+
+// total returns the number of seeders and leechers of both address families.
+func (c peerCounts) total() (seeders, leechers uint64) {
+	seeders4, leechers4 := c.family(bittorrent.IPv4)
+	seeders6, leechers6 := c.family(bittorrent.IPv6)
+	return seeders4 + seeders6, leechers4 + leechers6
+}
+
+// load reads counts that are updated atomically.
+// The fields are read one at a time, seeders are therefore clamped to the
+// number of peers.
+func (c *peerCounts) load() peerCounts {
+	l := peerCounts{
+		peers4:   atomic.LoadUint64(&c.peers4),
+		seeders4: atomic.LoadUint64(&c.seeders4),
+		peers6:   atomic.LoadUint64(&c.peers6),
+		seeders6: atomic.LoadUint64(&c.seeders6),
+	}
+	if l.seeders4 > l.peers4 {
+		l.seeders4 = l.peers4
+	}
+	if l.seeders6 > l.peers6 {
+		l.seeders6 = l.peers6
+	}
+	return l
+}
+
+// store atomically sets counts that are read using load.
+func (c *peerCounts) store(v peerCounts) {
+	atomic.StoreUint64(&c.peers4, v.peers4)
+	atomic.StoreUint64(&c.seeders4, v.seeders4)
+	atomic.StoreUint64(&c.peers6, v.peers6)
+	atomic.StoreUint64(&c.seeders6, v.seeders6)
+}
+
+// setSwarm stores a swarm in the shard.
+// The shard must be write-locked by the caller.
+func (s *shard) setSwarm(ih infohash, sw swarm) {
+	if s.known != nil {
+		if _, ok := s.swarms[ih]; !ok {
+			s.known.add(ih)
+		}
+	}
+	s.swarms[ih] = sw
+	if s.wheel != nil && sw.numPeers() == 0 {
+		s.wheel.addSwarm(ih)
+	}
+	if s.counters != nil {
+		s.publishCounters(ih, sw)
+	}
+}
+
+// deleteSwarm removes a swarm from the shard.
+// The shard must be write-locked by the caller.
+func (s *shard) deleteSwarm(ih infohash) {
+	if s.known != nil {
+		if _, ok := s.swarms[ih]; ok {
+			s.known.remove(ih)
+		}
+	}
+	delete(s.swarms, ih)
+	delete(s.tags, ih)
+	delete(s.webSeeds, ih)
+	if s.counters != nil {
+		s.counters.Delete(ih)
+	}
+	if s.limits != nil {
+		s.limits.Delete(ih)
+	}
+	if s.selections != nil {
+		s.selections.Delete(selectionKey{ih: ih, af: bittorrent.IPv4})
+		s.selections.Delete(selectionKey{ih: ih, af: bittorrent.IPv6})
+	}
+}
+
+// list returns the peer list of the given address family, which may be nil.
+func (sw swarm) list(af bittorrent.AddressFamily) *peerList {
+	if af == bittorrent.IPv4 {
+		return sw.peers4
+	}
+	return sw.peers6
+}
+
+// recount recomputes the counts of the shard from its swarms.
+// The shard must be write-locked by the caller.
+func (s *shard) recount() {
+	var counts peerCounts
+	for _, sw := range s.swarms {
+		counts.addSwarm(sw)
+	}
+	s.counts = counts
+}
+
+// nextVersion returns a new version for a mutated swarm of the shard.
+// Versions are taken from a shard-wide counter, so a swarm that is removed
+// and created again never reuses a version it had before.
+func (s *shard) nextVersion() uint64 {
+	s.version++
+	return s.version
 }
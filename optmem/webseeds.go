@@ -0,0 +1,156 @@
+package optmem
+
+import (
+	"net/url"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/pkg/errors"
+)
+
+// Limits for web seeds.
+const (
+	maxWebSeedsPerSwarm = 8
+	maxWebSeedLength    = 512
+)
+
+// ErrInvalidWebSeeds is returned if too many web seeds, or web seeds that are
+// not absolute HTTP or HTTPS URLs or too long, are set for a swarm.
+var ErrInvalidWebSeeds = errors.New("invalid web seeds")
+
+// validWebSeeds checks the given web seeds against the limits.
+func validWebSeeds(urls []string) bool {
+	if len(urls) > maxWebSeedsPerSwarm {
+		return false
+	}
+	for _, raw := range urls {
+		if len(raw) == 0 || len(raw) > maxWebSeedLength {
+			return false
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeWebSeeds returns a copy of the web seeds without duplicates, in
+// their original order, or nil if there are none.
+func normalizeWebSeeds(urls []string) []string {
+	var normalized []string
+	for i, u := range urls {
+		duplicate := false
+		for _, v := range urls[:i] {
+			if u == v {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			normalized = append(normalized, u)
+		}
+	}
+	return normalized
+}
+
+// setWebSeeds sets the web seeds of a swarm, removing them if urls is
+// empty.
+// The web seeds must be normalized.
+// The shard must be write-locked by the caller.
+func (s *shard) setWebSeeds(ih infohash, urls []string) {
+	if len(urls) == 0 {
+		delete(s.webSeeds, ih)
+		return
+	}
+	if s.webSeeds == nil {
+		s.webSeeds = make(map[infohash][]string)
+	}
+	s.webSeeds[ih] = urls
+}
+
+// SetWebSeeds replaces the HTTP web seeds (BEP 19) of the swarm of the given
+// infohash, so that frontends can include them in announce responses.
+// An empty list of URLs removes all web seeds.
+//
+// Swarms with web seeds are kept like pinned swarms, even if they have no
+// peers, so the web seeds are not removed by garbage collection.
+// If the swarm does not exist, an empty swarm is created.
+// Removing the web seeds of a swarm without peers removes the swarm, unless
+// it is pinned.
+// Like pins, web seeds are not part of exports.
+//
+// Returns ErrInvalidWebSeeds if more than 8 URLs are given or a URL is not
+// an absolute HTTP or HTTPS URL or longer than 512 bytes, or ErrReadOnly if
+// the store is read-only.
+func (s *PeerStore) SetWebSeeds(infoHash bittorrent.InfoHash, urls []string) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+	if !validWebSeeds(urls) {
+		return ErrInvalidWebSeeds
+	}
+	urls = normalizeWebSeeds(urls)
+
+	ih := infohash(infoHash)
+	shard := s.shards.lockShardByHash(ih)
+	sw, existed := shard.swarms[ih]
+	if !existed && len(urls) == 0 {
+		s.shards.unlockShardByHash(ih, 0)
+		return nil
+	}
+
+	final := sw
+	sw.webSeeded = len(urls) > 0
+	if !existed {
+		sw.created = uint16(s.nowUnix())
+		sw.swept, sw.oldest = sw.created, sw.created
+	}
+	if !sw.retained() {
+		if sw.peers4 != nil && sw.peers4.numPeers == 0 {
+			sw.peers4 = nil
+		}
+		if sw.peers6 != nil && sw.peers6.numPeers == 0 {
+			sw.peers6 = nil
+		}
+		if sw.peers4 == nil && sw.peers6 == nil {
+			s.hooks.swarmRemoved(shard, ih, final)
+			shard.deleteSwarm(ih)
+			s.shards.unlockShardByHash(ih, -1)
+			return nil
+		}
+	}
+	shard.setSwarm(ih, sw)
+	shard.setWebSeeds(ih, urls)
+
+	if existed {
+		s.shards.unlockShardByHash(ih, 0)
+	} else {
+		s.hooks.swarmCreated(shard, ih)
+		s.shards.unlockShardByHash(ih, 1)
+	}
+	return nil
+}
+
+// WebSeeds returns the web seeds of the swarm of the given infohash, in the
+// order they were set.
+func (s *PeerStore) WebSeeds(infoHash bittorrent.InfoHash) []string {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+	infoHash = s.resolveAlias(infoHash)
+
+	ih := infohash(infoHash)
+	shard := s.shards.rLockShardByHash(ih)
+	defer s.shards.rUnlockShardByHash(ih)
+
+	return append([]string(nil), shard.webSeeds[ih]...)
+}
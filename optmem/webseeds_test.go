@@ -0,0 +1,54 @@
+package optmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSeeds(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	ih2 := bittorrent.InfoHashFromString("11111111111111111111")
+	seeds := []string{"https://example.com/files/", "http://mirror.example.org/a.iso"}
+
+	require.Equal(t, ErrInvalidWebSeeds, ps.SetWebSeeds(ih, []string{"ftp://example.com/"}))
+	require.Equal(t, ErrInvalidWebSeeds, ps.SetWebSeeds(ih, []string{"/relative"}))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+
+	// Setting web seeds creates the swarm.
+	require.Nil(t, ps.SetWebSeeds(ih, append(seeds, seeds[0])))
+	require.Equal(t, seeds, ps.WebSeeds(ih))
+	require.Equal(t, uint64(1), ps.NumSwarms())
+
+	// Swarms with web seeds survive losing their peers and GC.
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	require.Nil(t, ps.PutSeeder(ih2, p1))
+	require.Nil(t, ps.SetWebSeeds(ih2, seeds[:1]))
+	require.Nil(t, ps.DeleteSeeder(ih, p1))
+	ps.collectGarbage(time.Now().Add(time.Minute))
+	require.Equal(t, uint64(2), ps.NumSwarms())
+	require.Equal(t, seeds[:1], ps.WebSeeds(ih2))
+	require.True(t, ps.CheckConsistency().OK())
+
+	info, ok := ps.SwarmInfo(ih)
+	require.True(t, ok)
+	require.Equal(t, seeds, info.WebSeeds)
+
+	// Unpinning keeps swarms with web seeds.
+	require.Nil(t, ps.PinSwarm(ih))
+	require.Nil(t, ps.UnpinSwarm(ih))
+	require.Equal(t, seeds, ps.WebSeeds(ih))
+
+	// Removing the web seeds removes swarms without peers.
+	require.Nil(t, ps.SetWebSeeds(ih, nil))
+	require.Nil(t, ps.SetWebSeeds(ih2, nil))
+	require.Equal(t, uint64(0), ps.NumSwarms())
+	require.Len(t, ps.WebSeeds(ih), 0)
+	require.True(t, ps.CheckConsistency().OK())
+
+	require.Nil(t, <-ps.Stop())
+}
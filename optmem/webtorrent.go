@@ -0,0 +1,93 @@
+package optmem
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Transport is the transport a peer accepts connections on.
+// Trackers serving both classic BitTorrent clients and WebTorrent clients,
+// for example through an HTTP and a WebSocket frontend, store peers with
+// their transport, so that announces only return peers the announcing peer
+// can connect to.
+type Transport byte
+
+// Peer transports.
+const (
+	// TransportClassic is used for peers that accept TCP or uTP connections.
+	TransportClassic Transport = iota
+
+	// TransportWebRTC is used for WebTorrent peers, which only accept WebRTC
+	// connections.
+	TransportWebRTC
+)
+
+// peerFlag returns the peer flag representing the transport.
+func (t Transport) peerFlag() peerFlag {
+	if t == TransportWebRTC {
+		return peerFlagWebRTC
+	}
+	return 0
+}
+
+// isWebRTC returns whether a peer only accepts WebRTC connections.
+func (p *peer) isWebRTC() bool {
+	return p.peerFlag()&peerFlagWebRTC != 0
+}
+
+// PutSeederTransport works like PutSeeder, but also stores the transport of
+// the peer.
+// PutSeeder stores peers with TransportClassic.
+func (s *PeerStore) PutSeederTransport(infoHash bittorrent.InfoHash, p bittorrent.Peer, transport Transport) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.put("optmem.PutSeeder", infoHash, p, peerFlagSeeder|transport.peerFlag(), false)
+}
+
+// PutLeecherTransport works like PutLeecher, but also stores the transport of
+// the peer.
+// PutLeecher stores peers with TransportClassic.
+func (s *PeerStore) PutLeecherTransport(infoHash bittorrent.InfoHash, p bittorrent.Peer, transport Transport) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.put("optmem.PutLeecher", infoHash, p, peerFlagLeecher|transport.peerFlag(), false)
+}
+
+// GraduateLeecherTransport works like GraduateLeecher, but also stores the
+// transport of the peer.
+// GraduateLeecher stores peers with TransportClassic.
+func (s *PeerStore) GraduateLeecherTransport(infoHash bittorrent.InfoHash, p bittorrent.Peer, transport Transport) error {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.graduate(infoHash, p, peerFlagSeeder|transport.peerFlag(), s.identityKey(p, ""))
+}
+
+// AnnouncePeersTransport works like AnnouncePeers, but takes the transport of
+// the announcing peer into account: WebTorrent peers only receive WebRTC
+// peers.
+//
+// Classic peers never receive WebRTC peers, regardless of whether they
+// announce using AnnouncePeers or AnnouncePeersTransport.
+// Announces of WebRTC peers, and announces of classic peers to swarms
+// containing WebRTC peers, run in linear time in regards to the number of
+// peers in the swarm.
+func (s *PeerStore) AnnouncePeersTransport(infoHash bittorrent.InfoHash, seeder bool, numWant int, announcingPeer bittorrent.Peer, transport Transport) ([]bittorrent.Peer, error) {
+	select {
+	case <-s.closed:
+		panic("attempted to interact with closed store")
+	default:
+	}
+
+	return s.announce(nil, infoHash, seeder, numWant, announcingPeer, transport.peerFlag())
+}
@@ -0,0 +1,68 @@
+package optmem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportAnnounce(t *testing.T) {
+	ps, err := New(testConfig)
+	require.Nil(t, err)
+
+	p4 := bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.ParseIP("3.4.5.6"), AddressFamily: bittorrent.IPv4},
+		Port: 4567,
+	}
+	announcer := bittorrent.Peer{
+		IP:   bittorrent.IP{IP: net.ParseIP("4.5.6.7"), AddressFamily: bittorrent.IPv4},
+		Port: 5678,
+	}
+
+	require.Nil(t, ps.PutSeeder(ih, p1))
+	peers, err := ps.AnnouncePeersTransport(ih, false, 10, announcer, TransportWebRTC)
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+
+	require.Nil(t, ps.PutSeederTransport(ih, p2, TransportWebRTC))
+	require.Nil(t, ps.PutLeecherTransport(ih, p4, TransportWebRTC))
+
+	peers, err = ps.AnnouncePeers(ih, false, 10, announcer)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, p1.Port, peers[0].Port)
+
+	peers, err = ps.AnnouncePeersTransport(ih, false, 10, announcer, TransportClassic)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+
+	peers, err = ps.AnnouncePeersTransport(ih, false, 10, announcer, TransportWebRTC)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.Equal(t, p2.Port, peers[0].Port)
+	require.Equal(t, p4.Port, peers[1].Port)
+
+	peers, err = ps.AnnouncePeersTransport(ih, true, 10, announcer, TransportWebRTC)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, p4.Port, peers[0].Port)
+
+	// Peers switching transports are counted correctly.
+	require.Nil(t, ps.PutSeeder(ih, p2))
+	peers, err = ps.AnnouncePeers(ih, false, 10, announcer)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+	require.True(t, ps.CheckConsistency().OK())
+
+	// Once the WebRTC peers are gone, classic announces are unfiltered.
+	require.Nil(t, ps.DeleteLeecher(ih, p4))
+	sw := ps.shards.rLockShard(ps.shards.shardIndex(infohash(ih))).swarms[infohash(ih)]
+	require.Equal(t, 0, sw.peers4.numWebRTC)
+	ps.shards.rUnlockShard(ps.shards.shardIndex(infohash(ih)))
+	require.True(t, ps.CheckConsistency().OK())
+
+	e := ps.Stop()
+	require.Nil(t, <-e)
+}